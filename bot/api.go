@@ -0,0 +1,280 @@
+package bot
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"tbooks/orders"
+	"time"
+)
+
+// defaultApiURL Telegram Bot API 地址
+const defaultApiURL = "https://api.telegram.org"
+
+// Update Telegram 推送的更新，只解析机器人处理的字段
+type Update struct {
+	UpdateID         int64             `json:"update_id"`
+	Message          *Message          `json:"message,omitempty"`
+	InlineQuery      *InlineQuery      `json:"inline_query,omitempty"`
+	PreCheckoutQuery *PreCheckoutQuery `json:"pre_checkout_query,omitempty"`
+}
+
+// User Telegram 用户
+type User struct {
+	ID           int64  `json:"id"`
+	IsBot        bool   `json:"is_bot"`
+	FirstName    string `json:"first_name"`
+	Username     string `json:"username,omitempty"`
+	LanguageCode string `json:"language_code,omitempty"`
+}
+
+// Chat 消息所在的会话
+type Chat struct {
+	ID   int64  `json:"id"`
+	Type string `json:"type"`
+}
+
+// Message 消息
+type Message struct {
+	MessageID         int64              `json:"message_id"`
+	From              *User              `json:"from,omitempty"`
+	Chat              Chat               `json:"chat"`
+	Text              string             `json:"text,omitempty"`
+	SuccessfulPayment *SuccessfulPayment `json:"successful_payment,omitempty"`
+}
+
+// PreCheckoutQuery 用户确认付款前的检查，需要在 10 秒内回复
+type PreCheckoutQuery struct {
+	ID             string `json:"id"`
+	From           User   `json:"from"`
+	Currency       string `json:"currency"`
+	TotalAmount    int64  `json:"total_amount"`
+	InvoicePayload string `json:"invoice_payload"`
+}
+
+// SuccessfulPayment 付款成功的服务消息
+type SuccessfulPayment struct {
+	Currency                string `json:"currency"`
+	TotalAmount             int64  `json:"total_amount"`
+	InvoicePayload          string `json:"invoice_payload"`
+	TelegramPaymentChargeID string `json:"telegram_payment_charge_id"`
+	ProviderPaymentChargeID string `json:"provider_payment_charge_id"`
+}
+
+// LabeledPrice 发票中的一项价格，Stars 发票只能有一项
+type LabeledPrice struct {
+	Label  string `json:"label"`
+	Amount int64  `json:"amount"`
+}
+
+// CreateInvoiceLinkParams createInvoiceLink 参数，Stars 发票的 provider_token 为空
+type CreateInvoiceLinkParams struct {
+	Title       string         `json:"title"`
+	Description string         `json:"description"`
+	Payload     string         `json:"payload"`
+	Currency    string         `json:"currency"`
+	Prices      []LabeledPrice `json:"prices"`
+}
+
+// InlineQuery 内联查询
+type InlineQuery struct {
+	ID    string `json:"id"`
+	From  User   `json:"from"`
+	Query string `json:"query"`
+}
+
+// InlineKeyboardButton 打开链接的内联键盘按钮
+type InlineKeyboardButton struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+// InlineKeyboardMarkup 消息下方的内联键盘
+type InlineKeyboardMarkup struct {
+	InlineKeyboard [][]InlineKeyboardButton `json:"inline_keyboard"`
+}
+
+// InputTextMessageContent 内联查询结果发送的文本
+type InputTextMessageContent struct {
+	MessageText string `json:"message_text"`
+}
+
+// InlineQueryResultArticle 文章类型的内联查询结果
+type InlineQueryResultArticle struct {
+	Type                string                  `json:"type"` // 固定为 article
+	ID                  string                  `json:"id"`
+	Title               string                  `json:"title"`
+	Description         string                  `json:"description,omitempty"`
+	InputMessageContent InputTextMessageContent `json:"input_message_content"`
+	ReplyMarkup         *InlineKeyboardMarkup   `json:"reply_markup,omitempty"`
+}
+
+// InlineQueryResultsButton 内联查询结果上方的按钮，点击后以 start 参数打开机器人私聊
+type InlineQueryResultsButton struct {
+	Text           string `json:"text"`
+	StartParameter string `json:"start_parameter"`
+}
+
+// SendMessageParams sendMessage 参数
+type SendMessageParams struct {
+	ChatID      int64                 `json:"chat_id"`
+	Text        string                `json:"text"`
+	ReplyMarkup *InlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+// AnswerInlineQueryParams answerInlineQuery 参数
+type AnswerInlineQueryParams struct {
+	InlineQueryID string                     `json:"inline_query_id"`
+	Results       []InlineQueryResultArticle `json:"results"`
+	CacheTime     int                        `json:"cache_time"`
+	IsPersonal    bool                       `json:"is_personal"`
+	Button        *InlineQueryResultsButton  `json:"button,omitempty"`
+}
+
+// APIError Bot API 返回的错误
+type APIError struct {
+	Method      string
+	Code        int
+	Description string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("telegram %s: %d %s", e.Method, e.Code, e.Description)
+}
+
+// Client Bot API 客户端
+type Client struct {
+	ApiURL     string // 为空时使用 defaultApiURL
+	Token      string
+	HTTPClient *http.Client
+}
+
+// Call 调用 Bot API 方法，结果解析到 out
+func (c *Client) Call(ctx context.Context, method string, params, out interface{}) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	apiURL := c.ApiURL
+	if apiURL == "" {
+		apiURL = defaultApiURL
+	}
+	endpoint := fmt.Sprintf("%s/bot%s/%s", strings.TrimRight(apiURL, "/"), c.Token, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := c.HTTPClient
+	if client == nil {
+		// 长轮询的请求会挂起 pollTimeout 秒
+		client = &http.Client{Timeout: pollTimeout*time.Second + 10*time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// 不把带令牌的地址写进错误
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("telegram %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Ok          bool            `json:"ok"`
+		ErrorCode   int             `json:"error_code"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return fmt.Errorf("telegram %s: status %d: %w", method, resp.StatusCode, err)
+	}
+	if !res.Ok {
+		code := res.ErrorCode
+		if code == 0 {
+			code = resp.StatusCode
+		}
+		return &APIError{Method: method, Code: code, Description: res.Description}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(res.Result, out)
+}
+
+// GetUpdates 长轮询获取更新
+func (c *Client) GetUpdates(ctx context.Context, offset int64, timeout int) ([]Update, error) {
+	var updates []Update
+	err := c.Call(ctx, "getUpdates", map[string]interface{}{
+		"offset":          offset,
+		"timeout":         timeout,
+		"allowed_updates": allowedUpdates,
+	}, &updates)
+	return updates, err
+}
+
+// SendMessage 发送消息
+func (c *Client) SendMessage(ctx context.Context, params SendMessageParams) error {
+	return c.Call(ctx, "sendMessage", params, nil)
+}
+
+// AnswerInlineQuery 回复内联查询
+func (c *Client) AnswerInlineQuery(ctx context.Context, params AnswerInlineQueryParams) error {
+	return c.Call(ctx, "answerInlineQuery", params, nil)
+}
+
+// CreateInvoiceLink 创建发票链接
+func (c *Client) CreateInvoiceLink(ctx context.Context, params CreateInvoiceLinkParams) (string, error) {
+	var link string
+	err := c.Call(ctx, "createInvoiceLink", params, &link)
+	return link, err
+}
+
+// StarsInvoiceLink 创建以 Stars 付款的发票链接
+func (c *Client) StarsInvoiceLink(ctx context.Context, title, description, payload string, stars int64) (string, error) {
+	return c.CreateInvoiceLink(ctx, CreateInvoiceLinkParams{
+		Title:       title,
+		Description: description,
+		Payload:     payload,
+		Currency:    orders.CurrencyStars,
+		Prices:      []LabeledPrice{{Label: title, Amount: stars}},
+	})
+}
+
+// AnswerPreCheckoutQuery 回复付款前的检查，拒绝时 errorMessage 会展示给用户
+func (c *Client) AnswerPreCheckoutQuery(ctx context.Context, queryID string, ok bool, errorMessage string) error {
+	params := map[string]interface{}{"pre_checkout_query_id": queryID, "ok": ok}
+	if !ok {
+		params["error_message"] = errorMessage
+	}
+	return c.Call(ctx, "answerPreCheckoutQuery", params, nil)
+}
+
+// RefundStarPayment 退回一笔 Stars 付款
+func (c *Client) RefundStarPayment(ctx context.Context, userID int64, chargeID string) error {
+	return c.Call(ctx, "refundStarPayment", map[string]interface{}{
+		"user_id":                    userID,
+		"telegram_payment_charge_id": chargeID,
+	}, nil)
+}
+
+// SetWebhook 设置 webhook，secret 会在每次推送的 X-Telegram-Bot-Api-Secret-Token 请求头中带回
+func (c *Client) SetWebhook(ctx context.Context, webhookURL, secret string) error {
+	return c.Call(ctx, "setWebhook", map[string]interface{}{
+		"url":             webhookURL,
+		"secret_token":    secret,
+		"allowed_updates": allowedUpdates,
+	}, nil)
+}
+
+// DeleteWebhook 删除 webhook，设置了 webhook 时无法使用 getUpdates
+func (c *Client) DeleteWebhook(ctx context.Context) error {
+	return c.Call(ctx, "deleteWebhook", map[string]interface{}{}, nil)
+}
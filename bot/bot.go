@@ -0,0 +1,377 @@
+package bot
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"tbooks/handle"
+	"tbooks/models"
+	"tbooks/orders"
+	"tbooks/quota"
+	"tbooks/referral"
+	"tbooks/usersync"
+	"time"
+)
+
+// Telegram 机器人：/start 推荐码归因、/balance 查询余额、/draw 抽奖、分享推荐链接的内联查询，以及 Stars 付款
+// 用户ID即 Telegram 用户ID，与小程序登录后的用户ID一致
+
+const (
+	// pollTimeout 长轮询等待更新的时间（秒）
+	pollTimeout = 30
+	// maxPaymentAttempts 长轮询模式下付款更新最多处理次数，超过后转入 deadLetterKey 并继续处理后续更新
+	maxPaymentAttempts = 5
+	// deadLetterKey 多次处理失败的付款更新，保存原始更新供人工处理
+	deadLetterKey = "telegram_dead_updates"
+	// defaultPlayMode /draw 未指定玩法时使用的玩法
+	defaultPlayMode = "1"
+	// startRegister 内联查询中未注册用户打开机器人时的 start 参数，不是推荐码
+	startRegister = "register"
+	// secretHeader Telegram 推送更新时带回 webhook secret 的请求头
+	secretHeader = "X-Telegram-Bot-Api-Secret-Token"
+)
+
+// allowedUpdates 机器人处理的更新类型
+var allowedUpdates = []string{"message", "inline_query", "pre_checkout_query"}
+
+// 机器人使用的业务操作，测试时可以替换
+var (
+	attribute    = referral.Attribute
+	balances     = usersync.Balances
+	draw         = handle.DrawWithQuota
+	referralCode = referral.GetCode
+	checkStars   = orders.CheckStars
+	payStars     = orders.PayStars
+)
+
+// retryDelay 获取或处理更新失败后的重试间隔
+var retryDelay = 3 * time.Second
+
+// Bot 处理 Telegram 更新
+type Bot struct {
+	Client *Client
+}
+
+// NewClient 使用配置中的机器人令牌和 Bot API 地址创建客户端
+func NewClient() *Client {
+	cfg := configs.Config().Telegram
+	return &Client{ApiURL: cfg.ApiURL, Token: cfg.BotToken}
+}
+
+// New 使用配置中的机器人令牌和 Bot API 地址创建机器人
+func New() (*Bot, error) {
+	if configs.Config().Telegram.BotToken == "" {
+		return nil, errors.New("Telegram bot token is not configured")
+	}
+	return &Bot{Client: NewClient()}, nil
+}
+
+// parseCommand 解析 /command@bot arg1 arg2，不是命令或是发给其他机器人的命令时返回空
+func parseCommand(text string) (string, []string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return "", nil
+	}
+	command, target, _ := strings.Cut(strings.TrimPrefix(fields[0], "/"), "@")
+	username := strings.TrimPrefix(configs.Config().Telegram.BotUsername, "@")
+	if target != "" && username != "" && !strings.EqualFold(target, username) {
+		return "", nil
+	}
+	return strings.ToLower(command), fields[1:]
+}
+
+// appKeyboard 打开小程序的按钮，未配置小程序地址时为 nil
+func appKeyboard() *InlineKeyboardMarkup {
+	webAppURL := configs.Config().Telegram.WebAppURL
+	if webAppURL == "" {
+		return nil
+	}
+	return &InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{{{Text: "打开小程序", URL: webAppURL}}}}
+}
+
+// HandleUpdate 处理一条更新
+func (b *Bot) HandleUpdate(ctx context.Context, update Update) error {
+	switch {
+	case update.Message != nil:
+		return b.handleMessage(ctx, update.Message)
+	case update.InlineQuery != nil:
+		return b.handleInlineQuery(ctx, update.InlineQuery)
+	case update.PreCheckoutQuery != nil:
+		return b.handlePreCheckout(ctx, update.PreCheckoutQuery)
+	}
+	return nil
+}
+
+// isPayment 是否为付款成功的更新，处理失败时需要重新处理，付款以 charge id 幂等，不会重复入账
+func (u Update) isPayment() bool {
+	return u.Message != nil && u.Message.SuccessfulPayment != nil
+}
+
+func (b *Bot) reply(ctx context.Context, msg *Message, text string, markup *InlineKeyboardMarkup) error {
+	return b.Client.SendMessage(ctx, SendMessageParams{ChatID: msg.Chat.ID, Text: text, ReplyMarkup: markup})
+}
+
+func (b *Bot) handleMessage(ctx context.Context, msg *Message) error {
+	if msg.From == nil || msg.From.IsBot {
+		return nil
+	}
+	userID := strconv.FormatInt(msg.From.ID, 10)
+	if msg.SuccessfulPayment != nil {
+		return b.successfulPayment(ctx, msg, userID)
+	}
+	command, args := parseCommand(msg.Text)
+	switch command {
+	case "start":
+		return b.start(ctx, msg, userID, args)
+	case "balance":
+		return b.balance(ctx, msg, userID)
+	case "draw":
+		return b.draw(ctx, msg, userID, args)
+	}
+	return nil
+}
+
+// start 欢迎消息，带推荐码时为用户归因
+func (b *Bot) start(ctx context.Context, msg *Message, userID string, args []string) error {
+	welcome := "欢迎来到 TBooks！点击下方按钮打开小程序开始抽奖。"
+	if len(args) == 0 || args[0] == startRegister {
+		return b.reply(ctx, msg, welcome, appKeyboard())
+	}
+
+	code := args[0]
+	result, err := attribute(ctx, userID, code)
+	var text string
+	switch {
+	case err == nil && result.Pending:
+		text = "推荐码已记录，在小程序中注册后生效。"
+	case err == nil:
+		text = "已成功绑定邀请人。"
+	case errors.Is(err, referral.ErrInvalidCode):
+		text = fmt.Sprintf("推荐码 %s 无效，请检查邀请链接。", code)
+	case errors.Is(err, referral.ErrSelfInvite), errors.Is(err, referral.ErrCyclicReferral):
+		text = "不能使用自己或下级的推荐码。"
+	case errors.Is(err, referral.ErrAlreadyAttributed):
+		text = "你已经绑定过邀请人。"
+	case errors.Is(err, referral.ErrAttributionExpired):
+		text = "注册时间已超过归因期限，无法再绑定邀请人。"
+	default:
+		if replyErr := b.reply(ctx, msg, "推荐码暂时无法处理，请稍后重试。", appKeyboard()); replyErr != nil {
+			logs.Error("Failed to reply to /start:", replyErr)
+		}
+		return fmt.Errorf("attribute user %s with code %s: %w", userID, code, err)
+	}
+	return b.reply(ctx, msg, text+"\n"+welcome, appKeyboard())
+}
+
+// balance 查询余额和抽奖卡
+func (b *Bot) balance(ctx context.Context, msg *Message, userID string) error {
+	cards, balance, err := balances(ctx, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return b.reply(ctx, msg, "你还没有注册，请先打开小程序。", appKeyboard())
+	} else if err != nil {
+		return err
+	}
+	return b.reply(ctx, msg, fmt.Sprintf("余额：%s\n抽奖卡：%d", balance, cards), appKeyboard())
+}
+
+// draw 使用一张抽奖卡抽奖，与小程序共用抽奖额度
+func (b *Bot) draw(ctx context.Context, msg *Message, userID string, args []string) error {
+	playMode := defaultPlayMode
+	if len(args) > 0 {
+		playMode = args[0]
+	}
+	result, drawQuota, err := draw(ctx, userID, playMode)
+	var text string
+	switch {
+	case errors.Is(err, quota.ErrExceeded):
+		text = fmt.Sprintf("抽奖太频繁，请在 %s 后再试。", drawQuota.NextAt.Format(time.RFC3339))
+	case errors.Is(err, handle.ErrUserNotFound):
+		text = "你还没有注册，请先打开小程序。"
+	case errors.Is(err, handle.ErrInsufficientCard):
+		text = "抽奖卡不足，完成任务或购买后再来。"
+	case errors.Is(err, handle.ErrInvalidPlayMode), errors.Is(err, handle.ErrPlayModeUnavailable):
+		text = fmt.Sprintf("玩法 %s 不存在。", playMode)
+	case errors.Is(err, handle.ErrPrizeSoldOut):
+		text = "奖品已抽完，请明天再来。"
+	case err != nil:
+		return err
+	default:
+		text = drawText(result)
+	}
+	return b.reply(ctx, msg, text, appKeyboard())
+}
+
+// drawText 抽奖结果的回复
+func drawText(result *handle.DrawResult) string {
+	switch result.Prize.Kind {
+	case models.PrizeKindPoints:
+		return fmt.Sprintf("恭喜获得 %s！\n余额：%s\n抽奖卡：%d", result.Prize.Name, result.Balance, result.CardCount)
+	case models.PrizeKindCard:
+		return fmt.Sprintf("恭喜获得抽奖卡！\n抽奖卡：%d", result.CardCount)
+	case models.PrizeKindItem:
+		return fmt.Sprintf("恭喜获得 %s！奖品将由工作人员发放。\n抽奖卡：%d", result.Prize.Name, result.CardCount)
+	}
+	return fmt.Sprintf("未中奖，再接再厉！\n抽奖卡：%d", result.CardCount)
+}
+
+// handleInlineQuery 在任意会话中输入 @机器人 时返回用户的推荐链接
+func (b *Bot) handleInlineQuery(ctx context.Context, query *InlineQuery) error {
+	params := AnswerInlineQueryParams{
+		InlineQueryID: query.ID,
+		Results:       []InlineQueryResultArticle{},
+		CacheTime:     60,
+		IsPersonal:    true,
+	}
+	code, err := referralCode(strconv.FormatInt(query.From.ID, 10))
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		params.Button = &InlineQueryResultsButton{Text: "注册后即可邀请好友", StartParameter: startRegister}
+		return b.Client.AnswerInlineQuery(ctx, params)
+	} else if err != nil {
+		return err
+	}
+
+	link := referral.Link(code.Code)
+	text := fmt.Sprintf("来 TBooks 和我一起抽奖吧！我的推荐码：%s", code.Code)
+	var markup *InlineKeyboardMarkup
+	if link != "" {
+		text += "\n" + link
+		markup = &InlineKeyboardMarkup{InlineKeyboard: [][]InlineKeyboardButton{{{Text: "立即加入", URL: link}}}}
+	}
+	params.Results = append(params.Results, InlineQueryResultArticle{
+		Type:                "article",
+		ID:                  "referral:" + code.Code,
+		Title:               "邀请好友",
+		Description:         "发送你的推荐链接，好友注册后你将获得返佣",
+		InputMessageContent: InputTextMessageContent{MessageText: text},
+		ReplyMarkup:         markup,
+	})
+	return b.Client.AnswerInlineQuery(ctx, params)
+}
+
+// Poll 长轮询获取并处理更新，直到 ctx 结束
+func (b *Bot) Poll(ctx context.Context) error {
+	// 设置了 webhook 时 getUpdates 会失败
+	if err := b.Client.DeleteWebhook(ctx); err != nil {
+		return err
+	}
+	var offset int64
+	attempts := make(map[int64]int) // 付款更新的处理次数
+	for {
+		updates, err := b.Client.GetUpdates(ctx, offset, pollTimeout)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			logs.Error("Failed to get telegram updates:", err)
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retryDelay):
+			}
+			continue
+		}
+		retry := false
+		for _, update := range updates {
+			if err := b.HandleUpdate(ctx, update); err != nil {
+				logs.Error("Failed to handle telegram update %d: %v", update.UpdateID, err)
+				if update.isPayment() {
+					attempts[update.UpdateID]++
+					if attempts[update.UpdateID] < maxPaymentAttempts {
+						// 不确认这条更新，稍后重新获取并处理
+						retry = true
+						break
+					}
+					deadLetter(ctx, update)
+				}
+			}
+			delete(attempts, update.UpdateID)
+			offset = update.UpdateID + 1
+		}
+		if retry {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(retryDelay):
+			}
+		}
+	}
+}
+
+// deadLetter 保存多次处理失败的付款更新，避免阻塞后续更新
+func deadLetter(ctx context.Context, update Update) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		logs.Error("Failed to encode telegram update %d: %v", update.UpdateID, err)
+		return
+	}
+	logs.Error("Giving up telegram update %d after %d attempts: %s", update.UpdateID, maxPaymentAttempts, data)
+	if err := configs.Rdb.RPush(ctx, deadLetterKey, data).Err(); err != nil {
+		logs.Error("Failed to save telegram update %d to %s: %v", update.UpdateID, deadLetterKey, err)
+	}
+}
+
+// WebhookHandler 接收 Telegram 推送的更新
+// 处理失败时同样返回 200，避免 Telegram 重试导致重复抽奖；只有付款处理失败时返回 500 由 Telegram 重新推送
+func (b *Bot) WebhookHandler(secret string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(secretHeader)), []byte(secret)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var update Update
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := b.HandleUpdate(r.Context(), update); err != nil {
+			logs.Error("Failed to handle telegram update %d: %v", update.UpdateID, err)
+			if update.isPayment() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Run 按配置以 webhook 或长轮询模式运行机器人，直到 ctx 结束
+func (b *Bot) Run(ctx context.Context) error {
+	webhook := configs.Config().Telegram.Webhook
+	if webhook.URL == "" {
+		logs.Info("Telegram bot is polling for updates")
+		return b.Poll(ctx)
+	}
+	if webhook.Secret == "" || webhook.Listen == "" {
+		return errors.New("Telegram webhook requires both secret and listen address")
+	}
+	if err := b.Client.SetWebhook(ctx, webhook.URL, webhook.Secret); err != nil {
+		return err
+	}
+
+	srv := &http.Server{Addr: webhook.Listen, Handler: b.WebhookHandler(webhook.Secret)}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+	logs.Info("Telegram bot is listening for webhook updates on", webhook.Listen)
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
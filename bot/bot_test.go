@@ -0,0 +1,406 @@
+package bot
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"tbooks/configs/configtest"
+	"tbooks/handle"
+	"tbooks/models"
+	"tbooks/orders"
+	"tbooks/quota"
+	"tbooks/referral"
+	"tbooks/usersync"
+	"testing"
+	"time"
+)
+
+// fakeTelegram 模拟 Bot API，记录机器人调用的方法和参数
+type fakeTelegram struct {
+	t       *testing.T
+	mu      sync.Mutex
+	updates [][]Update // 依次返回给 getUpdates
+	calls   []call
+	idle    chan struct{} // 所有更新都已返回且处理完后的下一次 getUpdates
+}
+
+type call struct {
+	Method string
+	Params map[string]interface{}
+}
+
+func newFakeTelegram(t *testing.T) (*fakeTelegram, *Bot) {
+	configtest.Load(t, "telegram:\n  bottoken: TOKEN\n  botusername: tbooks_bot\n  webappurl: https://t.me/tbooks_bot/app\n")
+	f := &fakeTelegram{t: t, idle: make(chan struct{}, 100)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, &Bot{Client: &Client{ApiURL: srv.URL, Token: "TOKEN"}}
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method, ok := strings.CutPrefix(r.URL.Path, "/botTOKEN/")
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"ok":false,"error_code":401,"description":"Unauthorized"}`))
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var params map[string]interface{}
+	if err := json.Unmarshal(body, &params); err != nil {
+		f.t.Errorf("%s: invalid body %s", method, body)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if method == "getUpdates" {
+		var updates []Update
+		if len(f.updates) > 0 {
+			updates, f.updates = f.updates[0], f.updates[1:]
+		} else {
+			f.idle <- struct{}{}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "result": updates})
+		return
+	}
+	f.calls = append(f.calls, call{Method: method, Params: params})
+	w.Write([]byte(`{"ok":true,"result":true}`))
+}
+
+// lastCall 最后一次调用的方法
+func (f *fakeTelegram) lastCall(t *testing.T, method string) call {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.calls) == 0 || f.calls[len(f.calls)-1].Method != method {
+		t.Fatalf("last call is not %s: %+v", method, f.calls)
+	}
+	return f.calls[len(f.calls)-1]
+}
+
+func message(userID int64, text string) Update {
+	return Update{UpdateID: 1, Message: &Message{MessageID: 1, From: &User{ID: userID}, Chat: Chat{ID: userID, Type: "private"}, Text: text}}
+}
+
+// stub 替换机器人使用的业务操作
+func stub(t *testing.T) {
+	t.Cleanup(func() {
+		attribute = referral.Attribute
+		balances = usersync.Balances
+		draw = handle.DrawWithQuota
+		referralCode = referral.GetCode
+		checkStars = orders.CheckStars
+		payStars = orders.PayStars
+	})
+}
+
+func TestStartAttribution(t *testing.T) {
+	f, b := newFakeTelegram(t)
+	stub(t)
+	attribute = func(ctx context.Context, userID, code string) (*referral.Attribution, error) {
+		switch code {
+		case "NEWCODE2":
+			return &referral.Attribution{InviterID: "1", Pending: true}, nil
+		case "SELFCODE":
+			return nil, referral.ErrSelfInvite
+		}
+		return nil, referral.ErrInvalidCode
+	}
+
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"/start NEWCODE2", "推荐码已记录"},
+		{"/start SELFCODE", "不能使用自己"},
+		{"/start@tbooks_bot BADCODE9", "推荐码 BADCODE9 无效"},
+		{"/start", "欢迎来到 TBooks"},
+	}
+	for _, tt := range tests {
+		if err := b.HandleUpdate(context.Background(), message(42, tt.text)); err != nil {
+			t.Fatalf("%s: %v", tt.text, err)
+		}
+		c := f.lastCall(t, "sendMessage")
+		if text := c.Params["text"].(string); !strings.Contains(text, tt.want) {
+			t.Errorf("%s: reply %q, want %q", tt.text, text, tt.want)
+		}
+		if c.Params["chat_id"].(float64) != 42 || c.Params["reply_markup"] == nil {
+			t.Errorf("%s: unexpected params %+v", tt.text, c.Params)
+		}
+	}
+
+	// 发给其他机器人的命令不处理
+	f.calls = nil
+	if err := b.HandleUpdate(context.Background(), message(42, "/start@other_bot NEWCODE2")); err != nil || len(f.calls) != 0 {
+		t.Fatalf("command for another bot was handled: %v %+v", err, f.calls)
+	}
+}
+
+func TestBalanceAndDraw(t *testing.T) {
+	f, b := newFakeTelegram(t)
+	stub(t)
+	balances = func(ctx context.Context, userID string) (int64, models.Amount, error) {
+		if userID != "42" {
+			return 0, 0, gorm.ErrRecordNotFound
+		}
+		return 3, models.Units(150), nil
+	}
+	nextAt := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	draw = func(ctx context.Context, userID, playMode string) (*handle.DrawResult, *quota.Result, error) {
+		switch playMode {
+		case "1":
+			prize := models.Prize{Name: "100points", Kind: models.PrizeKindPoints, Value: 100}
+			return &handle.DrawResult{Prize: prize, CardCount: 2, Balance: models.Units(250)}, &quota.Result{}, nil
+		case "2":
+			return nil, &quota.Result{NextAt: nextAt}, quota.ErrExceeded
+		}
+		return nil, &quota.Result{}, handle.ErrInvalidPlayMode
+	}
+
+	tests := []struct {
+		userID int64
+		text   string
+		want   string
+	}{
+		{42, "/balance", "余额：150.00\n抽奖卡：3"},
+		{7, "/balance", "还没有注册"},
+		{42, "/draw", "恭喜获得 100points！\n余额：250.00\n抽奖卡：2"},
+		{42, "/draw 2", "请在 2024-06-01T12:00:00Z 后再试"},
+		{42, "/draw 9", "玩法 9 不存在"},
+	}
+	for _, tt := range tests {
+		if err := b.HandleUpdate(context.Background(), message(tt.userID, tt.text)); err != nil {
+			t.Fatalf("%s: %v", tt.text, err)
+		}
+		if text := f.lastCall(t, "sendMessage").Params["text"].(string); !strings.Contains(text, tt.want) {
+			t.Errorf("%s: reply %q, want %q", tt.text, text, tt.want)
+		}
+	}
+}
+
+func TestInlineQuery(t *testing.T) {
+	f, b := newFakeTelegram(t)
+	stub(t)
+	referralCode = func(userID string) (*models.ReferralCode, error) {
+		if userID != "42" {
+			return nil, gorm.ErrRecordNotFound
+		}
+		return &models.ReferralCode{UserID: userID, Code: "ABCD2345"}, nil
+	}
+
+	inline := func(userID int64) Update {
+		return Update{UpdateID: 1, InlineQuery: &InlineQuery{ID: "q", From: User{ID: userID}}}
+	}
+	if err := b.HandleUpdate(context.Background(), inline(42)); err != nil {
+		t.Fatal(err)
+	}
+	results := f.lastCall(t, "answerInlineQuery").Params["results"].([]interface{})
+	if len(results) != 1 {
+		t.Fatalf("got %d results, want 1", len(results))
+	}
+	content := results[0].(map[string]interface{})["input_message_content"].(map[string]interface{})
+	if text := content["message_text"].(string); !strings.Contains(text, "https://t.me/tbooks_bot?start=ABCD2345") {
+		t.Errorf("message text %q does not contain the referral link", text)
+	}
+
+	// 未注册的用户引导到机器人私聊
+	if err := b.HandleUpdate(context.Background(), inline(7)); err != nil {
+		t.Fatal(err)
+	}
+	params := f.lastCall(t, "answerInlineQuery").Params
+	if len(params["results"].([]interface{})) != 0 || params["button"].(map[string]interface{})["start_parameter"] != startRegister {
+		t.Errorf("unexpected answer for unregistered user: %+v", params)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	f, b := newFakeTelegram(t)
+	stub(t)
+	f.updates = [][]Update{
+		{message(42, "/start"), {UpdateID: 2, Message: &Message{From: &User{ID: 42}, Chat: Chat{ID: 42}, Text: "hello"}}},
+		{{UpdateID: 3, Message: &Message{From: &User{ID: 43}, Chat: Chat{ID: 43}, Text: "/start"}}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Poll(ctx) }()
+	select {
+	case <-f.idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for updates to be handled")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.calls[0].Method != "deleteWebhook" {
+		t.Errorf("first call %s, want deleteWebhook", f.calls[0].Method)
+	}
+	var chats []float64
+	for _, c := range f.calls[1:] {
+		chats = append(chats, c.Params["chat_id"].(float64))
+	}
+	if len(chats) != 2 || chats[0] != 42 || chats[1] != 43 {
+		t.Errorf("replied to chats %v, want [42 43]", chats)
+	}
+}
+
+func TestPollDeadLetter(t *testing.T) {
+	f, b := newFakeTelegram(t)
+	mr := configtest.Redis(t)
+	stub(t)
+	delay := retryDelay
+	retryDelay = time.Millisecond
+	t.Cleanup(func() { retryDelay = delay })
+
+	calls := 0
+	payStars = func(ctx context.Context, p orders.StarsPayment) (*models.Order, orders.StarsResult, error) {
+		calls++
+		return nil, "", errors.New("database unavailable")
+	}
+	payment := message(42, "")
+	payment.Message.SuccessfulPayment = &SuccessfulPayment{Currency: "XTR", TotalAmount: 50, InvoicePayload: "memo1", TelegramPaymentChargeID: "charge1"}
+	next := Update{UpdateID: 2, Message: &Message{From: &User{ID: 43}, Chat: Chat{ID: 43}, Text: "/start"}}
+	// 未确认的更新会被重新返回
+	for i := 0; i < maxPaymentAttempts; i++ {
+		f.updates = append(f.updates, []Update{payment, next})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- b.Poll(ctx) }()
+	select {
+	case <-f.idle:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for updates to be handled")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	if calls != maxPaymentAttempts {
+		t.Fatalf("payment handled %d times, want %d", calls, maxPaymentAttempts)
+	}
+	dead, _ := mr.List(deadLetterKey)
+	if len(dead) != 1 || !strings.Contains(dead[0], "charge1") {
+		t.Fatalf("dead letters %v", dead)
+	}
+	// 放弃付款后继续处理后面的更新
+	if c := f.lastCall(t, "sendMessage"); c.Params["chat_id"] != float64(43) {
+		t.Fatalf("unexpected reply: %+v", c.Params)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	f, b := newFakeTelegram(t)
+	stub(t)
+	handler := b.WebhookHandler("SECRET")
+
+	post := func(secret, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if secret != "" {
+			req.Header.Set(secretHeader, secret)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	body := `{"update_id":5,"message":{"message_id":1,"from":{"id":42},"chat":{"id":42,"type":"private"},"text":"/start"}}`
+	if code := post("", body); code != http.StatusUnauthorized {
+		t.Fatalf("missing secret: status %d", code)
+	}
+	if code := post("WRONG", body); code != http.StatusUnauthorized {
+		t.Fatalf("wrong secret: status %d", code)
+	}
+	if len(f.calls) != 0 {
+		t.Fatalf("unauthorized update was handled: %+v", f.calls)
+	}
+	if code := post("SECRET", body); code != http.StatusOK {
+		t.Fatalf("status %d, want 200", code)
+	}
+	f.lastCall(t, "sendMessage")
+}
+
+func TestStarsPayment(t *testing.T) {
+	f, b := newFakeTelegram(t)
+	stub(t)
+	checkStars = func(userID, payload, currency string, amount int64) error {
+		if payload != "memo1" {
+			return orders.ErrOrderClosed
+		}
+		if userID != "42" || currency != "XTR" || amount != 50 {
+			return orders.ErrPaymentInvalid
+		}
+		return nil
+	}
+	ctx := context.Background()
+	precheckout := func(payload string) call {
+		t.Helper()
+		query := &PreCheckoutQuery{ID: "q1", From: User{ID: 42}, Currency: "XTR", TotalAmount: 50, InvoicePayload: payload}
+		if err := b.HandleUpdate(ctx, Update{UpdateID: 1, PreCheckoutQuery: query}); err != nil {
+			t.Fatal(err)
+		}
+		return f.lastCall(t, "answerPreCheckoutQuery")
+	}
+	if c := precheckout("memo1"); c.Params["ok"] != true || c.Params["pre_checkout_query_id"] != "q1" {
+		t.Fatalf("unexpected answer: %+v", c.Params)
+	}
+	if c := precheckout("memo2"); c.Params["ok"] != false || c.Params["error_message"] == nil {
+		t.Fatalf("closed order accepted: %+v", c.Params)
+	}
+
+	var got orders.StarsPayment
+	payStars = func(ctx context.Context, p orders.StarsPayment) (*models.Order, orders.StarsResult, error) {
+		got = p
+		return &models.Order{Status: models.OrderFulfilled, Cards: 10}, orders.StarsApplied, nil
+	}
+	update := message(42, "")
+	update.Message.SuccessfulPayment = &SuccessfulPayment{Currency: "XTR", TotalAmount: 50, InvoicePayload: "memo1", TelegramPaymentChargeID: "charge1"}
+	if err := b.HandleUpdate(ctx, update); err != nil {
+		t.Fatal(err)
+	}
+	if got != (orders.StarsPayment{UserID: "42", Payload: "memo1", Currency: "XTR", Amount: 50, ChargeID: "charge1"}) {
+		t.Fatalf("unexpected payment: %+v", got)
+	}
+	if text := f.lastCall(t, "sendMessage").Params["text"].(string); !strings.Contains(text, "10 张抽奖卡") {
+		t.Fatalf("unexpected reply: %s", text)
+	}
+
+	// 订单已关闭时按退回结果回复
+	for result, want := range map[orders.StarsResult]string{orders.StarsRefunded: "已退回", orders.StarsRefundFailed: "联系客服"} {
+		result := result
+		payStars = func(ctx context.Context, p orders.StarsPayment) (*models.Order, orders.StarsResult, error) {
+			return &models.Order{Status: models.OrderExpired}, result, nil
+		}
+		if err := b.HandleUpdate(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+		if text := f.lastCall(t, "sendMessage").Params["text"].(string); !strings.Contains(text, want) {
+			t.Fatalf("reply for %s: %s", result, text)
+		}
+	}
+
+	// 付款处理失败时返回 500，由 Telegram 重新推送
+	payStars = func(ctx context.Context, p orders.StarsPayment) (*models.Order, orders.StarsResult, error) {
+		return nil, "", errors.New("database unavailable")
+	}
+	body, _ := json.Marshal(update)
+	rec := httptest.NewRecorder()
+	b.WebhookHandler("SECRET").ServeHTTP(rec, func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(string(body)))
+		req.Header.Set(secretHeader, "SECRET")
+		return req
+	}())
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("failed payment: status %d, want 500", rec.Code)
+	}
+}
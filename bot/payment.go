@@ -0,0 +1,62 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"strconv"
+	"tbooks/models"
+	"tbooks/orders"
+)
+
+// handlePreCheckout 用户确认付款前核对订单，拒绝时 Telegram 向用户展示原因
+func (b *Bot) handlePreCheckout(ctx context.Context, query *PreCheckoutQuery) error {
+	userID := strconv.FormatInt(query.From.ID, 10)
+	err := checkStars(userID, query.InvoicePayload, query.Currency, query.TotalAmount)
+	var reason string
+	switch {
+	case err == nil:
+		return b.Client.AnswerPreCheckoutQuery(ctx, query.ID, true, "")
+	case errors.Is(err, orders.ErrOrderNotFound), errors.Is(err, orders.ErrPaymentInvalid):
+		reason = "订单无效，请在小程序中重新下单。"
+	case errors.Is(err, orders.ErrOrderClosed):
+		reason = "订单已过期或已支付，请在小程序中重新下单。"
+	default:
+		logs.Error("Failed to check stars order %s: %v", query.InvoicePayload, err)
+		reason = "暂时无法确认订单，请稍后重试。"
+	}
+	return b.Client.AnswerPreCheckoutQuery(ctx, query.ID, false, reason)
+}
+
+// successfulPayment 记录 Stars 付款并发放，失败时返回错误以便重新处理
+func (b *Bot) successfulPayment(ctx context.Context, msg *Message, userID string) error {
+	payment := msg.SuccessfulPayment
+	order, result, err := payStars(ctx, orders.StarsPayment{
+		UserID:   userID,
+		Payload:  payment.InvoicePayload,
+		Currency: payment.Currency,
+		Amount:   payment.TotalAmount,
+		ChargeID: payment.TelegramPaymentChargeID,
+	})
+	if errors.Is(err, orders.ErrOrderNotFound) {
+		// 不是本服务创建的发票，无法重新处理
+		logs.Error("Stars payment %s matches no order, needs a manual refund", payment.TelegramPaymentChargeID)
+		return b.reply(ctx, msg, "未找到对应的订单，请联系客服退款。", nil)
+	} else if err != nil {
+		return fmt.Errorf("stars payment %s: %w", payment.TelegramPaymentChargeID, err)
+	}
+
+	var text string
+	switch {
+	case result == orders.StarsRefunded:
+		text = "订单已关闭，本次支付的 Stars 已退回。"
+	case result == orders.StarsRefundFailed:
+		text = "订单已关闭，本次支付的 Stars 暂时无法自动退回，请联系客服退款。"
+	case order.Status == models.OrderFulfilled:
+		text = fmt.Sprintf("支付成功，已获得 %s。", orders.Describe(order))
+	default:
+		text = fmt.Sprintf("支付成功，%s 将在稍后到账。", orders.Describe(order))
+	}
+	return b.reply(ctx, msg, text, appKeyboard())
+}
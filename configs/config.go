@@ -2,7 +2,6 @@ package configs
 
 import (
 	"fmt"
-	"github.com/spf13/viper"
 	"sync"
 )
 
@@ -14,7 +13,7 @@ var (
 // MysqlConfig mysql配置参数
 type MysqlConfig struct {
 	User     string
-	Password string
+	Password string `secret:"true"`
 	Ip       string
 	Port     string
 	DbName   string
@@ -26,13 +25,125 @@ type GlobalConfig struct {
 	Mysql     MysqlConfig
 	Redis     RedisConfig
 	Debug     bool
-	JwtSecret string // 添加 JWT 密钥字段
+	JwtSecret string `secret:"true"` // 添加 JWT 密钥字段
+	Jwt       JwtConfig
+	Telegram  TelegramConfig
+	Wallet    WalletConfig
+	Ton       TonConfig
+	Admins    []string               // 管理员用户ID
+	Timezone  string                 // 每日额度的默认时区，例如 Asia/Shanghai，未设置时为 UTC
+	Quotas    map[string]QuotaPolicy // 额度策略，键为策略名称，覆盖代码中的默认值
+	Social    SocialConfig
+	Referral  ReferralConfig
+	Flags     map[string]FlagConfig // 功能开关默认值，键为开关名称，管理接口的设置覆盖同名默认值
+	CardPrice int64                 // 用余额购买一张抽奖卡的价格（积分），0 表示使用默认值
+	LogLevel  string                // 日志级别：debug、info、warn、error，修改后无需重启
+	Payment   PaymentConfig
+}
+
+// PaymentConfig 链上付款订单配置
+type PaymentConfig struct {
+	DepositAddress string                // 收款地址，为空时不能创建订单
+	Currency       string                // 付款币种，例如 TON
+	OrderExpire    int64                 // 付款期限（秒），默认 30 分钟
+	Packs          map[string]PackConfig // 商品包，键为商品包名称
+}
+
+// PackConfig 商品包，Cards 和 Points 至少设置一项，Price 和 Stars 至少设置一项
+type PackConfig struct {
+	Cards  int64 `json:"cards"`  // 卡片数量
+	Points int64 `json:"points"` // 积分（整数单位）
+	Price  int64 `json:"price"`  // 链上付款价格，最小单位，例如 TON 的 nanoton，0 表示不能用链上付款购买
+	Stars  int64 `json:"stars"`  // Telegram Stars 价格，0 表示不能用 Stars 购买
+}
+
+// ReferralConfig 多级邀请返佣配置
+type ReferralConfig struct {
+	Rates     []float64 // 第 n 项为第 n 级邀请人获得的被邀请人收益比例，例如 [0.1, 0.05]
+	MaxLevels int       // 为每个用户记录的邀请链层数，不少于 Rates 的层数
+	// AttributionWindow 归因窗口（秒）：打开推荐链接后在该时间内注册才归因，
+	// 已注册用户也只能在注册后该时间内补充归因，默认 7 天
+	AttributionWindow int64
+}
+
+// SocialConfig 社交任务校验配置
+type SocialConfig struct {
+	TelegramChannel   string // 需要加入的 Telegram 频道，@username 或 chat id，机器人需为频道管理员
+	Discord           DiscordConfig
+	X                 XConfig
+	RecheckInterval   int64 // 未通过校验时重新检查的间隔（秒），第 n 次失败后延迟 n 倍
+	MaxAttempts       int   // 未通过校验时最多检查次数，超过后拒绝
+	RevokeWindow      int64 // 发放后在该时间内（秒）退出则撤回奖励，0 表示不撤回
+	RetentionInterval int64 // 撤回窗口内重新检查的间隔（秒）
+}
+
+// OAuthConfig OAuth 应用配置
+type OAuthConfig struct {
+	ClientID     string
+	ClientSecret string `secret:"true"`
+	RedirectURL  string // 回调地址，需与平台应用中登记的一致
+}
+
+// DiscordConfig Discord 服务器成员校验配置
+type DiscordConfig struct {
+	OAuthConfig `mapstructure:",squash"`
+	GuildID     string // 需要加入的服务器ID
+}
+
+// XConfig X 关注校验配置
+type XConfig struct {
+	OAuthConfig  `mapstructure:",squash"`
+	TargetUserID string // 需要关注的账号ID
+}
+
+// WalletConfig 钱包签名验证配置
+type WalletConfig struct {
+	Domain      string // 签名消息及 ton_proof 中使用的域名
+	NonceExpire int64  // 签名挑战有效期（秒）
+}
+
+// TonConfig TON 网络配置
+type TonConfig struct {
+	ApiURL string // tonapi 兼容接口地址，例如 https://tonapi.io
+	ApiKey string `secret:"true"`
+}
+
+// JwtConfig 登录会话配置
+type JwtConfig struct {
+	ActiveKid  string            // 当前用于签发的密钥ID
+	Keys       map[string]string `secret:"true"` // kid -> 密钥，轮换期间新旧密钥同时保留
+	AccessTTL  int64             // access token 有效期（秒）
+	RefreshTTL int64             // refresh token 有效期（秒）
+}
 
+// TelegramConfig Telegram 机器人及 Mini App 配置
+type TelegramConfig struct {
+	BotToken       string `secret:"true"` // 机器人令牌，用于校验 initData
+	InitDataExpire int64  // initData 有效期（秒），0 时为 24 小时
+	BotUsername    string // 机器人用户名，用于生成推荐链接
+	ApiURL         string // Bot API 地址，为空时使用 https://api.telegram.org
+	WebAppURL      string // Mini App 地址，机器人回复中打开小程序的按钮
+	Webhook        WebhookConfig
+}
+
+// WebhookConfig 机器人 webhook 模式配置，URL 为空时使用长轮询
+type WebhookConfig struct {
+	URL    string // Telegram 推送更新的公网地址
+	Secret string `secret:"true"` // 与 X-Telegram-Bot-Api-Secret-Token 请求头比对
+	Listen string // 本地监听地址，例如 :8443
+}
+
+// QuotaPolicy 奖励类操作的额度策略
+type QuotaPolicy struct {
+	Max         int64  // 窗口内最多次数，0 表示不限次数
+	Window      string // 窗口类型：day 按用户时区的自然日，rolling 为滚动窗口
+	Period      int64  // 滚动窗口长度（秒）
+	MinInterval int64  // 两次之间的最小间隔（秒），0 表示不限制
 }
 
 type RedisConfig struct {
 	Addr     string
-	Password string
+	Password string `secret:"true"`
 	DB       int
 }
 
@@ -44,17 +155,10 @@ func Config() GlobalConfig {
 	return configCopy
 }
 
-// 加载配置文件
+// ParseConfig 加载配置文件，失败时 panic
 func ParseConfig(cfg string) {
-	viper.SetConfigFile(cfg)
-	err := viper.ReadInConfig()
-	if err != nil {
+	if err := Load(cfg); err != nil {
 		fmt.Println("配置文件读取错误")
 		panic(err)
 	}
-
-	err = viper.Unmarshal(&config)
-	if err != nil {
-		panic(err)
-	}
 }
@@ -0,0 +1,36 @@
+// Package configtest 测试使用的配置和 Redis，只应在测试中导入
+package configtest
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bsm/redislock"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"path/filepath"
+	"tbooks/configs"
+	"testing"
+)
+
+// Load 将 yaml 写入临时配置文件并加载为当前配置
+func Load(t testing.TB, yaml string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := configs.Load(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Redis 启动 miniredis 并替换 configs.Rdb，与 configs.NewRedis 一样设置 configs.Ctx 和 configs.Locker，测试结束时关闭
+func Redis(t testing.TB) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	configs.Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr(), PoolSize: 64})
+	configs.Ctx = context.Background()
+	configs.Locker = redislock.New(configs.Rdb)
+	t.Cleanup(func() { configs.Rdb.Close() })
+	return mr
+}
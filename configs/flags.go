@@ -0,0 +1,173 @@
+package configs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// 功能开关：配置文件中的 flags 为默认值，管理接口写入 Redis 的设置覆盖同名默认值，所有实例立即生效
+// 开关依次判断：对所有用户开启、用户在白名单中、按用户ID哈希落在灰度比例内
+// 名称用冒号分隔，例如 playmode:2、task:regular:discord，配置文件中的键不能包含点号
+
+// flagsKey Redis 中保存功能开关的哈希，字段为开关名称，值为 FlagConfig 的 JSON
+const flagsKey = "feature_flags"
+
+var ErrInvalidFlag = errors.New("Invalid feature flag")
+
+// FlagConfig 功能开关设置
+type FlagConfig struct {
+	Enabled bool     `json:"enabled"` // 对所有用户开启
+	Percent int      `json:"percent"` // 未全部开启时按用户ID哈希开启的比例，0-100
+	Users   []string `json:"users"`   // 始终开启的用户ID
+}
+
+// Validate 检查灰度比例
+func (f FlagConfig) Validate() error {
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("%w: percent must be between 0 and 100", ErrInvalidFlag)
+	}
+	return nil
+}
+
+// bucket 用户在开关上的分桶 0-99，开关名称参与哈希，不同开关的灰度用户互不相关
+func bucket(name, userID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name + ":" + userID))
+	return int(h.Sum32() % 100)
+}
+
+// on 开关对用户是否开启
+func (f FlagConfig) on(name, userID string) bool {
+	if f.Enabled {
+		return true
+	}
+	for _, id := range f.Users {
+		if id == userID {
+			return true
+		}
+	}
+	return f.Percent > 0 && bucket(name, userID) < f.Percent
+}
+
+// FlagName 统一开关名称的大小写，配置文件中的键不区分大小写
+func FlagName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// Flags 一次读取的全部开关
+type Flags map[string]FlagConfig
+
+// Enabled 开关对用户是否开启，未定义的开关视为关闭
+func (f Flags) Enabled(name, userID string) bool {
+	name = FlagName(name)
+	flag, ok := f[name]
+	return ok && flag.on(name, userID)
+}
+
+// Allowed 用于限制已有功能的开关，未定义时不限制
+func (f Flags) Allowed(name, userID string) bool {
+	name = FlagName(name)
+	flag, ok := f[name]
+	return !ok || flag.on(name, userID)
+}
+
+// overrides 读取 Redis 中的开关设置
+func overrides(ctx context.Context) (map[string]FlagConfig, error) {
+	values, err := Rdb.HGetAll(ctx, flagsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]FlagConfig, len(values))
+	for name, value := range values {
+		var flag FlagConfig
+		if err := json.Unmarshal([]byte(value), &flag); err != nil {
+			logs.Warn("Ignoring invalid feature flag %s: %v", name, err)
+			continue
+		}
+		out[name] = flag
+	}
+	return out, nil
+}
+
+// LoadFlags 读取全部开关，Redis 不可用时只使用配置中的默认值并记录日志
+func LoadFlags(ctx context.Context) Flags {
+	flags := make(Flags)
+	for name, flag := range Config().Flags {
+		flags[FlagName(name)] = flag
+	}
+	stored, err := overrides(ctx)
+	if err != nil {
+		logs.Error("Failed to load feature flags, using config defaults:", err)
+		return flags
+	}
+	for name, flag := range stored {
+		flags[name] = flag
+	}
+	return flags
+}
+
+// FlagState 管理接口中展示的开关
+type FlagState struct {
+	Name     string      `json:"name"`
+	Flag     FlagConfig  `json:"flag"`               // 当前生效的设置
+	Source   string      `json:"source"`             // config 或 redis
+	Default  *FlagConfig `json:"default,omitempty"`  // 配置文件中的默认值
+	Override bool        `json:"override,omitempty"` // Redis 中的设置覆盖了默认值
+}
+
+// ListFlags 列出全部开关及其来源
+func ListFlags(ctx context.Context) ([]FlagState, error) {
+	stored, err := overrides(ctx)
+	if err != nil {
+		return nil, err
+	}
+	states := make(map[string]*FlagState)
+	for name, flag := range Config().Flags {
+		flag := flag
+		name = FlagName(name)
+		states[name] = &FlagState{Name: name, Flag: flag, Source: "config", Default: &flag}
+	}
+	for name, flag := range stored {
+		state, ok := states[name]
+		if !ok {
+			state = &FlagState{Name: name}
+			states[name] = state
+		}
+		state.Flag, state.Source, state.Override = flag, "redis", state.Default != nil
+	}
+
+	list := make([]FlagState, 0, len(states))
+	for _, state := range states {
+		list = append(list, *state)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// SetFlag 保存开关设置，覆盖配置中的默认值
+func SetFlag(ctx context.Context, name string, flag FlagConfig) error {
+	name = FlagName(name)
+	if name == "" || strings.Contains(name, ".") {
+		return fmt.Errorf("%w: name must be non-empty and must not contain '.'", ErrInvalidFlag)
+	}
+	if err := flag.Validate(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(flag)
+	if err != nil {
+		return err
+	}
+	return Rdb.HSet(ctx, flagsKey, name, data).Err()
+}
+
+// DeleteFlag 删除 Redis 中的开关设置，恢复为配置中的默认值，不存在时返回 false
+func DeleteFlag(ctx context.Context, name string) (bool, error) {
+	n, err := Rdb.HDel(ctx, flagsKey, FlagName(name)).Result()
+	return n > 0, err
+}
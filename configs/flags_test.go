@@ -0,0 +1,89 @@
+package configs
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"testing"
+)
+
+func TestFlagRollout(t *testing.T) {
+	flags := Flags{
+		"on":      {Enabled: true},
+		"off":     {},
+		"rollout": {Percent: 20, Users: []string{"vip"}},
+	}
+	if !flags.Enabled("ON", "1") || flags.Enabled("off", "1") || flags.Enabled("missing", "1") {
+		t.Fatal("on/off flags evaluated incorrectly")
+	}
+	if !flags.Allowed("missing", "1") || flags.Allowed("off", "1") {
+		t.Fatal("undefined flags must not restrict, defined ones must")
+	}
+	if !flags.Enabled("rollout", "vip") {
+		t.Fatal("allowlisted user is not enabled")
+	}
+
+	enabled := 0
+	for i := 0; i < 10000; i++ {
+		userID := strconv.Itoa(i)
+		on := flags.Enabled("rollout", userID)
+		// 同一用户的结果稳定
+		if on != flags.Enabled("rollout", userID) {
+			t.Fatalf("user %s flipped between calls", userID)
+		}
+		if on {
+			enabled++
+		}
+	}
+	if enabled < 1800 || enabled > 2200 {
+		t.Fatalf("%d of 10000 users enabled at 20%%", enabled)
+	}
+}
+
+func TestFlagOverrides(t *testing.T) {
+	mr := miniredis.RunT(t)
+	Rdb = redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { Rdb.Close() })
+	path := writeFile(t, "config.yaml", "flags:\n  \"playmode:2\":\n    percent: 0\n  \"task:regular:discord\":\n    enabled: true\n")
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if LoadFlags(ctx).Allowed("playmode:2", "1") {
+		t.Fatal("config default not applied")
+	}
+	if err := SetFlag(ctx, "PlayMode:2", FlagConfig{Users: []string{"1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFlag(ctx, "wheel:v2", FlagConfig{Percent: 101}); !errors.Is(err, ErrInvalidFlag) {
+		t.Fatalf("err = %v, want ErrInvalidFlag", err)
+	}
+	flags := LoadFlags(ctx)
+	if !flags.Allowed("playmode:2", "1") || flags.Allowed("playmode:2", "2") {
+		t.Fatal("redis override not applied")
+	}
+
+	list, err := ListFlags(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].Name != "playmode:2" || list[0].Source != "redis" || !list[0].Override || list[1].Source != "config" {
+		t.Fatalf("unexpected flag list: %+v", list)
+	}
+
+	if ok, err := DeleteFlag(ctx, "playmode:2"); err != nil || !ok {
+		t.Fatalf("delete: %v %v", ok, err)
+	}
+	if LoadFlags(ctx).Allowed("playmode:2", "1") {
+		t.Fatal("deleting the override did not restore the default")
+	}
+
+	// Redis 不可用时使用配置中的默认值
+	mr.Close()
+	if !LoadFlags(ctx).Enabled("task:regular:discord", "1") {
+		t.Fatal("config defaults not used when redis is down")
+	}
+}
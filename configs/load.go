@@ -0,0 +1,249 @@
+package configs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/spf13/viper"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// 配置按以下顺序叠加，后面的覆盖前面的：
+//  1. 代码中的默认值 defaults
+//  2. YAML 配置文件
+//  3. 环境变量 TBOOKS_<键>，嵌套的键用下划线连接，例如 TBOOKS_MYSQL_PASSWORD
+//  4. 或者 TBOOKS_<键>_FILE 指向的文件内容，用于挂载的密钥文件，与 TBOOKS_<键> 不能同时设置
+// 列表用逗号分隔，map 类型的值使用 JSON 对象，例如 TBOOKS_JWT_KEYS={"k1":"..."}
+
+// EnvPrefix 环境变量前缀
+const EnvPrefix = "TBOOKS"
+
+// defaults 代码中的默认值
+var defaults = map[string]interface{}{
+	"port":       "8080",
+	"mysql.port": "3306",
+	"redis.addr": "127.0.0.1:6379",
+}
+
+// field 配置中的一个叶子字段
+type field struct {
+	key  string // viper 中的键，例如 mysql.password
+	kind reflect.Kind
+}
+
+// fields 展开配置结构体的所有叶子字段，mapstructure squash 的嵌入结构体与外层共用前缀
+func fields(t reflect.Type, prefix string) []field {
+	var out []field
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := prefix + strings.ToLower(f.Name)
+		if f.Type.Kind() == reflect.Struct {
+			if strings.Contains(f.Tag.Get("mapstructure"), "squash") {
+				out = append(out, fields(f.Type, prefix)...)
+			} else {
+				out = append(out, fields(f.Type, key+".")...)
+			}
+			continue
+		}
+		out = append(out, field{key: key, kind: f.Type.Kind()})
+	}
+	return out
+}
+
+// EnvName 配置键对应的环境变量名
+func EnvName(key string) string {
+	return EnvPrefix + "_" + strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// lookupEnv 读取配置键的环境变量或 _FILE 指向的文件
+func lookupEnv(key string) (string, bool, error) {
+	name := EnvName(key)
+	value, ok := os.LookupEnv(name)
+	path, fileOk := os.LookupEnv(name + "_FILE")
+	if !fileOk {
+		return value, ok, nil
+	}
+	if ok {
+		return "", false, fmt.Errorf("%s and %s_FILE are both set", name, name)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", false, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	// 密钥文件通常以换行结尾
+	return strings.TrimRight(string(data), "\r\n"), true, nil
+}
+
+// read 按默认值、配置文件、环境变量的顺序读取配置，path 为空时不读取配置文件
+func read(path string) (GlobalConfig, error) {
+	var cfg GlobalConfig
+	v := viper.New()
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil {
+			return cfg, err
+		}
+	}
+	for _, f := range fields(reflect.TypeOf(cfg), "") {
+		value, ok, err := lookupEnv(f.key)
+		if err != nil {
+			return cfg, err
+		}
+		if !ok {
+			continue
+		}
+		if f.kind == reflect.Map {
+			var m map[string]interface{}
+			if err := json.Unmarshal([]byte(value), &m); err != nil {
+				return cfg, fmt.Errorf("%s: %w", EnvName(f.key), err)
+			}
+			v.Set(f.key, m)
+			continue
+		}
+		v.Set(f.key, value)
+	}
+	if err := v.Unmarshal(&cfg); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Load 读取配置并替换当前配置
+func Load(path string) error {
+	cfg, err := read(path)
+	if err != nil {
+		return err
+	}
+	rConfig.Lock()
+	config = cfg
+	rConfig.Unlock()
+	return nil
+}
+
+// Validate 检查启动所需的配置，返回所有缺失或无效的设置
+func Validate(cfg GlobalConfig) error {
+	var errs []error
+	require := func(value, key string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required (%s)", key, EnvName(key)))
+		}
+	}
+	require(cfg.Port, "port")
+	require(cfg.Mysql.User, "mysql.user")
+	require(cfg.Mysql.Ip, "mysql.ip")
+	require(cfg.Mysql.Port, "mysql.port")
+	require(cfg.Mysql.DbName, "mysql.dbname")
+	require(cfg.Redis.Addr, "redis.addr")
+	require(cfg.Telegram.BotToken, "telegram.bottoken")
+
+	// 与 handle 中签发 JWT 时的规则一致，未配置 Jwt.Keys 时使用 JwtSecret
+	activeKid := cfg.Jwt.ActiveKid
+	if activeKid == "" {
+		activeKid = "default"
+	}
+	if cfg.Jwt.Keys[activeKid] == "" && (activeKid != "default" || cfg.JwtSecret == "") {
+		errs = append(errs, fmt.Errorf("JWT signing key %q is not configured (jwt.keys or jwtsecret)", activeKid))
+	}
+
+	if cfg.Telegram.Webhook.URL != "" && (cfg.Telegram.Webhook.Secret == "" || cfg.Telegram.Webhook.Listen == "") {
+		errs = append(errs, errors.New("telegram.webhook.secret and telegram.webhook.listen are required with telegram.webhook.url"))
+	}
+	switch strings.ToLower(cfg.LogLevel) {
+	case "", "debug", "info", "warn", "error":
+	default:
+		errs = append(errs, fmt.Errorf("loglevel %q must be one of debug, info, warn, error", cfg.LogLevel))
+	}
+	for name, flag := range cfg.Flags {
+		if err := flag.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("flags.%s: %w", name, err))
+		}
+	}
+	if cfg.CardPrice < 0 {
+		errs = append(errs, errors.New("cardprice must not be negative"))
+	}
+	for name, pack := range cfg.Payment.Packs {
+		if pack.Price < 0 || pack.Stars < 0 || pack.Price+pack.Stars == 0 ||
+			pack.Cards < 0 || pack.Points < 0 || pack.Cards+pack.Points == 0 {
+			errs = append(errs, fmt.Errorf("payment.packs.%s needs a price or stars, and cards or points", name))
+		}
+		if pack.Price > 0 && cfg.Payment.DepositAddress == "" {
+			errs = append(errs, fmt.Errorf("payment.depositaddress is required by payment.packs.%s", name))
+		}
+	}
+	if cfg.Timezone != "" {
+		if _, err := time.LoadLocation(cfg.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("timezone: %w", err))
+		}
+	}
+	var totalRate float64
+	for i, rate := range cfg.Referral.Rates {
+		if rate < 0 || rate >= 1 {
+			errs = append(errs, fmt.Errorf("referral.rates[%d] must be in [0, 1)", i))
+		}
+		totalRate += rate
+	}
+	// 各级返佣之和不能达到收益本身
+	if totalRate >= 1 {
+		errs = append(errs, errors.New("the sum of referral.rates must be less than 1"))
+	}
+	if cfg.Referral.MaxLevels > 0 && cfg.Referral.MaxLevels < len(cfg.Referral.Rates) {
+		errs = append(errs, errors.New("referral.maxlevels must not be less than the number of referral.rates"))
+	}
+	return errors.Join(errs...)
+}
+
+// redactedValue 密钥的替代值，未设置的密钥保持为空以便看出缺失
+const redactedValue = "******"
+
+// Redacted 返回隐藏了密钥的配置，键与配置文件一致，用于启动时输出实际生效的配置
+func Redacted(cfg GlobalConfig) map[string]interface{} {
+	return redact(reflect.ValueOf(cfg))
+}
+
+func redact(v reflect.Value) map[string]interface{} {
+	out := make(map[string]interface{}, v.NumField())
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f, value := t.Field(i), v.Field(i)
+		key := strings.ToLower(f.Name)
+		switch {
+		case f.Type.Kind() == reflect.Struct && strings.Contains(f.Tag.Get("mapstructure"), "squash"):
+			for k, inner := range redact(value) {
+				out[k] = inner
+			}
+		case f.Type.Kind() == reflect.Struct:
+			out[key] = redact(value)
+		case f.Tag.Get("secret") == "true" && f.Type.Kind() == reflect.Map:
+			// 保留 map 的键，例如 JWT 的 kid
+			keys := make(map[string]string, value.Len())
+			for _, k := range value.MapKeys() {
+				keys[fmt.Sprint(k.Interface())] = redactedValue
+			}
+			out[key] = keys
+		case f.Tag.Get("secret") == "true":
+			if value.IsZero() {
+				out[key] = ""
+			} else {
+				out[key] = redactedValue
+			}
+		default:
+			out[key] = value.Interface()
+		}
+	}
+	return out
+}
+
+// Dump 以 JSON 输出隐藏了密钥的配置
+func Dump(cfg GlobalConfig) string {
+	data, err := json.Marshal(Redacted(cfg))
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
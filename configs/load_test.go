@@ -0,0 +1,111 @@
+package configs
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testYAML = `
+mysql:
+  user: tbooks
+  password: from-yaml
+  ip: 127.0.0.1
+  dbname: tbooks
+telegram:
+  bottoken: yaml-token
+social:
+  discord:
+    clientid: discord-id
+referral:
+  rates: [0.1, 0.05]
+`
+
+func TestLoadLayers(t *testing.T) {
+	path := writeFile(t, "config.yaml", testYAML)
+	t.Setenv("TBOOKS_MYSQL_PASSWORD", "from-env")
+	t.Setenv("TBOOKS_TELEGRAM_BOTTOKEN_FILE", writeFile(t, "bot_token", "file-token\n"))
+	t.Setenv("TBOOKS_SOCIAL_DISCORD_CLIENTSECRET", "discord-secret")
+	t.Setenv("TBOOKS_JWT_KEYS", `{"k1":"jwt-secret"}`)
+	t.Setenv("TBOOKS_JWT_ACTIVEKID", "k1")
+	t.Setenv("TBOOKS_ADMINS", "1,2")
+
+	cfg, err := read(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != "8080" || cfg.Mysql.Port != "3306" {
+		t.Errorf("defaults not applied: port %q mysql.port %q", cfg.Port, cfg.Mysql.Port)
+	}
+	if cfg.Mysql.User != "tbooks" || cfg.Social.Discord.ClientID != "discord-id" || len(cfg.Referral.Rates) != 2 {
+		t.Errorf("yaml values not loaded: %+v", cfg)
+	}
+	if cfg.Mysql.Password != "from-env" {
+		t.Errorf("mysql password = %q, want value from environment", cfg.Mysql.Password)
+	}
+	if cfg.Telegram.BotToken != "file-token" {
+		t.Errorf("bot token = %q, want trimmed file content", cfg.Telegram.BotToken)
+	}
+	if cfg.Social.Discord.ClientSecret != "discord-secret" {
+		t.Errorf("squashed field not read from environment: %q", cfg.Social.Discord.ClientSecret)
+	}
+	if cfg.Jwt.Keys["k1"] != "jwt-secret" || len(cfg.Admins) != 2 {
+		t.Errorf("map or list not read from environment: %v %v", cfg.Jwt.Keys, cfg.Admins)
+	}
+	if err := Validate(cfg); err != nil {
+		t.Errorf("valid config rejected: %v", err)
+	}
+
+	dump := Dump(cfg)
+	for _, secret := range []string{"from-env", "file-token", "discord-secret", "jwt-secret"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("dump contains secret %q: %s", secret, dump)
+		}
+	}
+	if !strings.Contains(dump, `"user":"tbooks"`) || !strings.Contains(dump, `"keys":{"k1":"******"}`) {
+		t.Errorf("dump is missing non-secret values: %s", dump)
+	}
+}
+
+func TestLoadEnvAndFileConflict(t *testing.T) {
+	t.Setenv("TBOOKS_MYSQL_PASSWORD", "a")
+	t.Setenv("TBOOKS_MYSQL_PASSWORD_FILE", writeFile(t, "password", "b"))
+	if _, err := read(""); err == nil || !strings.Contains(err.Error(), "both set") {
+		t.Fatalf("err = %v, want conflict error", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cfg, err := read("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Timezone = "Not/AZone"
+	cfg.Referral.Rates = []float64{1.5, 0.2}
+	cfg.Telegram.Webhook.URL = "https://example.com/hook"
+	err = Validate(cfg)
+	if err == nil {
+		t.Fatal("empty config accepted")
+	}
+	for _, want := range []string{"TBOOKS_MYSQL_USER", "TBOOKS_TELEGRAM_BOTTOKEN", "JWT signing key", "telegram.webhook.secret", "timezone", "referral.rates[0]", "sum of referral.rates"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("validation error does not mention %s:\n%v", want, err)
+		}
+	}
+
+	// 每一级都有效但合计达到 1
+	cfg.Referral.Rates = []float64{0.6, 0.4}
+	if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), "sum of referral.rates") {
+		t.Errorf("rates summing to 1 accepted: %v", err)
+	}
+}
@@ -11,6 +11,9 @@ import (
 var Rdb *redis.Client
 var Ctx context.Context
 
+// Locker 基于 Rdb 的分布式锁客户端
+var Locker *redislock.Client
+
 // NewRedis 初始化Redis数据库
 func NewRedis() {
 	cfg := Config().Redis
@@ -23,7 +26,7 @@ func NewRedis() {
 	if ping.Err() != nil {
 		log.Fatalf("redis 启动失败: %v", ping.Err())
 	}
-	_ = redislock.New(Rdb)
+	Locker = redislock.New(Rdb)
 	Ctx = context.Background()
 	logs.Info("Redis数据库初始化连接成功")
 }
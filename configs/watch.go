@@ -0,0 +1,127 @@
+package configs
+
+import (
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// 配置文件修改后自动重新加载，校验失败时保留原配置
+// 连接类的配置在启动时使用一次，修改后需要重启，重新加载时保留原值
+
+// Subscriber 配置变更通知，参数为变更前后的配置
+type Subscriber func(old, new GlobalConfig)
+
+var (
+	subscribers  = make(map[int]Subscriber)
+	nextSubID    int
+	rSubscribers sync.Mutex
+	// rReload 保证同一时间只有一次重新加载，通知按加载顺序发出
+	rReload sync.Mutex
+)
+
+// Subscribe 注册配置变更通知，返回取消注册的函数
+// 通知在重新加载的协程中同步执行，耗时的操作需要自行异步处理
+func Subscribe(fn Subscriber) func() {
+	rSubscribers.Lock()
+	defer rSubscribers.Unlock()
+	id := nextSubID
+	nextSubID++
+	subscribers[id] = fn
+	return func() {
+		rSubscribers.Lock()
+		delete(subscribers, id)
+		rSubscribers.Unlock()
+	}
+}
+
+// notify 按注册顺序通知，单个订阅者 panic 不影响其他订阅者
+func notify(old, cfg GlobalConfig) {
+	rSubscribers.Lock()
+	fns := make([]Subscriber, 0, len(subscribers))
+	for i := 0; i < nextSubID; i++ {
+		if fn, ok := subscribers[i]; ok {
+			fns = append(fns, fn)
+		}
+	}
+	rSubscribers.Unlock()
+
+	for _, fn := range fns {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					logs.Error("Config subscriber panicked:", r)
+				}
+			}()
+			fn(old, cfg)
+		}()
+	}
+}
+
+// keepStructural 保留需要重启才能生效的配置，返回被忽略修改的键
+func keepStructural(cfg *GlobalConfig, old GlobalConfig) []string {
+	var ignored []string
+	keep := func(key string, dst, src interface{}) {
+		d, s := reflect.ValueOf(dst).Elem(), reflect.ValueOf(src)
+		if !reflect.DeepEqual(d.Interface(), s.Interface()) {
+			ignored = append(ignored, key)
+			d.Set(s)
+		}
+	}
+	keep("port", &cfg.Port, old.Port)
+	keep("mysql", &cfg.Mysql, old.Mysql)
+	keep("redis", &cfg.Redis, old.Redis)
+	keep("telegram.bottoken", &cfg.Telegram.BotToken, old.Telegram.BotToken)
+	keep("telegram.apiurl", &cfg.Telegram.ApiURL, old.Telegram.ApiURL)
+	keep("telegram.webhook", &cfg.Telegram.Webhook, old.Telegram.Webhook)
+	return ignored
+}
+
+// Reload 重新读取配置，校验失败时保留当前配置并返回错误，配置有变化时通知订阅者
+func Reload(path string) error {
+	rReload.Lock()
+	defer rReload.Unlock()
+
+	cfg, err := read(path)
+	if err != nil {
+		return err
+	}
+	if err := Validate(cfg); err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+
+	rConfig.Lock()
+	old := config
+	ignored := keepStructural(&cfg, old)
+	config = cfg
+	rConfig.Unlock()
+
+	if len(ignored) > 0 {
+		logs.Warn("Config changes to %s take effect after restart", strings.Join(ignored, ", "))
+	}
+	if reflect.DeepEqual(old, cfg) {
+		return nil
+	}
+	logs.Info("Config reloaded:", Dump(cfg))
+	notify(old, cfg)
+	return nil
+}
+
+// Watch 监听配置文件，修改后重新加载，path 为空时不监听
+func Watch(path string) {
+	if path == "" {
+		return
+	}
+	v := viper.New()
+	v.SetConfigFile(path)
+	v.OnConfigChange(func(e fsnotify.Event) {
+		if err := Reload(path); err != nil {
+			logs.Error("Failed to reload config, keeping the previous one:", err)
+		}
+	})
+	v.WatchConfig()
+}
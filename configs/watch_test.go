@@ -0,0 +1,65 @@
+package configs
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+const reloadYAML = `
+mysql:
+  user: tbooks
+  ip: 127.0.0.1
+  dbname: tbooks
+telegram:
+  bottoken: token
+jwtsecret: secret
+`
+
+func TestReload(t *testing.T) {
+	path := writeFile(t, "config.yaml", reloadYAML+"cardprice: 100\n")
+	if err := Load(path); err != nil {
+		t.Fatal(err)
+	}
+	var changes []int64
+	unsubscribe := Subscribe(func(old, cfg GlobalConfig) {
+		changes = append(changes, old.CardPrice, cfg.CardPrice)
+	})
+	defer unsubscribe()
+
+	write := func(content string) {
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 运行时配置立即生效，连接配置保留原值
+	write(strings.Replace(reloadYAML, "ip: 127.0.0.1", "ip: 10.0.0.1", 1) + "cardprice: 200\n")
+	if err := Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := Config(); cfg.CardPrice != 200 || cfg.Mysql.Ip != "127.0.0.1" {
+		t.Fatalf("after reload: cardprice %d, mysql.ip %s", cfg.CardPrice, cfg.Mysql.Ip)
+	}
+	if len(changes) != 2 || changes[0] != 100 || changes[1] != 200 {
+		t.Fatalf("subscriber got %v, want [100 200]", changes)
+	}
+
+	// 校验失败时保留原配置，不通知
+	write(reloadYAML + "cardprice: -1\n")
+	if err := Reload(path); err == nil {
+		t.Fatal("invalid config was accepted")
+	}
+	if Config().CardPrice != 200 || len(changes) != 2 {
+		t.Fatalf("invalid reload changed config: cardprice %d, notifications %v", Config().CardPrice, changes)
+	}
+
+	// 没有变化时不通知
+	write(reloadYAML + "cardprice: 200\n")
+	if err := Reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("unchanged reload notified subscribers: %v", changes)
+	}
+}
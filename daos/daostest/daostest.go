@@ -0,0 +1,34 @@
+// Package daostest 测试使用的 SQLite 数据库，只应在测试中导入
+package daostest
+
+import (
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"tbooks/daos"
+	"testing"
+)
+
+// Open 在临时目录中创建 SQLite 数据库并替换 daos.DB，迁移 daos.Models 中的所有表
+// 与 MySQL 一样开启 TranslateError，唯一键冲突返回 gorm.ErrDuplicatedKey
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+	dsn := "file:" + filepath.Join(t.TempDir(), "test.db") + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(daos.Models...); err != nil {
+		t.Fatal(err)
+	}
+	old := daos.DB
+	daos.DB = db
+	t.Cleanup(func() {
+		daos.DB = old
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
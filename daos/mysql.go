@@ -3,12 +3,15 @@ package daos
 import (
 	"context"
 	"fmt"
+	"github.com/beego/beego/v2/core/logs"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 	"io"
 	"log"
 	"os"
+	"strings"
 	"tbooks/configs"
 	"tbooks/models"
 	"time"
@@ -26,7 +29,7 @@ func InitMysql() {
 	dsn := fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4&parseTime=True&loc=Local",
 		cfg.User, cfg.Password, cfg.Ip, cfg.Port, cfg.DbName)
 	var err error
-	DB, err = gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	DB, err = gorm.Open(mysql.Open(dsn), &gorm.Config{TranslateError: true})
 	if err != nil {
 		panic("failed to connect database")
 	}
@@ -36,15 +39,106 @@ func InitMysql() {
 	}
 }
 
+// Models 自动迁移的表
+var Models = []interface{}{
+	models.User{}, models.AchievementReward{}, models.FreeCardTask{}, models.Invitation{}, models.Order{},
+	models.UserWallet{}, models.Prize{}, models.PrizeTableSnapshot{}, models.FairSeed{},
+	models.DrawRecord{}, models.LedgerEntry{}, models.Task{}, models.SocialClaim{}, models.SocialAccount{},
+	models.ReferralCommission{}, models.ReferralCode{}, models.OrderPayment{},
+}
+
 // CreateMysql 自动化表迁移
 func CreateMysql() error {
-	if err := DB.AutoMigrate(
-		models.User{}, models.AchievementReward{}, models.FreeCardTask{}, models.Invitation{}, models.Order{}); err != nil {
-		log.Printf("automigrate table error: %v", err)
+	if err := migrateAmountColumns(); err != nil {
+		return err
+	}
+	if err := dedupeAchievementRewards(); err != nil {
+		return err
+	}
+	if err := cleanInvitations(); err != nil {
+		return err
+	}
+	if err := dedupeSocialAccounts(); err != nil {
+		return err
+	}
+	if err := DB.AutoMigrate(Models...); err != nil {
+		logs.Error("automigrate table error: %v", err)
+	}
+	return nil
+}
+
+// amountColumns 由浮点数改为 models.Amount 定点整数的金额列
+var amountColumns = []struct {
+	model  interface{}
+	column string
+}{
+	{&models.User{}, "balance"},
+	{&models.Order{}, "amount"},
+	{&models.LedgerEntry{}, "amount"},
+	{&models.LedgerEntry{}, "balance_after"},
+	{&models.DrawRecord{}, "balance_before"},
+	{&models.DrawRecord{}, "balance_after"},
+}
+
+// migrateAmountColumns 将浮点金额列换算为最小单位的整数列
+// 先写入临时列，删除原列后将临时列改名为原列，中途失败时可重新执行
+func migrateAmountColumns() error {
+	migrator := DB.Migrator()
+	for _, col := range amountColumns {
+		if !migrator.HasTable(col.model) {
+			continue
+		}
+		legacy, err := legacyAmountColumn(col.model, col.column)
+		if err != nil {
+			return err
+		}
+		stmt := &gorm.Statement{DB: DB}
+		if err := stmt.Parse(col.model); err != nil {
+			return err
+		}
+		tmp := col.column + "_minor"
+		table, column, tmpColumn := clause.Table{Name: stmt.Table}, clause.Column{Name: col.column}, clause.Column{Name: tmp}
+		if legacy {
+			if !migrator.HasColumn(col.model, tmp) {
+				if err := DB.Exec("ALTER TABLE ? ADD COLUMN ? BIGINT NOT NULL DEFAULT 0", table, tmpColumn).Error; err != nil {
+					return err
+				}
+			}
+			if err := DB.Exec("UPDATE ? SET ? = ROUND(COALESCE(?, 0) * ?)", table, tmpColumn, column, models.AmountScale).Error; err != nil {
+				return err
+			}
+			if err := migrator.DropColumn(col.model, col.column); err != nil {
+				return err
+			}
+		}
+		// 上次迁移在删除原列后中断时只需改名
+		if !migrator.HasColumn(col.model, col.column) && migrator.HasColumn(col.model, tmp) {
+			if err := migrator.RenameColumn(col.model, tmp, col.column); err != nil {
+				return err
+			}
+			logs.Info("Migrated %s.%s to fixed-point amount", stmt.Table, col.column)
+		}
 	}
 	return nil
 }
 
+// legacyAmountColumn 金额列是否仍为浮点类型
+func legacyAmountColumn(model interface{}, column string) (bool, error) {
+	columnTypes, err := DB.Migrator().ColumnTypes(model)
+	if err != nil {
+		return false, err
+	}
+	for _, columnType := range columnTypes {
+		if columnType.Name() == column {
+			switch strings.ToLower(columnType.DatabaseTypeName()) {
+			case "float", "double", "decimal", "real":
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
 // StartDatabaseTransaction 启动数据库事务
 func StartDatabaseTransaction() (*gorm.DB, error) {
 	tx := DB.Begin()
@@ -115,6 +209,70 @@ func (l *Logger) Trace(ctx context.Context, begin time.Time, fc func() (string,
 		query, rows := fc()
 		// Implement your custom handling for slow queries here
 		// You can log or take any other action as needed
-		log.Printf("Slow query: %s [%v] %s\n", elapsed, rows, query)
+		logs.Warn("Slow query: %s [%v] %s", elapsed, rows, query)
+	}
+}
+
+// dedupeAchievementRewards 建立 (user_id, achievement_name) 唯一索引前删除重复发放的记录，保留最早的一条
+func dedupeAchievementRewards() error {
+	migrator := DB.Migrator()
+	reward := models.AchievementReward{}
+	if !migrator.HasTable(reward) || migrator.HasIndex(reward, "idx_achievement_user_name") {
+		return nil
+	}
+	table := clause.Table{Name: reward.TableName()}
+	result := DB.Exec("DELETE a FROM ? a JOIN ? b ON a.user_id = b.user_id AND a.achievement_name = b.achievement_name AND a.id > b.id",
+		table, table)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		logs.Info("Removed %d duplicate achievement rewards", result.RowsAffected)
+	}
+	return nil
+}
+
+// cleanInvitations 建立 (invitee_user_id, level) 唯一索引前清理旧的邀请记录
+// 旧版本按被邀请者自己的ID查找邀请者，写入的是邀请者为自己的无效记录
+func cleanInvitations() error {
+	migrator := DB.Migrator()
+	invitation := models.Invitation{}
+	if !migrator.HasTable(invitation) || migrator.HasIndex(invitation, "idx_invitation_invitee_level") {
+		return nil
+	}
+	table := clause.Table{Name: invitation.TableName()}
+	result := DB.Exec("DELETE FROM ? WHERE inviter_id = invitee_user_id", table)
+	if result.Error != nil {
+		return result.Error
 	}
+	removed := result.RowsAffected
+	result = DB.Exec("DELETE a FROM ? a JOIN ? b ON a.invitee_user_id = b.invitee_user_id AND a.level = b.level AND a.id > b.id",
+		table, table)
+	if result.Error != nil {
+		return result.Error
+	}
+	removed += result.RowsAffected
+	if removed > 0 {
+		logs.Info("Removed %d invalid invitations", removed)
+	}
+	return nil
+}
+
+// dedupeSocialAccounts 建立 (platform, external_id) 唯一索引前解除重复绑定的账号，保留最早绑定的用户
+func dedupeSocialAccounts() error {
+	migrator := DB.Migrator()
+	account := models.SocialAccount{}
+	if !migrator.HasTable(account) || migrator.HasIndex(account, "idx_social_account_platform_external") {
+		return nil
+	}
+	table := clause.Table{Name: account.TableName()}
+	result := DB.Exec("DELETE a FROM ? a JOIN ? b ON a.platform = b.platform AND a.external_id = b.external_id AND a.id > b.id",
+		table, table)
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected > 0 {
+		logs.Info("Unlinked %d social accounts already linked to another user", result.RowsAffected)
+	}
+	return nil
 }
@@ -0,0 +1,92 @@
+package daos
+
+import (
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+	"path/filepath"
+	"tbooks/models"
+	"testing"
+)
+
+// openLegacy 创建只包含旧版浮点金额表的 SQLite 数据库并替换 DB
+// daostest 会迁移全部表，这里需要迁移前的表结构，因此直接打开
+func openLegacy(t *testing.T, ddl ...string) {
+	t.Helper()
+	dsn := "file:" + filepath.Join(t.TempDir(), "legacy.db")
+	db, err := gorm.Open(sqlite.Open(dsn), &gorm.Config{TranslateError: true, Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range ddl {
+		if err := db.Exec(sql).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := DB
+	DB = db
+	t.Cleanup(func() {
+		DB = old
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+}
+
+// balances 按用户ID读取迁移后的余额
+func balances(t *testing.T) map[string]models.Amount {
+	t.Helper()
+	var rows []struct {
+		UserID  string
+		Balance int64
+	}
+	if err := DB.Table("user").Select("user_id", "balance").Find(&rows).Error; err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string]models.Amount, len(rows))
+	for _, row := range rows {
+		out[row.UserID] = models.Amount(row.Balance)
+	}
+	return out
+}
+
+func TestMigrateAmountColumns(t *testing.T) {
+	openLegacy(t,
+		"CREATE TABLE `user` (`id` integer PRIMARY KEY, `user_id` varchar(64), `balance` double)",
+		"INSERT INTO `user` (`user_id`, `balance`) VALUES ('A', 12.5), ('B', -0.01), ('C', NULL), ('D', 1234567.89), ('E', 0.125)",
+	)
+	want := map[string]models.Amount{"A": 1250, "B": -1, "C": 0, "D": 123456789, "E": 13}
+	for i := 0; i < 2; i++ {
+		// 再次执行时金额列已是整数，不会重复换算
+		if err := migrateAmountColumns(); err != nil {
+			t.Fatal(err)
+		}
+		got := balances(t)
+		for userID, amount := range want {
+			if got[userID] != amount {
+				t.Fatalf("run %d: user %s balance %d, want %d", i+1, userID, got[userID], amount)
+			}
+		}
+	}
+	legacy, err := legacyAmountColumn(&models.User{}, "balance")
+	if err != nil || legacy {
+		t.Fatalf("balance is still legacy: %v %v", legacy, err)
+	}
+	if DB.Migrator().HasColumn(&models.User{}, "balance_minor") {
+		t.Fatal("temporary column left behind")
+	}
+}
+
+func TestMigrateAmountColumnsResume(t *testing.T) {
+	// 上次迁移写入临时列并删除原列后中断
+	openLegacy(t,
+		"CREATE TABLE `user` (`id` integer PRIMARY KEY, `user_id` varchar(64), `balance_minor` bigint NOT NULL DEFAULT 0)",
+		"INSERT INTO `user` (`user_id`, `balance_minor`) VALUES ('A', 1250)",
+	)
+	if err := migrateAmountColumns(); err != nil {
+		t.Fatal(err)
+	}
+	if got := balances(t)["A"]; got != 1250 {
+		t.Fatalf("balance %d after resuming, want 1250", got)
+	}
+}
@@ -0,0 +1,37 @@
+package daos
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"tbooks/configs"
+)
+
+// ackQueueScript 仅当队首仍是已处理的元素时才弹出，多个实例同时消费也不会丢数据
+var ackQueueScript = redis.NewScript(`
+local removed = 0
+for i = 1, #ARGV do
+	if redis.call('LINDEX', KEYS[1], 0) ~= ARGV[i] then
+		break
+	end
+	redis.call('LPOP', KEYS[1])
+	removed = removed + 1
+end
+return removed
+`)
+
+// PeekQueue 读取 Redis 列表队首的最多 n 个元素
+func PeekQueue(ctx context.Context, key string, n int64) ([]string, error) {
+	return configs.Rdb.LRange(ctx, key, 0, n-1).Result()
+}
+
+// AckQueue 确认已处理的队首元素，items 需按 PeekQueue 返回的顺序传入
+func AckQueue(ctx context.Context, key string, items []string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	args := make([]interface{}, len(items))
+	for i, item := range items {
+		args[i] = item
+	}
+	return ackQueueScript.Run(ctx, configs.Rdb, []string{key}, args...).Err()
+}
@@ -23,9 +23,13 @@ type CustomError struct {
 var errorCodeTextMap = map[int]string{
 	400: "Bad Request",
 	401: "Unauthorized",
+	402: "Payment Required",
 	403: "Forbidden",
 	404: "Not Found",
+	409: "Conflict",
+	429: "Too Many Requests",
 	500: "Internal Server Error",
+	503: "Service Unavailable",
 }
 
 // JsonSuccess 统一成功返回程序
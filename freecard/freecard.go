@@ -0,0 +1,275 @@
+package freecard
+
+import (
+	"context"
+	"errors"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"strconv"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/models"
+	"tbooks/usersync"
+	"time"
+)
+
+// 免费卡片任务按发放时间写入 Redis 有序集合，到期后由任务取出发卡
+// 发卡在 Redis 中以任务ID幂等，成功后才将 MySQL 中的任务标记为已发放
+
+const (
+	// ScheduleKey 等待发放的任务ID，分数为发放时间
+	ScheduleKey = "free_card_schedule"
+	// processingKey 已取出、正在发放的任务ID，分数为超时时间
+	processingKey = "free_card_processing"
+	// DeadKey 多次失败后放弃的任务ID，分数为放弃时间
+	DeadKey = "free_card_dead"
+	// attemptsKey 每个任务已失败的次数
+	attemptsKey = "free_card_attempts"
+	// batchSize 每批取出的任务数
+	batchSize = 100
+	// processTimeout 取出后超过该时间仍未完成，视为实例异常并重新发放
+	processTimeout = time.Minute
+	// maxAttempts 最多尝试次数，超过后进入死信
+	maxAttempts = 5
+	// retryBackoff 第 n 次失败后延迟 n 倍该时间重试
+	retryBackoff = 30 * time.Second
+	// grantedExpire 发放幂等键的有效期
+	grantedExpire = 30 * 24 * time.Hour
+)
+
+// grantedKey 任务已发卡的幂等键
+func grantedKey(taskID uint) string {
+	return "free_card_granted:" + strconv.FormatUint(uint64(taskID), 10)
+}
+
+func member(taskID uint) string {
+	return strconv.FormatUint(uint64(taskID), 10)
+}
+
+// Schedule 按任务的发放时间加入发放队列
+func Schedule(ctx context.Context, task models.FreeCardTask) error {
+	at := time.Now()
+	if task.GrantedAt != nil {
+		at = *task.GrantedAt
+	}
+	return configs.Rdb.ZAddNX(ctx, ScheduleKey, redis.Z{Score: float64(at.Unix()), Member: member(task.ID)}).Err()
+}
+
+// claimScript 放回超时的任务，再取出一批到期的任务
+// KEYS[1] 发放队列  KEYS[2] 处理中集合  ARGV[1] 当前时间  ARGV[2] 超时时间  ARGV[3] 批量大小
+var claimScript = redis.NewScript(`
+local stale = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, id in ipairs(stale) do
+	redis.call('ZADD', KEYS[1], ARGV[1], id)
+	redis.call('ZREM', KEYS[2], id)
+end
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, ARGV[3])
+for _, id in ipairs(due) do
+	redis.call('ZREM', KEYS[1], id)
+	redis.call('ZADD', KEYS[2], ARGV[2], id)
+end
+return due
+`)
+
+// grantScript 以任务ID幂等地给用户增加一张卡片
+// KEYS[1] 卡片数量  KEYS[2] 待同步集合  KEYS[3] 幂等键
+// ARGV[1] 毫秒时间戳  ARGV[2] 用户ID  ARGV[3] 幂等键有效期
+var grantScript = redis.NewScript(usersync.LuaMarkDirty + `
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return 2
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+redis.call('INCR', KEYS[1])
+redis.call('SET', KEYS[3], 1, 'EX', ARGV[3])
+markDirty(KEYS[2], ARGV[1], ARGV[2])
+return 1
+`)
+
+// failScript 记录一次失败，未超过次数时延迟重试，否则进入死信
+// KEYS[1] 处理中集合  KEYS[2] 发放队列  KEYS[3] 死信集合  KEYS[4] 失败次数
+// ARGV[1] 任务ID  ARGV[2] 当前时间  ARGV[3] 最多尝试次数  ARGV[4] 重试间隔秒数
+var failScript = redis.NewScript(`
+redis.call('ZREM', KEYS[1], ARGV[1])
+local attempts = redis.call('HINCRBY', KEYS[4], ARGV[1], 1)
+if attempts >= tonumber(ARGV[3]) then
+	redis.call('ZREM', KEYS[2], ARGV[1])
+	redis.call('ZADD', KEYS[3], ARGV[2], ARGV[1])
+	return -1
+end
+redis.call('ZADD', KEYS[2], tonumber(ARGV[2]) + attempts * tonumber(ARGV[4]), ARGV[1])
+return attempts
+`)
+
+// ProcessDue 发放所有到期的任务，返回成功发放的任务数
+func ProcessDue(ctx context.Context) (int, error) {
+	granted := 0
+	for {
+		now := time.Now()
+		ids, err := claimScript.Run(ctx, configs.Rdb, []string{ScheduleKey, processingKey},
+			now.Unix(), now.Add(processTimeout).Unix(), batchSize).StringSlice()
+		if err != nil {
+			return granted, err
+		}
+		for _, id := range ids {
+			taskID, err := strconv.ParseUint(id, 10, 64)
+			if err != nil {
+				logs.Warn("Invalid free card task id:", id)
+				configs.Rdb.ZRem(ctx, processingKey, id)
+				continue
+			}
+			if err := grant(ctx, uint(taskID)); err != nil {
+				fail(ctx, id, err)
+				continue
+			}
+			pipe := configs.Rdb.TxPipeline()
+			pipe.ZRem(ctx, processingKey, id)
+			pipe.HDel(ctx, attemptsKey, id)
+			if _, err := pipe.Exec(ctx); err != nil {
+				return granted, err
+			}
+			granted++
+		}
+		if len(ids) < batchSize {
+			return granted, nil
+		}
+	}
+}
+
+// grant 发放一个任务，已发放过的任务只补写 MySQL 状态
+func grant(ctx context.Context, taskID uint) error {
+	var task models.FreeCardTask
+	if err := daos.DB.First(&task, taskID).Error; err != nil {
+		return err
+	}
+	if task.IsGranted {
+		return nil
+	}
+
+	keys := []string{usersync.CardCountKey(task.UserID), usersync.DirtyKey, grantedKey(taskID)}
+	for i := 0; ; i++ {
+		res, err := grantScript.Run(ctx, configs.Rdb, keys,
+			time.Now().UnixMilli(), task.UserID, int64(grantedExpire/time.Second)).Int()
+		if err != nil {
+			return err
+		}
+		if res != 0 {
+			break
+		}
+		if i > 0 {
+			return errors.New("User card count is not loaded")
+		}
+		if err := usersync.LoadUser(ctx, task.UserID); err != nil {
+			return err
+		}
+	}
+
+	// 卡片已到账后再标记任务已发放
+	return daos.DB.Model(&models.FreeCardTask{}).
+		Where("id = ? AND is_granted = ?", taskID, false).
+		Update("is_granted", true).Error
+}
+
+// fail 记录发放失败
+func fail(ctx context.Context, id string, cause error) {
+	now := time.Now()
+	attempts, err := failScript.Run(ctx, configs.Rdb, []string{processingKey, ScheduleKey, DeadKey, attemptsKey},
+		id, now.Unix(), maxAttempts, int64(retryBackoff/time.Second)).Int()
+	if err != nil {
+		// 留在处理中集合，超时后重新发放
+		logs.Error("Failed to record free card task %s failure: %v", id, err)
+		return
+	}
+	if attempts < 0 {
+		logs.Error("Free card task %s moved to dead letter: %v", id, cause)
+		return
+	}
+	logs.Warn("Free card task %s failed (attempt %d), will retry: %v", id, attempts, cause)
+}
+
+// recoverScript 将未在队列、处理中和死信中的任务加入队列
+// KEYS[1] 发放队列  KEYS[2] 处理中集合  KEYS[3] 死信集合  ARGV 依次为任务ID和发放时间
+var recoverScript = redis.NewScript(`
+local added = 0
+for i = 1, #ARGV, 2 do
+	local id = ARGV[i]
+	if not redis.call('ZSCORE', KEYS[2], id) and not redis.call('ZSCORE', KEYS[3], id) then
+		added = added + redis.call('ZADD', KEYS[1], 'NX', ARGV[i + 1], id)
+	end
+end
+return added
+`)
+
+// Recover 将 MySQL 中未发放但不在队列中的任务重新加入队列，用于迁移旧数据和补救入队失败
+func Recover(ctx context.Context) error {
+	var tasks []models.FreeCardTask
+	recovered := 0
+	err := daos.DB.Where("is_granted = ?", false).FindInBatches(&tasks, 500, func(tx *gorm.DB, batch int) error {
+		args := make([]interface{}, 0, len(tasks)*2)
+		for _, task := range tasks {
+			at := task.CreatedAt
+			if task.GrantedAt != nil {
+				at = *task.GrantedAt
+			}
+			args = append(args, member(task.ID), at.Unix())
+		}
+		added, err := recoverScript.Run(ctx, configs.Rdb, []string{ScheduleKey, processingKey, DeadKey}, args...).Int()
+		recovered += added
+		return err
+	}).Error
+	if recovered > 0 {
+		logs.Info("Recovered %d free card tasks into the schedule", recovered)
+	}
+	return err
+}
+
+// DeadTask 死信中的任务
+type DeadTask struct {
+	models.FreeCardTask
+	DeadAt   time.Time `json:"dead_at"`
+	Attempts int       `json:"attempts"`
+}
+
+// DeadTasks 列出死信中的任务
+func DeadTasks(ctx context.Context) ([]DeadTask, error) {
+	items, err := configs.Rdb.ZRangeWithScores(ctx, DeadKey, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	dead := make([]DeadTask, 0, len(items))
+	for _, item := range items {
+		id := item.Member.(string)
+		taskID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			continue
+		}
+		entry := DeadTask{DeadAt: time.Unix(int64(item.Score), 0)}
+		if err := daos.DB.First(&entry.FreeCardTask, taskID).Error; err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		entry.ID = uint(taskID)
+		entry.Attempts, _ = configs.Rdb.HGet(ctx, attemptsKey, id).Int()
+		dead = append(dead, entry)
+	}
+	return dead, nil
+}
+
+// retryDeadScript 将死信中的任务立即放回队列并清零失败次数
+// KEYS[1] 死信集合  KEYS[2] 发放队列  KEYS[3] 失败次数  ARGV[1] 任务ID  ARGV[2] 当前时间
+var retryDeadScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+redis.call('HDEL', KEYS[3], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[2], ARGV[1])
+return 1
+`)
+
+// RetryDead 重新发放死信中的任务，任务不在死信中时返回 false
+func RetryDead(ctx context.Context, taskID uint) (bool, error) {
+	n, err := retryDeadScript.Run(ctx, configs.Rdb, []string{DeadKey, ScheduleKey, attemptsKey},
+		member(taskID), time.Now().Unix()).Int()
+	return n == 1, err
+}
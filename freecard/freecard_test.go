@@ -0,0 +1,191 @@
+package freecard
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"tbooks/usersync"
+	"testing"
+	"time"
+)
+
+func setup(t *testing.T, userIDs ...string) {
+	t.Helper()
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "")
+	for _, userID := range userIDs {
+		if err := daos.DB.Create(&models.User{UserID: userID, Address: "addr-" + userID, CreatedAt: time.Now()}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTask 创建已到期的任务，schedule 为 true 时加入发放队列
+func newTask(t *testing.T, userID string, schedule bool) models.FreeCardTask {
+	t.Helper()
+	at := time.Now().Add(-time.Minute)
+	task := models.FreeCardTask{UserID: userID, CreatedAt: at, GrantedAt: &at}
+	if err := daos.DB.Create(&task).Error; err != nil {
+		t.Fatal(err)
+	}
+	if schedule {
+		if err := Schedule(context.Background(), task); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return task
+}
+
+func cards(t *testing.T, userID string) int64 {
+	t.Helper()
+	n, err := configs.Rdb.Get(context.Background(), usersync.CardCountKey(userID)).Int64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func granted(t *testing.T, taskID uint) bool {
+	t.Helper()
+	var task models.FreeCardTask
+	if err := daos.DB.First(&task, taskID).Error; err != nil {
+		t.Fatal(err)
+	}
+	return task.IsGranted
+}
+
+func TestProcessDueOnce(t *testing.T) {
+	setup(t, "U")
+	ctx := context.Background()
+	tasks := []models.FreeCardTask{newTask(t, "U", true), newTask(t, "U", true)}
+	// 尚未到期的任务不发放
+	later := time.Now().Add(time.Hour)
+	pending := models.FreeCardTask{UserID: "U", CreatedAt: time.Now(), GrantedAt: &later}
+	daos.DB.Create(&pending)
+	if err := Schedule(ctx, pending); err != nil {
+		t.Fatal(err)
+	}
+
+	// 多个实例同时处理，每个任务只发放一次
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total := 0
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := ProcessDue(ctx)
+			if err != nil {
+				t.Error(err)
+			}
+			mu.Lock()
+			total += n
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if total != 2 || cards(t, "U") != 2 {
+		t.Fatalf("granted %d tasks, %d cards, want 2", total, cards(t, "U"))
+	}
+	for _, task := range tasks {
+		if !granted(t, task.ID) {
+			t.Fatalf("task %d not marked granted", task.ID)
+		}
+	}
+	if granted(t, pending.ID) {
+		t.Fatal("task granted before it is due")
+	}
+
+	// 已发放的任务再次入队不会重复发卡
+	if err := Schedule(ctx, tasks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ProcessDue(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := cards(t, "U"); n != 2 {
+		t.Fatalf("%d cards after rescheduling a granted task", n)
+	}
+}
+
+func TestGrantAfterFailedUpdate(t *testing.T) {
+	setup(t, "U")
+	ctx := context.Background()
+	task := newTask(t, "U", true)
+	// 上次已在 Redis 发卡，但标记 MySQL 前实例退出
+	if _, err := usersync.AddCardsOnce(ctx, "U", 1, grantedKey(task.ID), grantedExpire); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ProcessDue(ctx); err != nil || n != 1 {
+		t.Fatalf("process: %d %v", n, err)
+	}
+	if n := cards(t, "U"); n != 1 || !granted(t, task.ID) {
+		t.Fatalf("%d cards, granted %v", n, granted(t, task.ID))
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	// 用户不存在，每次发放都失败
+	task := newTask(t, "missing", true)
+	for i := 1; i <= maxAttempts; i++ {
+		// 失败后按退避时间延后，这里直接提前到期
+		configs.Rdb.ZAddXX(ctx, ScheduleKey, redis.Z{Score: float64(time.Now().Add(-time.Second).Unix()), Member: member(task.ID)})
+		if n, err := ProcessDue(ctx); err != nil || n != 0 {
+			t.Fatalf("attempt %d: %d %v", i, n, err)
+		}
+	}
+	if n := configs.Rdb.ZCard(ctx, ScheduleKey).Val(); n != 0 {
+		t.Fatalf("%d tasks still scheduled", n)
+	}
+	dead, err := DeadTasks(ctx)
+	if err != nil || len(dead) != 1 || dead[0].ID != task.ID || dead[0].Attempts != maxAttempts {
+		t.Fatalf("dead tasks %+v %v", dead, err)
+	}
+	// 死信中的任务不会被恢复任务重新入队
+	if err := Recover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := configs.Rdb.ZCard(ctx, ScheduleKey).Val(); n != 0 {
+		t.Fatalf("recover scheduled a dead task")
+	}
+
+	// 补上用户后手动重试
+	daos.DB.Create(&models.User{UserID: "missing", Address: "addr-missing", CreatedAt: time.Now()})
+	if ok, err := RetryDead(ctx, task.ID); err != nil || !ok {
+		t.Fatalf("retry: %v %v", ok, err)
+	}
+	if ok, _ := RetryDead(ctx, task.ID); ok {
+		t.Fatal("retried a task that is not in dead letter")
+	}
+	if n, err := ProcessDue(ctx); err != nil || n != 1 || cards(t, "missing") != 1 {
+		t.Fatalf("process after retry: %d %v", n, err)
+	}
+}
+
+func TestRecover(t *testing.T) {
+	setup(t, "U")
+	ctx := context.Background()
+	// 入队失败的任务由恢复任务补入
+	task := newTask(t, "U", false)
+	if err := Recover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ProcessDue(ctx); err != nil || n != 1 || !granted(t, task.ID) {
+		t.Fatalf("process recovered task: %d %v", n, err)
+	}
+	// 已发放的任务不再入队
+	if err := Recover(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := configs.Rdb.ZCard(ctx, ScheduleKey).Val(); n != 0 {
+		t.Fatalf("%d granted tasks recovered", n)
+	}
+}
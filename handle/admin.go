@@ -0,0 +1,142 @@
+package handle
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strconv"
+	"tbooks/configs"
+	"tbooks/errorss"
+	"tbooks/freecard"
+	"tbooks/jobs"
+	"tbooks/ledger"
+	"tbooks/models"
+	"tbooks/quest"
+	"tbooks/usersync"
+	"time"
+)
+
+// AdminReconcileLedger 核对用户余额与账本分录
+func AdminReconcileLedger(c *gin.Context) {
+	report, err := ledger.Reconcile(c)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, report)
+}
+
+// AdminUserSyncStats 查看用户数据写回 MySQL 的积压和延迟
+func AdminUserSyncStats(c *gin.Context) {
+	stats, err := usersync.GetStats(c)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, stats)
+}
+
+// AdminJobs 查看后台任务由哪个实例运行
+func AdminJobs(c *gin.Context) {
+	statuses, err := jobs.Statuses(c)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"instance": jobs.InstanceID(), "jobs": statuses})
+}
+
+// AdminDeadFreeCards 查看多次发放失败的免费卡片任务
+func AdminDeadFreeCards(c *gin.Context) {
+	tasks, err := freecard.DeadTasks(c)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"tasks": tasks})
+}
+
+// AdminRetryFreeCard 将死信中的免费卡片任务放回发放队列
+func AdminRetryFreeCard(c *gin.Context) {
+	taskID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid task id"))
+		return
+	}
+	ok, err := freecard.RetryDead(c, uint(taskID))
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		errorss.HandleError(c, http.StatusNotFound, errors.New("Task is not in dead letter"))
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"message": "Task rescheduled successfully"})
+}
+
+// AdminGetTasks 查看全部任务配置
+func AdminGetTasks(c *gin.Context) {
+	errorss.JsonSuccess(c, gin.H{"tasks": quest.All()})
+}
+
+// AdminUpdateTasks 替换某个任务列表的全部任务，修改在各实例刷新缓存后生效
+func AdminUpdateTasks(c *gin.Context) {
+	list := c.Param("list")
+	if !quest.ValidList(list) {
+		errorss.HandleError(c, http.StatusBadRequest, quest.ErrInvalidList)
+		return
+	}
+	var input []models.Task
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := quest.Replace(list, input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"message": "Task list updated successfully", "tasks": quest.List(list, time.Now())})
+}
+
+// AdminGetFlags 查看全部功能开关及其来源
+func AdminGetFlags(c *gin.Context) {
+	flags, err := configs.ListFlags(c)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"flags": flags})
+}
+
+// AdminSetFlag 设置功能开关，覆盖配置中的默认值，所有实例立即生效
+func AdminSetFlag(c *gin.Context) {
+	var input configs.FlagConfig
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	err := configs.SetFlag(c, c.Param("name"), input)
+	if errors.Is(err, configs.ErrInvalidFlag) {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"message": "Feature flag updated successfully", "name": configs.FlagName(c.Param("name")), "flag": input})
+}
+
+// AdminDeleteFlag 删除功能开关的设置，恢复为配置中的默认值
+func AdminDeleteFlag(c *gin.Context) {
+	ok, err := configs.DeleteFlag(c, c.Param("name"))
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		errorss.HandleError(c, http.StatusNotFound, errors.New("Feature flag is not set"))
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"message": "Feature flag reset to default"})
+}
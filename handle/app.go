@@ -1,52 +1,50 @@
 package handle
 
 import (
-	"context"
-	"encoding/json"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/beego/beego/v2/core/logs"
 	"github.com/gin-gonic/gin"
-	"github.com/redis/go-redis/v9"
-	"log"
-	"math/rand"
+	"gorm.io/gorm"
 	"net/http"
 	"strconv"
 	"tbooks/configs"
 	"tbooks/daos"
 	"tbooks/errorss"
+	"tbooks/freecard"
+	"tbooks/ledger"
 	"tbooks/models"
+	"tbooks/quest"
+	"tbooks/quota"
+	"tbooks/referral"
+	"tbooks/social"
+	"tbooks/timeutil"
+	"tbooks/usersync"
 	"time"
 )
 
-type Prize struct {
-	Name     string `json:"name"`
-	Value    string `json:"value"`
-	ImageURL string `json:"image_url"` // 添加图片 URL 字段
-}
+// defaultCardPrice 未配置时用余额购买一张抽奖卡的价格
+var defaultCardPrice = models.Units(100)
+
+// scheduleFreeCard 将免费卡片任务加入发放队列，测试时可以替换
+var scheduleFreeCard = freecard.Schedule
 
-// 为不同玩法定义奖品
-var prizes = map[string]map[string]Prize{
-	"1": { // 玩法 1: 抽奖四个奖品
-		"1": {Name: "100points", Value: "100", ImageURL: "1"},
-		"2": {Name: "200points", Value: "200", ImageURL: "2"},
-		"3": {Name: "300points", Value: "300", ImageURL: "3"},
-		"4": {Name: "1card", Value: "1", ImageURL: "4"},
-	},
-	"2": { // 玩法 2: 大转盘八个奖品
-		"1": {Name: "50points", Value: "50", ImageURL: "1"},
-		"2": {Name: "100points", Value: "100", ImageURL: "2"},
-		"3": {Name: "150points", Value: "150", ImageURL: "3"},
-		"4": {Name: "200points", Value: "200", ImageURL: "4"},
-		"5": {Name: "250points", Value: "250", ImageURL: "5"},
-		"6": {Name: "300points", Value: "300", ImageURL: "6"},
-		"7": {Name: "1card", Value: "1", ImageURL: "7"},
-		"8": {Name: "400points", Value: "400", ImageURL: "8"},
-	},
+// cardPrice 用余额购买一张抽奖卡的价格，配置修改后立即生效
+func cardPrice() models.Amount {
+	if price := configs.Config().CardPrice; price > 0 {
+		return models.Units(price)
+	}
+	return defaultCardPrice
 }
 
 func LuckDraw(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
 	var input struct {
-		UserID   string `json:"userid" binding:"required"`
 		PlayMode string `json:"playmode" binding:"required"` // 添加玩法参数
 	}
 
@@ -55,76 +53,65 @@ func LuckDraw(c *gin.Context) {
 		errorss.HandleError(c, 400, err)
 		return
 	}
-	// 获取用户的卡片次数
-	cardCount, err := configs.Rdb.Get(c, input.UserID+"_card_count").Int()
-	if err == redis.Nil {
-		errorss.HandleError(c, 404, errors.New("User not found")) // 用户未找到
+	result, drawQuota, err := DrawWithQuota(c, userID, input.PlayMode)
+	switch {
+	case errors.Is(err, quota.ErrExceeded):
+		errorss.HandleError(c, http.StatusTooManyRequests,
+			fmt.Errorf("Quota exceeded, next available at %s", drawQuota.NextAt.Format(time.RFC3339)))
 		return
-	} else if err != nil {
-		errorss.HandleError(c, 500, err) // 获取用户卡片次数失败
+	case errors.Is(err, ErrUserNotFound):
+		errorss.HandleError(c, 404, err) // 用户未找到
 		return
-	}
-	// 检查卡片次数
-	if cardCount <= 0 {
-		errorss.HandleError(c, 403, errors.New("Insufficient card ")) // 卡片次数不足
+	case errors.Is(err, ErrInsufficientCard):
+		errorss.HandleError(c, 403, err) // 卡片次数不足
 		return
-	}
-	// 扣除一次卡片次数
-	if err := configs.Rdb.Decr(c, input.UserID+"_card_count").Err(); err != nil {
-		errorss.HandleError(c, 500, err) // 更新卡片次数失败
+	case errors.Is(err, ErrInvalidPlayMode):
+		errorss.HandleError(c, 400, err) // 无效的玩法参数
 		return
-	}
-	// 选择对应玩法的奖品
-	availablePrizes, ok := prizes[input.PlayMode]
-	if !ok {
-		errorss.HandleError(c, 400, errors.New("Invalid PlayMode parameter")) // 无效的玩法参数
+	case errors.Is(err, ErrPrizeSoldOut):
+		errorss.HandleError(c, 403, err) // 奖品已抽完
+		return
+	case errors.Is(err, ErrPlayModeUnavailable):
+		errorss.HandleError(c, 403, err) // 玩法未对该用户开放
+		return
+	case err != nil:
+		errorss.HandleError(c, 500, err) // 抽奖失败
 		return
 	}
-	// 随机选择一个奖品
-	rand.Seed(time.Now().UnixNano())
-	prizeKey := []string{"1", "2", "3", "4", "5", "6", "7", "8"}[rand.Intn(len(availablePrizes))]
-	prize := availablePrizes[prizeKey]
 
 	// 处理奖品
-	switch prize.Name {
-	case "100points", "200points", "300points", "400points", "50points", "150points", "250points":
+	resp := gin.H{
+		"prize":      result.Prize.Name,
+		"card_count": result.CardCount,
+		"number":     result.Prize.PrizeKey, // 奖品编号
+		"image_url":  result.Prize.ImageURL,
+		"fair": gin.H{ // 可证明公平参数
+			"server_seed_hash": result.ServerSeedHash,
+			"client_seed":      result.ClientSeed,
+			"nonce":            result.Nonce,
+			"sold_out":         result.SoldOut,
+			"table_hash":       result.TableHash,
+		},
+	}
+	switch result.Prize.Kind {
+	case models.PrizeKindPoints:
 		// 奖品是余额
-		balance, err := strconv.ParseFloat(prize.Value, 64)
-		if err != nil {
-			errorss.HandleError(c, 500, err) // 解析余额失败
-			return
-		}
-		userBalanceKey := input.UserID + "_balance"
-		if err := configs.Rdb.IncrByFloat(c, userBalanceKey, balance).Err(); err != nil {
-			errorss.HandleError(c, 500, err) // 更新余额失败
-			return
-		}
-		newBalance, _ := configs.Rdb.Get(c, userBalanceKey).Float64()
-		errorss.JsonSuccess(c, gin.H{
-			"message":    "congratulations! You have won the prize!",
-			"prize":      prize.Name,
-			"balance":    newBalance,
-			"number":     prize.ImageURL, // 包含奖品图片链接
-			"card_count": cardCount - 1,
-		})
-
-	case "1card":
+		resp["message"] = "congratulations! You have won the prize!"
+		resp["balance"] = result.Balance
+	case models.PrizeKindCard:
 		// 奖品是抽奖卡
-		if err := configs.Rdb.Incr(c, input.UserID+"_card_count").Err(); err != nil {
-			errorss.HandleError(c, 500, err) // 更新卡片次数失败
-			return
-		}
-		newCardCount, _ := configs.Rdb.Get(c, input.UserID+"_card_count").Int()
-		errorss.JsonSuccess(c, gin.H{
-			"message":    "congratulations! You have won a lottery card!",
-			"prize":      prize.Name,
-			"card_count": newCardCount,
-			"number":     prize.ImageURL, // 包含奖品图片链接
-		})
-
+		resp["message"] = "congratulations! You have won a lottery card!"
+	case models.PrizeKindItem:
+		// 奖品是实物或兑换码，后续人工发放
+		resp["message"] = "congratulations! You have won " + result.Prize.Name + "!"
+	case models.PrizeKindNone:
+		// 未中奖
+		resp["message"] = "Better luck next time!"
 	default:
 		errorss.HandleError(c, 500, errors.New("Unknown prize type")) // 未知奖品类型
+		return
 	}
+	errorss.JsonSuccess(c, resp)
 }
 
 //func LuckDraw(c *gin.Context) {
@@ -212,136 +199,97 @@ func LuckDraw(c *gin.Context) {
 //}
 
 func UserBalance(c *gin.Context) {
-	var input struct {
-		UserID string `json:"userid" binding:"required"`
-	}
-
-	// 绑定 JSON 输入到结构体
-	if err := c.ShouldBindJSON(&input); err != nil {
-		errorss.HandleError(c, 400, err) // 无效的 JSON 输入
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
 		return
 	}
 
-	// 获取 Redis 上的键
-	cardCountKey := input.UserID + "_card_count"
-	balanceKey := input.UserID + "_balance"
-
-	// 从 Redis 获取卡片数量和余额
-	redisCardCountStr, err := configs.Rdb.Get(context.Background(), cardCountKey).Result()
-	if err == redis.Nil {
-		// Redis 中没有卡片数量，尝试从数据库获取并缓存
-		var user models.User
-		if err := daos.DB.Where("user_id = ?", input.UserID).First(&user).Error; err != nil {
-			errorss.HandleError(c, 404, err) // 用户未找到
-			return
-		}
-		// 更新 Redis
-		err = configs.Rdb.Set(context.Background(), cardCountKey, user.CardCount, 0).Err()
-		if err != nil {
-			log.Println("Failed to cache user card count to Redis:", err)
-		}
-		redisCardCountStr = strconv.Itoa(user.CardCount)
-	} else if err != nil {
-		errorss.HandleError(c, 500, err) // 无法获取卡片数量
+	// 从 Redis 获取卡片数量和余额，没有时从数据库加载
+	cardCount, balance, err := usersync.Balances(c, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		errorss.HandleError(c, 404, err) // 用户未找到
 		return
-	}
-
-	redisBalanceStr, err := configs.Rdb.Get(context.Background(), balanceKey).Result()
-	if err == redis.Nil {
-		// Redis 中没有余额，尝试从数据库获取并缓存
-		var user models.User
-		if err := daos.DB.Where("user_id = ?", input.UserID).First(&user).Error; err != nil {
-			errorss.HandleError(c, 404, err) // 用户未找到
-			return
-		}
-		// 更新 Redis
-		err = configs.Rdb.Set(context.Background(), balanceKey, user.Balance, 0).Err()
-		if err != nil {
-			log.Println("Failed to cache user balance to Redis:", err)
-		}
-		redisBalanceStr = strconv.FormatFloat(user.Balance, 'f', -1, 64)
 	} else if err != nil {
-		errorss.HandleError(c, 500, err) // 无法获取余额
+		errorss.HandleError(c, 500, err) // 无法获取卡片数量和余额
 		return
 	}
 
 	// 从 Redis 中获取一级邀请数量
 	var friendsCount int64
-	if err := daos.DB.Model(&models.Invitation{}).Where("inviter_id = ? AND level = ?", input.UserID, 1).Count(&friendsCount).Error; err != nil {
+	if err := daos.DB.Model(&models.Invitation{}).Where("inviter_id = ? AND level = ?", userID, 1).Count(&friendsCount).Error; err != nil {
 		errorss.HandleError(c, 500, err) // 无法获取邀请数量
 		return
 	}
 
 	// 返回用户的余额和卡片次数
 	errorss.JsonSuccess(c, gin.H{
-		"user_id":       input.UserID,
-		"balance":       redisBalanceStr,
-		"card_count":    redisCardCountStr,
+		"user_id":       userID,
+		"balance":       balance,
+		"card_count":    strconv.FormatInt(cardCount, 10),
 		"friends_count": friendsCount,
 	})
 }
-func BuyCard(c *gin.Context) {
-	// 定义结构体以绑定请求中的 JSON 数据
-	var input struct {
-		UserID string `json:"userid" binding:"required"` // 用户ID，必填
-	}
 
-	// 将 JSON 请求体绑定到 input 结构体
-	if err := c.ShouldBindJSON(&input); err != nil {
-		errorss.HandleError(c, http.StatusBadRequest, err) // 无效的 JSON 格式
+// newPurchaseID 生成用余额购买抽奖卡的业务ID
+func newPurchaseID() string {
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func BuyCard(c *gin.Context) {
+	// 用户ID来自鉴权上下文
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
 		return
 	}
 
 	// 从数据库中检索用户信息
 	var user models.User
-	if err := daos.DB.Where("user_id = ?", input.UserID).First(&user).Error; err != nil {
+	if err := daos.DB.Where("user_id = ?", userID).First(&user).Error; err != nil {
 		errorss.HandleError(c, http.StatusNotFound, err) // 用户未找到
 		return
 	}
 
-	// 检查用户是否有足够的余额购买卡片
-	if user.Balance < 100 {
-		errorss.HandleError(c, http.StatusPaymentRequired, nil) // 余额不足
-		return
-	}
-
-	// 扣除余额并增加卡片数量
-	user.Balance -= 100
-	user.CardCount += 1
-	user.UpdatedAt = time.Now() // 更新最后修改时间
-
-	// 保存更新后的用户信息到数据库
-	if err := daos.DB.Save(&user).Error; err != nil {
-		errorss.HandleError(c, http.StatusInternalServerError, err) // 更新用户失败
+	buyQuota, ok := consumeQuota(c, quota.PolicyBuyCard, userID)
+	if !ok {
 		return
 	}
-
-	// 更新 Redis 缓存中的用户数据
-	// 将用户数据序列化为 JSON
-	userJSON, err := json.Marshal(user)
-	if err != nil {
-		log.Println("Failed to marshal user data:", err)
-	} else {
-		// 将用户数据缓存到 Redis 中
-		err = configs.Rdb.Set(configs.Ctx, "user:"+user.UserID, userJSON, 0).Err()
-		if err != nil {
-			log.Println("Failed to cache user data to Redis:", err)
+	// 购买失败时不占用额度
+	releaseQuota := func() {
+		if err := quota.Release(c, quota.PolicyBuyCard, userID, buyQuota); err != nil {
+			logs.Error("Failed to release buy card quota:", err)
 		}
 	}
 
-	// 缓存用户的卡片数量
-	cardCountKey := user.UserID + "_card_count"
-	err = configs.Rdb.Set(configs.Ctx, cardCountKey, user.CardCount, 0).Err()
+	// 通过账本扣除余额，余额不足时不会扣减；每次购买使用新的业务ID，退回时引用同一ID
+	price := cardPrice()
+	purchaseID := newPurchaseID()
+	balance, err := ledger.Debit(c, userID, price, ledger.ReasonCardPurchase, purchaseID)
 	if err != nil {
-		log.Println("Failed to cache user card count to Redis:", err)
+		releaseQuota()
+	}
+	if errors.Is(err, ledger.ErrInsufficientBalance) {
+		errorss.HandleError(c, http.StatusPaymentRequired, err) // 余额不足
+		return
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err) // 扣除余额失败
+		return
 	}
 
-	// 缓存用户的余额
-	balanceKey := user.UserID + "_balance"
-	err = configs.Rdb.Set(configs.Ctx, balanceKey, user.Balance, 0).Err()
+	// 增加卡片数量
+	cardCount, err := usersync.AddCards(c, userID, 1)
 	if err != nil {
-		log.Println("Failed to cache user balance to Redis:", err)
+		// 卡片发放失败时退回余额
+		if _, refundErr := ledger.Credit(c, userID, price, ledger.ReasonCardRefund, purchaseID); refundErr != nil {
+			logs.Error("Failed to refund card purchase:", refundErr)
+		}
+		releaseQuota()
+		errorss.HandleError(c, http.StatusInternalServerError, err) // 更新卡片数量失败
+		return
 	}
+	user.Balance = balance
+	user.CardCount = int(cardCount)
 
 	// 返回成功消息和更新后的用户数据
 	errorss.JsonSuccess(c, gin.H{
@@ -349,11 +297,16 @@ func BuyCard(c *gin.Context) {
 		"user":    user,
 	})
 }
+
 func CreateUser(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
 	var input struct {
-		UserID            string `json:"userid" binding:"required"`
 		Address           string `json:"address"`
-		InvitationAddress string `json:"invitation_address"`
+		InvitationAddress string `json:"invitation_address"` // 邀请人地址，兼容旧版本
+		ReferralCode      string `json:"referral_code"`      // 推荐码
 	}
 
 	// Bind JSON input to the struct
@@ -364,79 +317,55 @@ func CreateUser(c *gin.Context) {
 
 	// Check if the user already exists
 	var existingUser models.User
-	if err := daos.DB.Where("user_id = ?", input.UserID).First(&existingUser).Error; err == nil {
+	if err := daos.DB.Where("user_id = ?", userID).First(&existingUser).Error; err == nil {
 		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
 		return
 	}
 
 	// Create the user with default balance and card count
 	user := models.User{
-		UserID:    input.UserID,
+		UserID:    userID,
 		Balance:   0,     // Default balance
 		CardCount: 10000, // Default card count
 		Address:   input.Address,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
+	if tgUser, ok := GetTelegramUserFromContext(c); ok {
+		user.ProfilePhoto = tgUser.PhotoURL
+	}
 
-	if err := daos.DB.Create(&user).Error; err != nil {
+	// Create the user and its inviter chain in one transaction
+	err := daos.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		// Attribute the user by referral code, inviter address or the code recorded by the bot
+		_, err := referral.AttributeSignup(c, tx, &user, input.ReferralCode, input.InvitationAddress)
+		return err
+	})
+	if errors.Is(err, referral.ErrInviterNotFound) || errors.Is(err, referral.ErrInvalidCode) ||
+		errors.Is(err, referral.ErrSelfInvite) || errors.Is(err, referral.ErrCyclicReferral) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-
-	// Handle invitation if provided
-	if input.InvitationAddress != "" {
-		// Find the inviter based on the provided invitation address
-		var inviter models.User
-		if err := daos.DB.Where("user_id = ?", input.UserID).First(&inviter).Error; err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{"error": "Invitation address not found"})
-			return
-		}
-
-		// Check if the inviter has an upper-level inviter
-		var upperInviter models.Invitation
-		if err := daos.DB.Where("invitee_userid = ? AND level = ?", inviter.UserID, 1).First(&upperInviter).Error; err == nil {
-			// Inviter has an upper-level inviter, so this user becomes a level 2 invitee
-			invitation := models.Invitation{
-				InviterID:      upperInviter.InviterID,
-				InviterAddress: upperInviter.InviterAddress,
-				InviteeUserID:  user.UserID,
-				InviteeAddress: user.Address,
-				Level:          2, // This is a level 2 invitation
-				CreatedAt:      time.Now(),
-			}
-
-			if err := daos.DB.Create(&invitation).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-		} else {
-			// No upper-level inviter, so this user is a level 1 invitee
-			invitation := models.Invitation{
-				InviterID:      inviter.UserID,
-				InviterAddress: inviter.Address,
-				InviteeUserID:  user.UserID,
-				InviteeAddress: user.Address,
-				Level:          1, // This is a level 1 invitation
-				CreatedAt:      time.Now(),
-			}
-
-			if err := daos.DB.Create(&invitation).Error; err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-		}
+	if err := referral.ClearPending(c, userID); err != nil {
+		logs.Error("Failed to clear pending referral:", err)
 	}
 	// Respond with the created user
 	c.JSON(http.StatusOK, gin.H{"message": "User created successfully", "user": user})
 }
 
 type Leaderboard struct {
-	Rank         int     `json:"rank"`
-	UserID       string  `json:"user_id"`
-	Balance      float64 `json:"balance"`
-	ProfilePhoto string  `json:"profile_photo"`
-	Address      string  `json:"address"`
+	Rank         int           `json:"rank"`
+	UserID       string        `json:"user_id"`
+	Balance      models.Amount `json:"balance"`
+	ProfilePhoto string        `json:"profile_photo"`
+	Address      string        `json:"address"`
 }
 
 func GetLeaderboard(c *gin.Context) {
@@ -463,152 +392,92 @@ func GetLeaderboard(c *gin.Context) {
 }
 
 type RegularTask struct {
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	ImageURL    string `json:"image_url"`
-	Completed   bool   `json:"completed"`
-}
-
-// IncrementBalance 增加用户余额
-func IncrementBalance(userID string, amount int64) error {
-	ctx := context.Background()
-	balanceKey := userID + "_balance"
-	_, err := configs.Rdb.IncrBy(ctx, balanceKey, amount).Result()
-	return err
+	Key          string                `json:"key"` // 成就名称
+	Name         string                `json:"name"`
+	Description  string                `json:"description"`
+	ImageURL     string                `json:"image_url"`
+	RewardType   models.TaskRewardType `json:"reward_type"`
+	RewardAmount int64                 `json:"reward_amount"`
+	Completed    bool                  `json:"completed"`
+	Granted      bool                  `json:"granted"` // 奖励已发放
 }
 
+// GetRegularTasks 获取日常任务，已完成的任务在这里发放奖励
 func GetRegularTasks(c *gin.Context) {
-	userID := c.Query("user_id")
-
-	// 在数据库中查找用户
-	var user models.User
-	if err := daos.DB.Where("user_id = ?", userID).First(&user).Error; err != nil {
-		errorss.HandleError(c, http.StatusNotFound, err) // 用户未找到
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
 		return
 	}
 
-	// 查询用户邀请一级数量
-	var inviteCount int64
-	if err := daos.DB.Model(&models.Invitation{}).Where("inviter_id = ? AND level = ?", userID, 1).Count(&inviteCount).Error; err != nil {
-		errorss.HandleError(c, http.StatusInternalServerError, err) // 无法查询邀请数量
+	tasks, ok := evaluateTasks(c, quest.ListRegular, userID)
+	if !ok {
 		return
 	}
 
-	// 检查是否已完成“Invite 10 Frens”任务，并奖励用户
-	if inviteCount >= 10 {
-		var existingReward models.AchievementReward
-		if err := daos.DB.Where("user_id = ? AND achievement_name = ?", userID, "10Friend").First(&existingReward).Error; err != nil {
-			// 如果没有记录，则发放奖励
-			if err := IncrementBalance(userID, 1000); err != nil {
-				errorss.HandleError(c, http.StatusInternalServerError, err) // Redis 更新失败
-				return
-			}
-
-			// 创建奖励记录
-			reward := models.AchievementReward{
-				UserID:          userID,
-				AchievementName: "10Friend",
-				RewardType:      "Balance",
-				Amount:          1000,
-				CreatedAt:       time.Now(),
-			}
-
-			if err := daos.DB.Create(&reward).Error; err != nil {
-				errorss.HandleError(c, http.StatusInternalServerError, err) // 数据库插入失败
-				return
-			}
-		}
-	}
-
-	// 定义任务列表，完成状态写死
-	tasks := []RegularTask{
-		{Name: "Invite 10 Frens", Description: "邀请10个朋友", ImageURL: "invite_10_frens.png", Completed: inviteCount >= 10},
-		{Name: "Invite Bonus", Description: "邀请奖金", ImageURL: "invite_bonus.png", Completed: false}, // 假设未完成
-		{Name: "Join Channel", Description: "加入频道", ImageURL: "join_channel.png", Completed: user.JoinedDiscord},
-		{Name: "Follow us on X", Description: "在X上关注我们", ImageURL: "follow_us_on_x.png", Completed: user.JoinedX},
-		{Name: "Join Telegram Channel", Description: "加入Telegram频道", ImageURL: "join_telegram_channel.png", Completed: user.JoinedTelegram}, // 假设已完成
-	}
-
 	// 返回任务列表
 	errorss.JsonSuccess(c, tasks)
 }
 
-// GetFreeTasks 获取用户的任务状态
-func GetFreeTasks(c *gin.Context) {
-	userID := c.Query("user_id")
-
-	// 在数据库中查找用户
-	var user models.User
-	if err := daos.DB.Where("user_id = ?", userID).First(&user).Error; err != nil {
+// evaluateTasks 判断任务列表的完成情况并发放奖励
+func evaluateTasks(c *gin.Context, list, userID string) ([]RegularTask, bool) {
+	progress, err := quest.Evaluate(c, list, userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
 		errorss.HandleError(c, http.StatusNotFound, err) // 用户未找到
-		return
+		return nil, false
 	}
-
-	// 查询用户邀请一级数量
-	var inviteCount int64
-	if err := daos.DB.Model(&models.Invitation{}).Where("inviter_id = ? AND level = ?", userID, 1).Count(&inviteCount).Error; err != nil {
-		errorss.HandleError(c, http.StatusInternalServerError, err) // 无法查询邀请数量
-		return
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+
+	tasks := make([]RegularTask, 0, len(progress))
+	for _, p := range progress {
+		tasks = append(tasks, RegularTask{
+			Key:          p.TaskKey,
+			Name:         p.Title,
+			Description:  p.Description,
+			ImageURL:     p.ImageURL,
+			RewardType:   p.RewardType,
+			RewardAmount: p.RewardAmount,
+			Completed:    p.Completed,
+			Granted:      p.Granted,
+		})
 	}
+	return tasks, true
+}
 
-	// 检查是否已完成“Invite 10 Frens”任务，并奖励用户
-	if inviteCount >= 10 {
-		var existingReward models.AchievementReward
-		if err := daos.DB.Where("user_id = ? AND achievement_name = ?", userID, "10Friend").First(&existingReward).Error; err != nil {
-			// 如果没有记录，则发放奖励
-			if err := IncrementBalance(userID, 1000); err != nil {
-				errorss.HandleError(c, http.StatusInternalServerError, err) // Redis 更新失败
-				return
-			}
-
-			// 创建奖励记录
-			reward := models.AchievementReward{
-				UserID:          userID,
-				AchievementName: "10Friend",
-				RewardType:      "Balance",
-				Amount:          1000,
-				CreatedAt:       time.Now(),
-			}
-
-			if err := daos.DB.Create(&reward).Error; err != nil {
-				errorss.HandleError(c, http.StatusInternalServerError, err) // 数据库插入失败
-				return
-			}
-		}
+// GetFreeTasks 获取免费任务
+func GetFreeTasks(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
 	}
 
-	// 定义任务列表
-	tasks := []RegularTask{
-		{Name: "Invite a Frens", Description: "Earn 500", ImageURL: "invite_10_frens.png", Completed: inviteCount >= 10},
-		{Name: "Invite a Premium Fren", Description: "Earn 500", ImageURL: "invite_bonus.png", Completed: false}, // 假设未完成
+	tasks, ok := evaluateTasks(c, quest.ListFree, userID)
+	if !ok {
+		return
 	}
 
 	// 返回任务列表
 	errorss.JsonSuccess(c, gin.H{"tasks": tasks})
 }
 func GetBoostTasks(c *gin.Context) {
-	userID := c.Query("user_id")
-
-	// 获取今天的时间范围
-	todayStart := time.Now().Truncate(24 * time.Hour)
-	todayEnd := todayStart.Add(24 * time.Hour)
-
-	// 计算今日剩余可领取次数
-	limit := int64(5) // 查询今日领取的任务次数
-	var dailyCount int64
-	err := daos.DB.Model(&models.FreeCardTask{}).
-		Where("user_id = ? AND created_at BETWEEN ? AND ? AND is_granted = ? ", userID, todayStart, todayEnd, true).
-		Count(&dailyCount).Error
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+
+	// 今日免费卡片额度，与 UserLoginTriggered 使用同一策略
+	freeCardQuota, err := checkQuota(c, quota.PolicyFreeCard, userID)
 	if err != nil {
 		errorss.HandleError(c, http.StatusInternalServerError, err)
 		return
 	}
-
-	remainingTasks := limit - dailyCount
-
-	fmt.Println(remainingTasks)
-
-	fmt.Println(dailyCount)
+	dailyCount := freeCardQuota.Used
+	var nextAvailableTimestamp int64
+	if !freeCardQuota.NextAt.IsZero() {
+		nextAvailableTimestamp = freeCardQuota.NextAt.Unix()
+	}
 
 	// 查询下一次免费卡片发放时间
 	var nextReleaseTime time.Time
@@ -637,10 +506,17 @@ func GetBoostTasks(c *gin.Context) {
 	tasks := map[string]interface{}{
 		"daily_remaining_tasks": map[string]interface{}{
 			"name":        "daily_remaining_tasks",
-			"description": strconv.FormatInt(dailyCount, 10) + "/5" + "available",
+			"description": strconv.FormatInt(dailyCount, 10) + "/" + strconv.FormatInt(freeCardQuota.Limit, 10) + "available",
 			"value":       strconv.FormatInt(dailyCount, 10),
+			"remaining":   freeCardQuota.Remaining,
 			"url":         "http://example.com/daily_remaining_tasks", // 可替换为实际的URL
-			"completed":   dailyCount >= 5,
+			"completed":   freeCardQuota.Limit > 0 && freeCardQuota.Remaining == 0,
+		},
+		"next_available_time": map[string]interface{}{
+			"name":        "next_available_time",
+			"description": "Next Free Card Task",
+			"value":       nextAvailableTimestamp, // 0 表示现在即可领取
+			"completed":   false,
 		},
 		"next_release_time": map[string]interface{}{
 			"name":        "next_release_time",
@@ -655,52 +531,14 @@ func GetBoostTasks(c *gin.Context) {
 }
 
 func UserLoginTriggered(c *gin.Context) {
-	userID := c.Query("user_id")
-	if userID == "" {
-		errorss.HandleError(c, http.StatusBadRequest, fmt.Errorf("user_id is required"))
-		return
-	}
-
-	// 获取今天的时间范围
-	todayStart := time.Now().Truncate(24 * time.Hour)
-	todayEnd := todayStart.Add(24 * time.Hour)
-
-	// 查询今日未领取的任务次数
-	var count int64
-	err := daos.DB.Model(&models.FreeCardTask{}).
-		Where("user_id = ? AND created_at BETWEEN ? AND ? AND is_granted = ?", userID, todayStart, todayEnd, false).
-		Count(&count).Error
-	if err != nil {
-		errorss.HandleError(c, http.StatusInternalServerError, err)
-		return
-	}
-
-	// 检查今日发放次数是否超过限制（假设限制为 5 次）
-	limit := 5
-	if count >= int64(limit) {
-		errorss.HandleError(c, http.StatusTooManyRequests, fmt.Errorf("Daily limit exceeded"))
-		return
-	}
-
-	// 查询今天的最后一个任务的结束时间
-	var lastTaskEndTime *time.Time
-	err = daos.DB.Model(&models.FreeCardTask{}).
-		Where("user_id = ? AND created_at BETWEEN ? AND ?", userID, todayStart, todayEnd).
-		Order("granted_at DESC").
-		Pluck("granted_at", &lastTaskEndTime).Error
-	if err != nil {
-		errorss.HandleError(c, http.StatusInternalServerError, err)
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
 		return
 	}
 
-	if lastTaskEndTime != nil {
-		fmt.Printf("Last task end time: %s\n", lastTaskEndTime.Format(time.RFC3339))
-	}
-
-	// 检查新任务的创建时间是否在上一个任务的结束时间之后
-	now := time.Now()
-	if lastTaskEndTime != nil && now.Before(*lastTaskEndTime) {
-		errorss.HandleError(c, http.StatusBadRequest, fmt.Errorf("New task cannot be created before the last task's end time"))
+	// 检查每日次数和两次之间的间隔
+	freeCardQuota, ok := consumeQuota(c, quota.PolicyFreeCard, userID)
+	if !ok {
 		return
 	}
 
@@ -716,8 +554,23 @@ func UserLoginTriggered(c *gin.Context) {
 		IsGranted: false,
 	}
 
-	err = daos.DB.Create(&task).Error
-	if err != nil {
+	if err := daos.DB.Create(&task).Error; err != nil {
+		if err := quota.Release(c, quota.PolicyFreeCard, userID, freeCardQuota); err != nil {
+			logs.Error("Failed to release free card quota:", err)
+		}
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	// 加入发放队列失败时撤销任务和额度，让用户重试；撤销也失败时由恢复任务从数据库补入
+	if err := scheduleFreeCard(c, task); err != nil {
+		if delErr := daos.DB.Delete(&models.FreeCardTask{}, task.ID).Error; delErr != nil {
+			logs.Error("Failed to schedule free card task %d, left for recovery: %v", task.ID, err)
+			errorss.JsonSuccess(c, gin.H{"message": "Free card task successfully created"})
+			return
+		}
+		if err := quota.Release(c, quota.PolicyFreeCard, userID, freeCardQuota); err != nil {
+			logs.Error("Failed to release free card quota:", err)
+		}
 		errorss.HandleError(c, http.StatusInternalServerError, err)
 		return
 	}
@@ -725,231 +578,154 @@ func UserLoginTriggered(c *gin.Context) {
 	// 返回成功消息
 	errorss.JsonSuccess(c, gin.H{"message": "Free card task successfully created"})
 }
-func GetInvitationList(c *gin.Context) {
-	userID := c.Query("user_id")
 
-	// Validate input
-	if userID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "User ID is required"})
+// 绑定
+// BindUserAddress 处理用户地址绑定的请求，需要提交钱包签名证明
+func BindUserAddress(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
 		return
 	}
+	var input WalletProof
 
-	// Get level 1 invitations (direct invitations)
-	var level1Invitations []models.Invitation
-	err := daos.DB.Where("inviter_id = ? AND level = ?", userID, 1).Pluck("invitee_address", &level1Invitations).Error
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	// 绑定 JSON 输入到结构体
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, 400, errors.New("Invalid JSON input"))
 		return
 	}
 
-	// Get level 2 invitations (invitations from level 1 invitees)
-	var level2Invitations []models.Invitation
-	var level1UserIDs []string
-	for _, invite := range level1Invitations {
-		level1UserIDs = append(level1UserIDs, invite.InviteeUserID)
-	}
-
-	err = daos.DB.Where("inviter_id IN (?) AND level = ?", level1UserIDs, 2).Pluck("invitee_address", &level2Invitations).Error
+	// 校验钱包签名
+	address, err := VerifyWalletProof(c, &input)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		errorss.HandleError(c, 401, err)
 		return
 	}
 
-	// Prepare response
-	type InvitationResponse struct {
-		Address string `json:"address"`
-	}
-
-	var allInvitations []InvitationResponse
-	for _, invite := range level1Invitations {
-		allInvitations = append(allInvitations, InvitationResponse{
-			Address: invite.InviteeAddress,
-		})
+	// 在数据库中查找用户
+	var user models.User
+	if err := daos.DB.Where("user_id = ?", userID).First(&user).Error; err != nil {
+		errorss.HandleError(c, 404, errors.New("User not found"))
+		return
 	}
 
-	for _, invite := range level2Invitations {
-		allInvitations = append(allInvitations, InvitationResponse{
-			Address: invite.InviteeAddress,
-		})
+	// 更新用户地址，同一地址只能绑定一个用户
+	err = daos.DB.Transaction(func(tx *gorm.DB) error {
+		return bindWallet(tx, userID, input.Chain, address)
+	})
+	if errors.Is(err, ErrAddressTaken) || errors.Is(err, gorm.ErrDuplicatedKey) {
+		// 并发绑定同一地址时由唯一索引拒绝
+		errorss.HandleError(c, 409, ErrAddressTaken)
+		return
+	} else if err != nil {
+		errorss.HandleError(c, 500, errors.New("Unable to update user address"))
+		return
 	}
+	user.Address = address
 
-	// Return the result
-	c.JSON(http.StatusOK, gin.H{
-		"invitations": allInvitations,
-	})
+	// 返回成功信息
+	errorss.JsonSuccess(c, gin.H{"message": "User address binding successful", "user": user})
 }
 
-// 绑定
-// BindUserAddress 处理用户地址绑定的请求
-func BindUserAddress(c *gin.Context) {
+// ShareTaskCompletion 处理分享任务完成的请求，校验通过后才发放奖励
+func ShareTaskCompletion(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
 	var input struct {
-		UserID  string `json:"userid" binding:"required"`
-		Address string `json:"address" binding:"required"` // 添加玩法参数
+		Type string `json:"type" binding:"required"` // 任务类型: "discord", "x", "telegram"
 	}
 
 	// 绑定 JSON 输入到结构体
 	if err := c.ShouldBindJSON(&input); err != nil {
-		errorss.HandleError(c, 400, errors.New("Invalid JSON input"))
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid JSON input"))
 		return
 	}
 
-	// 在数据库中查找用户
-	var user models.User
-	if err := daos.DB.Where("user_id = ?", input.UserID).First(&user).Error; err != nil {
-		errorss.HandleError(c, 404, errors.New("User not found"))
+	// 校验任务完成状态并发放对应任务的奖励
+	result, err := social.Submit(c, userID, input.Type)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		errorss.HandleError(c, http.StatusNotFound, errors.New("User not found"))
+		return
+	case errors.Is(err, quest.ErrAlreadyGranted):
+		// 奖励记录已存在
+		errorss.HandleError(c, http.StatusOK, err)
+		return
+	case errors.Is(err, social.ErrUnknownPlatform), errors.Is(err, quest.ErrNoTask):
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid task type"))
+		return
+	case errors.Is(err, social.ErrNotLinked), errors.Is(err, social.ErrClaimRevoked):
+		errorss.HandleError(c, http.StatusForbidden, err)
+		return
+	case err != nil:
+		errorss.HandleError(c, http.StatusInternalServerError, err)
 		return
 	}
 
-	// 更新用户地址
-	user.Address = input.Address
-	if err := daos.DB.Save(&user).Error; err != nil {
-		errorss.HandleError(c, 500, errors.New("Unable to update user address"))
+	if result.Claim.Status != models.SocialClaimVerified {
+		// 暂未通过校验，后台会重新检查
+		errorss.JsonSuccess(c, gin.H{"message": "Task completion is pending verification", "claim": result.Claim})
 		return
 	}
-
 	// 返回成功信息
-	errorss.JsonSuccess(c, gin.H{"message": "User address binding successful", "user": user})
+	errorss.JsonSuccess(c, gin.H{"message": "Task completion status updated successfully", "claim": result.Claim,
+		"rewards": result.Rewards, "user": result.User})
 }
 
-// RecordAchievement 奖励记录
-func RecordAchievement(userID, achievementName, rewardType string, amount int64) error {
-	reward := models.AchievementReward{
-		UserID:          userID,
-		AchievementName: achievementName,
-		RewardType:      rewardType,
-		Amount:          amount,
-		CreatedAt:       time.Now(),
+// userLocation 返回用户设置的时区，每日额度按该时区的自然日计算
+func userLocation(userID string) *time.Location {
+	var timezones []string
+	if err := daos.DB.Model(&models.User{}).Where("user_id = ?", userID).Pluck("timezone", &timezones).Error; err != nil {
+		logs.Error("Failed to load user timezone:", err)
 	}
-
-	return daos.DB.Create(&reward).Error
-}
-
-type Order struct {
-	UserID  string  `json:"user_id"`
-	Address string  `json:"address"`
-	Amount  float64 `json:"amount"`
+	if len(timezones) == 0 {
+		return timeutil.DefaultLocation()
+	}
+	return timeutil.UserLocation(timezones[0])
 }
 
-func CreateOrder(c *gin.Context) {
-	var order Order
-	if err := c.BindJSON(&order); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+// UpdateUserTimezone 设置用户时区，例如 Asia/Shanghai
+func UpdateUserTimezone(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
 		return
 	}
-
-	orders := models.Order{
-		UserID:    order.UserID,
-		Address:   order.Address,
-		Status:    "pending",
-		Amount:    order.Amount,
-		CreatedAt: time.Now(),
+	var input struct {
+		Timezone string `json:"timezone" binding:"required"`
 	}
-
-	// 保存到数据库
-	if err := daos.DB.Create(&orders).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create order"})
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
 		return
 	}
-
-	errorss.JsonSuccess(c, gin.H{"message": "Order created successfully", "order": orders})
-
-}
-
-// ShareTaskCompletion 处理分享任务完成的请求
-func ShareTaskCompletion(c *gin.Context) {
-	var input struct {
-		UserID string `json:"userid" binding:"required"`
-		Type   string `json:"type" binding:"required"` // 任务类型: "discord", "x", "telegram"
+	loc, err := timeutil.LoadLocation(input.Timezone)
+	if err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid timezone"))
+		return
 	}
 
-	// 绑定 JSON 输入到结构体
-	if err := c.ShouldBindJSON(&input); err != nil {
-		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid JSON input"))
+	result := daos.DB.Model(&models.User{}).Where("user_id = ?", userID).Update("timezone", loc.String())
+	if result.Error != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, result.Error)
 		return
 	}
-
-	// 在数据库中查找用户
-	var user models.User
-	if err := daos.DB.Where("user_id = ?", input.UserID).First(&user).Error; err != nil {
+	if result.RowsAffected == 0 {
 		errorss.HandleError(c, http.StatusNotFound, errors.New("User not found"))
 		return
 	}
+	errorss.JsonSuccess(c, gin.H{"message": "Timezone updated successfully", "timezone": loc.String()})
+}
 
-	// 处理任务完成状态
-	switch input.Type {
-	case "discord":
-		// 检查是否已有奖励记录
-		var existingReward models.AchievementReward
-		if err := daos.DB.Where("user_id = ? AND achievement_name = ?", input.UserID, "discord").First(&existingReward).Error; err == nil {
-			// 奖励记录已存在
-			errorss.HandleError(c, http.StatusOK, errors.New("Reward already granted for this achievement"))
-			return
-		}
-		user.JoinedDiscord = true
-		// 增加用户余额
-		if err := IncrementBalance(input.UserID, 10000); err != nil {
-			errorss.HandleError(c, http.StatusInternalServerError, errors.New("Unable to update user balance"))
-			return
-		}
-		// 记录奖励
-		if err := RecordAchievement(input.UserID, "discord", "Balance", 10000); err != nil {
-			errorss.HandleError(c, http.StatusInternalServerError, errors.New("Unable to record achievement"))
-			return
-		}
-
-	case "x":
-		// 检查是否已有奖励记录
-		var existingReward models.AchievementReward
-		if err := daos.DB.Where("user_id = ? AND achievement_name = ?", input.UserID, "x").First(&existingReward).Error; err == nil {
-			// 奖励记录已存在
-			errorss.HandleError(c, http.StatusOK, errors.New("Reward already granted for this achievement"))
-			return
-		}
-		user.JoinedX = true
-		// 增加用户余额
-		if err := IncrementBalance(input.UserID, 10000); err != nil {
-			errorss.HandleError(c, http.StatusInternalServerError, errors.New("Unable to update user balance"))
-			return
-		}
-		// 记录奖励
-		if err := RecordAchievement(input.UserID, "x", "Balance", 10000); err != nil {
-			errorss.HandleError(c, http.StatusInternalServerError, errors.New("Unable to record achievement"))
-			return
-		}
-
-	case "telegram":
-		// 检查是否已有奖励记录
-		var existingReward models.AchievementReward
-		if err := daos.DB.Where("user_id = ? AND achievement_name = ?", input.UserID, "telegram").First(&existingReward).Error; err == nil {
-			// 奖励记录已存在
-			errorss.HandleError(c, http.StatusOK, errors.New("Reward already granted for this achievement"))
-			return
-		}
-		user.JoinedTelegram = true
-		// 增加用户余额
-		if err := IncrementBalance(input.UserID, 10000); err != nil {
-			errorss.HandleError(c, http.StatusInternalServerError, errors.New("Unable to update user balance"))
-			return
-		}
-		// 记录奖励
-		if err := RecordAchievement(input.UserID, "telegram", "Balance", 10000); err != nil {
-			errorss.HandleError(c, http.StatusInternalServerError, errors.New("Unable to record achievement"))
-			return
-		}
-
-	default:
-		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid task type"))
+// GetFlags 功能开关对当前用户的开启状态，前端据此显示或隐藏功能
+func GetFlags(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
 		return
 	}
-
-	user.UpdatedAt = time.Now()
-
-	// 保存更新后的用户信息
-	if err := daos.DB.Save(&user).Error; err != nil {
-		errorss.HandleError(c, http.StatusInternalServerError, errors.New("Unable to update user information"))
-		return
+	flags := configs.LoadFlags(c)
+	result := make(map[string]bool, len(flags))
+	for name := range flags {
+		result[name] = flags.Enabled(name, userID)
 	}
-
-	// 返回成功信息
-	errorss.JsonSuccess(c, gin.H{"message": "Task completion status updated successfully and balance increased by 10000", "user": user})
+	errorss.JsonSuccess(c, gin.H{"flags": result})
 }
@@ -0,0 +1,49 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/freecard"
+	"tbooks/models"
+	"tbooks/quota"
+	"testing"
+	"time"
+)
+
+func TestUserLoginTriggeredScheduleFailure(t *testing.T) {
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "")
+	ctx := context.Background()
+	scheduleFreeCard = func(context.Context, models.FreeCardTask) error {
+		return errors.New("redis unavailable")
+	}
+	t.Cleanup(func() { scheduleFreeCard = freecard.Schedule })
+
+	// 入队失败时撤销任务和额度，不会留下无人发放的任务
+	if code, _ := callHandler(t, UserLoginTriggered, "U", nil); code != http.StatusInternalServerError {
+		t.Fatalf("schedule failure: %d", code)
+	}
+	var n int64
+	daos.DB.Model(&models.FreeCardTask{}).Count(&n)
+	if n != 0 {
+		t.Fatalf("%d tasks left after schedule failure", n)
+	}
+	if r, err := quota.Check(ctx, quota.PolicyFreeCard, "U", time.UTC); err != nil || r.Used != 0 {
+		t.Fatalf("quota after schedule failure: %+v %v", r, err)
+	}
+
+	scheduleFreeCard = freecard.Schedule
+	if code, _ := callHandler(t, UserLoginTriggered, "U", nil); code != http.StatusOK {
+		t.Fatalf("retry: %d", code)
+	}
+	daos.DB.Model(&models.FreeCardTask{}).Count(&n)
+	if scheduled := configs.Rdb.ZCard(ctx, freecard.ScheduleKey).Val(); n != 1 || scheduled != 1 {
+		t.Fatalf("%d tasks, %d scheduled", n, scheduled)
+	}
+}
@@ -0,0 +1,165 @@
+package handle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"tbooks/errorss"
+	"time"
+)
+
+const (
+	// ContextTelegramUserKey gin 上下文中保存 Telegram 用户的键
+	ContextTelegramUserKey = "telegram_user"
+	// ContextUserIDKey gin 上下文中保存用户ID的键
+	ContextUserIDKey = "user_id"
+	// defaultInitDataExpire 未配置 Telegram.InitDataExpire 时 initData 的有效期
+	defaultInitDataExpire = 24 * time.Hour
+)
+
+// TelegramUser initData 中的 Telegram 用户信息
+type TelegramUser struct {
+	ID           int64  `json:"id"`
+	FirstName    string `json:"first_name"`
+	LastName     string `json:"last_name"`
+	Username     string `json:"username"`
+	LanguageCode string `json:"language_code"`
+	IsPremium    bool   `json:"is_premium"`
+	PhotoURL     string `json:"photo_url"`
+}
+
+// AuthMiddleware 鉴权中间件，校验 Telegram WebApp initData
+// 请求头格式: Authorization: tma <initData>，也接受登录后签发的 Bearer access token
+func AuthMiddleware() gin.HandlerFunc {
+	jwtAuth := JwtAuthMiddleware()
+	return func(c *gin.Context) {
+		if scheme, _, _ := strings.Cut(strings.TrimSpace(c.GetHeader("Authorization")), " "); strings.EqualFold(scheme, "Bearer") {
+			jwtAuth(c)
+			return
+		}
+		initData := extractInitData(c.GetHeader("Authorization"))
+		if initData == "" {
+			errorss.HandleError(c, http.StatusUnauthorized, errors.New("Missing init data"))
+			return
+		}
+
+		cfg := configs.Config().Telegram
+		user, err := ValidateInitData(initData, cfg.BotToken, time.Duration(cfg.InitDataExpire)*time.Second)
+		if err != nil {
+			errorss.HandleError(c, http.StatusUnauthorized, err)
+			return
+		}
+
+		c.Set(ContextTelegramUserKey, user)
+		c.Set(ContextUserIDKey, strconv.FormatInt(user.ID, 10))
+		c.Next()
+	}
+}
+
+// extractInitData 从 Authorization 头中取出 initData
+func extractInitData(header string) string {
+	scheme, value, ok := strings.Cut(strings.TrimSpace(header), " ")
+	if !ok || !strings.EqualFold(scheme, "tma") {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// ValidateInitData 校验 initData 签名并解析出 Telegram 用户
+// 参考 https://core.telegram.org/bots/webapps#validating-data-received-via-the-mini-app
+// expire 不大于 0 时使用默认有效期，initData 总是会过期
+func ValidateInitData(initData, botToken string, expire time.Duration) (*TelegramUser, error) {
+	if botToken == "" {
+		return nil, errors.New("Bot token is not configured")
+	}
+	values, err := url.ParseQuery(initData)
+	if err != nil {
+		return nil, errors.New("Invalid init data")
+	}
+
+	hash := values.Get("hash")
+	if hash == "" {
+		return nil, errors.New("Init data hash is missing")
+	}
+
+	// 除 hash 外的字段按键排序后以换行拼接
+	pairs := make([]string, 0, len(values))
+	for key := range values {
+		if key == "hash" {
+			continue
+		}
+		pairs = append(pairs, key+"="+values.Get(key))
+	}
+	sort.Strings(pairs)
+	dataCheckString := strings.Join(pairs, "\n")
+
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(botToken))
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write([]byte(dataCheckString))
+	expected := hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(hash))) {
+		return nil, errors.New("Invalid init data signature")
+	}
+
+	// 检查 initData 是否过期
+	if expire <= 0 {
+		expire = defaultInitDataExpire
+	}
+	authDate, err := strconv.ParseInt(values.Get("auth_date"), 10, 64)
+	if err != nil {
+		return nil, errors.New("Invalid auth date")
+	}
+	if time.Since(time.Unix(authDate, 0)) > expire {
+		return nil, errors.New("Init data expired")
+	}
+
+	var user TelegramUser
+	if err := json.Unmarshal([]byte(values.Get("user")), &user); err != nil || user.ID == 0 {
+		return nil, errors.New("Invalid user in init data")
+	}
+	return &user, nil
+}
+
+// GetUserIDFromContext 获取鉴权后的用户ID，失败时直接返回错误响应
+func GetUserIDFromContext(c *gin.Context) (string, bool) {
+	userID := c.GetString(ContextUserIDKey)
+	if userID == "" {
+		errorss.HandleError(c, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return "", false
+	}
+	return userID, true
+}
+
+// GetTelegramUserFromContext 获取鉴权后的 Telegram 用户信息
+func GetTelegramUserFromContext(c *gin.Context) (*TelegramUser, bool) {
+	value, ok := c.Get(ContextTelegramUserKey)
+	if !ok {
+		return nil, false
+	}
+	user, ok := value.(*TelegramUser)
+	return user, ok
+}
+
+// AdminMiddleware 管理员鉴权，需在 AuthMiddleware 之后使用
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID := c.GetString(ContextUserIDKey)
+		for _, admin := range configs.Config().Admins {
+			if userID != "" && userID == admin {
+				c.Next()
+				return
+			}
+		}
+		errorss.HandleError(c, http.StatusForbidden, errors.New("Admin permission required"))
+	}
+}
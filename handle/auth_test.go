@@ -0,0 +1,94 @@
+package handle
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBotToken = "123456:test-bot-token"
+
+// signInitData 按 Telegram 的规则为 values 生成 hash 并编码为 initData
+func signInitData(values url.Values, botToken string) string {
+	pairs := make([]string, 0, len(values))
+	for key := range values {
+		pairs = append(pairs, key+"="+values.Get(key))
+	}
+	sort.Strings(pairs)
+	secret := hmac.New(sha256.New, []byte("WebAppData"))
+	secret.Write([]byte(botToken))
+	mac := hmac.New(sha256.New, secret.Sum(nil))
+	mac.Write([]byte(strings.Join(pairs, "\n")))
+	signed := url.Values{"hash": {hex.EncodeToString(mac.Sum(nil))}}
+	for key := range values {
+		signed.Set(key, values.Get(key))
+	}
+	return signed.Encode()
+}
+
+func initDataValues(authDate time.Time) url.Values {
+	return url.Values{
+		"auth_date": {strconv.FormatInt(authDate.Unix(), 10)},
+		"query_id":  {"AAHdF6IQAAAAAN0XohDhrOrc"},
+		"user":      {`{"id":279058397,"first_name":"Vlad","username":"vdkfrost","language_code":"ru","is_premium":true}`},
+	}
+}
+
+func TestValidateInitData(t *testing.T) {
+	initData := signInitData(initDataValues(time.Now().Add(-time.Minute)), testBotToken)
+	user, err := ValidateInitData(initData, testBotToken, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != 279058397 || user.Username != "vdkfrost" || !user.IsPremium {
+		t.Fatalf("user %+v", user)
+	}
+
+	// 签名后修改任何字段都会使 hash 不匹配
+	values, _ := url.ParseQuery(initData)
+	values.Set("user", `{"id":1,"first_name":"Eve"}`)
+	if _, err := ValidateInitData(values.Encode(), testBotToken, time.Hour); err == nil {
+		t.Fatal("tampered init data accepted")
+	}
+	if _, err := ValidateInitData(initData, "654321:other-bot-token", time.Hour); err == nil {
+		t.Fatal("init data signed for another bot accepted")
+	}
+	values, _ = url.ParseQuery(initData)
+	values.Del("hash")
+	if _, err := ValidateInitData(values.Encode(), testBotToken, time.Hour); err == nil {
+		t.Fatal("init data without hash accepted")
+	}
+	if _, err := ValidateInitData(initData, "", time.Hour); err == nil {
+		t.Fatal("init data accepted without a bot token")
+	}
+}
+
+func TestValidateInitDataExpired(t *testing.T) {
+	stale := signInitData(initDataValues(time.Now().Add(-2*time.Hour)), testBotToken)
+	if _, err := ValidateInitData(stale, testBotToken, time.Hour); err == nil {
+		t.Fatal("expired init data accepted")
+	}
+	if _, err := ValidateInitData(stale, testBotToken, 3*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// 未配置有效期时使用默认的 24 小时，不会永久有效
+	old := signInitData(initDataValues(time.Now().Add(-defaultInitDataExpire-time.Minute)), testBotToken)
+	if _, err := ValidateInitData(old, testBotToken, 0); err == nil {
+		t.Fatal("init data older than the default expiry accepted")
+	}
+	if _, err := ValidateInitData(stale, testBotToken, 0); err != nil {
+		t.Fatal(err)
+	}
+	values := initDataValues(time.Now())
+	values.Del("auth_date")
+	if _, err := ValidateInitData(signInitData(values, testBotToken), testBotToken, 0); err == nil {
+		t.Fatal("init data without auth_date accepted")
+	}
+}
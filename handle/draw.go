@@ -0,0 +1,269 @@
+package handle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"tbooks/ledger"
+	"tbooks/models"
+	"tbooks/quota"
+	"tbooks/usersync"
+	"time"
+)
+
+var (
+	ErrUserNotFound     = errors.New("User not found")
+	ErrInsufficientCard = errors.New("Insufficient card ")
+	ErrInvalidPlayMode  = errors.New("Invalid PlayMode parameter")
+	ErrPrizeSoldOut     = errors.New("All prizes are out of stock")
+	// ErrPlayModeUnavailable 玩法的功能开关对该用户未开启
+	ErrPlayModeUnavailable = errors.New("Play mode is not available")
+	// errFairStateChanged 抽奖前读取的种子已轮换或 nonce 已被使用
+	errFairStateChanged = errors.New("fair seed changed during draw")
+)
+
+const (
+	// maxFairAttempts 并发抽奖占用同一 nonce 时的最多尝试次数
+	maxFairAttempts = 100
+	// drawHistoryLimit Redis 中保留的最近抽奖记录条数
+	drawHistoryLimit = 100
+	// prizeStockExpire 每日库存计数的过期时间
+	prizeStockExpire = 48 * time.Hour
+)
+
+// luckDrawScript 原子地完成一次抽奖：检查并扣除卡片、按权重和库存选出奖品、发放奖品、写入抽奖记录
+// 选奖算法需与 PickPrize 保持一致，以便用公开的种子复算
+// KEYS[1] 卡片数量  KEYS[2] 余额  KEYS[3] 抽奖历史  KEYS[4] 待落库的抽奖记录队列  KEYS[5] 账本队列
+// KEYS[6] 待同步用户集合  KEYS[7] 公平种子  KEYS[8..] 每个奖品的当日库存计数
+// ARGV[1] 随机数 [0,1)  ARGV[2] 时间戳  ARGV[3] 玩法  ARGV[4] 历史条数上限  ARGV[5] 库存计数过期秒数
+// ARGV[6] 服务端种子哈希  ARGV[7] nonce  ARGV[8] 客户端种子  ARGV[9] 用户ID  ARGV[10] 每积分的最小单位数
+// ARGV[11] 奖品表哈希  ARGV[12..] 奖品六元组: 奖品编号, 奖品名称, 奖品类型, 奖品数值, 权重, 每日库存(0 不限)
+// 随机数由 ARGV[6] 的种子和 ARGV[7] 的 nonce 计算，种子已轮换或 nonce 已被其他抽奖使用时返回 -3，只有抽奖成功才占用 nonce
+var luckDrawScript = redis.NewScript(ledger.LuaAmountFunc + usersync.LuaMarkDirty + `
+local cards = redis.call('GET', KEYS[1])
+if not cards then
+	return {0}
+end
+cards = tonumber(cards)
+if cards <= 0 then
+	return {-1}
+end
+local seed = redis.call('HMGET', KEYS[7], 'server_seed_hash', 'nonce')
+if seed[1] ~= ARGV[6] or seed[2] ~= ARGV[7] then
+	return {-3}
+end
+
+local first, size = 12, 6
+local n = (#ARGV - first + 1) / size
+local total = 0
+local available = {}
+local soldOut = {}
+for i = 0, n - 1 do
+	local base = first + i * size
+	local weight = tonumber(ARGV[base + 4])
+	local stock = tonumber(ARGV[base + 5])
+	local ok = weight > 0
+	if ok and stock > 0 then
+		ok = tonumber(redis.call('GET', KEYS[8 + i]) or '0') < stock
+		if not ok then
+			soldOut[#soldOut + 1] = ARGV[base]
+		end
+	end
+	if ok then
+		total = total + weight
+		available[#available + 1] = i
+	end
+end
+if total == 0 then
+	return {-2}
+end
+
+local target = tonumber(ARGV[1]) * total
+local pick = available[#available]
+local acc = 0
+for _, i in ipairs(available) do
+	acc = acc + tonumber(ARGV[first + i * size + 4])
+	if target < acc then
+		pick = i
+		break
+	end
+end
+local base = first + pick * size
+local prize, name, kind, value, stock = ARGV[base], ARGV[base + 1], ARGV[base + 2], ARGV[base + 3], tonumber(ARGV[base + 5])
+if stock > 0 then
+	redis.call('INCR', KEYS[8 + pick])
+	redis.call('EXPIRE', KEYS[8 + pick], ARGV[5])
+end
+redis.call('HINCRBY', KEYS[7], 'nonce', 1)
+
+local cardsBefore = cards
+local balanceBefore = redis.call('GET', KEYS[2]) or '0'
+local balance = balanceBefore
+local points = integer(tonumber(value) * tonumber(ARGV[10]))
+cards = redis.call('DECR', KEYS[1])
+if kind == 'points' then
+	balance = integer(redis.call('INCRBY', KEYS[2], points))
+elseif kind == 'card' then
+	cards = redis.call('INCRBY', KEYS[1], value)
+end
+markDirty(KEYS[6], tonumber(ARGV[2]) * 1000, ARGV[9])
+
+local soldOutList = table.concat(soldOut, ',')
+local record = cjson.encode({
+	user_id = ARGV[9], play_mode = ARGV[3], prize_key = prize, prize_name = name, prize_kind = kind,
+	prize_value = tonumber(value), card_cost = 1, cards_before = cardsBefore, cards_after = cards,
+	balance_before = amount(balanceBefore), balance_after = amount(balance),
+	server_seed_hash = ARGV[6], client_seed = ARGV[8], nonce = tonumber(ARGV[7]), sold_out = soldOutList,
+	table_hash = ARGV[11], time = tonumber(ARGV[2])})
+redis.call('LPUSH', KEYS[3], record)
+redis.call('LTRIM', KEYS[3], 0, tonumber(ARGV[4]) - 1)
+redis.call('RPUSH', KEYS[4], record)
+if kind == 'points' then
+	local ref = ARGV[6] .. ':' .. ARGV[7]
+	redis.call('RPUSH', KEYS[5], cjson.encode({tx_id = 'draw_prize:' .. ARGV[9] .. ':' .. ref, user_id = ARGV[9],
+		amount = amount(points), reason = 'draw_prize', ref_id = ref, balance_after = amount(balance),
+		time = tonumber(ARGV[2])}))
+end
+return {1, prize, integer(cards), balance, soldOutList}
+`)
+
+// DrawResult 一次抽奖的结果
+type DrawResult struct {
+	Prize          models.Prize
+	CardCount      int
+	Balance        models.Amount
+	ServerSeedHash string   // 本次使用的服务端种子承诺
+	ClientSeed     string   // 本次使用的客户端种子
+	Nonce          int64    // 本次使用的 nonce
+	SoldOut        []string // 抽奖时已无库存的奖品编号
+	TableHash      string   // 本次使用的奖品表哈希
+}
+
+// loadUserCache 将用户从 MySQL 加载到 Redis
+var loadUserCache = usersync.LoadUser
+
+func drawHistoryKey(userID string) string {
+	return userID + "_draw_history"
+}
+
+// Draw 为用户执行一次抽奖，整个过程在 Redis 中原子完成
+func Draw(ctx context.Context, userID, playMode string) (*DrawResult, error) {
+	table, ok := GetPrizeTable(playMode)
+	if !ok {
+		return nil, ErrInvalidPlayMode
+	}
+	_, tableHash := PrizeTableSnapshot(playMode, table)
+
+	// 同一用户并发抽奖时 nonce 可能已被使用，重新读取种子状态后重试
+	for i := 0; i < maxFairAttempts; i++ {
+		result, err := drawOnce(ctx, userID, playMode, table, tableHash)
+		if !errors.Is(err, errFairStateChanged) {
+			return result, err
+		}
+	}
+	return nil, errors.New("Too many concurrent draws, please retry")
+}
+
+// drawOnce 用当前的种子和 nonce 抽奖
+func drawOnce(ctx context.Context, userID, playMode string, table []models.Prize, tableHash string) (*DrawResult, error) {
+	// 随机数由 HMAC(server_seed, client_seed:nonce) 决定，种子公开后可复算
+	fair, err := currentFairState(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	roll := FairRoll(fair.ServerSeed, fair.ClientSeed, fair.Nonce)
+
+	now := time.Now()
+	keys := []string{usersync.CardCountKey(userID), ledger.BalanceKey(userID), drawHistoryKey(userID), drawRecordQueueKey,
+		ledger.QueueKey, usersync.DirtyKey, fairSeedKey(userID)}
+	args := []interface{}{roll, now.Unix(), playMode, drawHistoryLimit, int64(prizeStockExpire / time.Second),
+		fair.ServerSeedHash, fair.Nonce, fair.ClientSeed, userID, models.AmountScale, tableHash}
+	for _, prize := range table {
+		keys = append(keys, prizeStockKey(playMode, prize.PrizeKey, now))
+		args = append(args, prize.PrizeKey, prize.Name, string(prize.Kind), prize.Value, prize.Weight, prize.DailyStock)
+	}
+
+	res, err := luckDrawScript.Run(ctx, configs.Rdb, keys, args...).Slice()
+	if err == nil && res[0].(int64) == 0 {
+		// Redis 中没有该用户时从 MySQL 加载后重试
+		if err := loadUserCache(ctx, userID); errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		} else if err != nil {
+			return nil, err
+		}
+		res, err = luckDrawScript.Run(ctx, configs.Rdb, keys, args...).Slice()
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch res[0].(int64) {
+	case 0:
+		return nil, ErrUserNotFound
+	case -1:
+		return nil, ErrInsufficientCard
+	case -2:
+		return nil, ErrPrizeSoldOut
+	case -3:
+		return nil, errFairStateChanged
+	}
+
+	prizeKey := res[1].(string)
+	cardCount, err := strconv.Atoi(res[2].(string))
+	if err != nil {
+		return nil, fmt.Errorf("parse card count: %w", err)
+	}
+	balance, err := strconv.ParseInt(res[3].(string), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("parse balance: %w", err)
+	}
+	result := &DrawResult{
+		CardCount:      cardCount,
+		Balance:        models.Amount(balance),
+		ServerSeedHash: fair.ServerSeedHash,
+		ClientSeed:     fair.ClientSeed,
+		Nonce:          fair.Nonce,
+		TableHash:      tableHash,
+	}
+	if soldOut := res[4].(string); soldOut != "" {
+		result.SoldOut = strings.Split(soldOut, ",")
+	}
+	for _, prize := range table {
+		if prize.PrizeKey == prizeKey {
+			result.Prize = prize
+			break
+		}
+	}
+	return result, nil
+}
+
+// PlayModeFlag 玩法的功能开关名称，未定义该开关时玩法对所有用户开放
+func PlayModeFlag(playMode string) string {
+	return "playmode:" + playMode
+}
+
+// DrawWithQuota 使用一次抽奖额度后抽奖，没有抽奖成功时退还额度
+// 额度不足时返回 quota.ErrExceeded 和额度状态
+func DrawWithQuota(ctx context.Context, userID, playMode string) (*DrawResult, *quota.Result, error) {
+	if !configs.LoadFlags(ctx).Allowed(PlayModeFlag(playMode), userID) {
+		return nil, nil, ErrPlayModeUnavailable
+	}
+	drawQuota, err := quota.Consume(ctx, quota.PolicyLuckDraw, userID, quotaLocation(quota.PolicyLuckDraw, userID))
+	if err != nil {
+		return nil, drawQuota, err
+	}
+	// 检查卡片、扣卡、选奖、发奖在 Redis 脚本中原子完成
+	result, err := Draw(ctx, userID, playMode)
+	if err != nil {
+		if err := quota.Release(ctx, quota.PolicyLuckDraw, userID, drawQuota); err != nil {
+			logs.Error("Failed to release draw quota:", err)
+		}
+		return nil, drawQuota, err
+	}
+	return result, drawQuota, nil
+}
@@ -0,0 +1,153 @@
+package handle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"strconv"
+	"tbooks/daos"
+	"tbooks/errorss"
+	"tbooks/models"
+	"time"
+)
+
+const (
+	// drawRecordQueueKey 抽奖脚本写入、等待落库的抽奖记录
+	drawRecordQueueKey = "draw_record_queue"
+	// drawRecordBatchSize 每批落库的记录数
+	drawRecordBatchSize = 200
+)
+
+// drawRecordEntry 抽奖脚本写入队列的记录
+type drawRecordEntry struct {
+	models.DrawRecord
+	Time int64 `json:"time"`
+}
+
+// FlushDrawRecords 将队列中的抽奖记录批量写入 MySQL，返回写入条数
+func FlushDrawRecords(ctx context.Context) (int, error) {
+	flushed := 0
+	for {
+		items, err := daos.PeekQueue(ctx, drawRecordQueueKey, drawRecordBatchSize)
+		if err != nil {
+			return flushed, err
+		}
+		if len(items) == 0 {
+			return flushed, nil
+		}
+
+		records := make([]models.DrawRecord, 0, len(items))
+		for _, item := range items {
+			var entry drawRecordEntry
+			if err := json.Unmarshal([]byte(item), &entry); err != nil {
+				logs.Error("Failed to decode draw record:", err, item)
+				continue
+			}
+			entry.CreatedAt = time.Unix(entry.Time, 0)
+			records = append(records, entry.DrawRecord)
+		}
+		// 同一种子和 nonce 只会落库一次
+		if len(records) > 0 {
+			if err := daos.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&records).Error; err != nil {
+				return flushed, err
+			}
+		}
+
+		if err := daos.AckQueue(ctx, drawRecordQueueKey, items); err != nil {
+			return flushed, err
+		}
+		flushed += len(records)
+		if len(items) < drawRecordBatchSize {
+			return flushed, nil
+		}
+	}
+}
+
+// GetDrawRecords 分页查询当前用户的抽奖记录
+func GetDrawRecords(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	pageSize, _ := strconv.Atoi(c.DefaultQuery("page_size", "20"))
+	if page < 1 {
+		page = 1
+	}
+	if pageSize < 1 || pageSize > 100 {
+		pageSize = 20
+	}
+
+	query := daos.DB.Model(&models.DrawRecord{}).Where("user_id = ?", userID)
+	if playMode := c.Query("playmode"); playMode != "" {
+		query = query.Where("play_mode = ?", playMode)
+	}
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var records []models.DrawRecord
+	if err := query.Order("created_at DESC, id DESC").
+		Offset((page - 1) * pageSize).Limit(pageSize).
+		Find(&records).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	errorss.JsonSuccess(c, gin.H{
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+		"records":   records,
+	})
+}
+
+// DrawStats 用户抽奖统计
+type DrawStats struct {
+	TotalDraws     int64              `json:"total_draws"`
+	TotalPointsWon int64              `json:"total_points_won"`
+	TotalCardsWon  int64              `json:"total_cards_won"`
+	ItemsWon       int64              `json:"items_won"`
+	BestPrize      *models.DrawRecord `json:"best_prize"` // 积分最高的一次中奖
+}
+
+// GetDrawStats 返回当前用户的抽奖统计
+func GetDrawStats(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+
+	var stats DrawStats
+	err := daos.DB.Model(&models.DrawRecord{}).
+		Select(`COUNT(*) AS total_draws,
+			COALESCE(SUM(CASE WHEN prize_kind = ? THEN prize_value ELSE 0 END), 0) AS total_points_won,
+			COALESCE(SUM(CASE WHEN prize_kind = ? THEN prize_value ELSE 0 END), 0) AS total_cards_won,
+			COALESCE(SUM(CASE WHEN prize_kind = ? THEN 1 ELSE 0 END), 0) AS items_won`,
+			models.PrizeKindPoints, models.PrizeKindCard, models.PrizeKindItem).
+		Where("user_id = ?", userID).
+		Scan(&stats).Error
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	var best models.DrawRecord
+	err = daos.DB.Where("user_id = ? AND prize_kind = ?", userID, models.PrizeKindPoints).
+		Order("prize_value DESC, created_at ASC").
+		First(&best).Error
+	if err == nil {
+		stats.BestPrize = &best
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	errorss.JsonSuccess(c, stats)
+}
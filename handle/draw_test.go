@@ -0,0 +1,274 @@
+package handle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"gorm.io/gorm"
+	"strconv"
+	"sync"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/ledger"
+	"tbooks/models"
+	"tbooks/usersync"
+	"testing"
+)
+
+// setupRedis 使用 miniredis 替换全局 Redis 客户端
+func setupRedis(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := configtest.Redis(t)
+	configs.Ctx = context.Background()
+	// 测试中没有数据库，Redis 里没有的用户都视为不存在
+	loadUserCache = func(context.Context, string) error { return gorm.ErrRecordNotFound }
+	t.Cleanup(func() { loadUserCache = usersync.LoadUser })
+	return mr
+}
+
+// setupFairSeed 预先写入种子，避免测试中访问数据库
+func setupFairSeed(mr *miniredis.Miniredis, userID, serverSeed, clientSeed string) {
+	mr.HSet(fairSeedKey(userID), "server_seed", serverSeed, "server_seed_hash", HashServerSeed(serverSeed),
+		"client_seed", clientSeed, "nonce", "0")
+}
+
+func TestDrawConcurrentNoOverdraft(t *testing.T) {
+	mr := setupRedis(t)
+	const (
+		userID       = "10001"
+		initialCards = 50
+		attempts     = 500
+	)
+	mr.Set(userID+"_card_count", strconv.Itoa(initialCards))
+	mr.Set(ledger.BalanceKey(userID), "0")
+	setupFairSeed(mr, userID, "server", "client")
+
+	var (
+		wg           sync.WaitGroup
+		mu           sync.Mutex
+		wins         int
+		cardsWon     int
+		pointsWon    models.Amount
+		insufficient int
+	)
+	for i := 0; i < attempts; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := Draw(context.Background(), userID, "2")
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case errors.Is(err, ErrInsufficientCard):
+				insufficient++
+			case err != nil:
+				t.Errorf("draw: %v", err)
+			default:
+				wins++
+				switch result.Prize.Kind {
+				case models.PrizeKindCard:
+					cardsWon += int(result.Prize.Value)
+				case models.PrizeKindPoints:
+					pointsWon += models.Units(result.Prize.Value)
+				}
+				if result.CardCount < 0 {
+					t.Errorf("card count went negative: %d", result.CardCount)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	cards, err := configs.Rdb.Get(context.Background(), userID+"_card_count").Int()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cards < 0 {
+		t.Fatalf("card count overdrawn: %d", cards)
+	}
+	if got, want := cards, initialCards+cardsWon-wins; got != want {
+		t.Fatalf("card count = %d, want %d", got, want)
+	}
+	if wins+insufficient != attempts {
+		t.Fatalf("wins %d + insufficient %d != attempts %d", wins, insufficient, attempts)
+	}
+	if wins > initialCards+cardsWon {
+		t.Fatalf("spent %d cards but only %d were available", wins, initialCards+cardsWon)
+	}
+
+	balance, err := configs.Rdb.Get(context.Background(), ledger.BalanceKey(userID)).Int64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if models.Amount(balance) != pointsWon {
+		t.Fatalf("balance = %v, want %v", balance, pointsWon)
+	}
+
+	queued, err := configs.Rdb.LLen(context.Background(), drawRecordQueueKey).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queued != int64(wins) {
+		t.Fatalf("queued draw records = %d, want %d", queued, wins)
+	}
+	var last drawRecordEntry
+	item, err := configs.Rdb.LIndex(context.Background(), drawRecordQueueKey, -1).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(item), &last); err != nil {
+		t.Fatal(err)
+	}
+	if last.BalanceAfter != pointsWon {
+		t.Fatalf("last record balance_after = %s, want %s", last.BalanceAfter, pointsWon)
+	}
+
+	if dirty, err := configs.Rdb.ZScore(context.Background(), usersync.DirtyKey, userID).Result(); err != nil || dirty == 0 {
+		t.Fatalf("user not marked dirty: %v", err)
+	}
+
+	history, err := configs.Rdb.LLen(context.Background(), drawHistoryKey(userID)).Result()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(min(wins, drawHistoryLimit)); history != want {
+		t.Fatalf("history length = %d, want %d", history, want)
+	}
+}
+
+func TestDrawUnknownUser(t *testing.T) {
+	mr := setupRedis(t)
+	setupFairSeed(mr, "missing", "server", "client")
+	if _, err := Draw(context.Background(), "missing", "1"); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("err = %v, want ErrUserNotFound", err)
+	}
+}
+
+func TestDrawInvalidPlayMode(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set("10001_card_count", "1")
+	if _, err := Draw(context.Background(), "10001", "9"); !errors.Is(err, ErrInvalidPlayMode) {
+		t.Fatalf("err = %v, want ErrInvalidPlayMode", err)
+	}
+	if got, _ := mr.Get("10001_card_count"); got != "1" {
+		t.Fatalf("card count changed to %s", got)
+	}
+}
+
+func TestDrawRespectsWeightsAndDailyStock(t *testing.T) {
+	mr := setupRedis(t)
+	rPrizeTables.Lock()
+	previous := prizeTables
+	prizeTables = map[string][]models.Prize{
+		"test": {
+			{PrizeKey: "1", Name: "rare", Kind: models.PrizeKindItem, Value: 1, Weight: 1000, DailyStock: 3, Enabled: true},
+			{PrizeKey: "2", Name: "common", Kind: models.PrizeKindPoints, Value: 10, Weight: 1, Enabled: true},
+			{PrizeKey: "3", Name: "never", Kind: models.PrizeKindCard, Value: 1, Weight: 0, Enabled: true},
+		},
+	}
+	rPrizeTables.Unlock()
+	t.Cleanup(func() {
+		rPrizeTables.Lock()
+		prizeTables = previous
+		rPrizeTables.Unlock()
+	})
+
+	mr.Set("10001_card_count", "100")
+	setupFairSeed(mr, "10001", "server", "client")
+	counts := map[string]int{}
+	for i := 0; i < 100; i++ {
+		result, err := Draw(context.Background(), "10001", "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[result.Prize.Name]++
+	}
+	if counts["rare"] != 3 {
+		t.Fatalf("rare prize issued %d times, want 3", counts["rare"])
+	}
+	if counts["never"] != 0 {
+		t.Fatalf("zero-weight prize issued %d times", counts["never"])
+	}
+	if counts["common"] != 97 {
+		t.Fatalf("common prize issued %d times, want 97", counts["common"])
+	}
+}
+
+func TestDrawSoldOutKeepsCard(t *testing.T) {
+	mr := setupRedis(t)
+	rPrizeTables.Lock()
+	previous := prizeTables
+	prizeTables = map[string][]models.Prize{
+		"test": {{PrizeKey: "1", Name: "rare", Kind: models.PrizeKindItem, Value: 1, Weight: 1, DailyStock: 1, Enabled: true}},
+	}
+	rPrizeTables.Unlock()
+	t.Cleanup(func() {
+		rPrizeTables.Lock()
+		prizeTables = previous
+		rPrizeTables.Unlock()
+	})
+
+	mr.Set("10001_card_count", "2")
+	setupFairSeed(mr, "10001", "server", "client")
+	if _, err := Draw(context.Background(), "10001", "test"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Draw(context.Background(), "10001", "test"); !errors.Is(err, ErrPrizeSoldOut) {
+		t.Fatalf("err = %v, want ErrPrizeSoldOut", err)
+	}
+	if got, _ := mr.Get("10001_card_count"); got != "1" {
+		t.Fatalf("card count = %s, want 1", got)
+	}
+}
+
+func TestDrawIsReproducibleFromSeeds(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set("10001_card_count", "20")
+	setupFairSeed(mr, "10001", "revealed-server-seed", "my-client-seed")
+
+	table, _ := GetPrizeTable("2")
+	for i := int64(0); i < 20; i++ {
+		result, err := Draw(context.Background(), "10001", "2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Nonce != i {
+			t.Fatalf("nonce = %d, want %d", result.Nonce, i)
+		}
+		want, _ := PickPrize(table, FairRoll("revealed-server-seed", "my-client-seed", i), nil)
+		if result.Prize.PrizeKey != want.PrizeKey {
+			t.Fatalf("draw %d: prize %s, recomputed %s", i, result.Prize.PrizeKey, want.PrizeKey)
+		}
+	}
+}
+
+func TestFailedDrawKeepsNonce(t *testing.T) {
+	mr := setupRedis(t)
+	mr.Set("10001_card_count", "0")
+	setupFairSeed(mr, "10001", "server", "client")
+	if _, err := Draw(context.Background(), "10001", "2"); !errors.Is(err, ErrInsufficientCard) {
+		t.Fatalf("err = %v, want ErrInsufficientCard", err)
+	}
+	if nonce := mr.HGet(fairSeedKey("10001"), "nonce"); nonce != "0" {
+		t.Fatalf("failed draw consumed nonce, now %s", nonce)
+	}
+
+	mr.Set("10001_card_count", "1")
+	result, err := Draw(context.Background(), "10001", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table, _ := GetPrizeTable("2")
+	if _, hash := PrizeTableSnapshot("2", table); result.Nonce != 0 || result.TableHash != hash {
+		t.Fatalf("nonce %d, table %s, want 0 and %s", result.Nonce, result.TableHash, hash)
+	}
+	var record drawRecordEntry
+	item, _ := configs.Rdb.LIndex(context.Background(), drawRecordQueueKey, 0).Result()
+	if err := json.Unmarshal([]byte(item), &record); err != nil || record.TableHash != result.TableHash {
+		t.Fatalf("queued record %s", item)
+	}
+	if nonce := mr.HGet(fairSeedKey("10001"), "nonce"); nonce != "1" {
+		t.Fatalf("nonce %s after one draw, want 1", nonce)
+	}
+}
@@ -0,0 +1,382 @@
+package handle
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"net/http"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/errorss"
+	"tbooks/models"
+	"time"
+)
+
+// FairState 用户当前的可证明公平种子状态
+type FairState struct {
+	ServerSeed     string `json:"-"`
+	ServerSeedHash string `json:"server_seed_hash"`
+	ClientSeed     string `json:"client_seed"`
+	Nonce          int64  `json:"nonce"`
+}
+
+func fairSeedKey(userID string) string {
+	return userID + "_fair_seed"
+}
+
+// createFairSeedScript 种子不存在时写入新种子，返回 1 表示写入成功
+// KEYS[1] 种子哈希  ARGV[1] 服务端种子  ARGV[2] 服务端种子哈希  ARGV[3] 客户端种子
+var createFairSeedScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HSET', KEYS[1], 'server_seed', ARGV[1], 'server_seed_hash', ARGV[2], 'client_seed', ARGV[3], 'nonce', 0)
+return 1
+`)
+
+// rotateFairSeedScript 当前种子仍为 ARGV[4] 时替换种子，返回旧种子，并将旧种子加入待公开队列
+// KEYS[1] 种子哈希  KEYS[2] 待公开队列  ARGV[1] 服务端种子  ARGV[2] 服务端种子哈希  ARGV[3] 客户端种子  ARGV[4] 旧的服务端种子哈希
+var rotateFairSeedScript = redis.NewScript(`
+local old = redis.call('HMGET', KEYS[1], 'server_seed', 'server_seed_hash', 'client_seed', 'nonce')
+if old[2] ~= ARGV[4] then
+	return false
+end
+redis.call('HSET', KEYS[1], 'server_seed', ARGV[1], 'server_seed_hash', ARGV[2], 'client_seed', ARGV[3], 'nonce', 0)
+redis.call('RPUSH', KEYS[2], cjson.encode({server_seed_hash = old[2], nonce = tonumber(old[4])}))
+return old
+`)
+
+// fairRevealQueueKey 已轮换、等待在数据库中标记为公开的种子
+const fairRevealQueueKey = "fair_seed_reveal_queue"
+
+// ErrFairSeedRotated 轮换期间种子已被其他请求轮换
+var ErrFairSeedRotated = errors.New("Fair seed was rotated by another request")
+
+// HashServerSeed 计算服务端种子的承诺哈希
+func HashServerSeed(serverSeed string) string {
+	sum := sha256.Sum256([]byte(serverSeed))
+	return hex.EncodeToString(sum[:])
+}
+
+// FairRoll 由 HMAC(server_seed, client_seed:nonce) 计算 [0,1) 的随机数
+func FairRoll(serverSeed, clientSeed string, nonce int64) float64 {
+	mac := hmac.New(sha256.New, []byte(serverSeed))
+	mac.Write([]byte(fmt.Sprintf("%s:%d", clientSeed, nonce)))
+	sum := mac.Sum(nil)
+	return float64(binary.BigEndian.Uint64(sum[:8])>>11) / (1 << 53)
+}
+
+// PickPrize 按随机数在可用奖品中加权选择，与抽奖脚本的算法一致
+// soldOut 为抽奖时已无库存的奖品编号
+func PickPrize(table []models.Prize, roll float64, soldOut map[string]bool) (models.Prize, bool) {
+	var total float64
+	available := make([]models.Prize, 0, len(table))
+	for _, prize := range table {
+		if prize.Weight > 0 && !soldOut[prize.PrizeKey] {
+			total += float64(prize.Weight)
+			available = append(available, prize)
+		}
+	}
+	if len(available) == 0 {
+		return models.Prize{}, false
+	}
+	target := roll * total
+	var acc float64
+	for _, prize := range available {
+		acc += float64(prize.Weight)
+		if target < acc {
+			return prize, true
+		}
+	}
+	return available[len(available)-1], true
+}
+
+func newServerSeed() (string, error) {
+	return randomToken(32)
+}
+
+// createFairSeed 为用户生成第一对种子
+// 种子先写入数据库再写入 Redis，抽奖使用的种子都能在数据库中找到
+func createFairSeed(ctx context.Context, userID string) error {
+	serverSeed, err := newServerSeed()
+	if err != nil {
+		return err
+	}
+	clientSeed, err := randomToken(8)
+	if err != nil {
+		return err
+	}
+	seedHash := HashServerSeed(serverSeed)
+	record := models.FairSeed{UserID: userID, ServerSeed: serverSeed, ServerSeedHash: seedHash, ClientSeed: clientSeed}
+	if err := daos.DB.Create(&record).Error; err != nil {
+		return err
+	}
+	created, err := createFairSeedScript.Run(ctx, configs.Rdb, []string{fairSeedKey(userID)},
+		serverSeed, seedHash, clientSeed).Int()
+	if err != nil {
+		return err
+	}
+	if created == 0 {
+		// 其他请求已经生成了种子，这条记录没有被使用
+		return daos.DB.Delete(&record).Error
+	}
+
+	// Redis 中的种子丢失时，数据库中遗留的种子直接公开
+	now := time.Now()
+	return daos.DB.Model(&models.FairSeed{}).
+		Where("user_id = ? AND revealed = ? AND server_seed_hash <> ?", userID, false, seedHash).
+		Updates(map[string]interface{}{"revealed": true, "revealed_at": &now}).Error
+}
+
+// fairReveal 待公开的种子
+type fairReveal struct {
+	ServerSeedHash string `json:"server_seed_hash"`
+	Nonce          int64  `json:"nonce"`
+}
+
+// FlushFairSeedReveals 在数据库中公开已轮换的种子，返回处理的数量
+func FlushFairSeedReveals(ctx context.Context) (int, error) {
+	flushed := 0
+	for {
+		items, err := daos.PeekQueue(ctx, fairRevealQueueKey, drawRecordBatchSize)
+		if err != nil || len(items) == 0 {
+			return flushed, err
+		}
+		now := time.Now()
+		for i, item := range items {
+			var reveal fairReveal
+			if err := json.Unmarshal([]byte(item), &reveal); err != nil {
+				logs.Error("Failed to decode fair seed reveal:", err, item)
+				continue
+			}
+			if err := daos.DB.Model(&models.FairSeed{}).Where("server_seed_hash = ?", reveal.ServerSeedHash).
+				Updates(map[string]interface{}{"revealed": true, "revealed_at": &now, "nonce": reveal.Nonce}).Error; err != nil {
+				if ackErr := daos.AckQueue(ctx, fairRevealQueueKey, items[:i]); ackErr != nil {
+					logs.Error("Failed to ack fair seed reveals:", ackErr)
+				}
+				return flushed, err
+			}
+			flushed++
+		}
+		if err := daos.AckQueue(ctx, fairRevealQueueKey, items); err != nil {
+			return flushed, err
+		}
+		if len(items) < drawRecordBatchSize {
+			return flushed, nil
+		}
+	}
+}
+
+// currentFairState 返回用户当前的种子状态，nonce 为下一次抽奖使用的值
+func currentFairState(ctx context.Context, userID string) (*FairState, error) {
+	values, err := configs.Rdb.HGetAll(ctx, fairSeedKey(userID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		if err := createFairSeed(ctx, userID); err != nil {
+			return nil, err
+		}
+		if values, err = configs.Rdb.HGetAll(ctx, fairSeedKey(userID)).Result(); err != nil {
+			return nil, err
+		}
+	}
+	nonce, _ := strconv.ParseInt(values["nonce"], 10, 64)
+	return &FairState{
+		ServerSeed:     values["server_seed"],
+		ServerSeedHash: values["server_seed_hash"],
+		ClientSeed:     values["client_seed"],
+		Nonce:          nonce,
+	}, nil
+}
+
+// GetFairSeed 返回当前服务端种子的哈希、客户端种子和 nonce
+func GetFairSeed(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	state, err := currentFairState(c, userID)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, state)
+}
+
+// RotateFairSeed 公开当前服务端种子，生成新的服务端种子并设置新的客户端种子
+func RotateFairSeed(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		ClientSeed string `json:"client_seed"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	if len(input.ClientSeed) > 64 {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Client seed is too long"))
+		return
+	}
+	// 确保旧种子存在，避免公开空种子
+	current, err := currentFairState(c, userID)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	serverSeed, err := newServerSeed()
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	clientSeed := input.ClientSeed
+	if clientSeed == "" {
+		if clientSeed, err = randomToken(8); err != nil {
+			errorss.HandleError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	// 新种子先写入数据库，Redis 中替换后旧种子经队列公开，任一步失败都不会出现数据库中没有的种子
+	seedHash := HashServerSeed(serverSeed)
+	record := models.FairSeed{UserID: userID, ServerSeed: serverSeed, ServerSeedHash: seedHash, ClientSeed: clientSeed}
+	if err := daos.DB.Create(&record).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	old, err := rotateFairSeedScript.Run(c, configs.Rdb, []string{fairSeedKey(userID), fairRevealQueueKey},
+		serverSeed, seedHash, clientSeed, current.ServerSeedHash).StringSlice()
+	if err == redis.Nil {
+		if err := daos.DB.Delete(&record).Error; err != nil {
+			logs.Error("Failed to delete unused fair seed:", err)
+		}
+		errorss.HandleError(c, http.StatusConflict, ErrFairSeedRotated)
+		return
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	oldNonce, _ := strconv.ParseInt(old[3], 10, 64)
+	// 失败时由后台任务继续公开
+	if _, err := FlushFairSeedReveals(c); err != nil {
+		logs.Error("Failed to reveal fair seeds:", err)
+	}
+
+	errorss.JsonSuccess(c, gin.H{
+		"revealed": gin.H{
+			"server_seed":      old[0],
+			"server_seed_hash": old[1],
+			"client_seed":      old[2],
+			"nonce":            oldNonce,
+		},
+		"current": FairState{ServerSeedHash: seedHash, ClientSeed: clientSeed},
+	})
+}
+
+// VerifyDraw 根据公开的种子重新计算抽奖结果，供第三方审计
+// 传入 draw_id 时从抽奖记录中取参数，否则使用请求中的种子、nonce 和玩法
+func VerifyDraw(c *gin.Context) {
+	var input struct {
+		DrawID     uint     `json:"draw_id"`
+		ServerSeed string   `json:"server_seed"`
+		ClientSeed string   `json:"client_seed"`
+		Nonce      int64    `json:"nonce"`
+		PlayMode   string   `json:"playmode"`
+		SoldOut    []string `json:"sold_out"`   // 抽奖时已无库存的奖品编号
+		TableHash  string   `json:"table_hash"` // 抽奖时的奖品表哈希，为空时使用当前奖品表
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var seed models.FairSeed
+	var record *models.DrawRecord
+	if input.DrawID != 0 {
+		record = &models.DrawRecord{}
+		if err := daos.DB.First(record, input.DrawID).Error; err != nil {
+			errorss.HandleError(c, http.StatusNotFound, errors.New("Draw record not found"))
+			return
+		}
+		if err := daos.DB.Where("server_seed_hash = ? AND revealed = ?", record.ServerSeedHash, true).First(&seed).Error; err != nil {
+			errorss.HandleError(c, http.StatusNotFound, errors.New("Server seed has not been revealed"))
+			return
+		}
+		input.ServerSeed = seed.ServerSeed
+		input.ClientSeed = record.ClientSeed
+		input.Nonce = record.Nonce
+		input.PlayMode = record.PlayMode
+		input.TableHash = record.TableHash
+		input.SoldOut = nil
+		if record.SoldOut != "" {
+			input.SoldOut = strings.Split(record.SoldOut, ",")
+		}
+	} else {
+		if input.ServerSeed == "" || input.ClientSeed == "" || input.PlayMode == "" {
+			errorss.HandleError(c, http.StatusBadRequest, errors.New("server_seed, client_seed and playmode are required"))
+			return
+		}
+		// 只有已公开的种子才能验证
+		if err := daos.DB.Where("server_seed_hash = ? AND revealed = ?", HashServerSeed(input.ServerSeed), true).First(&seed).Error; err != nil {
+			errorss.HandleError(c, http.StatusNotFound, errors.New("Server seed has not been revealed"))
+			return
+		}
+	}
+
+	// 按抽奖时的奖品表复算，启用快照之前的记录只能使用当前奖品表
+	var table []models.Prize
+	if input.TableHash != "" {
+		var err error
+		if table, err = snapshotPrizeTable(input.TableHash); err != nil {
+			errorss.HandleError(c, http.StatusNotFound, errors.New("Prize table snapshot not found"))
+			return
+		}
+	} else {
+		var ok bool
+		if table, ok = GetPrizeTable(input.PlayMode); !ok {
+			errorss.HandleError(c, http.StatusBadRequest, ErrInvalidPlayMode)
+			return
+		}
+		_, input.TableHash = PrizeTableSnapshot(input.PlayMode, table)
+	}
+	soldOut := make(map[string]bool, len(input.SoldOut))
+	for _, key := range input.SoldOut {
+		soldOut[key] = true
+	}
+	roll := FairRoll(input.ServerSeed, input.ClientSeed, input.Nonce)
+	prize, ok := PickPrize(table, roll, soldOut)
+	if !ok {
+		errorss.HandleError(c, http.StatusBadRequest, ErrPrizeSoldOut)
+		return
+	}
+
+	resp := gin.H{
+		"server_seed":      input.ServerSeed,
+		"server_seed_hash": seed.ServerSeedHash,
+		"client_seed":      input.ClientSeed,
+		"nonce":            input.Nonce,
+		"table_hash":       input.TableHash,
+		"prizes":           table,
+		"user_id":          seed.UserID,
+		"roll":             roll,
+		"prize":            prize,
+	}
+	if record != nil {
+		resp["draw"] = record
+		resp["matches"] = record.PrizeKey == prize.PrizeKey
+	}
+	errorss.JsonSuccess(c, resp)
+}
@@ -0,0 +1,138 @@
+package handle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"net/http/httptest"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"testing"
+)
+
+// callHandler 以 userID 的身份调用接口，返回响应中的 code 和 data
+func callHandler(t *testing.T, handler gin.HandlerFunc, userID string, body interface{}) (int, json.RawMessage) {
+	t.Helper()
+	data, _ := json.Marshal(body)
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest("POST", "/", bytes.NewReader(data))
+	c.Request.Header.Set("Content-Type", "application/json")
+	if userID != "" {
+		c.Set(ContextUserIDKey, userID)
+	}
+	handler(c)
+	var resp struct {
+		Code int             `json:"code"`
+		Data json.RawMessage `json:"data"`
+		Err  string          `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid response %s", rec.Body.String())
+	}
+	return resp.Code, resp.Data
+}
+
+// usePrizeTables 替换奖品表，测试结束时恢复
+func usePrizeTables(t *testing.T, tables map[string][]models.Prize) {
+	t.Helper()
+	rPrizeTables.Lock()
+	previous := prizeTables
+	prizeTables = tables
+	rPrizeTables.Unlock()
+	t.Cleanup(func() {
+		rPrizeTables.Lock()
+		prizeTables = previous
+		rPrizeTables.Unlock()
+	})
+}
+
+func verifyDraw(t *testing.T, id uint) (matches bool, tableHash string) {
+	t.Helper()
+	code, data := callHandler(t, VerifyDraw, "", gin.H{"draw_id": id})
+	var resp struct {
+		Matches   bool   `json:"matches"`
+		TableHash string `json:"table_hash"`
+	}
+	if err := json.Unmarshal(data, &resp); code != 200 || err != nil {
+		t.Fatalf("verify draw %d: code %d %s", id, code, data)
+	}
+	return resp.Matches, resp.TableHash
+}
+
+func TestFairSeedRotationAndVerify(t *testing.T) {
+	daostest.Open(t)
+	mr := setupRedis(t)
+	ctx := context.Background()
+	usePrizeTables(t, nil)
+	if err := LoadPrizeTables(); err != nil {
+		t.Fatal(err)
+	}
+	mr.Set("10001_card_count", "5")
+	for i := 0; i < 3; i++ {
+		if _, err := Draw(ctx, "10001", "2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := FlushDrawRecords(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 种子先写入数据库
+	var seeds []models.FairSeed
+	daos.DB.Where("user_id = ?", "10001").Find(&seeds)
+	current := mr.HGet(fairSeedKey("10001"), "server_seed_hash")
+	if len(seeds) != 1 || seeds[0].ServerSeedHash != current || seeds[0].Revealed {
+		t.Fatalf("seeds %+v, current %s", seeds, current)
+	}
+
+	code, data := callHandler(t, RotateFairSeed, "10001", gin.H{"client_seed": "mine"})
+	var rotated struct {
+		Revealed struct {
+			ServerSeed     string `json:"server_seed"`
+			ServerSeedHash string `json:"server_seed_hash"`
+			Nonce          int64  `json:"nonce"`
+		} `json:"revealed"`
+		Current FairState `json:"current"`
+	}
+	if err := json.Unmarshal(data, &rotated); code != 200 || err != nil {
+		t.Fatalf("rotate: code %d %s", code, data)
+	}
+	if rotated.Revealed.ServerSeedHash != current || rotated.Revealed.Nonce != 3 || rotated.Current.ClientSeed != "mine" {
+		t.Fatalf("rotated %+v", rotated)
+	}
+	var old, next models.FairSeed
+	daos.DB.Where("server_seed_hash = ?", current).First(&old)
+	daos.DB.Where("server_seed_hash = ?", rotated.Current.ServerSeedHash).First(&next)
+	if !old.Revealed || old.Nonce != 3 || old.ServerSeed != rotated.Revealed.ServerSeed || next.Revealed || next.ClientSeed != "mine" {
+		t.Fatalf("old seed %+v, new seed %+v", old, next)
+	}
+	if n, _ := configs.Rdb.LLen(ctx, fairRevealQueueKey).Result(); n != 0 {
+		t.Fatalf("%d reveals left in queue", n)
+	}
+
+	// 种子已被其他请求轮换时不替换
+	if err := rotateFairSeedScript.Run(ctx, configs.Rdb, []string{fairSeedKey("10001"), fairRevealQueueKey},
+		"s", HashServerSeed("s"), "c", current).Err(); err != redis.Nil {
+		t.Fatalf("rotated a stale seed: %v", err)
+	}
+
+	// 奖品表修改后仍按抽奖时的奖品表复算
+	var records []models.DrawRecord
+	daos.DB.Order("nonce").Find(&records)
+	if len(records) != 3 || records[0].TableHash == "" {
+		t.Fatalf("draw records %+v", records)
+	}
+	changed := []models.Prize{{PlayMode: "2", PrizeKey: "1", Name: "only", Kind: models.PrizeKindNone, Weight: 1, Enabled: true}}
+	usePrizeTables(t, map[string][]models.Prize{"2": changed})
+	for _, record := range records {
+		matches, tableHash := verifyDraw(t, record.ID)
+		if !matches || tableHash != record.TableHash {
+			t.Fatalf("draw %d: matches %v, table %s, recorded %s", record.ID, matches, tableHash, record.TableHash)
+		}
+	}
+}
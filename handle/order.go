@@ -0,0 +1,194 @@
+package handle
+
+import (
+	"errors"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"strconv"
+	"tbooks/daos"
+	"tbooks/errorss"
+	"tbooks/models"
+	"tbooks/orders"
+)
+
+// GetPacks 可购买的商品包
+func GetPacks(c *gin.Context) {
+	errorss.JsonSuccess(c, gin.H{"packs": orders.Packs()})
+}
+
+// CreateOrder 创建商品包订单，返回付款所需的收款地址、金额和备注
+func CreateOrder(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Pack    string `json:"pack" binding:"required"` // 商品包名称
+		Address string `json:"address"`                 // 付款钱包地址
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if input.Address != "" {
+		address, err := NormalizeTonAddress(input.Address)
+		if err != nil {
+			errorss.HandleError(c, http.StatusBadRequest, err)
+			return
+		}
+		input.Address = address
+	}
+
+	order, err := orders.Create(userID, input.Pack, input.Address)
+	if errors.Is(err, orders.ErrPaymentsDisabled) {
+		errorss.HandleError(c, http.StatusServiceUnavailable, err)
+		return
+	} else if errors.Is(err, orders.ErrUnknownPack) {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, errors.New("Failed to create order"))
+		return
+	}
+	payment, err := orderPayment(order)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	errorss.JsonSuccess(c, gin.H{"message": "Order created successfully", "order": order, "payment": payment})
+}
+
+// CreateStarsInvoice 创建 Stars 付款的商品包订单，返回发票链接，小程序中用 Telegram.WebApp.openInvoice 打开
+func CreateStarsInvoice(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Pack string `json:"pack" binding:"required"` // 商品包名称
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	order, link, err := orders.StarsInvoice(c, userID, input.Pack)
+	if errors.Is(err, orders.ErrPaymentsDisabled) {
+		errorss.HandleError(c, http.StatusServiceUnavailable, err)
+		return
+	} else if errors.Is(err, orders.ErrUnknownPack) {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	} else if err != nil {
+		logs.Error("Failed to create stars invoice:", err)
+		errorss.HandleError(c, http.StatusInternalServerError, errors.New("Failed to create invoice"))
+		return
+	}
+
+	errorss.JsonSuccess(c, gin.H{"message": "Invoice created successfully", "order": order, "invoice_link": link})
+}
+
+// orderPayment 待付款订单的付款信息，其他状态或不支持的币种返回 nil
+func orderPayment(order *models.Order) (*TonPayment, error) {
+	if order.Status != models.OrderPending || !isTon(order) {
+		return nil, nil
+	}
+	return tonPayment(order)
+}
+
+// GetOrders 用户的订单，按创建时间倒序
+func GetOrders(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var list []models.Order
+	if err := daos.DB.Where("user_id = ?", userID).Order("id DESC").Limit(100).Find(&list).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"orders": list})
+}
+
+// GetOrder 查询订单状态，付款后轮询直到 fulfilled
+func GetOrder(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var order models.Order
+	err := daos.DB.Where("id = ? AND user_id = ?", c.Param("id"), userID).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		errorss.HandleError(c, http.StatusNotFound, errors.New("Order not found"))
+		return
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	payment, err := orderPayment(&order)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"order": order, "payment": payment})
+}
+
+// AdminPaymentIssues 需要人工处理的订单和转账：期限内未付足的订单、多付的订单、退款未完成的订单、订单关闭后收到的转账
+func AdminPaymentIssues(c *gin.Context) {
+	var failed, overpaid, refunding []models.Order
+	if err := daos.DB.Where("status = ?", models.OrderFailed).Order("id").Find(&failed).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := daos.DB.Where("status = ?", models.OrderRefunding).Order("id").Find(&refunding).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := daos.DB.Where("status IN ? AND paid_amount > price", []models.OrderStatus{models.OrderPaid, models.OrderFulfilling, models.OrderFulfilled}).
+		Order("id").Find(&overpaid).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var unapplied []models.OrderPayment
+	if err := daos.DB.Where("applied = ? AND refunded_at IS NULL", false).Order("id").Find(&unapplied).Error; err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"failed": failed, "overpaid": overpaid, "refunding": refunding, "unapplied": unapplied})
+}
+
+// AdminRefundOrder 订单退款，先收回已发放的卡片和积分，Stars 订单同时退回 Stars，链上付款需先手动退款
+// 退回 Stars 失败时订单保持 refunding，可以重新调用
+func AdminRefundOrder(c *gin.Context) {
+	orderID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid order id"))
+		return
+	}
+	var input struct {
+		Reason string `json:"reason" binding:"required"` // 退款原因
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	order, err := orders.Refund(c, uint(orderID), input.Reason)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		errorss.HandleError(c, http.StatusNotFound, errors.New("Order not found"))
+		return
+	} else if errors.Is(err, orders.ErrInvalidTransition) || errors.Is(err, orders.ErrStatusChanged) {
+		errorss.HandleError(c, http.StatusConflict, err)
+		return
+	} else if errors.Is(err, orders.ErrPaymentsDisabled) {
+		errorss.HandleError(c, http.StatusServiceUnavailable, err)
+		return
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"message": "Order refunded successfully", "order": order})
+}
@@ -0,0 +1,154 @@
+package handle
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"net/url"
+	"strconv"
+	"strings"
+	"tbooks/models"
+	"tbooks/orders"
+	"time"
+)
+
+// TonApiClient 同时实现 orders.ChainClient，按 lt 顺序读取收款地址的转入交易
+var _ orders.ChainClient = (*TonApiClient)(nil)
+
+// tonTransaction tonapi 返回的交易，只保留付款匹配需要的字段
+type tonTransaction struct {
+	Hash    string `json:"hash"`
+	Lt      int64  `json:"lt"`
+	Utime   int64  `json:"utime"`
+	Success bool   `json:"success"`
+	Aborted bool   `json:"aborted"`
+	InMsg   *struct {
+		MsgType string `json:"msg_type"`
+		Value   int64  `json:"value"`
+		Bounced bool   `json:"bounced"`
+		Source  *struct {
+			Address string `json:"address"`
+		} `json:"source"`
+		Destination *struct {
+			Address string `json:"address"`
+		} `json:"destination"`
+		DecodedOpName string `json:"decoded_op_name"`
+		DecodedBody   struct {
+			Text string `json:"text"`
+		} `json:"decoded_body"`
+	} `json:"in_msg"`
+}
+
+// transfer 转换为付款监听使用的转账，失败、退回或不是转入的交易金额为 0
+func (tx tonTransaction) transfer() orders.Transfer {
+	t := orders.Transfer{Hash: tx.Hash, Cursor: strconv.FormatInt(tx.Lt, 10), Time: time.Unix(tx.Utime, 0)}
+	msg := tx.InMsg
+	if !tx.Success || tx.Aborted || msg == nil || msg.MsgType != "int_msg" || msg.Bounced || msg.Source == nil {
+		return t
+	}
+	t.From = msg.Source.Address
+	if msg.Destination != nil {
+		t.To = msg.Destination.Address
+	}
+	t.Amount = msg.Value
+	if msg.DecodedOpName == "text_comment" {
+		t.Memo = msg.DecodedBody.Text
+	}
+	return t
+}
+
+// Transfers 按 lt 升序查询 cursor 之后收款地址的交易，cursor 为交易的 lt
+func (t *TonApiClient) Transfers(ctx context.Context, address, cursor string, limit int) ([]orders.Transfer, error) {
+	query := url.Values{}
+	query.Set("limit", strconv.Itoa(limit))
+	query.Set("sort_order", "asc")
+	if cursor != "" {
+		query.Set("after_lt", cursor)
+	}
+	var out struct {
+		Transactions []tonTransaction `json:"transactions"`
+	}
+	if err := t.do(ctx, "/v2/blockchain/accounts/"+url.PathEscape(address)+"/transactions?"+query.Encode(), &out); err != nil {
+		return nil, err
+	}
+	transfers := make([]orders.Transfer, 0, len(out.Transactions))
+	for _, tx := range out.Transactions {
+		transfers = append(transfers, tx.transfer())
+	}
+	return transfers, nil
+}
+
+// maxCommentBytes 单个 cell 中能放下的评论长度，1023 位减去 32 位的操作码
+const maxCommentBytes = 123
+
+// TonCommentPayload 生成文本评论消息体的 base64 BOC，作为 TON Connect 消息的 payload
+// 消息体为 32 位 0 操作码加 UTF-8 文本，序列化为只有一个 cell 的 BOC，带 CRC32C 校验
+func TonCommentPayload(comment string) (string, error) {
+	if len(comment) > maxCommentBytes {
+		return "", errors.New("TON comment is too long")
+	}
+	data := append(make([]byte, 4), comment...)
+	// cell 描述字节：没有引用，数据为整字节
+	cell := append([]byte{0, byte(2 * len(data))}, data...)
+	// 魔数；带 CRC32C，cell 序号 1 字节；偏移量 1 字节；cell 数、根数、缺失数；cell 总长度；根 cell 序号
+	boc := []byte{0xb5, 0xee, 0x9c, 0x72, 0x41, 1, 1, 1, 0, byte(len(cell)), 0}
+	boc = append(boc, cell...)
+	boc = binary.LittleEndian.AppendUint32(boc, crc32.Checksum(boc, crc32.MakeTable(crc32.Castagnoli)))
+	return base64.StdEncoding.EncodeToString(boc), nil
+}
+
+// TonConnectMessage TON Connect sendTransaction 中的一条消息
+type TonConnectMessage struct {
+	Address string `json:"address"`
+	Amount  string `json:"amount"`  // nanoton
+	Payload string `json:"payload"` // base64 BOC
+}
+
+// TonConnectTransaction 可直接传给 TON Connect sendTransaction 的交易
+type TonConnectTransaction struct {
+	ValidUntil int64               `json:"validUntil"`
+	Messages   []TonConnectMessage `json:"messages"`
+}
+
+// TonPayment 订单的 TON 付款信息，必须带上评论才能匹配到订单
+type TonPayment struct {
+	Address     string                `json:"address"` // 收款地址
+	Amount      string                `json:"amount"`  // 应付金额，nanoton
+	Comment     string                `json:"comment"` // 转账评论
+	ValidUntil  int64                 `json:"valid_until"`
+	Transaction TonConnectTransaction `json:"transaction"`
+}
+
+// tonPayment 生成待付款订单的 TON 付款信息，部分付款后只需补足剩余金额
+func tonPayment(order *models.Order) (*TonPayment, error) {
+	address := order.DepositAddress
+	if friendly, err := NormalizeTonAddress(address); err == nil {
+		address = friendly
+	}
+	payload, err := TonCommentPayload(order.Memo)
+	if err != nil {
+		return nil, err
+	}
+	amount := strconv.FormatInt(order.Price-order.PaidAmount, 10)
+	var validUntil int64
+	if order.ExpiresAt != nil {
+		validUntil = order.ExpiresAt.Unix()
+	}
+	return &TonPayment{
+		Address:    address,
+		Amount:     amount,
+		Comment:    order.Memo,
+		ValidUntil: validUntil,
+		Transaction: TonConnectTransaction{
+			ValidUntil: validUntil,
+			Messages:   []TonConnectMessage{{Address: address, Amount: amount, Payload: payload}},
+		},
+	}, nil
+}
+
+// isTon 订单是否以 TON 付款
+func isTon(order *models.Order) bool {
+	return strings.EqualFold(order.Currency, orders.CurrencyTON)
+}
@@ -0,0 +1,106 @@
+package handle
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"tbooks/configs/configtest"
+	"tbooks/models"
+	"testing"
+	"time"
+)
+
+func TestTonCommentPayload(t *testing.T) {
+	payload, err := TonCommentPayload("3f2a9c01d4e5b6a7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 单个 cell、带 CRC32C 的 BOC 都以该前缀开头
+	if !strings.HasPrefix(payload, "te6cckEBAQEA") {
+		t.Fatalf("unexpected BOC prefix: %s", payload)
+	}
+	boc, _ := base64.StdEncoding.DecodeString(payload)
+	body := boc[:len(boc)-4]
+	if crc := binary.LittleEndian.Uint32(boc[len(boc)-4:]); crc != crc32.Checksum(body, crc32.MakeTable(crc32.Castagnoli)) {
+		t.Fatal("CRC32C mismatch")
+	}
+	// 描述字节之后为 32 位 0 操作码和评论文本
+	cell := body[11:]
+	if int(body[9]) != len(cell) || cell[1] != byte(2*(4+16)) || string(cell[2:6]) != "\x00\x00\x00\x00" || string(cell[6:]) != "3f2a9c01d4e5b6a7" {
+		t.Fatalf("unexpected cell: %x", cell)
+	}
+
+	if _, err := TonCommentPayload(strings.Repeat("a", maxCommentBytes+1)); err == nil {
+		t.Fatal("comment longer than a cell accepted")
+	}
+}
+
+func TestTonPayment(t *testing.T) {
+	expiresAt := time.Unix(1700000000, 0)
+	raw := "0:" + strings.Repeat("ab", 32)
+	order := &models.Order{
+		Status: models.OrderPending, Currency: "TON", Price: 1500000000, PaidAmount: 500000000,
+		DepositAddress: raw, Memo: "3f2a9c01d4e5b6a7", ExpiresAt: &expiresAt,
+	}
+	payment, err := orderPayment(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+	friendly, _ := NormalizeTonAddress(raw)
+	msg := payment.Transaction.Messages[0]
+	// 部分付款后只需补足剩余金额
+	if payment.Amount != "1000000000" || msg.Amount != payment.Amount || msg.Address != friendly || payment.Transaction.ValidUntil != 1700000000 {
+		t.Fatalf("unexpected payment: %+v", payment)
+	}
+
+	order.Status = models.OrderPaid
+	if payment, _ := orderPayment(order); payment != nil {
+		t.Fatal("payment info returned for a paid order")
+	}
+}
+
+func TestTonTransfers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/v2/blockchain/accounts/DEPOSIT/transactions" || q.Get("after_lt") != "100" ||
+			q.Get("sort_order") != "asc" || q.Get("limit") != "10" {
+			http.Error(w, "unexpected request "+r.URL.String(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"transactions":[
+			{"hash":"a","lt":101,"utime":1700000000,"success":true,"in_msg":{"msg_type":"int_msg","value":1000,
+				"source":{"address":"0:aa"},"destination":{"address":"0:bb"},"decoded_op_name":"text_comment","decoded_body":{"text":"memo1"}}},
+			{"hash":"b","lt":102,"utime":1700000001,"success":true,"in_msg":{"msg_type":"int_msg","value":1000,"bounced":true,
+				"source":{"address":"0:aa"},"decoded_op_name":"text_comment","decoded_body":{"text":"memo2"}}},
+			{"hash":"c","lt":103,"utime":1700000002,"success":true,"in_msg":{"msg_type":"ext_in_msg"}},
+			{"hash":"d","lt":104,"utime":1700000003,"success":true,"in_msg":{"msg_type":"int_msg","value":500,
+				"source":{"address":"0:aa"},"decoded_op_name":"jetton_notify"}}
+		]}`))
+	}))
+	defer srv.Close()
+	configtest.Load(t, "ton:\n  apiurl: "+srv.URL+"\n")
+
+	transfers, err := (&TonApiClient{}).Transfers(context.Background(), "DEPOSIT", "100", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 4 {
+		t.Fatalf("got %d transfers, want all 4 to advance the cursor", len(transfers))
+	}
+	first := transfers[0]
+	if first.Hash != "a" || first.Cursor != "101" || first.Amount != 1000 || first.Memo != "memo1" || first.From != "0:aa" || first.To != "0:bb" {
+		t.Fatalf("unexpected transfer: %+v", first)
+	}
+	// 退回的交易和外部消息不计入
+	if transfers[1].Amount != 0 || transfers[2].Amount != 0 || transfers[3].Cursor != "104" {
+		t.Fatalf("unexpected transfers: %+v", transfers[1:])
+	}
+	// 没有评论的转账无法匹配订单
+	if transfers[3].Memo != "" || transfers[3].Amount != 500 {
+		t.Fatalf("unexpected transfer: %+v", transfers[3])
+	}
+}
@@ -0,0 +1,269 @@
+package handle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"net/http"
+	"sort"
+	"sync"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/errorss"
+	"tbooks/models"
+	"tbooks/timeutil"
+	"time"
+)
+
+// defaultPrizeTables 数据库中没有奖品配置时使用的默认奖品
+var defaultPrizeTables = map[string][]models.Prize{
+	"1": { // 玩法 1: 抽奖四个奖品
+		{PrizeKey: "1", Name: "100points", Kind: models.PrizeKindPoints, Value: 100, Weight: 1, ImageURL: "1"},
+		{PrizeKey: "2", Name: "200points", Kind: models.PrizeKindPoints, Value: 200, Weight: 1, ImageURL: "2"},
+		{PrizeKey: "3", Name: "300points", Kind: models.PrizeKindPoints, Value: 300, Weight: 1, ImageURL: "3"},
+		{PrizeKey: "4", Name: "1card", Kind: models.PrizeKindCard, Value: 1, Weight: 1, ImageURL: "4"},
+	},
+	"2": { // 玩法 2: 大转盘八个奖品
+		{PrizeKey: "1", Name: "50points", Kind: models.PrizeKindPoints, Value: 50, Weight: 1, ImageURL: "1"},
+		{PrizeKey: "2", Name: "100points", Kind: models.PrizeKindPoints, Value: 100, Weight: 1, ImageURL: "2"},
+		{PrizeKey: "3", Name: "150points", Kind: models.PrizeKindPoints, Value: 150, Weight: 1, ImageURL: "3"},
+		{PrizeKey: "4", Name: "200points", Kind: models.PrizeKindPoints, Value: 200, Weight: 1, ImageURL: "4"},
+		{PrizeKey: "5", Name: "250points", Kind: models.PrizeKindPoints, Value: 250, Weight: 1, ImageURL: "5"},
+		{PrizeKey: "6", Name: "300points", Kind: models.PrizeKindPoints, Value: 300, Weight: 1, ImageURL: "6"},
+		{PrizeKey: "7", Name: "1card", Kind: models.PrizeKindCard, Value: 1, Weight: 1, ImageURL: "7"},
+		{PrizeKey: "8", Name: "400points", Kind: models.PrizeKindPoints, Value: 400, Weight: 1, ImageURL: "8"},
+	},
+}
+
+var (
+	prizeTables  = normalizedDefaultPrizeTables()
+	rPrizeTables sync.RWMutex
+)
+
+// normalizedDefaultPrizeTables 返回补全玩法和启用状态的默认奖品副本
+func normalizedDefaultPrizeTables() map[string][]models.Prize {
+	tables := make(map[string][]models.Prize, len(defaultPrizeTables))
+	for mode, table := range defaultPrizeTables {
+		for _, prize := range table {
+			prize.PlayMode = mode
+			prize.Enabled = true
+			tables[mode] = append(tables[mode], prize)
+		}
+	}
+	return tables
+}
+
+// GetPrizeTable 返回玩法下启用的奖品，按奖品编号排序
+func GetPrizeTable(playMode string) ([]models.Prize, bool) {
+	rPrizeTables.RLock()
+	table, ok := prizeTables[playMode]
+	rPrizeTables.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	enabled := enabledPrizes(table)
+	return enabled, len(enabled) > 0
+}
+
+func enabledPrizes(table []models.Prize) []models.Prize {
+	enabled := make([]models.Prize, 0, len(table))
+	for _, prize := range table {
+		if prize.Enabled {
+			enabled = append(enabled, prize)
+		}
+	}
+	return enabled
+}
+
+// prizeSnapshotEntry 奖品表快照中参与选奖的字段
+type prizeSnapshotEntry struct {
+	PrizeKey   string           `json:"prize_key"`
+	Name       string           `json:"name"`
+	Kind       models.PrizeKind `json:"kind"`
+	Value      int64            `json:"value"`
+	Weight     int64            `json:"weight"`
+	DailyStock int64            `json:"daily_stock"`
+}
+
+// PrizeTableSnapshot 返回玩法奖品表的快照内容及其哈希，抽奖记录保存哈希以便按当时的奖品表复算
+func PrizeTableSnapshot(playMode string, table []models.Prize) (string, string) {
+	entries := make([]prizeSnapshotEntry, len(table))
+	for i, prize := range table {
+		entries[i] = prizeSnapshotEntry{PrizeKey: prize.PrizeKey, Name: prize.Name, Kind: prize.Kind,
+			Value: prize.Value, Weight: prize.Weight, DailyStock: prize.DailyStock}
+	}
+	data, _ := json.Marshal(entries)
+	sum := sha256.Sum256([]byte(playMode + "\n" + string(data)))
+	return string(data), hex.EncodeToString(sum[:])
+}
+
+// savePrizeSnapshots 保存奖品表快照，需在奖品表用于抽奖之前保存
+func savePrizeSnapshots(tables map[string][]models.Prize) error {
+	var rows []models.PrizeTableSnapshot
+	for mode, table := range tables {
+		enabled := enabledPrizes(table)
+		if len(enabled) == 0 {
+			continue
+		}
+		prizes, hash := PrizeTableSnapshot(mode, enabled)
+		rows = append(rows, models.PrizeTableSnapshot{Hash: hash, PlayMode: mode, Prizes: prizes})
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return daos.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error
+}
+
+// snapshotPrizeTable 按哈希读取抽奖时的奖品表
+func snapshotPrizeTable(hash string) ([]models.Prize, error) {
+	var snapshot models.PrizeTableSnapshot
+	if err := daos.DB.Where("hash = ?", hash).First(&snapshot).Error; err != nil {
+		return nil, err
+	}
+	var entries []prizeSnapshotEntry
+	if err := json.Unmarshal([]byte(snapshot.Prizes), &entries); err != nil {
+		return nil, err
+	}
+	table := make([]models.Prize, len(entries))
+	for i, entry := range entries {
+		table[i] = models.Prize{PlayMode: snapshot.PlayMode, PrizeKey: entry.PrizeKey, Name: entry.Name, Kind: entry.Kind,
+			Value: entry.Value, Weight: entry.Weight, DailyStock: entry.DailyStock, Enabled: true}
+	}
+	return table, nil
+}
+
+// LoadPrizeTables 从数据库加载奖品配置，表为空时写入默认奖品
+func LoadPrizeTables() error {
+	var rows []models.Prize
+	if err := daos.DB.Order("play_mode, prize_key").Find(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		for _, table := range normalizedDefaultPrizeTables() {
+			rows = append(rows, table...)
+		}
+		if err := daos.DB.Create(&rows).Error; err != nil {
+			return err
+		}
+	}
+
+	tables := make(map[string][]models.Prize)
+	for _, prize := range rows {
+		tables[prize.PlayMode] = append(tables[prize.PlayMode], prize)
+	}
+	for _, table := range tables {
+		sortPrizes(table)
+	}
+	if err := savePrizeSnapshots(tables); err != nil {
+		return err
+	}
+	rPrizeTables.Lock()
+	prizeTables = tables
+	rPrizeTables.Unlock()
+	return nil
+}
+
+func sortPrizes(table []models.Prize) {
+	sort.Slice(table, func(i, j int) bool {
+		if len(table[i].PrizeKey) != len(table[j].PrizeKey) {
+			return len(table[i].PrizeKey) < len(table[j].PrizeKey)
+		}
+		return table[i].PrizeKey < table[j].PrizeKey
+	})
+}
+
+// validatePrizeTable 校验管理员提交的奖品配置
+func validatePrizeTable(table []models.Prize) error {
+	if len(table) == 0 {
+		return errors.New("Prize table is empty")
+	}
+	seen := make(map[string]bool, len(table))
+	var totalWeight int64
+	for _, prize := range table {
+		if prize.PrizeKey == "" || prize.Name == "" {
+			return errors.New("Prize key and name are required")
+		}
+		if seen[prize.PrizeKey] {
+			return fmt.Errorf("Duplicate prize key %s", prize.PrizeKey)
+		}
+		seen[prize.PrizeKey] = true
+		if !prize.Kind.Valid() {
+			return fmt.Errorf("Invalid prize kind %q", prize.Kind)
+		}
+		if prize.Weight < 0 || prize.Value < 0 || prize.DailyStock < 0 {
+			return fmt.Errorf("Prize %s has negative weight, value or stock", prize.PrizeKey)
+		}
+		if prize.Enabled {
+			totalWeight += prize.Weight
+		}
+	}
+	if totalWeight <= 0 {
+		return errors.New("Prize table has no enabled prize with positive weight")
+	}
+	return nil
+}
+
+func prizeStockKey(playMode, prizeKey string, day time.Time) string {
+	return fmt.Sprintf("prize_stock:%s:%s:%s", playMode, prizeKey, timeutil.DayKey(day, timeutil.DefaultLocation()))
+}
+
+// AdminGetPrizes 查看全部奖品配置及今日已发放数量
+func AdminGetPrizes(c *gin.Context) {
+	rPrizeTables.RLock()
+	tables := prizeTables
+	rPrizeTables.RUnlock()
+
+	type prizeView struct {
+		models.Prize
+		IssuedToday int64 `json:"issued_today"`
+	}
+	now := time.Now()
+	resp := make(map[string][]prizeView, len(tables))
+	for mode, table := range tables {
+		for _, prize := range table {
+			issued, _ := configs.Rdb.Get(c, prizeStockKey(mode, prize.PrizeKey, now)).Int64()
+			resp[mode] = append(resp[mode], prizeView{Prize: prize, IssuedToday: issued})
+		}
+	}
+	errorss.JsonSuccess(c, resp)
+}
+
+// AdminUpdatePrizes 替换某个玩法的全部奖品配置
+func AdminUpdatePrizes(c *gin.Context) {
+	playMode := c.Param("playMode")
+	var input []models.Prize
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err := validatePrizeTable(input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	for i := range input {
+		input[i].ID = 0
+		input[i].PlayMode = playMode
+	}
+
+	err := daos.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("play_mode = ?", playMode).Delete(&models.Prize{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&input).Error
+	})
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if err := LoadPrizeTables(); err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	table, _ := GetPrizeTable(playMode)
+	errorss.JsonSuccess(c, gin.H{"message": "Prize table updated successfully", "prizes": table})
+}
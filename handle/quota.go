@@ -0,0 +1,39 @@
+package handle
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"tbooks/errorss"
+	"tbooks/quota"
+	"tbooks/timeutil"
+	"time"
+)
+
+// quotaLocation 自然日窗口的额度按用户时区计算
+func quotaLocation(policy, userID string) *time.Location {
+	if p, ok := quota.Lookup(policy); ok && p.Window == quota.WindowDay {
+		return userLocation(userID)
+	}
+	return timeutil.DefaultLocation()
+}
+
+// consumeQuota 为用户使用一次额度，额度不足或出错时写入响应并返回 false
+func consumeQuota(c *gin.Context, policy, userID string) (*quota.Result, bool) {
+	result, err := quota.Consume(c, policy, userID, quotaLocation(policy, userID))
+	if errors.Is(err, quota.ErrExceeded) {
+		errorss.HandleError(c, http.StatusTooManyRequests,
+			fmt.Errorf("Quota exceeded, next available at %s", result.NextAt.Format(time.RFC3339)))
+		return nil, false
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return nil, false
+	}
+	return result, true
+}
+
+// checkQuota 查询用户的额度
+func checkQuota(c *gin.Context, policy, userID string) (*quota.Result, error) {
+	return quota.Check(c, policy, userID, quotaLocation(policy, userID))
+}
@@ -0,0 +1,124 @@
+package handle
+
+import (
+	"crypto/subtle"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+	"net/http"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/errorss"
+	"tbooks/referral"
+)
+
+// GetReferralCode 获取用户的推荐码和推荐链接
+func GetReferralCode(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	code, err := referral.GetCode(userID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		errorss.HandleError(c, http.StatusNotFound, errors.New("User not found"))
+		return
+	}
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"code": code.Code, "link": referral.Link(code.Code)})
+}
+
+// ResolveReferralCode 查询推荐码是否有效
+func ResolveReferralCode(c *gin.Context) {
+	inviter, err := referral.Resolve(daos.DB, c.Param("code"))
+	if errors.Is(err, referral.ErrInvalidCode) {
+		errorss.HandleError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{
+		"code":          referral.NormalizeCode(c.Param("code")),
+		"inviter_id":    inviter.UserID,
+		"profile_photo": inviter.ProfilePhoto,
+	})
+}
+
+// attribute 归因并按错误类型返回
+func attribute(c *gin.Context, userID, code string) {
+	result, err := referral.Attribute(c, userID, code)
+	switch {
+	case errors.Is(err, referral.ErrInvalidCode):
+		errorss.HandleError(c, http.StatusNotFound, err)
+	case errors.Is(err, referral.ErrSelfInvite), errors.Is(err, referral.ErrCyclicReferral),
+		errors.Is(err, referral.ErrAlreadyAttributed), errors.Is(err, referral.ErrAttributionExpired):
+		errorss.HandleError(c, http.StatusBadRequest, err)
+	case err != nil:
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+	default:
+		errorss.JsonSuccess(c, result)
+	}
+}
+
+// AttributeReferral 将当前用户归因到推荐码的所有者
+func AttributeReferral(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	var input struct {
+		Code string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid JSON input"))
+		return
+	}
+	attribute(c, userID, input.Code)
+}
+
+// BotAuthMiddleware 机器人调用的接口，请求头格式: Authorization: Bot <机器人令牌>
+func BotAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		botToken := configs.Config().Telegram.BotToken
+		scheme, token, _ := strings.Cut(strings.TrimSpace(c.GetHeader("Authorization")), " ")
+		if botToken == "" || !strings.EqualFold(scheme, "Bot") ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(token)), []byte(botToken)) != 1 {
+			errorss.HandleError(c, http.StatusUnauthorized, errors.New("Invalid bot token"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// BotAttributeReferral 机器人收到 /start <推荐码> 时为 Telegram 用户归因
+func BotAttributeReferral(c *gin.Context) {
+	var input struct {
+		UserID string `json:"user_id" binding:"required"` // Telegram 用户ID
+		Code   string `json:"code" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid JSON input"))
+		return
+	}
+	attribute(c, input.UserID, input.Code)
+}
+
+// GetReferrals 获取用户的邀请树、每一级的人数和累计返佣
+func GetReferrals(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+
+	tree, err := referral.GetTree(userID)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, tree)
+}
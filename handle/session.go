@@ -0,0 +1,414 @@
+package handle
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/redis/go-redis/v9"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/errorss"
+	"tbooks/models"
+	"time"
+)
+
+const (
+	defaultJwtKid     = "default"
+	defaultAccessTTL  = 15 * time.Minute
+	defaultRefreshTTL = 30 * 24 * time.Hour
+)
+
+// ContextSessionKey gin 上下文中保存 JWT 会话信息的键
+const ContextSessionKey = "session_claims"
+
+// SessionClaims access token 的声明
+type SessionClaims struct {
+	jwt.RegisteredClaims
+}
+
+// Session 登录或刷新后返回给客户端的令牌
+type Session struct {
+	AccessToken      string `json:"access_token"`
+	AccessExpiresAt  int64  `json:"access_expires_at"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresAt int64  `json:"refresh_expires_at"`
+}
+
+func refreshTokenKey(token string) string {
+	return "refresh_token:" + token
+}
+
+func userSessionsKey(userID string) string {
+	return "user_sessions:" + userID
+}
+
+func userAccessTokensKey(userID string) string {
+	return "user_access_tokens:" + userID
+}
+
+func revokedJtiKey(jti string) string {
+	return "revoked_jti:" + jti
+}
+
+// jwtKeys 返回所有可用于校验的密钥以及当前签发使用的 kid
+// 未配置 Jwt.Keys 时回退到 JwtSecret
+func jwtKeys() (map[string][]byte, string, error) {
+	cfg := configs.Config()
+	keys := make(map[string][]byte, len(cfg.Jwt.Keys)+1)
+	for kid, secret := range cfg.Jwt.Keys {
+		if secret != "" {
+			keys[kid] = []byte(secret)
+		}
+	}
+	if cfg.JwtSecret != "" {
+		if _, ok := keys[defaultJwtKid]; !ok {
+			keys[defaultJwtKid] = []byte(cfg.JwtSecret)
+		}
+	}
+
+	activeKid := cfg.Jwt.ActiveKid
+	if activeKid == "" {
+		activeKid = defaultJwtKid
+	}
+	if _, ok := keys[activeKid]; !ok {
+		return nil, "", errors.New("JWT signing key is not configured")
+	}
+	return keys, activeKid, nil
+}
+
+func accessTTL() time.Duration {
+	if ttl := configs.Config().Jwt.AccessTTL; ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return defaultAccessTTL
+}
+
+func refreshTTL() time.Duration {
+	if ttl := configs.Config().Jwt.RefreshTTL; ttl > 0 {
+		return time.Duration(ttl) * time.Second
+	}
+	return defaultRefreshTTL
+}
+
+func randomToken(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// saveSessionScript 保存新签发的会话，刷新时同时消费旧的 refresh token，旧 token 已被使用时返回 0
+// KEYS[1] 新 refresh token  KEYS[2] 用户的 refresh token 集合  KEYS[3] 用户未过期的 access token  KEYS[4] 旧 refresh token（仅刷新）
+// ARGV[1] 用户ID  ARGV[2] 新 refresh token  ARGV[3] refresh token 有效期（秒）  ARGV[4] access token 的 jti
+// ARGV[5] access token 过期时间（毫秒）  ARGV[6] 当前时间（毫秒）  ARGV[7] 旧 refresh token
+var saveSessionScript = redis.NewScript(`
+if #KEYS == 4 then
+	if redis.call('GET', KEYS[4]) ~= ARGV[1] then
+		return 0
+	end
+	redis.call('DEL', KEYS[4])
+	redis.call('SREM', KEYS[2], ARGV[7])
+end
+redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[3])
+redis.call('SADD', KEYS[2], ARGV[2])
+redis.call('EXPIRE', KEYS[2], ARGV[3])
+redis.call('ZREMRANGEBYSCORE', KEYS[3], '-inf', ARGV[6])
+redis.call('ZADD', KEYS[3], ARGV[5], ARGV[4])
+local last = redis.call('ZRANGE', KEYS[3], -1, -1, 'WITHSCORES')
+redis.call('PEXPIREAT', KEYS[3], last[2])
+return 1
+`)
+
+// IssueSession 为用户签发 access token 并在 Redis 中保存 refresh token
+func IssueSession(userID string) (*Session, error) {
+	session, _, err := issueSession(userID, "")
+	return session, err
+}
+
+// issueSession 签发会话，oldRefreshToken 不为空时只有该 token 仍属于用户才保存新会话并使其失效
+func issueSession(userID, oldRefreshToken string) (*Session, bool, error) {
+	keys, kid, err := jwtKeys()
+	if err != nil {
+		return nil, false, err
+	}
+	jti, err := randomToken(16)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	accessExpiresAt := now.Add(accessTTL())
+	claims := SessionClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   userID,
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(accessExpiresAt),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
+	accessToken, err := token.SignedString(keys[kid])
+	if err != nil {
+		return nil, false, err
+	}
+
+	refreshToken, err := randomToken(32)
+	if err != nil {
+		return nil, false, err
+	}
+	ttl := refreshTTL()
+	redisKeys := []string{refreshTokenKey(refreshToken), userSessionsKey(userID), userAccessTokensKey(userID)}
+	if oldRefreshToken != "" {
+		redisKeys = append(redisKeys, refreshTokenKey(oldRefreshToken))
+	}
+	saved, err := saveSessionScript.Run(configs.Ctx, configs.Rdb, redisKeys, userID, refreshToken, int64(ttl/time.Second),
+		jti, accessExpiresAt.UnixMilli(), now.UnixMilli(), oldRefreshToken).Int()
+	if err != nil || saved == 0 {
+		return nil, false, err
+	}
+
+	return &Session{
+		AccessToken:      accessToken,
+		AccessExpiresAt:  accessExpiresAt.Unix(),
+		RefreshToken:     refreshToken,
+		RefreshExpiresAt: now.Add(ttl).Unix(),
+	}, true, nil
+}
+
+// ParseAccessToken 校验 access token 的签名、有效期和吊销状态
+func ParseAccessToken(tokenString string) (*SessionClaims, error) {
+	keys, _, err := jwtKeys()
+	if err != nil {
+		return nil, err
+	}
+	var claims SessionClaims
+	_, err = jwt.ParseWithClaims(tokenString, &claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if kid == "" {
+			kid = defaultJwtKid
+		}
+		key, ok := keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		return key, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, errors.New("Invalid access token")
+	}
+	if claims.Subject == "" || claims.ID == "" {
+		return nil, errors.New("Invalid access token")
+	}
+
+	revoked, err := configs.Rdb.Exists(configs.Ctx, revokedJtiKey(claims.ID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if revoked > 0 {
+		return nil, errors.New("Access token revoked")
+	}
+	return &claims, nil
+}
+
+// RevokeAccessToken 将 access token 加入黑名单直到其过期
+func RevokeAccessToken(claims *SessionClaims) error {
+	ttl := time.Until(claims.ExpiresAt.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return configs.Rdb.Set(configs.Ctx, revokedJtiKey(claims.ID), claims.Subject, ttl).Err()
+}
+
+// RevokeRefreshToken 删除属于该用户的单个 refresh token
+func RevokeRefreshToken(userID, refreshToken string) error {
+	removed, err := configs.Rdb.SRem(configs.Ctx, userSessionsKey(userID), refreshToken).Result()
+	if err != nil || removed == 0 {
+		return err
+	}
+	return configs.Rdb.Del(configs.Ctx, refreshTokenKey(refreshToken)).Err()
+}
+
+// revokeAllScript 删除用户的全部 refresh token，并将未过期的 access token 加入黑名单
+// KEYS[1] 用户的 refresh token 集合  KEYS[2] 用户未过期的 access token
+// ARGV[1] 当前时间（毫秒）  ARGV[2] refresh token 键前缀  ARGV[3] 黑名单键前缀  ARGV[4] 用户ID
+var revokeAllScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens = redis.call('SMEMBERS', KEYS[1])
+for _, token in ipairs(tokens) do
+	redis.call('DEL', ARGV[2] .. token)
+end
+local access = redis.call('ZRANGEBYSCORE', KEYS[2], '(' .. now, '+inf', 'WITHSCORES')
+for i = 1, #access, 2 do
+	redis.call('SET', ARGV[3] .. access[i], ARGV[4], 'PX', tonumber(access[i + 1]) - now)
+end
+redis.call('DEL', KEYS[1], KEYS[2])
+return #tokens
+`)
+
+// RevokeAllSessions 删除用户的全部 refresh token，并吊销已签发且未过期的 access token
+func RevokeAllSessions(userID string) error {
+	return revokeAllScript.Run(configs.Ctx, configs.Rdb, []string{userSessionsKey(userID), userAccessTokensKey(userID)},
+		time.Now().UnixMilli(), refreshTokenKey(""), revokedJtiKey(""), userID).Err()
+}
+
+// JwtAuthMiddleware 校验 Bearer access token
+func JwtAuthMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		scheme, token, _ := strings.Cut(strings.TrimSpace(c.GetHeader("Authorization")), " ")
+		if !strings.EqualFold(scheme, "Bearer") || token == "" {
+			errorss.HandleError(c, http.StatusUnauthorized, errors.New("Missing access token"))
+			return
+		}
+		claims, err := ParseAccessToken(strings.TrimSpace(token))
+		if err != nil {
+			errorss.HandleError(c, http.StatusUnauthorized, err)
+			return
+		}
+		c.Set(ContextSessionKey, claims)
+		c.Set(ContextUserIDKey, claims.Subject)
+		c.Next()
+	}
+}
+
+// Login 使用已验证的身份换取会话令牌
+func Login(c *gin.Context) {
+	var input struct {
+		Type     string       `json:"type" binding:"required"` // 身份类型: "telegram", "wallet"
+		InitData string       `json:"init_data"`
+		Wallet   *WalletProof `json:"wallet"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	var userID string
+	switch input.Type {
+	case "telegram":
+		cfg := configs.Config().Telegram
+		user, err := ValidateInitData(input.InitData, cfg.BotToken, time.Duration(cfg.InitDataExpire)*time.Second)
+		if err != nil {
+			errorss.HandleError(c, http.StatusUnauthorized, err)
+			return
+		}
+		userID = strconv.FormatInt(user.ID, 10)
+	case "wallet":
+		// 钱包登录要求地址已经绑定过用户
+		if input.Wallet == nil {
+			errorss.HandleError(c, http.StatusBadRequest, errors.New("Missing wallet proof"))
+			return
+		}
+		address, err := VerifyWalletProof(c, input.Wallet)
+		if err != nil {
+			errorss.HandleError(c, http.StatusUnauthorized, err)
+			return
+		}
+		var wallet models.UserWallet
+		if err := daos.DB.Where("address = ?", address).First(&wallet).Error; err != nil {
+			errorss.HandleError(c, http.StatusNotFound, errors.New("Wallet is not bound to any user"))
+			return
+		}
+		userID = wallet.UserID
+	default:
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Invalid login type"))
+		return
+	}
+
+	session, err := IssueSession(userID)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"user_id": userID, "session": session})
+}
+
+// RefreshSession 使用 refresh token 换取新的会话令牌，旧 refresh token 立即失效
+func RefreshSession(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refresh_token" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	userID, err := configs.Rdb.Get(configs.Ctx, refreshTokenKey(input.RefreshToken)).Result()
+	if err == redis.Nil {
+		errorss.HandleError(c, http.StatusUnauthorized, errors.New("Invalid refresh token"))
+		return
+	} else if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// 新会话保存成功时才消费旧 refresh token，签发失败后客户端仍可重试；并发刷新只有一个成功
+	session, ok, err := issueSession(userID, input.RefreshToken)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	if !ok {
+		errorss.HandleError(c, http.StatusUnauthorized, errors.New("Invalid refresh token"))
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"user_id": userID, "session": session})
+}
+
+// Logout 吊销当前 access token 及 refresh token，all 为 true 时注销全部会话
+func Logout(c *gin.Context) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+		All          bool   `json:"all"`
+	}
+	// 请求体为空时只注销当前会话
+	if err := c.ShouldBindJSON(&input); err != nil && !errors.Is(err, io.EOF) {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	value, ok := c.Get(ContextSessionKey)
+	claims, _ := value.(*SessionClaims)
+	if !ok || claims == nil {
+		errorss.HandleError(c, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+
+	if err := RevokeAccessToken(claims); err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	var err error
+	if input.All {
+		err = RevokeAllSessions(claims.Subject)
+	} else if input.RefreshToken != "" {
+		err = RevokeRefreshToken(claims.Subject, input.RefreshToken)
+	}
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"message": "Logged out successfully"})
+}
+
+// GetSession 返回当前会话信息
+func GetSession(c *gin.Context) {
+	value, _ := c.Get(ContextSessionKey)
+	claims, ok := value.(*SessionClaims)
+	if !ok {
+		errorss.HandleError(c, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{
+		"user_id":    claims.Subject,
+		"issued_at":  claims.IssuedAt.Unix(),
+		"expires_at": claims.ExpiresAt.Unix(),
+	})
+}
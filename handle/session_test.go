@@ -0,0 +1,145 @@
+package handle
+
+import (
+	"encoding/json"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"net/http/httptest"
+	"tbooks/configs/configtest"
+	"testing"
+)
+
+const sessionConfig = "jwtsecret: test-secret\n"
+
+// refresh 调用刷新接口，成功时返回新会话
+func refresh(t *testing.T, refreshToken string) (int, *Session) {
+	t.Helper()
+	code, data := callHandler(t, RefreshSession, "", gin.H{"refresh_token": refreshToken})
+	if code != http.StatusOK {
+		return code, nil
+	}
+	var resp struct {
+		Session Session `json:"session"`
+	}
+	if err := json.Unmarshal(data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	return code, &resp.Session
+}
+
+func TestRefreshSession(t *testing.T) {
+	configtest.Redis(t)
+	configtest.Load(t, sessionConfig)
+	session, err := IssueSession("U")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 签发新会话失败时旧 refresh token 仍然有效
+	configtest.Load(t, "")
+	if code, _ := refresh(t, session.RefreshToken); code != http.StatusInternalServerError {
+		t.Fatalf("refresh without signing key: %d", code)
+	}
+	configtest.Load(t, sessionConfig)
+	code, next := refresh(t, session.RefreshToken)
+	if code != http.StatusOK || next.RefreshToken == session.RefreshToken {
+		t.Fatalf("refresh: %d %+v", code, next)
+	}
+	if _, err := ParseAccessToken(next.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧 refresh token 只能使用一次
+	if code, _ := refresh(t, session.RefreshToken); code != http.StatusUnauthorized {
+		t.Fatalf("reused refresh token: %d", code)
+	}
+	// 并发刷新时只有先保存的一方成功
+	if _, ok, err := issueSession("U", next.RefreshToken); err != nil || !ok {
+		t.Fatalf("first refresh: %v %v", ok, err)
+	}
+	if s, ok, err := issueSession("U", next.RefreshToken); err != nil || ok || s != nil {
+		t.Fatalf("second refresh: %+v %v %v", s, ok, err)
+	}
+	// refresh token 属于其他用户时不能使用
+	other, err := IssueSession("V")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := issueSession("U", other.RefreshToken); err != nil || ok {
+		t.Fatalf("refresh with another user's token: %v %v", ok, err)
+	}
+}
+
+func TestRevokeAllSessions(t *testing.T) {
+	configtest.Redis(t)
+	configtest.Load(t, sessionConfig)
+	var sessions []*Session
+	for i := 0; i < 2; i++ {
+		session, err := IssueSession("U")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, session)
+	}
+	other, err := IssueSession("V")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RevokeAllSessions("U"); err != nil {
+		t.Fatal(err)
+	}
+	for _, session := range sessions {
+		if _, err := ParseAccessToken(session.AccessToken); err == nil {
+			t.Fatal("access token still valid after revoking all sessions")
+		}
+		if code, _ := refresh(t, session.RefreshToken); code != http.StatusUnauthorized {
+			t.Fatalf("refresh after revoking all sessions: %d", code)
+		}
+	}
+	if _, err := ParseAccessToken(other.AccessToken); err != nil {
+		t.Fatalf("other user's session revoked: %v", err)
+	}
+
+	// 注销后重新登录的会话有效
+	session, err := IssueSession("U")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseAccessToken(session.AccessToken); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogoutWithoutBody(t *testing.T) {
+	configtest.Redis(t)
+	configtest.Load(t, sessionConfig)
+	session, err := IssueSession("U")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := ParseAccessToken(session.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 没有请求体时注销当前会话，refresh token 不受影响
+	rec := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(rec)
+	c.Request = httptest.NewRequest("POST", "/", nil)
+	c.Request.Header.Set("Content-Type", "application/json")
+	c.Set(ContextSessionKey, claims)
+	Logout(c)
+	var resp struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Code != http.StatusOK {
+		t.Fatalf("logout: %s", rec.Body.String())
+	}
+	if _, err := ParseAccessToken(session.AccessToken); err == nil {
+		t.Fatal("access token still valid after logout")
+	}
+	if code, _ := refresh(t, session.RefreshToken); code != http.StatusOK {
+		t.Fatalf("refresh after logout: %d", code)
+	}
+}
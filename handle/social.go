@@ -0,0 +1,66 @@
+package handle
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"tbooks/errorss"
+	"tbooks/social"
+)
+
+// SocialAuthorize 获取绑定 Discord 或 X 账号的授权链接
+func SocialAuthorize(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	authURL, err := social.AuthorizeURL(c, userID, c.Param("platform"))
+	if errors.Is(err, social.ErrUnknownPlatform) {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Unsupported platform"))
+		return
+	}
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"url": authURL})
+}
+
+// SocialCallback 平台授权后的回调，绑定社交账号
+func SocialCallback(c *gin.Context) {
+	code, state := c.Query("code"), c.Query("state")
+	if code == "" || state == "" {
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Missing code or state"))
+		return
+	}
+	account, err := social.Link(c, c.Param("platform"), state, code)
+	switch {
+	case errors.Is(err, social.ErrUnknownPlatform):
+		errorss.HandleError(c, http.StatusBadRequest, errors.New("Unsupported platform"))
+		return
+	case errors.Is(err, social.ErrInvalidState):
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	case errors.Is(err, social.ErrAccountTaken), errors.Is(err, social.ErrAccountLocked):
+		errorss.HandleError(c, http.StatusConflict, err)
+		return
+	case err != nil:
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"message": "Account linked successfully", "account": account})
+}
+
+// GetSocialClaims 查看用户社交任务的校验状态
+func GetSocialClaims(c *gin.Context) {
+	userID, ok := GetUserIDFromContext(c)
+	if !ok {
+		return
+	}
+	claims, err := social.Claims(userID)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	errorss.JsonSuccess(c, gin.H{"claims": claims})
+}
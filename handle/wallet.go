@@ -0,0 +1,177 @@
+package handle
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"net/http"
+	"tbooks/configs"
+	"tbooks/errorss"
+	"tbooks/models"
+	"time"
+)
+
+const (
+	ChainEVM = "evm"
+	ChainTON = "ton"
+
+	defaultWalletNonceExpire = 5 * time.Minute
+)
+
+// WalletProof 客户端提交的钱包签名证明
+type WalletProof struct {
+	Chain     string    `json:"chain" binding:"required"`   // 链类型: "evm", "ton"
+	Address   string    `json:"address" binding:"required"` // 钱包地址
+	Nonce     string    `json:"nonce" binding:"required"`   // 服务端下发的挑战
+	Signature string    `json:"signature"`                  // EVM personal_sign 签名
+	TonProof  *TonProof `json:"ton_proof"`                  // TON Connect ton_proof
+}
+
+type walletChallenge struct {
+	Chain   string `json:"chain"`
+	Address string `json:"address"`
+}
+
+// ErrAddressTaken 地址已经绑定了其他用户
+var ErrAddressTaken = errors.New("Address already bound to another user")
+
+func walletNonceKey(nonce string) string {
+	return "wallet_nonce:" + nonce
+}
+
+func walletNonceExpire() time.Duration {
+	if expire := configs.Config().Wallet.NonceExpire; expire > 0 {
+		return time.Duration(expire) * time.Second
+	}
+	return defaultWalletNonceExpire
+}
+
+// NormalizeWalletAddress 按链类型规范化地址
+func NormalizeWalletAddress(chain, address string) (string, error) {
+	switch chain {
+	case ChainEVM:
+		return NormalizeEvmAddress(address)
+	case ChainTON:
+		return NormalizeTonAddress(address)
+	default:
+		return "", errors.New("Unsupported chain")
+	}
+}
+
+// evmSignMessage 生成 EVM 钱包需要签名的消息
+func evmSignMessage(address, nonce string) string {
+	return fmt.Sprintf("%s wants you to verify your wallet.\n\nAddress: %s\nNonce: %s",
+		configs.Config().Wallet.Domain, address, nonce)
+}
+
+// VerifyWalletProof 消费挑战并校验签名，返回规范化后的地址
+func VerifyWalletProof(ctx context.Context, proof *WalletProof) (string, error) {
+	address, err := NormalizeWalletAddress(proof.Chain, proof.Address)
+	if err != nil {
+		return "", err
+	}
+
+	// 挑战只能使用一次
+	data, err := configs.Rdb.GetDel(ctx, walletNonceKey(proof.Nonce)).Result()
+	if err == redis.Nil {
+		return "", errors.New("Invalid or expired nonce")
+	} else if err != nil {
+		return "", err
+	}
+	var challenge walletChallenge
+	if err := json.Unmarshal([]byte(data), &challenge); err != nil {
+		return "", err
+	}
+	if challenge.Chain != proof.Chain || challenge.Address != address {
+		return "", errors.New("Nonce was not issued for this address")
+	}
+
+	switch proof.Chain {
+	case ChainEVM:
+		err = VerifyEvmPersonalSign(address, evmSignMessage(address, proof.Nonce), proof.Signature)
+	case ChainTON:
+		err = VerifyTonProof(ctx, address, proof.TonProof, proof.Nonce, configs.Config().Wallet.Domain, walletNonceExpire())
+	}
+	if err != nil {
+		return "", err
+	}
+	return address, nil
+}
+
+// WalletNonce 下发钱包签名挑战
+func WalletNonce(c *gin.Context) {
+	var input struct {
+		Chain   string `json:"chain" binding:"required"`
+		Address string `json:"address" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+	address, err := NormalizeWalletAddress(input.Chain, input.Address)
+	if err != nil {
+		errorss.HandleError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	nonce, err := randomToken(16)
+	if err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+	data, _ := json.Marshal(walletChallenge{Chain: input.Chain, Address: address})
+	expire := walletNonceExpire()
+	if err := configs.Rdb.Set(c, walletNonceKey(nonce), data, expire).Err(); err != nil {
+		errorss.HandleError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp := gin.H{
+		"chain":      input.Chain,
+		"address":    address,
+		"nonce":      nonce,
+		"expires_at": time.Now().Add(expire).Unix(),
+	}
+	if input.Chain == ChainEVM {
+		resp["message"] = evmSignMessage(address, nonce) // personal_sign 的消息
+	} else {
+		resp["payload"] = nonce // ton_proof 的 payload
+	}
+	errorss.JsonSuccess(c, resp)
+}
+
+// bindWallet 绑定或更换用户的钱包地址，同一地址只能绑定一个用户
+// 不使用 upsert：MySQL 的 ON DUPLICATE KEY UPDATE 在 address 唯一键冲突时同样会更新，会改写其他用户的绑定
+func bindWallet(tx *gorm.DB, userID, chain, address string) error {
+	var owner models.UserWallet
+	err := tx.Where("address = ?", address).First(&owner).Error
+	if err == nil && owner.UserID != userID {
+		return ErrAddressTaken
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	// 启用钱包表之前绑定的地址只记录在用户表中
+	var count int64
+	if err := tx.Model(&models.User{}).Where("address = ? AND user_id <> ?", address, userID).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrAddressTaken
+	}
+
+	var wallet models.UserWallet
+	err = tx.Where("user_id = ?", userID).First(&wallet).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		err = tx.Create(&models.UserWallet{UserID: userID, Chain: chain, Address: address}).Error
+	} else if err == nil {
+		err = tx.Model(&wallet).Updates(models.UserWallet{Chain: chain, Address: address}).Error
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Model(&models.User{}).Where("user_id = ?", userID).Update("address", address).Error
+}
@@ -0,0 +1,84 @@
+package handle
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	"golang.org/x/crypto/sha3"
+	"strings"
+)
+
+func keccak256(data ...[]byte) []byte {
+	h := sha3.NewLegacyKeccak256()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// NormalizeEvmAddress 校验 EVM 地址并转换为 EIP-55 校验和格式
+func NormalizeEvmAddress(address string) (string, error) {
+	raw := strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(address), "0x"), "0X")
+	if len(raw) != 40 {
+		return "", errors.New("Invalid EVM address")
+	}
+	if _, err := hex.DecodeString(raw); err != nil {
+		return "", errors.New("Invalid EVM address")
+	}
+	// 大小写混合的地址必须本身满足校验和
+	lower := strings.ToLower(raw)
+	checksummed := evmChecksum(lower)
+	if raw != lower && raw != strings.ToUpper(raw) && "0x"+raw != checksummed {
+		return "", errors.New("Invalid EVM address checksum")
+	}
+	return checksummed, nil
+}
+
+// evmChecksum 按 EIP-55 规则生成校验和地址
+func evmChecksum(lowerHex string) string {
+	hash := hex.EncodeToString(keccak256([]byte(lowerHex)))
+	out := make([]byte, len(lowerHex))
+	for i := 0; i < len(lowerHex); i++ {
+		ch := lowerHex[i]
+		if ch >= 'a' && ch <= 'f' && hash[i] >= '8' {
+			ch -= 'a' - 'A'
+		}
+		out[i] = ch
+	}
+	return "0x" + string(out)
+}
+
+// VerifyEvmPersonalSign 校验 personal_sign 签名是否由该地址签出
+func VerifyEvmPersonalSign(address, message, signature string) error {
+	sig, err := hex.DecodeString(strings.TrimPrefix(signature, "0x"))
+	if err != nil || len(sig) != 65 {
+		return errors.New("Invalid signature")
+	}
+	// personal_sign 的 v 可能是 27/28 或 0/1
+	v := sig[64]
+	if v >= 27 {
+		v -= 27
+	}
+	if v > 1 {
+		return errors.New("Invalid signature")
+	}
+
+	prefix := fmt.Sprintf("\x19Ethereum Signed Message:\n%d", len(message))
+	hash := keccak256([]byte(prefix), []byte(message))
+
+	// 转换为 [27+recid][R][S] 的紧凑格式
+	compact := make([]byte, 65)
+	compact[0] = 27 + v
+	copy(compact[1:], sig[:64])
+	pubKey, _, err := ecdsa.RecoverCompact(compact, hash)
+	if err != nil {
+		return errors.New("Invalid signature")
+	}
+
+	recovered := evmChecksum(hex.EncodeToString(keccak256(pubKey.SerializeUncompressed()[1:])[12:]))
+	if recovered != address {
+		return errors.New("Signature does not match address")
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package handle
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"gorm.io/gorm"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"testing"
+	"time"
+)
+
+// evmVector eth-account 文档中 personal_sign 的示例签名
+var evmVector = struct{ address, message, signature string }{
+	address:   "0x5ce9454909639D2D17A3F753ce7d93fa0b9aB12E",
+	message:   "I♥SF",
+	signature: "0xe6ca9bba58c88611fad66a6ce8f996908195593807c4b38bd528d2cff09d4eb33e5bfbbf4d3e39b1a2fd816a7680c19ebebaf3a141b239934ad43cb33fcec8ce1c",
+}
+
+func TestVerifyEvmPersonalSign(t *testing.T) {
+	if err := VerifyEvmPersonalSign(evmVector.address, evmVector.message, evmVector.signature); err != nil {
+		t.Fatalf("known-good signature rejected: %v", err)
+	}
+	// v 为 0/1 的格式
+	sig := evmVector.signature[:len(evmVector.signature)-2] + "01"
+	if err := VerifyEvmPersonalSign(evmVector.address, evmVector.message, sig); err != nil {
+		t.Fatalf("signature with v=1 rejected: %v", err)
+	}
+	other, _ := NormalizeEvmAddress("0x0000000000000000000000000000000000000001")
+	cases := []struct{ name, address, message, signature string }{
+		{"other message", evmVector.address, "I♥NY", evmVector.signature},
+		{"other address", other, evmVector.message, evmVector.signature},
+		{"wrong recovery id", evmVector.address, evmVector.message, evmVector.signature[:len(evmVector.signature)-2] + "1b"},
+		{"bad v", evmVector.address, evmVector.message, evmVector.signature[:len(evmVector.signature)-2] + "1d"},
+		{"short", evmVector.address, evmVector.message, evmVector.signature[:20]},
+	}
+	for _, c := range cases {
+		if err := VerifyEvmPersonalSign(c.address, c.message, c.signature); err == nil {
+			t.Errorf("%s: signature accepted", c.name)
+		}
+	}
+}
+
+// fakeTonAccounts 按 raw 地址返回钱包公钥
+type fakeTonAccounts map[string]string
+
+func (f fakeTonAccounts) GetPublicKey(ctx context.Context, rawAddress string) ([]byte, error) {
+	key, ok := f[rawAddress]
+	if !ok {
+		return nil, errors.New("account not found")
+	}
+	return hex.DecodeString(key)
+}
+
+// tonVector 由 tonkeeper/tongo 的 tonconnect.CreateSignedProof 生成，钱包为 RFC 8032 测试密钥的 v4r2 钱包
+const (
+	tonVectorAddress   = "0:cdac97c9162b2e141ad4463828b2a70efdf8762b97e83563f352becf902e88a6"
+	tonVectorPublicKey = "d75a980182b10ab7d54bfed3c964073a0ee172f3daa62325af021a68f707511a"
+)
+
+func tonVectorProof() *TonProof {
+	proof := &TonProof{
+		Timestamp: 1700000000,
+		Payload:   "3f1c9a7e5b2d4c6e",
+		Signature: "/NN0Dqqf1w5FMxV3jpa2P268BDcR523WmfU6jpmEr6rs2py88oJJ6Gbkn2zfVNKFZAl0yE8/VT2Mx/k8SUtnBA==",
+	}
+	proof.Domain.LengthBytes = 14
+	proof.Domain.Value = "tbooks.example"
+	return proof
+}
+
+func TestVerifyTonProof(t *testing.T) {
+	TonAccounts = fakeTonAccounts{tonVectorAddress: tonVectorPublicKey}
+	t.Cleanup(func() { TonAccounts = &TonApiClient{} })
+	ctx := context.Background()
+	address, err := NormalizeTonAddress(tonVectorAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyTonProof(ctx, address, tonVectorProof(), "3f1c9a7e5b2d4c6e", "tbooks.example", 0); err != nil {
+		t.Fatalf("known-good proof rejected: %v", err)
+	}
+
+	cases := []struct {
+		name    string
+		change  func(p *TonProof)
+		payload string
+		domain  string
+		expire  time.Duration
+	}{
+		{"other payload", func(p *TonProof) { p.Payload = "3f1c9a7e5b2d4c6f" }, "3f1c9a7e5b2d4c6f", "tbooks.example", 0},
+		{"payload not issued", nil, "other", "tbooks.example", 0},
+		{"other domain", func(p *TonProof) { p.Domain.Value = "evil.example" }, "3f1c9a7e5b2d4c6e", "", 0},
+		{"domain mismatch", nil, "3f1c9a7e5b2d4c6e", "evil.example", 0},
+		{"other timestamp", func(p *TonProof) { p.Timestamp++ }, "3f1c9a7e5b2d4c6e", "tbooks.example", 0},
+		{"expired", nil, "3f1c9a7e5b2d4c6e", "tbooks.example", time.Minute},
+		{"bad signature", func(p *TonProof) { p.Signature = "AAAA" }, "3f1c9a7e5b2d4c6e", "tbooks.example", 0},
+	}
+	for _, c := range cases {
+		proof := tonVectorProof()
+		if c.change != nil {
+			c.change(proof)
+		}
+		if err := VerifyTonProof(ctx, address, proof, c.payload, c.domain, c.expire); err == nil {
+			t.Errorf("%s: proof accepted", c.name)
+		}
+	}
+
+	// 同一公钥在其他 workchain 的钱包不能使用这份证明
+	other, _ := NormalizeTonAddress("-1:" + tonVectorAddress[2:])
+	TonAccounts = fakeTonAccounts{"-1:" + tonVectorAddress[2:]: tonVectorPublicKey}
+	if err := VerifyTonProof(ctx, other, tonVectorProof(), "3f1c9a7e5b2d4c6e", "tbooks.example", 0); err == nil {
+		t.Error("proof accepted for another workchain")
+	}
+	if err := VerifyTonProof(ctx, address, nil, "3f1c9a7e5b2d4c6e", "tbooks.example", 0); err == nil {
+		t.Error("missing proof accepted")
+	}
+}
+
+func TestBindWallet(t *testing.T) {
+	daostest.Open(t)
+	for _, userID := range []string{"1", "2"} {
+		if err := daos.DB.Create(&models.User{UserID: userID}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	bind := func(userID, address string) error {
+		return bindWallet(daos.DB, userID, ChainEVM, address)
+	}
+	if err := bind("1", "0xA"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复绑定和更换地址
+	if err := bind("1", "0xA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bind("1", "0xB"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bind("2", "0xB"); !errors.Is(err, ErrAddressTaken) {
+		t.Fatalf("bound another user's address: %v", err)
+	}
+	// 旧地址释放后可以被其他用户绑定
+	if err := bind("2", "0xA"); err != nil {
+		t.Fatal(err)
+	}
+	// 只记录在用户表中的旧绑定同样占用地址
+	daos.DB.Model(&models.User{}).Where("user_id = ?", "2").Update("address", "0xLegacy")
+	if err := bind("1", "0xLegacy"); !errors.Is(err, ErrAddressTaken) {
+		t.Fatalf("bound a legacy address: %v", err)
+	}
+
+	var wallets []models.UserWallet
+	daos.DB.Order("user_id").Find(&wallets)
+	if len(wallets) != 2 || wallets[0].Address != "0xB" || wallets[1].Address != "0xA" {
+		t.Fatalf("wallets %+v", wallets)
+	}
+	var user models.User
+	daos.DB.Where("user_id = ?", "1").First(&user)
+	if user.Address != "0xB" {
+		t.Fatalf("user address %s", user.Address)
+	}
+
+	// 并发插入同一地址时唯一索引拒绝
+	err := daos.DB.Create(&models.UserWallet{UserID: "3", Chain: ChainEVM, Address: "0xB"}).Error
+	if !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Fatalf("duplicate address inserted: %v", err)
+	}
+}
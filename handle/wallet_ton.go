@@ -0,0 +1,206 @@
+package handle
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"time"
+)
+
+// TonAccountClient 查询 TON 链上账户信息
+type TonAccountClient interface {
+	GetPublicKey(ctx context.Context, rawAddress string) ([]byte, error)
+}
+
+// TonAccounts 默认使用 tonapi 兼容接口，测试时可以替换
+var TonAccounts TonAccountClient = &TonApiClient{}
+
+// TonApiClient tonapi 兼容接口客户端
+type TonApiClient struct {
+	HTTPClient *http.Client
+}
+
+func (t *TonApiClient) do(ctx context.Context, path string, out interface{}) error {
+	cfg := configs.Config().Ton
+	if cfg.ApiURL == "" {
+		return errors.New("TON api url is not configured")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(cfg.ApiURL, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if cfg.ApiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.ApiKey)
+	}
+	client := t.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ton api %s: status %d", path, resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// GetPublicKey 查询已部署钱包合约的公钥
+func (t *TonApiClient) GetPublicKey(ctx context.Context, rawAddress string) ([]byte, error) {
+	var out struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := t.do(ctx, "/v2/accounts/"+url.PathEscape(rawAddress)+"/publickey", &out); err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(out.PublicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, errors.New("Invalid wallet public key")
+	}
+	return key, nil
+}
+
+// TonAddress 解析后的 TON 地址
+type TonAddress struct {
+	Workchain int32
+	Hash      []byte
+}
+
+// Raw 返回 "workchain:hex" 格式
+func (a TonAddress) Raw() string {
+	return fmt.Sprintf("%d:%s", a.Workchain, hex.EncodeToString(a.Hash))
+}
+
+// Friendly 返回带 CRC16 校验的 bounceable url-safe 格式
+func (a TonAddress) Friendly() string {
+	buf := make([]byte, 36)
+	buf[0] = 0x11
+	buf[1] = byte(int8(a.Workchain))
+	copy(buf[2:34], a.Hash)
+	binary.BigEndian.PutUint16(buf[34:], crc16(buf[:34]))
+	return base64.URLEncoding.EncodeToString(buf)
+}
+
+// ParseTonAddress 解析 raw 或 user-friendly 格式的 TON 地址
+func ParseTonAddress(address string) (TonAddress, error) {
+	address = strings.TrimSpace(address)
+	if wc, hash, ok := strings.Cut(address, ":"); ok {
+		workchain, err := strconv.ParseInt(wc, 10, 32)
+		if err != nil {
+			return TonAddress{}, errors.New("Invalid TON address")
+		}
+		raw, err := hex.DecodeString(hash)
+		if err != nil || len(raw) != 32 {
+			return TonAddress{}, errors.New("Invalid TON address")
+		}
+		return TonAddress{Workchain: int32(workchain), Hash: raw}, nil
+	}
+
+	if len(address) != 48 {
+		return TonAddress{}, errors.New("Invalid TON address")
+	}
+	buf, err := base64.URLEncoding.DecodeString(strings.NewReplacer("+", "-", "/", "_").Replace(address))
+	if err != nil || len(buf) != 36 {
+		return TonAddress{}, errors.New("Invalid TON address")
+	}
+	if crc16(buf[:34]) != binary.BigEndian.Uint16(buf[34:]) {
+		return TonAddress{}, errors.New("Invalid TON address checksum")
+	}
+	return TonAddress{Workchain: int32(int8(buf[1])), Hash: buf[2:34]}, nil
+}
+
+// NormalizeTonAddress 校验 TON 地址并转换为统一的 user-friendly 格式
+func NormalizeTonAddress(address string) (string, error) {
+	addr, err := ParseTonAddress(address)
+	if err != nil {
+		return "", err
+	}
+	return addr.Friendly(), nil
+}
+
+// crc16 CRC-16/XMODEM
+func crc16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b) << 8
+		for i := 0; i < 8; i++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// TonProof TON Connect 返回的 ton_proof
+type TonProof struct {
+	Timestamp int64 `json:"timestamp"`
+	Domain    struct {
+		LengthBytes uint32 `json:"lengthBytes"`
+		Value       string `json:"value"`
+	} `json:"domain"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"` // base64
+}
+
+// VerifyTonProof 校验 ton_proof 签名
+// 参考 https://docs.ton.org/develop/dapps/ton-connect/sign
+func VerifyTonProof(ctx context.Context, address string, proof *TonProof, payload, domain string, expire time.Duration) error {
+	if proof == nil {
+		return errors.New("Missing ton_proof")
+	}
+	addr, err := ParseTonAddress(address)
+	if err != nil {
+		return err
+	}
+	if proof.Payload != payload {
+		return errors.New("Proof payload mismatch")
+	}
+	if domain != "" && proof.Domain.Value != domain {
+		return errors.New("Proof domain mismatch")
+	}
+	if expire > 0 && time.Since(time.Unix(proof.Timestamp, 0)) > expire {
+		return errors.New("Proof expired")
+	}
+	signature, err := base64.StdEncoding.DecodeString(proof.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return errors.New("Invalid signature")
+	}
+
+	msg := []byte("ton-proof-item-v2/")
+	msg = binary.BigEndian.AppendUint32(msg, uint32(addr.Workchain))
+	msg = append(msg, addr.Hash...)
+	msg = binary.LittleEndian.AppendUint32(msg, uint32(len(proof.Domain.Value)))
+	msg = append(msg, proof.Domain.Value...)
+	msg = binary.LittleEndian.AppendUint64(msg, uint64(proof.Timestamp))
+	msg = append(msg, proof.Payload...)
+	msgHash := sha256.Sum256(msg)
+
+	full := append([]byte{0xff, 0xff}, "ton-connect"...)
+	full = append(full, msgHash[:]...)
+	fullHash := sha256.Sum256(full)
+
+	publicKey, err := TonAccounts.GetPublicKey(ctx, addr.Raw())
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(publicKey, fullHash[:], signature) {
+		return errors.New("Signature does not match address")
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/bsm/redislock"
+	"github.com/redis/go-redis/v9"
+	"os"
+	"sync"
+	"tbooks/configs"
+	"time"
+)
+
+// 多个实例同时运行时，每个非本地任务由持有对应 redislock 的实例执行
+// 持有者定期续期，续期失败或实例退出时停止执行并释放锁，由其他实例接管
+
+const (
+	// lockPrefix 任务锁的键前缀
+	lockPrefix = "job_lock:"
+	// tokenBytes 锁令牌的随机字节数，锁的值为十六进制令牌加实例标识
+	tokenBytes = 16
+)
+
+// 锁的有效期和续期间隔，测试时可以替换
+var (
+	// lockTTL 任务锁的有效期，持有者崩溃后最多经过该时间由其他实例接管
+	lockTTL = 15 * time.Second
+	// refreshInterval 续期和争抢锁的间隔
+	refreshInterval = lockTTL / 3
+)
+
+// Job 定时任务
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+	// Local 为 true 时每个实例都运行，例如刷新本实例的内存缓存
+	Local bool
+}
+
+// runner 运行中的任务及其在本实例的状态
+type runner struct {
+	Job
+	instance  string // 写入锁的实例标识
+	mu        sync.Mutex
+	leader    bool
+	lastRunAt time.Time
+	lastErr   string
+}
+
+var (
+	instanceID = newInstanceID()
+	rJobs      sync.Mutex
+	runners    []*runner
+	stopJobs   context.CancelFunc
+	wg         sync.WaitGroup
+)
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(buf))
+}
+
+// InstanceID 本实例的标识
+func InstanceID() string {
+	return instanceID
+}
+
+// Register 注册任务，需在 Start 之前调用
+func Register(job Job) {
+	rJobs.Lock()
+	defer rJobs.Unlock()
+	runners = append(runners, &runner{Job: job, instance: instanceID})
+}
+
+// Start 启动所有已注册的任务，ctx 取消或调用 Stop 后停止
+func Start(ctx context.Context) {
+	rJobs.Lock()
+	defer rJobs.Unlock()
+	ctx, stopJobs = context.WithCancel(ctx)
+	for _, r := range runners {
+		wg.Add(1)
+		go func(r *runner) {
+			defer wg.Done()
+			if r.Local {
+				r.loop(ctx)
+			} else {
+				r.lead(ctx)
+			}
+		}(r)
+	}
+	logs.Info("Jobs started on instance %s", instanceID)
+}
+
+// Stop 停止所有任务并释放持有的锁，使其他实例立即接管
+func Stop() {
+	rJobs.Lock()
+	cancel := stopJobs
+	rJobs.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	wg.Wait()
+}
+
+// lead 争抢任务锁，抢到后运行任务直到失去锁或停止
+func (r *runner) lead(ctx context.Context) {
+	for ctx.Err() == nil {
+		lock, err := configs.Locker.Obtain(ctx, lockPrefix+r.Name, lockTTL, &redislock.Options{
+			Token:    newToken(),
+			Metadata: r.instance,
+		})
+		if err == nil {
+			logs.Debug("Job %s acquired by %s", r.Name, r.instance)
+			r.runAsLeader(ctx, lock)
+			logs.Debug("Job %s released by %s", r.Name, r.instance)
+		} else if !errors.Is(err, redislock.ErrNotObtained) && ctx.Err() == nil {
+			logs.Error("Failed to obtain lock for job %s: %v", r.Name, err)
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(refreshInterval):
+		}
+	}
+}
+
+// runAsLeader 持有锁期间运行任务并定期续期
+func (r *runner) runAsLeader(ctx context.Context, lock *redislock.Lock) {
+	jobCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	r.setLeader(true)
+	defer r.setLeader(false)
+
+	refreshed := make(chan struct{})
+	go func() {
+		defer close(refreshed)
+		// 续期失败说明锁已过期或被其他实例持有，停止运行
+		defer cancel()
+		ticker := time.NewTicker(refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-jobCtx.Done():
+				return
+			case <-ticker.C:
+				if err := lock.Refresh(jobCtx, lockTTL, nil); err != nil {
+					if jobCtx.Err() == nil {
+						logs.Error("Lost lock for job %s: %v", r.Name, err)
+					}
+					return
+				}
+			}
+		}
+	}()
+
+	r.loop(jobCtx)
+	<-refreshed
+
+	releaseCtx, cancelRelease := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelRelease()
+	if err := lock.Release(releaseCtx); err != nil && !errors.Is(err, redislock.ErrLockNotHeld) {
+		logs.Error("Failed to release lock for job %s: %v", r.Name, err)
+	}
+}
+
+// loop 按间隔运行任务直到 ctx 取消
+func (r *runner) loop(ctx context.Context) {
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := r.Run(ctx)
+			if err != nil && ctx.Err() == nil {
+				logs.Error("Job %s failed: %v", r.Name, err)
+			}
+			r.mu.Lock()
+			r.lastRunAt = time.Now()
+			r.lastErr = ""
+			if err != nil {
+				r.lastErr = err.Error()
+			}
+			r.mu.Unlock()
+		}
+	}
+}
+
+func (r *runner) setLeader(leader bool) {
+	r.mu.Lock()
+	r.leader = leader
+	r.mu.Unlock()
+}
+
+func newToken() string {
+	buf := make([]byte, tokenBytes)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Status 任务状态
+type Status struct {
+	Name      string    `json:"name"`
+	Local     bool      `json:"local"`       // 每个实例都运行
+	Owner     string    `json:"owner"`       // 当前持有任务锁的实例，本地任务和无人持有时为空
+	Running   bool      `json:"running"`     // 本实例是否在运行该任务
+	LastRunAt time.Time `json:"last_run_at"` // 本实例最近一次运行时间
+	LastError string    `json:"last_error"`  // 本实例最近一次运行的错误
+}
+
+// Statuses 返回所有任务的持有者和本实例的运行状态
+func Statuses(ctx context.Context) ([]Status, error) {
+	rJobs.Lock()
+	list := append([]*runner(nil), runners...)
+	rJobs.Unlock()
+
+	statuses := make([]Status, 0, len(list))
+	for _, r := range list {
+		r.mu.Lock()
+		status := Status{
+			Name:      r.Name,
+			Local:     r.Local,
+			Running:   r.Local || r.leader,
+			LastRunAt: r.lastRunAt,
+			LastError: r.lastErr,
+		}
+		r.mu.Unlock()
+		if !r.Local {
+			value, err := configs.Rdb.Get(ctx, lockPrefix+r.Name).Result()
+			if err != nil && err != redis.Nil {
+				return nil, err
+			}
+			if len(value) > tokenBytes*2 {
+				status.Owner = value[tokenBytes*2:]
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
@@ -0,0 +1,169 @@
+package jobs
+
+import (
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/bsm/redislock"
+	"sync/atomic"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"testing"
+	"time"
+)
+
+func setup(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := configtest.Redis(t)
+	ttl, interval := lockTTL, refreshInterval
+	lockTTL, refreshInterval = time.Second, 20*time.Millisecond
+	t.Cleanup(func() { lockTTL, refreshInterval = ttl, interval })
+	return mr
+}
+
+// instance 模拟一个实例上运行的同名任务
+type instance struct {
+	r      *runner
+	runs   atomic.Int64
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func start(name, id string) *instance {
+	in := &instance{done: make(chan struct{})}
+	in.r = &runner{Job: Job{Name: name, Interval: 5 * time.Millisecond, Run: func(ctx context.Context) error {
+		in.runs.Add(1)
+		return nil
+	}}, instance: id}
+	ctx, cancel := context.WithCancel(context.Background())
+	in.cancel = cancel
+	go func() {
+		defer close(in.done)
+		in.r.lead(ctx)
+	}()
+	return in
+}
+
+// stop 与 Stop 一样停止任务并释放锁
+func (in *instance) stop() {
+	in.cancel()
+	<-in.done
+}
+
+func (in *instance) leader() bool {
+	in.r.mu.Lock()
+	defer in.r.mu.Unlock()
+	return in.r.leader
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// useRunners 替换已注册的任务，测试结束时恢复
+func useRunners(t *testing.T, list ...*runner) {
+	t.Helper()
+	rJobs.Lock()
+	old := runners
+	runners = list
+	rJobs.Unlock()
+	t.Cleanup(func() {
+		rJobs.Lock()
+		runners = old
+		rJobs.Unlock()
+	})
+}
+
+func owner(t *testing.T) string {
+	t.Helper()
+	statuses, err := Statuses(context.Background())
+	if err != nil || len(statuses) != 1 {
+		t.Fatalf("statuses %+v %v", statuses, err)
+	}
+	return statuses[0].Owner
+}
+
+func TestSingleLeader(t *testing.T) {
+	setup(t)
+	useRunners(t)
+	var runs atomic.Int64
+	Register(Job{Name: "sync", Interval: 5 * time.Millisecond, Run: func(ctx context.Context) error {
+		runs.Add(1)
+		return nil
+	}})
+	Start(context.Background())
+	defer Stop()
+	waitFor(t, "this instance to lead", func() bool { return runs.Load() > 0 })
+
+	// 另一个实例拿不到锁，不运行任务
+	other := start("sync", "other")
+	defer other.stop()
+	waitFor(t, "more runs", func() bool { return runs.Load() >= 5 })
+	if other.leader() || other.runs.Load() != 0 {
+		t.Fatalf("other instance ran %d times", other.runs.Load())
+	}
+	if got := owner(t); got != InstanceID() {
+		t.Fatalf("owner %q, want %q", got, InstanceID())
+	}
+
+	// Stop 释放锁，另一个实例立即接管
+	Stop()
+	stopped := runs.Load()
+	waitFor(t, "failover", func() bool { return other.leader() && other.runs.Load() > 0 })
+	if got := owner(t); got != "other" {
+		t.Fatalf("owner %q after stop, want other", got)
+	}
+	statuses, _ := Statuses(context.Background())
+	if statuses[0].Running {
+		t.Fatal("stopped instance still reported as running")
+	}
+	if runs.Load() != stopped {
+		t.Fatal("stopped instance kept running")
+	}
+}
+
+func TestFailoverAfterExpiry(t *testing.T) {
+	mr := setup(t)
+	// 持有锁的实例崩溃，没有释放锁
+	_, err := configs.Locker.Obtain(context.Background(), lockPrefix+"sync", lockTTL, &redislock.Options{Token: newToken(), Metadata: "crashed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := start("sync", "b")
+	defer b.stop()
+	useRunners(t, b.r)
+
+	time.Sleep(5 * refreshInterval)
+	if b.leader() || b.runs.Load() != 0 {
+		t.Fatal("job ran while another instance held the lock")
+	}
+	if got := owner(t); got != "crashed" {
+		t.Fatalf("owner %q, want crashed", got)
+	}
+	statuses, _ := Statuses(context.Background())
+	if statuses[0].Running {
+		t.Fatal("status reports the job running on a follower")
+	}
+
+	// 锁过期后接管
+	mr.FastForward(lockTTL)
+	waitFor(t, "takeover", func() bool { return b.leader() && b.runs.Load() > 0 })
+	if got := owner(t); got != "b" {
+		t.Fatalf("owner %q after expiry, want b", got)
+	}
+	statuses, _ = Statuses(context.Background())
+	if !statuses[0].Running || statuses[0].LastRunAt.IsZero() {
+		t.Fatalf("status %+v", statuses[0])
+	}
+
+	b.stop()
+	if got := owner(t); got != "" {
+		t.Fatalf("owner %q after stop, want none", got)
+	}
+}
@@ -0,0 +1,476 @@
+package ledger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strconv"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/models"
+	"time"
+)
+
+// Reason 余额变动原因代码
+type Reason string
+
+const (
+	ReasonDrawPrize          Reason = "draw_prize"          // 抽奖中奖
+	ReasonTaskReward         Reason = "task_reward"         // 社交任务奖励
+	ReasonAchievementReward  Reason = "achievement_reward"  // 成就奖励
+	ReasonRewardRevoked      Reason = "reward_revoked"      // 撤回任务奖励
+	ReasonReferralCommission Reason = "referral_commission" // 邀请返佣
+	ReasonCommissionReversed Reason = "commission_reversed" // 奖励撤回后收回的返佣
+	ReasonCardPurchase       Reason = "card_purchase"       // 购买抽奖卡
+	ReasonCardRefund         Reason = "card_refund"         // 抽奖卡发放失败退回的余额
+	ReasonOpeningBalance     Reason = "opening_balance"     // 启用账本前的历史余额
+	ReasonAdjustment         Reason = "adjustment"          // 人工调整
+	ReasonOrderPurchase      Reason = "order_purchase"      // 付款订单发放的积分
+	ReasonOrderRefund        Reason = "order_refund"        // 订单退款收回的积分
+)
+
+const (
+	// QueueKey Redis 中等待写入 MySQL 账本的余额变动
+	QueueKey = "ledger_queue"
+	// batchSize 每批写入的事件数
+	batchSize = 200
+	// txKeyExpire Redis 中交易幂等键的有效期
+	txKeyExpire = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInsufficientBalance = errors.New("Insufficient balance")
+	ErrBalanceNotLoaded    = errors.New("User balance is not loaded")
+)
+
+// UserAccount 用户账户名
+func UserAccount(userID string) string {
+	return "user:" + userID
+}
+
+// CounterAccount 每种原因对应的系统对手账户
+func CounterAccount(reason Reason) string {
+	switch reason {
+	case ReasonDrawPrize:
+		return "system:draw_prizes"
+	case ReasonTaskReward, ReasonAchievementReward, ReasonRewardRevoked, ReasonReferralCommission, ReasonCommissionReversed:
+		return "system:rewards"
+	case ReasonCardPurchase, ReasonCardRefund:
+		return "system:card_sales"
+	case ReasonOrderPurchase, ReasonOrderRefund:
+		return "system:order_sales"
+	default:
+		return "system:equity"
+	}
+}
+
+// BalanceKey Redis 中用户余额的键，值为最小单位的整数
+func BalanceKey(userID string) string {
+	return userID + "_balance_minor"
+}
+
+// legacyBalanceKey 定点金额之前以浮点数保存余额的键
+func legacyBalanceKey(userID string) string {
+	return userID + "_balance"
+}
+
+// LuaAmountFunc Redis 脚本中处理金额的函数
+// integer 将整数格式化为不带指数的字符串，Lua 数字直接转为字符串时大数会变成科学计数法
+// amount 将最小单位整数格式化为十进制金额，与 models.Amount 的 JSON 格式一致，传入字符串时不经过浮点运算
+const LuaAmountFunc = `
+local function integer(v)
+	if type(v) == 'string' then
+		return v
+	end
+	return string.format('%d', v)
+end
+
+local function amount(v)
+	v = integer(v)
+	local sign = ''
+	if string.sub(v, 1, 1) == '-' then
+		sign = '-'
+		v = string.sub(v, 2)
+	end
+	v = string.rep('0', 3 - #v) .. v
+	return sign .. string.sub(v, 1, -3) .. '.' .. string.sub(v, -2)
+end
+`
+
+// TxID 生成交易ID，传入业务ID时同一业务只会入账一次
+func TxID(userID string, reason Reason, refID string) string {
+	if refID == "" {
+		buf := make([]byte, 12)
+		_, _ = rand.Read(buf)
+		refID = hex.EncodeToString(buf)
+	}
+	return string(reason) + ":" + userID + ":" + refID
+}
+
+// Event 余额变动事件，由 Redis 脚本写入队列后异步记账
+type Event struct {
+	TxID         string        `json:"tx_id"`
+	UserID       string        `json:"user_id"`
+	Amount       models.Amount `json:"amount"`
+	Reason       Reason        `json:"reason"`
+	RefID        string        `json:"ref_id"`
+	BalanceAfter models.Amount `json:"balance_after"`
+	Time         int64         `json:"time"`
+}
+
+// postScript 原子地检查余额、变更余额并写入账本事件
+// KEYS[1] 用户余额  KEYS[2] 账本队列  KEYS[3] 交易幂等键
+// ARGV[1] 金额（最小单位）  ARGV[2] 交易ID  ARGV[3] 用户ID  ARGV[4] 原因  ARGV[5] 业务ID  ARGV[6] 时间戳  ARGV[7] 幂等键有效期
+var postScript = redis.NewScript(LuaAmountFunc + `
+local balance = redis.call('GET', KEYS[1])
+if not balance then
+	return {0}
+end
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return {2, balance}
+end
+local delta = tonumber(ARGV[1])
+if delta < 0 and tonumber(balance) + delta < 0 then
+	return {-1, balance}
+end
+balance = integer(redis.call('INCRBY', KEYS[1], ARGV[1]))
+redis.call('SET', KEYS[3], 1, 'EX', ARGV[7])
+redis.call('RPUSH', KEYS[2], cjson.encode({tx_id = ARGV[2], user_id = ARGV[3], amount = amount(ARGV[1]), reason = ARGV[4],
+	ref_id = ARGV[5], balance_after = amount(balance), time = tonumber(ARGV[6])}))
+return {1, balance}
+`)
+
+// Post 变更用户余额并记账，amount 为负时要求余额充足
+// refID 非空时同一用户、原因和业务ID只会入账一次，重复调用返回当前余额
+func Post(ctx context.Context, userID string, amount models.Amount, reason Reason, refID string) (models.Amount, error) {
+	txID := TxID(userID, reason, refID)
+	for i := 0; i < 2; i++ {
+		res, err := postScript.Run(ctx, configs.Rdb,
+			[]string{BalanceKey(userID), QueueKey, "ledger_tx:" + txID},
+			int64(amount), txID, userID, string(reason), refID, time.Now().Unix(), int64(txKeyExpire/time.Second)).Slice()
+		if err != nil {
+			return 0, err
+		}
+		if res[0].(int64) == 0 {
+			if err := loadBalance(ctx, userID); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		v, err := strconv.ParseInt(res[1].(string), 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		balance := models.Amount(v)
+		if res[0].(int64) == -1 {
+			return balance, ErrInsufficientBalance
+		}
+		return balance, nil
+	}
+	return 0, ErrBalanceNotLoaded
+}
+
+// Credit 增加用户余额
+func Credit(ctx context.Context, userID string, amount models.Amount, reason Reason, refID string) (models.Amount, error) {
+	return Post(ctx, userID, amount, reason, refID)
+}
+
+// Debit 扣减用户余额，余额不足时返回 ErrInsufficientBalance
+func Debit(ctx context.Context, userID string, amount models.Amount, reason Reason, refID string) (models.Amount, error) {
+	return Post(ctx, userID, -amount, reason, refID)
+}
+
+// loadBalance Redis 中没有余额时从 MySQL 加载
+func loadBalance(ctx context.Context, userID string) error {
+	var user models.User
+	if err := daos.DB.Where("user_id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+	return configs.Rdb.SetNX(ctx, BalanceKey(userID), int64(user.Balance), 0).Err()
+}
+
+// apply 在一个数据库事务中写入交易的两条分录并更新用户余额缓存
+func apply(event Event) error {
+	createdAt := time.Unix(event.Time, 0)
+	return daos.DB.Transaction(func(tx *gorm.DB) error {
+		entries := []models.LedgerEntry{
+			{TxID: event.TxID, Account: UserAccount(event.UserID), Amount: event.Amount, Reason: string(event.Reason),
+				RefID: event.RefID, BalanceAfter: event.BalanceAfter, CreatedAt: createdAt},
+			{TxID: event.TxID, Account: CounterAccount(event.Reason), Amount: -event.Amount, Reason: string(event.Reason),
+				RefID: event.RefID, CreatedAt: createdAt},
+		}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&entries)
+		if result.Error != nil {
+			return result.Error
+		}
+		// 已经入账过的交易不再重复更新余额
+		if result.RowsAffected == 0 {
+			return nil
+		}
+		return tx.Model(&models.User{}).Where("user_id = ?", event.UserID).
+			Update("balance", gorm.Expr("balance + ?", event.Amount)).Error
+	})
+}
+
+// Flush 将队列中的余额变动写入 MySQL 账本，返回处理的事件数
+func Flush(ctx context.Context) (int, error) {
+	flushed := 0
+	for {
+		items, err := daos.PeekQueue(ctx, QueueKey, batchSize)
+		if err != nil || len(items) == 0 {
+			return flushed, err
+		}
+		for i, item := range items {
+			var event Event
+			if err := json.Unmarshal([]byte(item), &event); err != nil {
+				logs.Error("Failed to decode ledger event:", err, item)
+				continue
+			}
+			if err := apply(event); err != nil {
+				// 只确认已经入账的部分
+				if ackErr := daos.AckQueue(ctx, QueueKey, items[:i]); ackErr != nil {
+					logs.Error("Failed to ack ledger events:", ackErr)
+				}
+				return flushed, err
+			}
+			flushed++
+		}
+		if err := daos.AckQueue(ctx, QueueKey, items); err != nil {
+			return flushed, err
+		}
+		if len(items) < batchSize {
+			return flushed, nil
+		}
+	}
+}
+
+// Mismatch 对账不一致的用户
+type Mismatch struct {
+	UserID    string         `json:"user_id"`
+	Balance   models.Amount  `json:"balance"`    // MySQL 中的用户余额
+	LedgerSum models.Amount  `json:"ledger_sum"` // 账本分录之和
+	Cached    *models.Amount `json:"cached"`     // Redis 中的余额扣除尚未入账的变动，未加载到 Redis 时为空
+}
+
+// Report 对账结果
+type Report struct {
+	CheckedAt  time.Time     `json:"checked_at"`
+	TotalSum   models.Amount `json:"total_sum"` // 所有分录之和，复式记账下应为 0
+	Mismatches []Mismatch    `json:"mismatches"`
+}
+
+// reconcileBatch 每批核对的用户数
+const reconcileBatch = 500
+
+// Reconcile 核对每个用户的账本分录之和与 MySQL 余额、Redis 余额是否一致
+// Redis 余额包含队列中尚未写入账本的变动，核对前先扣除
+func Reconcile(ctx context.Context) (*Report, error) {
+	report := &Report{CheckedAt: time.Now(), Mismatches: []Mismatch{}}
+	if err := daos.DB.Model(&models.LedgerEntry{}).
+		Select("COALESCE(SUM(amount), 0)").Scan(&report.TotalSum).Error; err != nil {
+		return nil, err
+	}
+	var users []models.User
+	err := daos.DB.Select("id", "user_id", "balance").FindInBatches(&users, reconcileBatch, func(tx *gorm.DB, batch int) error {
+		mismatches, err := reconcileUsers(ctx, users)
+		report.Mismatches = append(report.Mismatches, mismatches...)
+		return err
+	}).Error
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// reconcileUsers 核对一批用户
+func reconcileUsers(ctx context.Context, users []models.User) ([]Mismatch, error) {
+	keys := make([]string, len(users))
+	accounts := make([]string, len(users))
+	for i, user := range users {
+		keys[i] = BalanceKey(user.UserID)
+		accounts[i] = UserAccount(user.UserID)
+	}
+	// 余额与队列在同一个事务中读取，先于账本读取，读取期间写入账本的变动在下面按交易ID排除
+	var balances *redis.SliceCmd
+	var queue *redis.StringSliceCmd
+	if _, err := configs.Rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		balances = pipe.MGet(ctx, keys...)
+		queue = pipe.LRange(ctx, QueueKey, 0, -1)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	var sums []struct {
+		Account string
+		Total   models.Amount
+	}
+	if err := daos.DB.Model(&models.LedgerEntry{}).Select("account, SUM(amount) AS total").
+		Where("account IN ?", accounts).Group("account").Scan(&sums).Error; err != nil {
+		return nil, err
+	}
+	ledgerSums := make(map[string]models.Amount, len(sums))
+	for _, sum := range sums {
+		ledgerSums[sum.Account] = sum.Total
+	}
+
+	pending, err := pendingAmounts(queue.Val(), accounts)
+	if err != nil {
+		return nil, err
+	}
+
+	var mismatches []Mismatch
+	for i, user := range users {
+		m := Mismatch{UserID: user.UserID, Balance: user.Balance, LedgerSum: ledgerSums[accounts[i]]}
+		if value, ok := balances.Val()[i].(string); ok {
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("parse balance of user %s: %w", user.UserID, err)
+			}
+			cached := models.Amount(v) - pending[user.UserID]
+			m.Cached = &cached
+		}
+		if m.Balance != m.LedgerSum || (m.Cached != nil && *m.Cached != m.LedgerSum) {
+			mismatches = append(mismatches, m)
+		}
+	}
+	return mismatches, nil
+}
+
+// pendingAmounts 队列中尚未写入账本的变动，按用户汇总
+func pendingAmounts(items []string, accounts []string) (map[string]models.Amount, error) {
+	users := make(map[string]bool, len(accounts))
+	for _, account := range accounts {
+		users[account] = true
+	}
+	var events []Event
+	var txIDs []string
+	for _, item := range items {
+		var event Event
+		if err := json.Unmarshal([]byte(item), &event); err != nil || !users[UserAccount(event.UserID)] {
+			continue
+		}
+		events = append(events, event)
+		txIDs = append(txIDs, event.TxID)
+	}
+	pending := make(map[string]models.Amount)
+	if len(events) == 0 {
+		return pending, nil
+	}
+	var applied []string
+	if err := daos.DB.Model(&models.LedgerEntry{}).Where("tx_id IN ? AND account LIKE ?", txIDs, "user:%").
+		Pluck("tx_id", &applied).Error; err != nil {
+		return nil, err
+	}
+	done := make(map[string]bool, len(applied))
+	for _, txID := range applied {
+		done[txID] = true
+	}
+	for _, event := range events {
+		if !done[event.TxID] {
+			pending[event.UserID] += event.Amount
+		}
+	}
+	return pending, nil
+}
+
+// MigrateOpeningBalances 为启用账本前已有余额的用户补记期初余额
+func MigrateOpeningBalances() error {
+	var users []models.User
+	if err := daos.DB.Where("balance <> 0").Find(&users).Error; err != nil {
+		return err
+	}
+	accounts := make([]string, len(users))
+	for i, user := range users {
+		accounts[i] = UserAccount(user.UserID)
+	}
+	// 已经有分录的账户不再补记
+	var existing []string
+	for start := 0; start < len(accounts); start += reconcileBatch {
+		end := min(start+reconcileBatch, len(accounts))
+		var batch []string
+		if err := daos.DB.Model(&models.LedgerEntry{}).Distinct("account").
+			Where("account IN ?", accounts[start:end]).Pluck("account", &batch).Error; err != nil {
+			return err
+		}
+		existing = append(existing, batch...)
+	}
+	posted := make(map[string]bool, len(existing))
+	for _, account := range existing {
+		posted[account] = true
+	}
+	migrated := 0
+	for _, user := range users {
+		if posted[UserAccount(user.UserID)] {
+			continue
+		}
+		migrated++
+		txID := TxID(user.UserID, ReasonOpeningBalance, "migration")
+		createdAt := time.Now()
+		entries := []models.LedgerEntry{
+			{TxID: txID, Account: UserAccount(user.UserID), Amount: user.Balance, Reason: string(ReasonOpeningBalance),
+				RefID: "migration", BalanceAfter: user.Balance, CreatedAt: createdAt},
+			{TxID: txID, Account: CounterAccount(ReasonOpeningBalance), Amount: -user.Balance, Reason: string(ReasonOpeningBalance),
+				RefID: "migration", CreatedAt: createdAt},
+		}
+		if err := daos.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&entries).Error; err != nil {
+			return err
+		}
+	}
+	if migrated > 0 {
+		logs.Info("Ledger opening balances migrated for %d users", migrated)
+	}
+	return nil
+}
+
+// migrateBalanceScript 将旧的浮点余额键换算为最小单位整数键
+// KEYS[1] 旧余额键  KEYS[2] 新余额键  ARGV[1] 读取到的旧值  ARGV[2] 换算后的金额
+var migrateBalanceScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+redis.call('SETNX', KEYS[2], ARGV[2])
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+// MigrateRedisBalances 将 Redis 中以浮点数保存的旧余额迁移为定点整数，可重复执行
+func MigrateRedisBalances(ctx context.Context) error {
+	migrated := 0
+	iter := configs.Rdb.Scan(ctx, 0, legacyBalanceKey("*"), 500).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		userID := key[:len(key)-len(legacyBalanceKey(""))]
+		value, err := configs.Rdb.Get(ctx, key).Result()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return err
+		}
+		balance, err := models.ParseAmount(value)
+		if err != nil {
+			logs.Error("Failed to parse legacy balance:", key, value, err)
+			continue
+		}
+		ok, err := migrateBalanceScript.Run(ctx, configs.Rdb,
+			[]string{key, BalanceKey(userID)}, value, int64(balance)).Int()
+		if err != nil {
+			return err
+		}
+		migrated += ok
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if migrated > 0 {
+		logs.Info("Redis balances migrated to fixed-point for %d users", migrated)
+	}
+	return nil
+}
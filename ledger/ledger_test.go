@@ -0,0 +1,189 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"testing"
+)
+
+// setupLedger 使用 SQLite 和 miniredis，创建启用账本前已有余额的用户
+func setupLedger(t *testing.T, balances map[string]models.Amount) {
+	t.Helper()
+	daostest.Open(t)
+	configtest.Redis(t)
+	for userID, balance := range balances {
+		if err := daos.DB.Create(&models.User{UserID: userID, Balance: balance}).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := MigrateOpeningBalances(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func reconcile(t *testing.T) *Report {
+	t.Helper()
+	report, err := Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestPost(t *testing.T) {
+	setupLedger(t, map[string]models.Amount{"42": models.Units(10)})
+	ctx := context.Background()
+
+	// 同一业务ID只扣一次，余额从 MySQL 加载
+	for i := 0; i < 2; i++ {
+		if balance, err := Debit(ctx, "42", models.Units(3), ReasonCardPurchase, "p1"); err != nil || balance != models.Units(7) {
+			t.Fatalf("debit %d: %s %v", i, balance, err)
+		}
+	}
+	if balance, err := Debit(ctx, "42", models.Units(8), ReasonCardPurchase, "p2"); !errors.Is(err, ErrInsufficientBalance) || balance != models.Units(7) {
+		t.Fatalf("overdraft: %s %v", balance, err)
+	}
+	// 退回引用购买的业务ID，原因不同所以不会被当作重复的购买
+	if balance, err := Credit(ctx, "42", models.Units(3), ReasonCardRefund, "p1"); err != nil || balance != models.Units(10) {
+		t.Fatalf("refund: %s %v", balance, err)
+	}
+	// 没有业务ID时每次都入账
+	for i := 0; i < 2; i++ {
+		if _, err := Credit(ctx, "42", models.Units(1), ReasonAdjustment, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if balance, _ := configs.Rdb.Get(ctx, BalanceKey("42")).Int64(); models.Amount(balance) != models.Units(12) {
+		t.Fatalf("balance %s, want 12", models.Amount(balance))
+	}
+	if n, _ := configs.Rdb.LLen(ctx, QueueKey).Result(); n != 4 {
+		t.Fatalf("%d queued events, want 4", n)
+	}
+	if _, err := Credit(ctx, "unknown", models.Units(1), ReasonAdjustment, ""); err == nil {
+		t.Fatal("credited a user that does not exist")
+	}
+}
+
+func TestFlush(t *testing.T) {
+	setupLedger(t, map[string]models.Amount{"42": models.Units(10)})
+	ctx := context.Background()
+	if _, err := Debit(ctx, "42", models.Units(3), ReasonCardPurchase, "p1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Credit(ctx, "42", models.Units(3), ReasonCardRefund, "p1"); err != nil {
+		t.Fatal(err)
+	}
+	// 重复的事件只入账一次
+	item, _ := configs.Rdb.LIndex(ctx, QueueKey, 0).Result()
+	configs.Rdb.RPush(ctx, QueueKey, item)
+
+	if n, err := Flush(ctx); err != nil || n != 3 {
+		t.Fatalf("flushed %d, %v", n, err)
+	}
+	if n, _ := configs.Rdb.LLen(ctx, QueueKey).Result(); n != 0 {
+		t.Fatalf("%d events left in queue", n)
+	}
+	var user models.User
+	daos.DB.Where("user_id = ?", "42").First(&user)
+	if user.Balance != models.Units(10) {
+		t.Fatalf("balance %s after flush, want 10", user.Balance)
+	}
+	var entries []models.LedgerEntry
+	daos.DB.Where("reason = ?", ReasonCardRefund).Order("id").Find(&entries)
+	if len(entries) != 2 || entries[0].Account != "user:42" || entries[0].RefID != "p1" || entries[1].Account != "system:card_sales" {
+		t.Fatalf("refund entries %+v", entries)
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	setupLedger(t, map[string]models.Amount{"42": models.Units(10), "43": models.Units(5), "44": 0})
+	ctx := context.Background()
+	if _, err := Credit(ctx, "42", models.Units(2), ReasonAdjustment, "a1"); err != nil {
+		t.Fatal(err)
+	}
+	// 尚未写入账本的变动不算不一致
+	if report := reconcile(t); report.TotalSum != 0 || len(report.Mismatches) != 0 {
+		t.Fatalf("pending events reported: %+v", report)
+	}
+	if _, err := Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// 已写入账本但仍在队列中的事件不重复扣除
+	configs.Rdb.RPush(ctx, QueueKey, `{"tx_id":"adjustment:42:a1","user_id":"42","amount":"2.00"}`)
+	if report := reconcile(t); len(report.Mismatches) != 0 {
+		t.Fatalf("flushed events reported: %+v", report.Mismatches)
+	}
+	configs.Rdb.Del(ctx, QueueKey)
+
+	// Redis 与 MySQL 余额分别被直接修改
+	configs.Rdb.IncrBy(ctx, BalanceKey("42"), 1)
+	daos.DB.Model(&models.User{}).Where("user_id = ?", "43").Update("balance", models.Units(6))
+	report := reconcile(t)
+	if report.TotalSum != 0 || len(report.Mismatches) != 2 {
+		t.Fatalf("mismatches %+v", report.Mismatches)
+	}
+	for _, m := range report.Mismatches {
+		switch m.UserID {
+		case "42":
+			if m.Balance != models.Units(12) || m.LedgerSum != models.Units(12) || m.Cached == nil || *m.Cached != models.Units(12)+1 {
+				t.Errorf("redis mismatch %+v", m)
+			}
+		case "43":
+			// 没有加载到 Redis 的用户只核对 MySQL
+			if m.Balance != models.Units(6) || m.LedgerSum != models.Units(5) || m.Cached != nil {
+				t.Errorf("mysql mismatch %+v", m)
+			}
+		default:
+			t.Errorf("unexpected mismatch %+v", m)
+		}
+	}
+}
+
+func TestPostLargeAmount(t *testing.T) {
+	setupLedger(t, map[string]models.Amount{"42": 1})
+	ctx := context.Background()
+	// Redis 的 Lua 将超过 1e14 的数字转为字符串时使用科学计数法，脚本中的金额需以整数字符串传递
+	large := models.Amount(4_000_000_000_000_123)
+	if balance, err := Credit(ctx, "42", large, ReasonAdjustment, "large"); err != nil || balance != large+1 {
+		t.Fatalf("credit: %s %v", balance, err)
+	}
+	if _, err := Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var entry models.LedgerEntry
+	daos.DB.Where("account = ? AND ref_id = ?", "user:42", "large").First(&entry)
+	if entry.Amount != large || entry.BalanceAfter != large+1 {
+		t.Fatalf("entry amount %s, balance after %s", entry.Amount, entry.BalanceAfter)
+	}
+	if balance, err := Debit(ctx, "42", large, ReasonAdjustment, "large-back"); err != nil || balance != 1 {
+		t.Fatalf("debit: %s %v", balance, err)
+	}
+}
+
+func TestLuaAmount(t *testing.T) {
+	configtest.Redis(t)
+	script := LuaAmountFunc + `
+local out = {}
+for i, v in ipairs(ARGV) do
+	out[i] = amount(v)
+end
+out[#out + 1] = amount(tonumber(ARGV[1]) * 100)
+return out
+`
+	args := []interface{}{"1250", "0", "1", "-1", "-99", "100", "9007199254740993"}
+	want := []string{"12.50", "0.00", "0.01", "-0.01", "-0.99", "1.00", "90071992547409.93", "1250.00"}
+	got, err := configs.Rdb.Eval(context.Background(), script, nil, args...).StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("amount(%v) = %q, want %q", append(args, "1250*100")[i], got[i], want[i])
+		}
+	}
+}
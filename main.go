@@ -2,17 +2,27 @@ package main
 
 import (
 	"context"
-	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/beego/beego/v2/core/logs"
 	"github.com/gin-gonic/gin"
-	"github.com/redis/go-redis/v9"
 	"log"
-	"strconv"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"tbooks/bot"
 	"tbooks/configs"
 	"tbooks/daos"
+	"tbooks/freecard"
 	"tbooks/handle"
-	"tbooks/models"
+	"tbooks/jobs"
+	"tbooks/ledger"
+	"tbooks/orders"
+	"tbooks/quest"
+	"tbooks/referral"
+	"tbooks/social"
+	"tbooks/usersync"
 	"time"
 )
 
@@ -26,206 +36,293 @@ func initLogger() {
 
 func main() {
 	initLogger() // 初始化日志
-	configs.Config()
-	configs.ParseConfig("./configs/config.yaml") // 加载 configs 目录中的配置文件
+	path := loadConfig()
+	watchConfig(path)
 	daos.InitMysql()
 	configs.NewRedis()
+	if err := handle.LoadPrizeTables(); err != nil {
+		log.Fatalf("failed to load prize tables: %v", err)
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bot" {
+		runBot()
+		return
+	}
+	if err := quest.Load(); err != nil {
+		log.Fatalf("failed to load tasks: %v", err)
+	}
+	if err := ledger.MigrateRedisBalances(context.Background()); err != nil {
+		log.Fatalf("failed to migrate redis balances: %v", err)
+	}
+	if err := ledger.MigrateOpeningBalances(); err != nil {
+		log.Fatalf("failed to migrate ledger opening balances: %v", err)
+	}
+	if err := freecard.Recover(context.Background()); err != nil {
+		logs.Error("Failed to recover free card tasks:", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// 通过 tonapi 兼容接口确认 TON 付款，未配置时不监听
+	if configs.Config().Ton.ApiURL != "" {
+		orders.Chain = &handle.TonApiClient{}
+	}
+	// Stars 发票和退款使用机器人的 Bot API 客户端
+	orders.Stars = bot.NewClient()
 	// 启动定时任务
-	go startUserCacheJob()
-	go startFreeCardTaskJob()
+	registerJobs()
+	jobs.Start(ctx)
 	r := gin.Default()
 	route(r)
 	r.Use(handle.Core())
-	err := r.Run(":" + configs.Config().Port)
-	if err != nil {
-		return
+	srv := &http.Server{Addr: ":" + configs.Config().Port, Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("failed to start server: %v", err)
+		}
+	}()
+
+	// 退出时先停止接收请求，再释放任务锁交给其他实例
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logs.Error("Failed to shut down server:", err)
 	}
+	jobs.Stop()
 }
 
 func route(r *gin.Engine) {
 	// 不鉴权接口
 	public := r.Group("/api/v1")
 	{
-		public.GET("/ping", handle.GetPing)                          // 不鉴权的测试接口 ✅
-		public.POST("/luckDraw", handle.LuckDraw)                    // 抽奖
-		public.POST("/userBalance", handle.UserBalance)              //用户的余额
-		public.POST("/createUser", handle.CreateUser)                //创建用户
-		public.POST("/buyCard", handle.BuyCard)                      //购买卡片
-		public.GET("/getLeaderboard", handle.GetLeaderboard)         //获取排行榜
-		public.GET("/getRegularTasks", handle.GetRegularTasks)       //获取日常任务
-		public.GET("/getBoostTasks", handle.GetBoostTasks)           //获取Boost任务
-		public.GET("/userLoginTriggered", handle.UserLoginTriggered) //用户登陆触发
-		public.GET("/getFreeTasks", handle.GetFreeTasks)             //获取用户任务
-		//public.GET("/getInvitationList", handle.GetInvitationList)      //获取邀请列表
-		public.POST("/bindUserAddress", handle.BindUserAddress)         //绑定用户地址
-		public.POST("/shareTaskCompletion", handle.ShareTaskCompletion) //分享任务完成
-		public.POST("/createOrder", handle.CreateOrder)
-	}
-
-	//// 鉴权接口
-	//private := r.Group("/api/v1")
-	//private.Use(handle.AuthMiddleware()) // 启用鉴权中间件x
-	//{
-	//
-	//}ç
-}
+		public.GET("/ping", handle.GetPing)                               // 不鉴权的测试接口 ✅
+		public.POST("/auth/login", handle.Login)                          // 登录换取会话令牌
+		public.POST("/auth/refresh", handle.RefreshSession)               // 刷新会话令牌
+		public.POST("/wallet/nonce", handle.WalletNonce)                  // 获取钱包签名挑战
+		public.POST("/verifyDraw", handle.VerifyDraw)                     // 用公开的种子复算抽奖结果
+		public.GET("/social/:platform/callback", handle.SocialCallback)   // 社交账号授权回调
+		public.GET("/referral/resolve/:code", handle.ResolveReferralCode) // 查询推荐码
+	}
 
-func startUserCacheJob() {
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	// 机器人接口，使用机器人令牌鉴权
+	bot := r.Group("/api/v1/bot")
+	bot.Use(handle.BotAuthMiddleware())
+	{
+		bot.POST("/referral/attribute", handle.BotAttributeReferral) // /start 推荐码归因
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			cacheUserData()
-		}
+	// 会话接口，仅接受 Bearer access token
+	session := r.Group("/api/v1/auth")
+	session.Use(handle.JwtAuthMiddleware())
+	{
+		session.GET("/session", handle.GetSession) // 当前会话信息
+		session.POST("/logout", handle.Logout)     // 注销/吊销会话
 	}
-}
 
-func startFreeCardTaskJob() {
-	ticker := time.NewTicker(10 * time.Second)
-	defer ticker.Stop()
+	// 鉴权接口
+	private := r.Group("/api/v1")
+	private.Use(handle.AuthMiddleware()) // 启用鉴权中间件
+	{
+		private.POST("/luckDraw", handle.LuckDraw)                         // 抽奖
+		private.GET("/fairSeed", handle.GetFairSeed)                       // 当前公平抽奖种子
+		private.POST("/rotateSeed", handle.RotateFairSeed)                 // 轮换并公开服务端种子
+		private.GET("/draws", handle.GetDrawRecords)                       // 抽奖记录
+		private.GET("/draws/stats", handle.GetDrawStats)                   // 抽奖统计
+		private.POST("/userBalance", handle.UserBalance)                   //用户的余额
+		private.POST("/createUser", handle.CreateUser)                     //创建用户
+		private.POST("/buyCard", handle.BuyCard)                           //购买卡片
+		private.GET("/getLeaderboard", handle.GetLeaderboard)              //获取排行榜
+		private.GET("/getRegularTasks", handle.GetRegularTasks)            //获取日常任务
+		private.GET("/getBoostTasks", handle.GetBoostTasks)                //获取Boost任务
+		private.GET("/userLoginTriggered", handle.UserLoginTriggered)      //用户登陆触发
+		private.GET("/getFreeTasks", handle.GetFreeTasks)                  //获取用户任务
+		private.GET("/referrals", handle.GetReferrals)                     //获取邀请树及返佣
+		private.GET("/referral/code", handle.GetReferralCode)              //获取推荐码
+		private.POST("/referral/attribute", handle.AttributeReferral)      //推荐码归因
+		private.POST("/bindUserAddress", handle.BindUserAddress)           //绑定用户地址
+		private.POST("/shareTaskCompletion", handle.ShareTaskCompletion)   //分享任务完成
+		private.GET("/packs", handle.GetPacks)                             // 可购买的商品包
+		private.POST("/createOrder", handle.CreateOrder)                   // 创建商品包订单
+		private.GET("/orders", handle.GetOrders)                           // 订单列表
+		private.GET("/orders/:id", handle.GetOrder)                        // 订单状态
+		private.POST("/timezone", handle.UpdateUserTimezone)               // 设置用户时区
+		private.GET("/social/:platform/authorize", handle.SocialAuthorize) // 绑定 Discord 或 X 账号
+		private.GET("/social/claims", handle.GetSocialClaims)              // 社交任务校验状态
+		private.GET("/flags", handle.GetFlags)                             // 功能开关
+	}
 
-	for {
-		select {
-		case <-ticker.C:
-			processFreeCardTasks()
-		}
+	// 管理接口
+	admin := r.Group("/api/v1/admin")
+	admin.Use(handle.AuthMiddleware(), handle.AdminMiddleware())
+	{
+		admin.GET("/prizes", handle.AdminGetPrizes)                        // 查看奖品配置
+		admin.PUT("/prizes/:playMode", handle.AdminUpdatePrizes)           // 修改玩法奖品配置
+		admin.GET("/ledger/reconcile", handle.AdminReconcileLedger)        // 账本对账
+		admin.GET("/sync/stats", handle.AdminUserSyncStats)                // 用户数据同步延迟
+		admin.GET("/jobs", handle.AdminJobs)                               // 后台任务及其所在实例
+		admin.GET("/freeCards/dead", handle.AdminDeadFreeCards)            // 发放失败的免费卡片任务
+		admin.POST("/freeCards/dead/:id/retry", handle.AdminRetryFreeCard) // 重新发放免费卡片任务
+		admin.GET("/tasks", handle.AdminGetTasks)                          // 查看任务配置
+		admin.PUT("/tasks/:list", handle.AdminUpdateTasks)                 // 修改任务列表
+		admin.GET("/flags", handle.AdminGetFlags)                          // 查看功能开关
+		admin.PUT("/flags/:name", handle.AdminSetFlag)                     // 设置功能开关
+		admin.DELETE("/flags/:name", handle.AdminDeleteFlag)               // 恢复功能开关默认值
+		admin.GET("/orders/issues", handle.AdminPaymentIssues)             // 需要人工退款的订单和转账
+		admin.POST("/orders/:id/refund", handle.AdminRefundOrder)          // 标记订单已退款
 	}
 }
 
-func cacheUserData() {
-	var users []models.User
-	if err := daos.DB.Find(&users).Error; err != nil {
-		log.Println("Failed to load user data from MySQL:", err)
-		return
-	}
+// registerJobs 注册后台任务，非本地任务在多个实例中只由一个实例运行
+func registerJobs() {
+	jobs.Register(jobs.Job{Name: "free_card_grants", Interval: time.Second, Run: func(ctx context.Context) error {
+		_, err := freecard.ProcessDue(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "free_card_recover", Interval: 10 * time.Minute, Run: freecard.Recover})
+	jobs.Register(jobs.Job{Name: "user_sync", Interval: 2 * time.Second, Run: func(ctx context.Context) error {
+		_, err := usersync.Sync(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "user_sync_stats", Interval: time.Minute, Run: reportUserSync})
+	jobs.Register(jobs.Job{Name: "draw_records", Interval: 2 * time.Second, Run: func(ctx context.Context) error {
+		_, err := handle.FlushDrawRecords(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "fair_seed_reveals", Interval: 5 * time.Second, Run: func(ctx context.Context) error {
+		_, err := handle.FlushFairSeedReveals(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "ledger_flush", Interval: 2 * time.Second, Run: func(ctx context.Context) error {
+		_, err := ledger.Flush(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "ledger_reconcile", Interval: time.Hour, Run: reconcileLedger})
+	jobs.Register(jobs.Job{Name: "referral_commissions", Interval: 5 * time.Second, Run: func(ctx context.Context) error {
+		_, err := referral.Process(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "social_recheck", Interval: 30 * time.Second, Run: func(ctx context.Context) error {
+		_, err := social.Recheck(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "order_payments", Interval: 5 * time.Second, Run: func(ctx context.Context) error {
+		_, err := orders.Watch(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "order_fulfillment", Interval: 10 * time.Second, Run: func(ctx context.Context) error {
+		_, err := orders.FulfillPaid(ctx)
+		return err
+	}})
+	jobs.Register(jobs.Job{Name: "order_expiry", Interval: time.Minute, Run: func(ctx context.Context) error {
+		_, err := orders.Expire(ctx)
+		return err
+	}})
+	registerPrizeTableJob()
+	// 任务配置同样缓存在每个实例的内存中，修改数据库后无需重新部署
+	jobs.Register(jobs.Job{Name: "task_definitions", Interval: 30 * time.Second, Local: true, Run: func(context.Context) error {
+		return quest.Load()
+	}})
+}
+
+// defaultConfigPath 未设置 TBOOKS_CONFIG 时使用的配置文件，不存在时只使用环境变量
+const defaultConfigPath = "./configs/config.yaml"
 
-	for _, user := range users {
-		userKey := "user:" + user.UserID
-		cardCountKey := user.UserID + "_card_count"
-		balanceKey := user.UserID + "_balance"
-
-		// 检查 Redis 中是否已经存在数据
-		redisUserJSON, err := configs.Rdb.Get(configs.Ctx, userKey).Result()
-		if err == redis.Nil {
-			// 如果 Redis 中没有数据，则缓存 MySQL 中的数据到 Redis
-			userJSON, err := json.Marshal(user)
-			if err != nil {
-				log.Println("Failed to marshal user data:", err)
-				continue
-			}
-			fmt.Printf("Caching user data: %s\n", string(userJSON))
-
-			// 存储用户的完整信息
-			err = configs.Rdb.Set(configs.Ctx, userKey, userJSON, 0).Err()
-			if err != nil {
-				log.Println("Failed to cache user data to Redis:", err)
-			}
-
-			// 存储用户的卡片数量
-			err = configs.Rdb.Set(configs.Ctx, cardCountKey, user.CardCount, 0).Err()
-			if err != nil {
-				log.Println("Failed to cache user card count to Redis:", err)
-			}
-
-			// 存储用户的余额
-			err = configs.Rdb.Set(configs.Ctx, balanceKey, user.Balance, 0).Err()
-			if err != nil {
-				log.Println("Failed to cache user balance to Redis:", err)
-			}
-
-		} else if err != nil {
-			log.Println("Failed to get user data from Redis:", err)
-			continue
-		} else {
-			// 如果 Redis 中已经存在数据，检查和更新数据库
-			var redisUser models.User
-			if err := json.Unmarshal([]byte(redisUserJSON), &redisUser); err != nil {
-				log.Println("Failed to unmarshal Redis user data:", err)
-				continue
-			}
-
-			// 检查 Redis 中的卡片数量和余额
-			redisCardCount, err := configs.Rdb.Get(configs.Ctx, cardCountKey).Int()
-			if err != nil && err != redis.Nil {
-				log.Println("Failed to get card count from Redis:", err)
-				continue
-			}
-
-			redisBalance, err := configs.Rdb.Get(configs.Ctx, balanceKey).Float64()
-			if err != nil && err != redis.Nil {
-				log.Println("Failed to get balance from Redis:", err)
-				continue
-			}
-
-			// 如果 Redis 中的卡片数量和余额与 MySQL 中的数据不同，则更新 MySQL
-			if redisCardCount != user.CardCount || redisBalance != user.Balance {
-				user.CardCount = redisCardCount
-				user.Balance = redisBalance
-				if err := daos.DB.Save(&user).Error; err != nil {
-					log.Println("Failed to update user data in MySQL:", err)
-				}
-			}
+// loadConfig 加载并校验配置，缺少必需的配置时直接退出，返回使用的配置文件
+func loadConfig() string {
+	path := os.Getenv("TBOOKS_CONFIG")
+	if path == "" {
+		if _, err := os.Stat(defaultConfigPath); err == nil {
+			path = defaultConfigPath
 		}
 	}
-	log.Println("User data cached to Redis successfully")
+	if err := configs.Load(path); err != nil {
+		log.Fatalf("failed to load config: %v", err)
+	}
+	cfg := configs.Config()
+	if err := configs.Validate(cfg); err != nil {
+		log.Fatalf("invalid config:\n%v", err)
+	}
+	logs.Info("Loaded config from %q: %s", path, configs.Dump(cfg))
+	return path
 }
 
-func processFreeCardTasks() {
-	// 查询所有未发放且当前时间已经超过granted_at时间的任务
-	var tasks []models.FreeCardTask
-	err := daos.DB.Model(&models.FreeCardTask{}).
-		Where("is_granted = ? AND granted_at <= ?", false, time.Now().Add(-10*time.Second)).
-		Find(&tasks).Error
-	if err != nil {
-		log.Println("Failed to query ungranted tasks:", err)
-		return
+// logLevels 配置中的日志级别
+var logLevels = map[string]int{
+	"debug": logs.LevelDebug,
+	"info":  logs.LevelInformational,
+	"warn":  logs.LevelWarning,
+	"error": logs.LevelError,
+}
+
+// applyLogLevel 设置日志级别，运行日志统一通过 beego logs 输出，标准库 log 只用于启动失败时退出
+func applyLogLevel(level string) {
+	if l, ok := logLevels[strings.ToLower(level)]; ok {
+		logs.SetLevel(l)
 	}
-	for _, task := range tasks {
-		// 标记任务为已发放
-		task.IsGranted = true
+}
 
-		// 更新任务记录
-		err := daos.DB.Save(&task).Error
-		if err != nil {
-			log.Println("Failed to update task record:", err)
-			continue
+// watchConfig 配置文件修改后重新加载，日志级别、额度、购卡价格等无需重启即可生效
+func watchConfig(path string) {
+	applyLogLevel(configs.Config().LogLevel)
+	configs.Subscribe(func(old, cfg configs.GlobalConfig) {
+		if old.LogLevel != cfg.LogLevel {
+			applyLogLevel(cfg.LogLevel)
 		}
+	})
+	configs.Watch(path)
+}
 
-		// 更新用户卡片数量到 Redis
-		cardCountKey := task.UserID + "_card_count"
-
-		// 获取当前用户的卡片数量
-		cardCountStr, err := configs.Rdb.Get(context.Background(), cardCountKey).Result()
-		if err == redis.Nil {
-			// 如果 Redis 中没有用户的卡片数量，则从数据库中获取
-			var user models.User
-			if err := daos.DB.Where("user_id = ?", task.UserID).First(&user).Error; err != nil {
-				log.Println("Failed to get user data from MySQL:", err)
-				continue
-			}
-			cardCountStr = string(user.CardCount)
-		} else if err != nil {
-			log.Println("Failed to get card count from Redis:", err)
-			continue
-		}
+// registerPrizeTableJob 奖品配置缓存在每个实例的内存中，每个实例都需要刷新
+func registerPrizeTableJob() {
+	jobs.Register(jobs.Job{Name: "prize_tables", Interval: 30 * time.Second, Local: true, Run: func(context.Context) error {
+		return handle.LoadPrizeTables()
+	}})
+}
 
-		// 解析卡片数量并增加
-		cardCount, err := strconv.Atoi(cardCountStr)
-		if err != nil {
-			log.Println("Failed to parse card count from Redis:", err)
-			continue
-		}
-		cardCount++
+// runBot 运行 Telegram 机器人，用法: tbooks bot
+// 机器人抽奖写入的 Redis 队列由 API 服务的定时任务写回 MySQL，机器人进程只刷新奖品配置
+func runBot() {
+	b, err := bot.New()
+	if err != nil {
+		log.Fatalf("failed to create bot: %v", err)
+	}
+	// 订单关闭后收到的 Stars 付款由机器人自动退回
+	orders.Stars = b.Client
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	registerPrizeTableJob()
+	jobs.Start(ctx)
+	if err := b.Run(ctx); err != nil {
+		logs.Info("Telegram bot stopped:", err)
+	}
+	jobs.Stop()
+}
 
-		// 更新卡片数量到 Redis
-		err = configs.Rdb.Set(context.Background(), cardCountKey, cardCount, 0).Err()
-		if err != nil {
-			log.Println("Failed to update card count in Redis:", err)
-			continue
-		}
+// reportUserSync 输出用户数据同步的积压和延迟
+func reportUserSync(ctx context.Context) error {
+	stats, err := usersync.GetStats(ctx)
+	if err != nil {
+		return err
+	}
+	logs.Info("User sync: pending %d, processing %d, lag %.1fs, synced %d",
+		stats.Pending, stats.Processing, stats.LagSeconds, stats.Synced)
+	return nil
+}
 
-		log.Printf("Card granted to user %s, updated card count to Redis successfully\n", task.UserID)
+// reconcileLedger 核对用户余额与账本
+func reconcileLedger(ctx context.Context) error {
+	report, err := ledger.Reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	if report.TotalSum != 0 {
+		logs.Error("Ledger is unbalanced, total sum %s", report.TotalSum)
+	}
+	for _, m := range report.Mismatches {
+		cached := "not loaded"
+		if m.Cached != nil {
+			cached = m.Cached.String()
+		}
+		logs.Error("Ledger mismatch for user %s: balance %s, ledger %s, redis %s", m.UserID, m.Balance, m.LedgerSum, cached)
 	}
+	return nil
 }
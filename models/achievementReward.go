@@ -4,13 +4,13 @@ import (
 	"time"
 )
 
-// AchievementReward 记录成就奖励的发放情况
+// AchievementReward 记录成就奖励的发放情况，同一用户的同一成就只有一条记录
 type AchievementReward struct {
 	ID              uint      `gorm:"primaryKey"`
-	UserID          string    `gorm:"not null"` // 用户ID
-	AchievementName string    `gorm:"not null"` // 成就名称 10Friend
-	RewardType      string    `gorm:"not null"` // 奖励类型，例如"Balance",
-	Amount          int64     `gorm:"not null"` // 奖励数量
+	UserID          string    `gorm:"size:64;not null;uniqueIndex:idx_achievement_user_name"`  // 用户ID
+	AchievementName string    `gorm:"size:128;not null;uniqueIndex:idx_achievement_user_name"` // 成就名称 10Friend，每日任务带日期后缀
+	RewardType      string    `gorm:"not null"`                                                // 奖励类型，例如"Balance",
+	Amount          int64     `gorm:"not null"`                                                // 奖励数量
 	CreatedAt       time.Time // 奖励发放时间
 }
 
@@ -0,0 +1,113 @@
+package models
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Amount 定点金额，按最小单位（0.01）存为整数，数据库列为 BIGINT
+// JSON 中以十进制数字表示，例如 12.50
+type Amount int64
+
+const (
+	// AmountScale 一个整单位包含的最小单位数，Redis 脚本中的换算需与此保持一致
+	AmountScale = 100
+	// amountDecimals 小数位数
+	amountDecimals = 2
+)
+
+var ErrInvalidAmount = errors.New("Invalid amount")
+
+// Units 返回 n 个整单位的金额，例如 Units(100) 为 100.00
+func Units(n int64) Amount {
+	return Amount(n * AmountScale)
+}
+
+// AmountFromFloat 将历史浮点数据四舍五入为定点金额，仅用于迁移
+func AmountFromFloat(f float64) Amount {
+	return Amount(math.Round(f * AmountScale))
+}
+
+// ParseAmount 解析十进制金额，例如 "12.5"、"-0.01"
+// 超过两位的小数按十进制四舍五入，不经过浮点运算
+func ParseAmount(s string) (Amount, error) {
+	s = strings.TrimSpace(s)
+	negative := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "-"), "+")
+	intPart, fracPart, _ := strings.Cut(s, ".")
+	if intPart == "" && fracPart == "" {
+		return 0, ErrInvalidAmount
+	}
+	for _, part := range []string{intPart, fracPart} {
+		for _, r := range part {
+			if r < '0' || r > '9' {
+				return 0, ErrInvalidAmount
+			}
+		}
+	}
+
+	roundUp := false
+	if len(fracPart) > amountDecimals {
+		roundUp = fracPart[amountDecimals] >= '5'
+		fracPart = fracPart[:amountDecimals]
+	}
+	fracPart += strings.Repeat("0", amountDecimals-len(fracPart))
+	digits := strings.TrimLeft(intPart+fracPart, "0")
+	if digits == "" {
+		digits = "0"
+	}
+	v, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAmount
+	}
+	if roundUp {
+		if v == math.MaxInt64 {
+			return 0, ErrInvalidAmount
+		}
+		v++
+	}
+	if negative {
+		v = -v
+	}
+	return Amount(v), nil
+}
+
+// String 以两位小数的十进制格式输出
+func (a Amount) String() string {
+	v := int64(a)
+	sign := ""
+	if v < 0 {
+		sign = "-"
+	}
+	u := uint64(v)
+	if v < 0 {
+		u = uint64(-(v + 1)) + 1
+	}
+	frac := strconv.FormatUint(u%AmountScale, 10)
+	return sign + strconv.FormatUint(u/AmountScale, 10) + "." + strings.Repeat("0", amountDecimals-len(frac)) + frac
+}
+
+// MarshalJSON 输出为 JSON 数字
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// UnmarshalJSON 接受 JSON 数字或数字字符串
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	if bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	s := string(b)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	v, err := ParseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = v
+	return nil
+}
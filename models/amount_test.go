@@ -0,0 +1,100 @@
+package models
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Amount
+	}{
+		{"12.5", 1250},
+		{"12.50", 1250},
+		{" 7 ", 700},
+		{"+3.01", 301},
+		{"-0.01", -1},
+		{".5", 50},
+		{"5.", 500},
+		{"0.005", 1},  // 四舍五入
+		{"0.0049", 0}, // 只看第三位小数
+		{"-1.235", -124},
+		{"0.145", 15}, // 按十进制舍入，不受浮点误差影响
+		{"92233720368547758.07", math.MaxInt64},
+		{"-92233720368547758.07", -math.MaxInt64},
+	}
+	for _, tt := range tests {
+		got, err := ParseAmount(tt.in)
+		if err != nil || got != tt.want {
+			t.Fatalf("ParseAmount(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	// 先按绝对值解析，超过 int64 的金额（包括最小值）都无法表示
+	for _, in := range []string{"", "-", ".", "1e3", "1,5", "abc", "1.2.3", "--1",
+		"92233720368547758.08", "92233720368547758.075", "-92233720368547758.08"} {
+		if got, err := ParseAmount(in); err == nil {
+			t.Fatalf("ParseAmount(%q) = %d, want an error", in, got)
+		}
+	}
+}
+
+func TestAmountString(t *testing.T) {
+	tests := []struct {
+		in   Amount
+		want string
+	}{
+		{0, "0.00"},
+		{1, "0.01"},
+		{-1, "-0.01"},
+		{1250, "12.50"},
+		{-123456789, "-1234567.89"},
+		{math.MaxInt64, "92233720368547758.07"},
+		{math.MinInt64, "-92233720368547758.08"},
+	}
+	for _, tt := range tests {
+		if got := tt.in.String(); got != tt.want {
+			t.Fatalf("Amount(%d).String() = %q, want %q", int64(tt.in), got, tt.want)
+		}
+		// 字符串形式可以原样解析回来，最小值除外
+		if tt.in != math.MinInt64 {
+			if back, err := ParseAmount(tt.want); err != nil || back != tt.in {
+				t.Fatalf("ParseAmount(%q) = %d, %v, want %d", tt.want, back, err, tt.in)
+			}
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	type payload struct {
+		Amount  Amount  `json:"amount"`
+		Pointer *Amount `json:"pointer"`
+	}
+	in := payload{Amount: -1234567, Pointer: new(Amount)}
+	*in.Pointer = 5
+	data, err := json.Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"amount":-12345.67,"pointer":0.05}` {
+		t.Fatalf("marshal: %s", data)
+	}
+	var out payload
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Amount != in.Amount || out.Pointer == nil || *out.Pointer != 5 {
+		t.Fatalf("round trip: %+v", out)
+	}
+
+	// 接受数字字符串和 null，拒绝非数字
+	if err := json.Unmarshal([]byte(`{"amount":"12.5","pointer":null}`), &out); err != nil || out.Amount != 1250 || out.Pointer != nil {
+		t.Fatalf("string amount: %+v %v", out, err)
+	}
+	for _, data := range []string{`{"amount":1e3}`, `{"amount":"abc"}`, `{"amount":true}`} {
+		if err := json.Unmarshal([]byte(data), &out); err == nil {
+			t.Fatalf("unmarshal %s accepted", data)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// DrawRecord 抽奖记录，每次抽奖写入一条
+type DrawRecord struct {
+	ID             uint      `gorm:"primaryKey" json:"id"`
+	UserID         string    `gorm:"index:idx_draw_user_time;size:64;not null" json:"user_id"` // 用户ID
+	PlayMode       string    `gorm:"size:32;not null" json:"play_mode"`                        // 玩法
+	PrizeKey       string    `gorm:"size:32;not null" json:"prize_key"`                        // 奖品编号
+	PrizeName      string    `gorm:"not null" json:"prize_name"`                               // 奖品名称
+	PrizeKind      PrizeKind `gorm:"size:16;not null" json:"prize_kind"`                       // 奖品类型
+	PrizeValue     int64     `gorm:"not null" json:"prize_value"`                              // 奖品数值
+	CardCost       int       `gorm:"not null" json:"card_cost"`                                // 消耗的卡片数
+	CardsBefore    int       `gorm:"not null" json:"cards_before"`                             // 抽奖前卡片数
+	CardsAfter     int       `gorm:"not null" json:"cards_after"`                              // 抽奖后卡片数
+	BalanceBefore  Amount    `gorm:"not null" json:"balance_before"`                           // 抽奖前余额
+	BalanceAfter   Amount    `gorm:"not null" json:"balance_after"`                            // 抽奖后余额
+	ServerSeedHash string    `gorm:"uniqueIndex:idx_draw_seed_nonce;size:64;not null" json:"server_seed_hash"`
+	ClientSeed     string    `gorm:"size:64;not null" json:"client_seed"`
+	Nonce          int64     `gorm:"uniqueIndex:idx_draw_seed_nonce;not null" json:"nonce"`
+	SoldOut        string    `json:"sold_out"`                                   // 抽奖时已无库存的奖品编号，逗号分隔
+	TableHash      string    `gorm:"size:64" json:"table_hash"`                  // 抽奖时奖品表的哈希，对应 prize_table_snapshot
+	CreatedAt      time.Time `gorm:"index:idx_draw_user_time" json:"created_at"` // 抽奖时间
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m DrawRecord) TableName() string {
+	return "draw_record"
+}
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// FairSeed 可证明公平抽奖的服务端种子，轮换后公开
+type FairSeed struct {
+	ID             uint       `gorm:"primaryKey" json:"id"`
+	UserID         string     `gorm:"index;size:64;not null" json:"user_id"`                // 用户ID
+	ServerSeed     string     `gorm:"size:64;not null" json:"-"`                            // 服务端种子，公开前不返回
+	ServerSeedHash string     `gorm:"uniqueIndex;size:64;not null" json:"server_seed_hash"` // 服务端种子的 SHA256 承诺
+	ClientSeed     string     `gorm:"size:64;not null" json:"client_seed"`                  // 客户端种子
+	Nonce          int64      `gorm:"not null" json:"nonce"`                                // 公开时已使用的 nonce 数量
+	Revealed       bool       `gorm:"not null" json:"revealed"`                             // 是否已公开
+	CreatedAt      time.Time  `json:"created_at"`
+	RevealedAt     *time.Time `gorm:"default:null" json:"revealed_at"` // 公开时间
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m FairSeed) TableName() string {
+	return "fair_seed"
+}
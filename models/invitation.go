@@ -2,14 +2,15 @@ package models
 
 import "time"
 
+// Invitation 邀请链，每个用户为其每一级上级各记录一条
 type Invitation struct {
 	ID             uint      `gorm:"primary_key"`
-	InviterID      string    `gorm:"not null"` // 邀请者用户ID
+	InviterID      string    `gorm:"size:64;not null;index:idx_invitation_inviter_level"` // 邀请者用户ID
 	InviterAddress string    `gorm:"not null"`
-	InviteeUserID  string    `gorm:"not null"` // 被邀请者用户ID
+	InviteeUserID  string    `gorm:"size:64;not null;uniqueIndex:idx_invitation_invitee_level"` // 被邀请者用户ID
 	InviteeAddress string    `gorm:"not null"`
-	Level          int       `gorm:"not null"` // 邀请级别 (1: 一级邀请, 2: 二级邀请)
-	CreatedAt      time.Time `gorm:"not null"` // 邀请记录创建时间
+	Level          int       `gorm:"not null;uniqueIndex:idx_invitation_invitee_level;index:idx_invitation_inviter_level"` // 邀请级别 (1: 直接邀请, n: 第 n 级上级)
+	CreatedAt      time.Time `gorm:"not null"`                                                                             // 邀请记录创建时间
 }
 
 // TableName returns the corresponding database table name for this struct.
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// LedgerEntry 余额账本分录，写入后不可修改
+// 每笔交易由两条分录组成，金额相加为 0
+type LedgerEntry struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	TxID         string    `gorm:"uniqueIndex:idx_ledger_tx_account;size:191;not null" json:"tx_id"`        // 交易ID
+	Account      string    `gorm:"uniqueIndex:idx_ledger_tx_account;index;size:96;not null" json:"account"` // 账户，例如 user:<userid>、system:rewards
+	Amount       Amount    `gorm:"not null" json:"amount"`                                                  // 入账为正，出账为负
+	Reason       string    `gorm:"size:32;not null" json:"reason"`                                          // 原因代码
+	RefID        string    `gorm:"size:128" json:"ref_id"`                                                  // 关联业务ID
+	BalanceAfter Amount    `json:"balance_after"`                                                           // 用户账户入账后的余额
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m LedgerEntry) TableName() string {
+	return "ledger_entry"
+}
@@ -2,14 +2,63 @@ package models
 
 import "time"
 
+// OrderStatus 订单状态
+type OrderStatus string
+
+const (
+	OrderPending    OrderStatus = "pending"    // 等待付款
+	OrderPaid       OrderStatus = "paid"       // 已确认到账，等待发放
+	OrderFulfilling OrderStatus = "fulfilling" // 正在发放，发放中断时由后台任务继续
+	OrderFulfilled  OrderStatus = "fulfilled"  // 卡片或积分已发放
+	OrderExpired    OrderStatus = "expired"    // 超过付款期限未到账
+	OrderFailed     OrderStatus = "failed"     // 付款期限内未付足，已收到的金额需要退款
+	OrderRefunding  OrderStatus = "refunding"  // 已收回发放的卡片和积分，等待退回付款
+	OrderRefunded   OrderStatus = "refunded"   // 已退款
+)
+
+// orderTransitions 每个状态允许变更到的状态
+// 过期后仍可能收到付款，此时照常确认到账；发放开始后不能退款，发放完成后收回再退款
+var orderTransitions = map[OrderStatus][]OrderStatus{
+	OrderPending:    {OrderPaid, OrderExpired, OrderFailed},
+	OrderExpired:    {OrderPaid, OrderFailed},
+	OrderPaid:       {OrderFulfilling, OrderFailed, OrderRefunding},
+	OrderFulfilling: {OrderFulfilled},
+	OrderFulfilled:  {OrderRefunding},
+	OrderFailed:     {OrderRefunding},
+	OrderRefunding:  {OrderRefunded},
+}
+
+// CanTransition 订单是否可以从当前状态变更为 to
+func (s OrderStatus) CanTransition(to OrderStatus) bool {
+	for _, next := range orderTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Order 购买卡片或积分的订单，付款确认后发放 Cards 张卡片和 Amount 积分
 type Order struct {
-	ID        uint      `gorm:"primaryKey"`
-	UserID    string    `json:"user_id"`
-	Address   string    `json:"address"`
-	Status    string    `json:"status"`
-	Amount    float64   `json:"amount"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID             uint        `gorm:"primaryKey" json:"id"`
+	UserID         string      `gorm:"size:64;index" json:"user_id"`
+	Address        string      `json:"address"`                               // 用户的付款地址，可为空
+	Status         OrderStatus `gorm:"size:16;index" json:"status"`           // 状态
+	Pack           string      `gorm:"size:32" json:"pack"`                   // 商品包
+	Cards          int64       `json:"cards"`                                 // 发放的卡片数量
+	Amount         Amount      `json:"amount"`                                // 发放的积分
+	Currency       string      `gorm:"size:16" json:"currency"`               // 付款币种
+	Price          int64       `json:"price"`                                 // 应付金额，链上最小单位
+	DepositAddress string      `gorm:"size:128" json:"deposit_address"`       // 收款地址
+	Memo           string      `gorm:"size:32;uniqueIndex" json:"memo"`       // 付款备注，用于匹配转账
+	TxHash         *string     `gorm:"size:128;uniqueIndex" json:"tx_hash"`   // 付足金额的转账
+	PaidAmount     int64       `gorm:"not null;default:0" json:"paid_amount"` // 已计入的到账金额，链上最小单位，可以分多笔付款
+	FailReason     string      `gorm:"size:255" json:"fail_reason,omitempty"` // 失败或退款原因
+	ExpiresAt      *time.Time  `gorm:"index" json:"expires_at"`               // 付款期限
+	PaidAt         *time.Time  `json:"paid_at"`                               // 确认到账时间
+	FulfilledAt    *time.Time  `json:"fulfilled_at"`                          // 发放时间
+	CreatedAt      time.Time   `json:"created_at"`
+	UpdatedAt      time.Time   `json:"updated_at"`
 }
 
 // TableName returns the corresponding database table name for this struct.
@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// OrderPayment 按备注匹配到订单的一笔转账或 Stars 付款，同一笔交易只记录一次
+// Stars 付款的 TxHash 为 telegram_payment_charge_id
+type OrderPayment struct {
+	ID         uint       `gorm:"primaryKey" json:"id"`
+	OrderID    uint       `gorm:"not null;index" json:"order_id"`
+	TxHash     string     `gorm:"size:128;not null;uniqueIndex" json:"tx_hash"` // 交易哈希
+	From       string     `gorm:"size:128" json:"from"`                         // 付款地址，Stars 付款为用户ID
+	Amount     int64      `gorm:"not null" json:"amount"`                       // 金额，链上最小单位或 Stars 数量
+	Applied    bool       `gorm:"not null" json:"applied"`                      // 是否计入订单，订单关闭后收到的转账不计入，需要退款
+	RefundedAt *time.Time `json:"refunded_at"`                                  // 未计入的付款已自动退回的时间
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m OrderPayment) TableName() string {
+	return "order_payment"
+}
@@ -0,0 +1,43 @@
+package models
+
+import "time"
+
+// PrizeKind 奖品类型
+type PrizeKind string
+
+const (
+	PrizeKindPoints PrizeKind = "points" // 积分，Value 为积分数量
+	PrizeKindCard   PrizeKind = "card"   // 抽奖卡，Value 为卡片数量
+	PrizeKindItem   PrizeKind = "item"   // 实物或兑换码等，需人工发放
+	PrizeKindNone   PrizeKind = "none"   // 谢谢参与
+)
+
+// Valid 是否为已知的奖品类型
+func (k PrizeKind) Valid() bool {
+	switch k {
+	case PrizeKindPoints, PrizeKindCard, PrizeKindItem, PrizeKindNone:
+		return true
+	}
+	return false
+}
+
+// Prize 抽奖奖品配置，按玩法分组
+type Prize struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	PlayMode   string    `gorm:"size:32;not null;uniqueIndex:idx_prize_mode_key" json:"play_mode"` // 玩法
+	PrizeKey   string    `gorm:"size:32;not null;uniqueIndex:idx_prize_mode_key" json:"prize_key"` // 奖品编号，对应转盘格子
+	Name       string    `gorm:"not null" json:"name"`                                             // 奖品名称
+	Kind       PrizeKind `gorm:"size:16;not null" json:"kind"`                                     // 奖品类型
+	Value      int64     `gorm:"not null" json:"value"`                                            // 奖品数值
+	Weight     int64     `gorm:"not null" json:"weight"`                                           // 抽中权重
+	DailyStock int64     `gorm:"not null;default:0" json:"daily_stock"`                            // 每日库存，0 表示不限
+	ImageURL   string    `json:"image_url"`                                                        // 奖品图片
+	Enabled    bool      `gorm:"not null" json:"enabled"`                                          // 是否启用
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m Prize) TableName() string {
+	return "prize"
+}
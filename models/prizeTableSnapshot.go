@@ -0,0 +1,17 @@
+package models
+
+import "time"
+
+// PrizeTableSnapshot 抽奖使用过的奖品表，按内容哈希保存，奖品配置修改后仍可复算历史抽奖
+type PrizeTableSnapshot struct {
+	ID        uint      `gorm:"primaryKey" json:"id"`
+	Hash      string    `gorm:"uniqueIndex;size:64;not null" json:"hash"` // 玩法和奖品表内容的 SHA256
+	PlayMode  string    `gorm:"size:32;not null" json:"play_mode"`        // 玩法
+	Prizes    string    `gorm:"type:text;not null" json:"prizes"`         // 参与选奖的奖品字段，JSON 数组
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m PrizeTableSnapshot) TableName() string {
+	return "prize_table_snapshot"
+}
@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// ReferralCode 用户的推荐码，每个用户一个
+type ReferralCode struct {
+	ID        uint      `gorm:"primaryKey" json:"-"`
+	UserID    string    `gorm:"size:64;not null;uniqueIndex" json:"user_id"` // 推荐码所有者
+	Code      string    `gorm:"size:16;not null;uniqueIndex" json:"code"`    // 推荐码
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m ReferralCode) TableName() string {
+	return "referral_code"
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// ReferralCommission 邀请返佣记录，每笔收益的每一级上级只返一次
+type ReferralCommission struct {
+	ID            uint      `gorm:"primaryKey" json:"id"`
+	SourceEntryID uint      `gorm:"not null;uniqueIndex:idx_referral_source_level" json:"source_entry_id"`                        // 产生收益的账本分录ID
+	InviterID     string    `gorm:"size:64;not null;index:idx_referral_inviter_level" json:"inviter_id"`                          // 获得返佣的上级
+	InviteeUserID string    `gorm:"size:64;not null" json:"invitee_user_id"`                                                      // 产生收益的用户
+	Level         int       `gorm:"not null;uniqueIndex:idx_referral_source_level;index:idx_referral_inviter_level" json:"level"` // 上级的层级
+	Reason        string    `gorm:"size:32;not null" json:"reason"`                                                               // 收益原因
+	Amount        Amount    `gorm:"not null" json:"amount"`                                                                       // 返佣金额
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m ReferralCommission) TableName() string {
+	return "referral_commission"
+}
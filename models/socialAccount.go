@@ -0,0 +1,22 @@
+package models
+
+import "time"
+
+// SocialAccount 用户通过 OAuth 绑定的社交账号，每个用户每个平台一个，每个平台账号只能绑定一个用户
+type SocialAccount struct {
+	ID           uint      `gorm:"primaryKey" json:"id"`
+	UserID       string    `gorm:"size:64;not null;uniqueIndex:idx_social_account_user_platform" json:"user_id"`                                                   // 用户ID
+	Platform     string    `gorm:"size:16;not null;uniqueIndex:idx_social_account_user_platform;uniqueIndex:idx_social_account_platform_external" json:"platform"` // 平台: discord、x
+	ExternalID   string    `gorm:"size:64;not null;uniqueIndex:idx_social_account_platform_external" json:"external_id"`                                           // 平台上的用户ID，同一账号只能绑定一个用户
+	Username     string    `json:"username"`                                                                                                                       // 平台上的用户名
+	AccessToken  string    `gorm:"type:text" json:"-"`
+	RefreshToken string    `gorm:"type:text" json:"-"`
+	ExpiresAt    time.Time `json:"-"` // access token 过期时间
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m SocialAccount) TableName() string {
+	return "social_account"
+}
@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// SocialClaimStatus 社交任务声明的状态
+type SocialClaimStatus string
+
+const (
+	SocialClaimPending  SocialClaimStatus = "pending"  // 尚未通过校验，等待重新检查
+	SocialClaimVerified SocialClaimStatus = "verified" // 已通过校验并发放奖励
+	SocialClaimRejected SocialClaimStatus = "rejected" // 多次检查仍未通过
+	SocialClaimRevoked  SocialClaimStatus = "revoked"  // 发放后在撤回窗口内退出，奖励已撤回
+)
+
+// SocialClaim 用户声明完成的社交任务，每个用户每个平台一条
+type SocialClaim struct {
+	ID          uint              `gorm:"primaryKey" json:"id"`
+	UserID      string            `gorm:"size:64;not null;uniqueIndex:idx_social_claim_user_platform" json:"user_id"`  // 用户ID
+	Platform    string            `gorm:"size:16;not null;uniqueIndex:idx_social_claim_user_platform" json:"platform"` // 平台: discord、x、telegram
+	Status      SocialClaimStatus `gorm:"size:16;not null;index:idx_social_claim_check" json:"status"`                 // 状态
+	Attempts    int               `gorm:"not null;default:0" json:"attempts"`                                          // 未通过校验的次数
+	NextCheckAt time.Time         `gorm:"index:idx_social_claim_check" json:"next_check_at"`                           // 下一次检查时间
+	VerifiedAt  *time.Time        `json:"verified_at"`                                                                 // 通过校验时间
+	RevokedAt   *time.Time        `json:"revoked_at"`                                                                  // 撤回时间
+	LastError   string            `gorm:"size:255" json:"-"`                                                           // 最近一次检查的错误，只用于排查，不返回给用户
+	CreatedAt   time.Time         `json:"created_at"`
+	UpdatedAt   time.Time         `json:"updated_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m SocialClaim) TableName() string {
+	return "social_claim"
+}
@@ -0,0 +1,76 @@
+package models
+
+import "time"
+
+// TaskTrigger 任务完成条件
+type TaskTrigger string
+
+const (
+	TaskTriggerInviteCount    TaskTrigger = "invite_count"    // 一级邀请人数达到 Threshold
+	TaskTriggerJoinedDiscord  TaskTrigger = "joined_discord"  // 加入 Discord
+	TaskTriggerJoinedX        TaskTrigger = "joined_x"        // 关注 X
+	TaskTriggerJoinedTelegram TaskTrigger = "joined_telegram" // 加入 Telegram 频道
+	TaskTriggerNone           TaskTrigger = "none"            // 仅展示，不会自动完成
+)
+
+// Valid 是否为已知的完成条件
+func (t TaskTrigger) Valid() bool {
+	switch t {
+	case TaskTriggerInviteCount, TaskTriggerJoinedDiscord, TaskTriggerJoinedX, TaskTriggerJoinedTelegram, TaskTriggerNone:
+		return true
+	}
+	return false
+}
+
+// TaskRewardType 任务奖励类型
+type TaskRewardType string
+
+const (
+	TaskRewardBalance TaskRewardType = "Balance" // 余额，RewardAmount 为整数单位
+	TaskRewardCard    TaskRewardType = "Card"    // 抽奖卡，RewardAmount 为卡片数量
+)
+
+// Valid 是否为已知的奖励类型
+func (t TaskRewardType) Valid() bool {
+	return t == TaskRewardBalance || t == TaskRewardCard
+}
+
+// TaskRepeat 任务可重复完成的周期
+type TaskRepeat string
+
+const (
+	TaskRepeatOnce  TaskRepeat = "once"  // 只能完成一次
+	TaskRepeatDaily TaskRepeat = "daily" // 每个自然日可完成一次，按用户时区
+)
+
+// Valid 是否为已知的重复周期
+func (r TaskRepeat) Valid() bool {
+	return r == TaskRepeatOnce || r == TaskRepeatDaily
+}
+
+// Task 任务和成就配置，按任务列表分组
+// 不同列表中 TaskKey 相同的任务视为同一个成就，奖励只发放一次
+type Task struct {
+	ID           uint           `gorm:"primaryKey" json:"id"`
+	List         string         `gorm:"size:32;not null;uniqueIndex:idx_task_list_key" json:"list"`       // 任务列表，例如 regular、free
+	TaskKey      string         `gorm:"size:64;not null;uniqueIndex:idx_task_list_key" json:"task_key"`   // 成就名称，例如 10Friend
+	Title        string         `gorm:"not null" json:"title"`                                            // 任务标题
+	Description  string         `json:"description"`                                                      // 任务描述
+	ImageURL     string         `json:"image_url"`                                                        // 任务图片
+	Trigger      TaskTrigger    `gorm:"column:trigger_type;size:32;not null" json:"trigger"`              // 完成条件
+	Threshold    int64          `gorm:"not null;default:0" json:"threshold"`                              // 完成条件的数值
+	RewardType   TaskRewardType `gorm:"size:16;not null" json:"reward_type"`                              // 奖励类型
+	RewardAmount int64          `gorm:"not null;default:0" json:"reward_amount"`                          // 奖励数量，0 表示没有奖励
+	Repeat       TaskRepeat     `gorm:"column:repeat_period;size:16;not null;default:once" json:"repeat"` // 重复周期
+	StartAt      *time.Time     `json:"start_at"`                                                         // 开始时间，空表示不限
+	EndAt        *time.Time     `json:"end_at"`                                                           // 结束时间，空表示不限
+	Sort         int            `gorm:"not null;default:0" json:"sort"`                                   // 列表中的顺序
+	Enabled      bool           `gorm:"not null" json:"enabled"`                                          // 是否启用
+	CreatedAt    time.Time      `json:"created_at"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m Task) TableName() string {
+	return "task"
+}
@@ -10,12 +10,13 @@ type User struct {
 	Address        string `json:"address"`
 	CreatedAt      time.Time
 	UpdatedAt      time.Time
-	Balance        float64 `json:"balance"`
-	CardCount      int     `json:"card_count"`
-	ProfilePhoto   string  `json:"profile_photo"`                        // 添加头像字段
-	JoinedDiscord  bool    `json:"joined_discord" gorm:"default:false"`  // 是否加入 Discord，默认为 false
-	JoinedX        bool    `json:"joined_x" gorm:"default:false"`        // 是否加入 X，默认为 false
-	JoinedTelegram bool    `json:"joined_telegram" gorm:"default:false"` // 是否加入 Telegram，默认为 false
+	Balance        Amount `json:"balance"`
+	CardCount      int    `json:"card_count"`
+	ProfilePhoto   string `json:"profile_photo"`                        // 添加头像字段
+	JoinedDiscord  bool   `json:"joined_discord" gorm:"default:false"`  // 是否加入 Discord，默认为 false
+	JoinedX        bool   `json:"joined_x" gorm:"default:false"`        // 是否加入 X，默认为 false
+	JoinedTelegram bool   `json:"joined_telegram" gorm:"default:false"` // 是否加入 Telegram，默认为 false
+	Timezone       string `json:"timezone" gorm:"size:64"`              // IANA 时区，每日额度按该时区的自然日重置，空表示使用默认时区
 }
 
 // TableName returns the corresponding database table name for this struct.
@@ -0,0 +1,18 @@
+package models
+
+import "time"
+
+// UserWallet 用户绑定的钱包地址，一个地址只能绑定一个用户
+type UserWallet struct {
+	ID        uint      `gorm:"primaryKey"`
+	UserID    string    `gorm:"uniqueIndex;size:64;not null"`  // 用户ID
+	Chain     string    `gorm:"size:16;not null"`              // 链类型: "evm", "ton"
+	Address   string    `gorm:"uniqueIndex;size:128;not null"` // 规范化后的地址
+	CreatedAt time.Time // 首次绑定时间
+	UpdatedAt time.Time // 最近一次绑定时间
+}
+
+// TableName returns the corresponding database table name for this struct.
+func (m UserWallet) TableName() string {
+	return "user_wallet"
+}
@@ -0,0 +1,303 @@
+package orders
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/ledger"
+	"tbooks/models"
+	"tbooks/usersync"
+	"time"
+)
+
+// 订单状态：pending 等待付款 → paid 确认到账 → fulfilling 发放中 → fulfilled 已发放
+// 超过付款期限变为 expired，过期后付足仍会确认；期限内未付足变为 failed
+// 退款时先收回已发放的卡片和积分并变为 refunding，退回付款后变为 refunded
+// 状态变更都以当前状态为条件更新，多个实例同时处理同一订单时只有一个成功
+// 卡片和积分都由 Fulfill 发放，发放以订单ID幂等，成功后才标记为已发放
+
+const (
+	// defaultOrderExpire 未配置付款期限时的默认值
+	defaultOrderExpire = 30 * time.Minute
+	// fulfilledExpire 发放卡片幂等键的有效期
+	fulfilledExpire = 30 * 24 * time.Hour
+	// batchSize 每批处理的订单或转账数
+	batchSize = 100
+	// memoBytes 付款备注的随机字节数
+	memoBytes = 8
+)
+
+const (
+	// CurrencyTON 未配置币种时链上付款的币种
+	CurrencyTON = "TON"
+	// CurrencyStars Telegram Stars 的币种代码
+	CurrencyStars = "XTR"
+)
+
+var (
+	ErrPaymentsDisabled  = errors.New("Payments are not available")
+	ErrUnknownPack       = errors.New("Unknown pack")
+	ErrInvalidTransition = errors.New("Invalid order status transition")
+	ErrStatusChanged     = errors.New("Order status changed concurrently")
+)
+
+// refID 订单在账本中的业务ID
+func refID(orderID uint) string {
+	return "order:" + strconv.FormatUint(uint64(orderID), 10)
+}
+
+// fulfilledKey 订单已发放卡片的幂等键
+func fulfilledKey(orderID uint) string {
+	return "order_fulfilled:" + strconv.FormatUint(uint64(orderID), 10)
+}
+
+// reclaimedKey 订单退款时已收回卡片的幂等键
+func reclaimedKey(orderID uint) string {
+	return "order_reclaimed:" + strconv.FormatUint(uint64(orderID), 10)
+}
+
+func newMemo() string {
+	buf := make([]byte, memoBytes)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Packs 当前配置的商品包
+func Packs() map[string]configs.PackConfig {
+	return configs.Config().Payment.Packs
+}
+
+// pack 查找商品包，配置中的键已被转为小写
+func pack(name string) (string, configs.PackConfig, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	p, ok := configs.Config().Payment.Packs[name]
+	return name, p, ok
+}
+
+// create 保存待付款订单，生成付款备注和付款期限
+func create(order models.Order) (*models.Order, error) {
+	expire := defaultOrderExpire
+	if seconds := configs.Config().Payment.OrderExpire; seconds > 0 {
+		expire = time.Duration(seconds) * time.Second
+	}
+	expiresAt := time.Now().Add(expire)
+	order.Status = models.OrderPending
+	order.ExpiresAt = &expiresAt
+	// 备注随机生成，极少数情况下重复时重新生成
+	var err error
+	for i := 0; i < 3; i++ {
+		order.ID = 0
+		order.Memo = newMemo()
+		if err = daos.DB.Create(&order).Error; !errors.Is(err, gorm.ErrDuplicatedKey) {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// Create 为用户创建链上付款的商品包订单，address 为用户的付款地址，可为空
+func Create(userID, name, address string) (*models.Order, error) {
+	cfg := configs.Config().Payment
+	if cfg.DepositAddress == "" {
+		return nil, ErrPaymentsDisabled
+	}
+	name, p, ok := pack(name)
+	if !ok || p.Price <= 0 {
+		return nil, ErrUnknownPack
+	}
+	currency := cfg.Currency
+	if currency == "" {
+		currency = CurrencyTON
+	}
+	return create(models.Order{
+		UserID:         userID,
+		Address:        address,
+		Pack:           name,
+		Cards:          p.Cards,
+		Amount:         models.Units(p.Points),
+		Currency:       currency,
+		Price:          p.Price,
+		DepositAddress: cfg.DepositAddress,
+	})
+}
+
+// transition 以当前状态为条件变更订单状态，updates 为同时更新的列
+// 状态已被其他实例修改时返回 ErrStatusChanged
+func transition(tx *gorm.DB, order *models.Order, to models.OrderStatus, updates map[string]interface{}) error {
+	if !order.Status.CanTransition(to) {
+		return fmt.Errorf("%w: order %d %s -> %s", ErrInvalidTransition, order.ID, order.Status, to)
+	}
+	if updates == nil {
+		updates = make(map[string]interface{})
+	}
+	updates["status"] = to
+	res := tx.Model(&models.Order{}).Where("id = ? AND status = ?", order.ID, order.Status).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%w: order %d", ErrStatusChanged, order.ID)
+	}
+	order.Status = to
+	return nil
+}
+
+// Fulfill 发放已付款订单的卡片和积分，已发放的订单直接返回
+// 发放前先将订单变为 fulfilling，此后不能再退款，退款与发放不会同时进行
+// 发放失败时订单保持 fulfilling，由 FulfillPaid 重试
+func Fulfill(ctx context.Context, orderID uint) error {
+	var order models.Order
+	if err := daos.DB.First(&order, orderID).Error; err != nil {
+		return err
+	}
+	switch order.Status {
+	case models.OrderFulfilled:
+		return nil
+	case models.OrderPaid:
+		err := transition(daos.DB, &order, models.OrderFulfilling, nil)
+		if errors.Is(err, ErrStatusChanged) {
+			// 其他实例已经开始发放，或订单已经退款，按当前状态重新处理
+			return Fulfill(ctx, orderID)
+		} else if err != nil {
+			return err
+		}
+	case models.OrderFulfilling:
+		// 上次发放中断，发放以订单ID幂等，可以重新执行
+	default:
+		return fmt.Errorf("%w: order %d is %s", ErrInvalidTransition, order.ID, order.Status)
+	}
+
+	if order.Cards > 0 {
+		if _, err := usersync.AddCardsOnce(ctx, order.UserID, order.Cards, fulfilledKey(order.ID), fulfilledExpire); err != nil {
+			return err
+		}
+	}
+	if order.Amount > 0 {
+		if _, err := ledger.Credit(ctx, order.UserID, order.Amount, ledger.ReasonOrderPurchase, refID(order.ID)); err != nil {
+			return err
+		}
+	}
+
+	err := transition(daos.DB, &order, models.OrderFulfilled, map[string]interface{}{"fulfilled_at": time.Now()})
+	if errors.Is(err, ErrStatusChanged) {
+		// 其他实例已经完成发放
+		var current models.Order
+		if daos.DB.Select("status").First(&current, order.ID).Error == nil && current.Status == models.OrderFulfilled {
+			return nil
+		}
+	}
+	return err
+}
+
+// FulfillPaid 发放所有已付款但尚未发放完成的订单，返回成功发放的订单数
+func FulfillPaid(ctx context.Context) (int, error) {
+	var paid []models.Order
+	if err := daos.DB.Select("id").Where("status IN ?", []models.OrderStatus{models.OrderPaid, models.OrderFulfilling}).
+		Order("id").Limit(batchSize).Find(&paid).Error; err != nil {
+		return 0, err
+	}
+	fulfilled := 0
+	for _, order := range paid {
+		if err := Fulfill(ctx, order.ID); err != nil {
+			logs.Error("Failed to fulfill order %d: %v", order.ID, err)
+			continue
+		}
+		fulfilled++
+	}
+	return fulfilled, nil
+}
+
+// Expire 处理超过付款期限的订单，返回处理的订单数
+// 已部分付款的订单不再等待补款，标记为失败，不自动退款，由管理员在 AdminPaymentIssues 中查看后通过 Refund 手动退款
+// 其余标记为过期，过期后付足仍会确认到账
+// 没有付款期限的订单是付款流程上线前创建的，无法匹配付款，同样过期
+func Expire(ctx context.Context) (int64, error) {
+	now := time.Now()
+	failed := daos.DB.WithContext(ctx).Model(&models.Order{}).
+		Where("status = ? AND expires_at < ? AND paid_amount > 0", models.OrderPending, now).
+		Updates(map[string]interface{}{"status": models.OrderFailed, "fail_reason": "underpaid before expiry"})
+	if failed.Error != nil {
+		return 0, failed.Error
+	}
+	expired := daos.DB.WithContext(ctx).Model(&models.Order{}).
+		Where("status = ? AND (expires_at < ? OR expires_at IS NULL)", models.OrderPending, now).
+		Update("status", models.OrderExpired)
+	return failed.RowsAffected + expired.RowsAffected, expired.Error
+}
+
+// Refund 订单退款：先收回已发放的卡片和积分，再变为 refunding，Stars 订单通过 Bot API 退回 Stars，最后变为 refunded
+// 链上付款的退款转账由管理员手动完成；退回失败时订单保持 refunding，再次调用 Refund 继续
+// 正在发放的订单不能退款，发放完成后再退
+func Refund(ctx context.Context, orderID uint, reason string) (*models.Order, error) {
+	var order models.Order
+	if err := daos.DB.First(&order, orderID).Error; err != nil {
+		return nil, err
+	}
+	if order.Status != models.OrderRefunding {
+		if !order.Status.CanTransition(models.OrderRefunding) {
+			return nil, fmt.Errorf("%w: order %d %s -> %s", ErrInvalidTransition, order.ID, order.Status, models.OrderRefunding)
+		}
+		if order.Status == models.OrderFulfilled {
+			if err := reclaim(ctx, &order); err != nil {
+				return nil, err
+			}
+		}
+		if err := transition(daos.DB, &order, models.OrderRefunding, map[string]interface{}{"fail_reason": reason}); err != nil {
+			return nil, err
+		}
+		order.FailReason = reason
+	}
+
+	if order.Currency == CurrencyStars && order.TxHash != nil {
+		if err := refundStars(ctx, order.UserID, *order.TxHash); err != nil {
+			return nil, err
+		}
+	}
+	if err := transition(daos.DB, &order, models.OrderRefunded, nil); err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+// reclaim 收回订单发放的卡片和积分，以订单ID幂等
+// 用户已经使用的部分无法收回，只收回剩余的部分
+func reclaim(ctx context.Context, order *models.Order) error {
+	if order.Cards > 0 {
+		removed, err := usersync.RemoveCardsOnce(ctx, order.UserID, order.Cards, reclaimedKey(order.ID), fulfilledExpire)
+		if err != nil {
+			return err
+		}
+		if removed >= 0 && removed < order.Cards {
+			logs.Info("Order %d refund reclaimed %d of %d cards", order.ID, removed, order.Cards)
+		}
+	}
+	if order.Amount > 0 {
+		amount := order.Amount
+		balance, err := ledger.Debit(ctx, order.UserID, amount, ledger.ReasonOrderRefund, refID(order.ID))
+		if errors.Is(err, ledger.ErrInsufficientBalance) && balance > 0 {
+			amount = balance
+			_, err = ledger.Debit(ctx, order.UserID, amount, ledger.ReasonOrderRefund, refID(order.ID))
+		}
+		if errors.Is(err, ledger.ErrInsufficientBalance) {
+			amount, err = 0, nil
+		}
+		if err != nil {
+			return err
+		}
+		if amount < order.Amount {
+			logs.Info("Order %d refund reclaimed %s of %s points", order.ID, amount, order.Amount)
+		}
+	}
+	return nil
+}
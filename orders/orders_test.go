@@ -0,0 +1,277 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"tbooks/usersync"
+	"testing"
+	"time"
+)
+
+// fakeChain 本地的收款地址交易列表，游标为交易序号
+type fakeChain struct {
+	address   string
+	transfers []Transfer
+	calls     int
+}
+
+func (f *fakeChain) add(hash, memo string, amount int64) {
+	f.transfers = append(f.transfers, Transfer{
+		Hash: hash, Cursor: strconv.Itoa(len(f.transfers) + 1), To: f.address, Amount: amount, Memo: memo,
+	})
+}
+
+func (f *fakeChain) Transfers(ctx context.Context, address, cursor string, limit int) ([]Transfer, error) {
+	f.calls++
+	if address != f.address {
+		return nil, errors.New("unexpected address")
+	}
+	start, _ := strconv.Atoi(cursor)
+	end := start + limit
+	if end > len(f.transfers) {
+		end = len(f.transfers)
+	}
+	return f.transfers[start:end], nil
+}
+
+func TestOrderTransitions(t *testing.T) {
+	allowed := []struct{ from, to models.OrderStatus }{
+		{models.OrderPending, models.OrderPaid},
+		{models.OrderPending, models.OrderExpired},
+		{models.OrderExpired, models.OrderPaid},
+		{models.OrderPaid, models.OrderFulfilling},
+		{models.OrderPaid, models.OrderRefunding},
+		{models.OrderFulfilling, models.OrderFulfilled},
+		{models.OrderFulfilled, models.OrderRefunding},
+		{models.OrderFailed, models.OrderRefunding},
+		{models.OrderRefunding, models.OrderRefunded},
+	}
+	for _, c := range allowed {
+		if !c.from.CanTransition(c.to) {
+			t.Errorf("%s -> %s should be allowed", c.from, c.to)
+		}
+	}
+	denied := []struct{ from, to models.OrderStatus }{
+		{models.OrderPending, models.OrderFulfilled},
+		{models.OrderPending, models.OrderRefunded},
+		{models.OrderPaid, models.OrderFulfilled}, // 必须先变为 fulfilling
+		{models.OrderFulfilling, models.OrderRefunding},
+		{models.OrderFulfilled, models.OrderRefunded}, // 必须先收回
+		{models.OrderFulfilled, models.OrderPaid},
+		{models.OrderRefunded, models.OrderPaid},
+		{models.OrderRefunding, models.OrderFulfilled},
+		{models.OrderExpired, models.OrderFulfilled},
+	}
+	for _, c := range denied {
+		if c.from.CanTransition(c.to) {
+			t.Errorf("%s -> %s should be denied", c.from, c.to)
+		}
+	}
+}
+
+func TestSettle(t *testing.T) {
+	cases := []struct {
+		status models.OrderStatus
+		paid   int64
+		want   models.OrderStatus
+	}{
+		{models.OrderPending, 1000, models.OrderPaid},
+		{models.OrderPending, 1500, models.OrderPaid},   // 多付照常确认
+		{models.OrderPending, 999, models.OrderPending}, // 期限内等待补款
+		{models.OrderExpired, 1000, models.OrderPaid},   // 过期后付足仍确认
+		{models.OrderExpired, 999, models.OrderFailed},
+	}
+	for _, c := range cases {
+		to, reason := settle(models.Order{Status: c.status, Price: 1000, PaidAmount: c.paid})
+		if to != c.want || (to == models.OrderFailed) != (reason != "") {
+			t.Errorf("%s paid %d: %s %q, want %s", c.status, c.paid, to, reason, c.want)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	mr := configtest.Redis(t)
+	configtest.Load(t, "payment:\n  depositaddress: DEPOSIT\n")
+
+	chain := &fakeChain{address: "DEPOSIT"}
+	for i := 0; i < batchSize+1; i++ {
+		chain.add("tx"+strconv.Itoa(i), "memo"+strconv.Itoa(i), 100)
+	}
+	Chain = chain
+	t.Cleanup(func() { Chain = nil; applyTransfer = apply })
+
+	var applied []string
+	failOn := "tx3"
+	applyTransfer = func(ctx context.Context, tr Transfer) (bool, error) {
+		if tr.Hash == failOn {
+			return false, errors.New("db down")
+		}
+		applied = append(applied, tr.Hash)
+		return tr.Memo != "", nil
+	}
+	ctx := context.Background()
+
+	// 中途失败时游标停在失败的交易之前
+	if n, err := Watch(ctx); err == nil || n != 3 {
+		t.Fatalf("matched %d, err %v", n, err)
+	}
+	if cursor, _ := mr.Get(cursorKey("DEPOSIT")); cursor != "3" {
+		t.Fatalf("cursor = %q, want 3", cursor)
+	}
+
+	// 恢复后从失败的交易继续，跨批次处理完全部交易
+	failOn = ""
+	n, err := Watch(ctx)
+	if err != nil || n != batchSize+1-3 {
+		t.Fatalf("matched %d, err %v", n, err)
+	}
+	if len(applied) != batchSize+1 || applied[3] != "tx3" {
+		t.Fatalf("applied %d transfers, applied[3] = %s", len(applied), applied[3])
+	}
+
+	// 没有新交易时不重复处理
+	chain.add("late", "", 100)
+	if n, err := Watch(ctx); err != nil || n != 0 || applied[len(applied)-1] != "late" {
+		t.Fatalf("matched %d, err %v, last %s", n, err, applied[len(applied)-1])
+	}
+	if n, _ := Watch(ctx); n != 0 || len(applied) != batchSize+2 {
+		t.Fatalf("transfers reprocessed: %d", len(applied))
+	}
+}
+
+func TestCheckStars(t *testing.T) {
+	future, past := time.Now().Add(time.Minute), time.Now().Add(-time.Minute)
+	order := models.Order{UserID: "42", Status: models.OrderPending, Currency: CurrencyStars, Price: 50, ExpiresAt: &future}
+	if err := checkStars(order, "42", CurrencyStars, 50); err != nil {
+		t.Fatalf("valid payment rejected: %v", err)
+	}
+	cases := []struct {
+		name     string
+		order    func(o *models.Order)
+		userID   string
+		currency string
+		amount   int64
+		want     error
+	}{
+		{"other user", nil, "43", CurrencyStars, 50, ErrPaymentInvalid},
+		{"wrong currency", nil, "42", "USD", 50, ErrPaymentInvalid},
+		{"wrong amount", nil, "42", CurrencyStars, 49, ErrPaymentInvalid},
+		{"paid", func(o *models.Order) { o.Status = models.OrderPaid }, "42", CurrencyStars, 50, ErrOrderClosed},
+		{"expired", func(o *models.Order) { o.ExpiresAt = &past }, "42", CurrencyStars, 50, ErrOrderClosed},
+	}
+	for _, c := range cases {
+		o := order
+		if c.order != nil {
+			c.order(&o)
+		}
+		if err := checkStars(o, c.userID, c.currency, c.amount); !errors.Is(err, c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.want)
+		}
+	}
+}
+
+// setupOrders 使用 SQLite 和 miniredis，创建持有 cards 张卡片和 balance 积分的用户
+func setupOrders(t *testing.T, userID string, cards int, balance models.Amount) {
+	t.Helper()
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "")
+	if err := daos.DB.Create(&models.User{UserID: userID, CardCount: cards, Balance: balance}).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newOrder(t *testing.T, order models.Order) *models.Order {
+	t.Helper()
+	order.Memo = newMemo()
+	if err := daos.DB.Create(&order).Error; err != nil {
+		t.Fatal(err)
+	}
+	return &order
+}
+
+func orderStatus(t *testing.T, id uint) models.OrderStatus {
+	t.Helper()
+	var order models.Order
+	if err := daos.DB.First(&order, id).Error; err != nil {
+		t.Fatal(err)
+	}
+	return order.Status
+}
+
+func balances(t *testing.T, userID string) (int64, models.Amount) {
+	t.Helper()
+	cards, balance, err := usersync.Balances(context.Background(), userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cards, balance
+}
+
+func TestFulfillAndRefund(t *testing.T) {
+	setupOrders(t, "42", 1, models.Units(3))
+	ctx := context.Background()
+	order := newOrder(t, models.Order{UserID: "42", Status: models.OrderPaid, Cards: 10, Amount: models.Units(500), Currency: CurrencyTON, Price: 1000})
+
+	for i := 0; i < 2; i++ {
+		if err := Fulfill(ctx, order.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cards, balance := balances(t, "42"); cards != 11 || balance != models.Units(503) {
+		t.Fatalf("after fulfill: %d cards, %s points", cards, balance)
+	}
+
+	// 用户已经用掉部分卡片，只收回剩余的
+	configs.Rdb.DecrBy(ctx, usersync.CardCountKey("42"), 5)
+	refunded, err := Refund(ctx, order.ID, "customer request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refunded.Status != models.OrderRefunded || refunded.FailReason != "customer request" {
+		t.Fatalf("refunded order %+v", refunded)
+	}
+	if cards, balance := balances(t, "42"); cards != 0 || balance != models.Units(3) {
+		t.Fatalf("after refund: %d cards, %s points", cards, balance)
+	}
+	if _, err := Refund(ctx, order.ID, "again"); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("second refund: %v", err)
+	}
+	if err := Fulfill(ctx, order.ID); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("fulfilled a refunded order: %v", err)
+	}
+}
+
+func TestRefundBeforeFulfill(t *testing.T) {
+	setupOrders(t, "42", 0, 0)
+	ctx := context.Background()
+	paid := newOrder(t, models.Order{UserID: "42", Status: models.OrderPaid, Cards: 10, Amount: models.Units(5), Currency: CurrencyTON, Price: 1000})
+	if _, err := Refund(ctx, paid.ID, "duplicate order"); err != nil {
+		t.Fatal(err)
+	}
+	// 退款后发放任务不会再发放
+	if n, err := FulfillPaid(ctx); err != nil || n != 0 {
+		t.Fatalf("fulfilled %d orders, %v", n, err)
+	}
+	if cards, balance := balances(t, "42"); cards != 0 || balance != 0 {
+		t.Fatalf("refunded order granted %d cards, %s points", cards, balance)
+	}
+
+	// 正在发放的订单不能退款，中断的发放由 FulfillPaid 继续
+	fulfilling := newOrder(t, models.Order{UserID: "42", Status: models.OrderFulfilling, Cards: 3, Currency: CurrencyTON, Price: 1000})
+	if _, err := Refund(ctx, fulfilling.ID, "too early"); !errors.Is(err, ErrInvalidTransition) {
+		t.Fatalf("refunded an order being fulfilled: %v", err)
+	}
+	if n, err := FulfillPaid(ctx); err != nil || n != 1 || orderStatus(t, fulfilling.ID) != models.OrderFulfilled {
+		t.Fatalf("resumed %d orders, %v", n, err)
+	}
+	if cards, _ := balances(t, "42"); cards != 3 {
+		t.Fatalf("%d cards after resumed fulfillment", cards)
+	}
+}
@@ -0,0 +1,209 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"tbooks/daos"
+	"tbooks/models"
+	"time"
+)
+
+// Telegram Stars 付款：订单备注作为发票 payload，pre_checkout_query 时核对订单，
+// successful_payment 时以 telegram_payment_charge_id 记录付款并发放，同一笔付款只会入账一次
+
+var (
+	ErrOrderNotFound  = errors.New("Order not found")
+	ErrOrderClosed    = errors.New("Order is no longer awaiting payment")
+	ErrPaymentInvalid = errors.New("Payment does not match the order")
+)
+
+// StarsClient 通过 Bot API 创建 Stars 发票和退回 Stars，由机器人客户端实现
+type StarsClient interface {
+	// StarsInvoiceLink 创建以 Stars 付款的发票链接，payload 在付款时原样带回
+	StarsInvoiceLink(ctx context.Context, title, description, payload string, stars int64) (string, error)
+	// RefundStarPayment 退回一笔 Stars 付款
+	RefundStarPayment(ctx context.Context, userID int64, chargeID string) error
+}
+
+// Stars 未设置时不能使用 Stars 付款，测试时可以替换为本地实现
+var Stars StarsClient
+
+// refundStars 退回用户的一笔 Stars 付款，用户ID即 Telegram 用户ID，已经退回过时视为成功
+func refundStars(ctx context.Context, userID, chargeID string) error {
+	if Stars == nil {
+		return ErrPaymentsDisabled
+	}
+	telegramID, err := strconv.ParseInt(userID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid telegram user id %q", userID)
+	}
+	err = Stars.RefundStarPayment(ctx, telegramID, chargeID)
+	if err != nil && strings.Contains(err.Error(), "CHARGE_ALREADY_REFUNDED") {
+		// 上次已经退回，但没来得及记录
+		return nil
+	}
+	return err
+}
+
+// Describe 订单发放的商品内容，用于发票和机器人回复
+func Describe(order *models.Order) string {
+	var parts []string
+	if order.Cards > 0 {
+		parts = append(parts, fmt.Sprintf("%d 张抽奖卡", order.Cards))
+	}
+	if order.Amount > 0 {
+		parts = append(parts, order.Amount.String()+" 积分")
+	}
+	return strings.Join(parts, " + ")
+}
+
+// StarsInvoice 创建 Stars 付款的商品包订单和发票链接，小程序中用 openInvoice 打开
+func StarsInvoice(ctx context.Context, userID, name string) (*models.Order, string, error) {
+	if Stars == nil {
+		return nil, "", ErrPaymentsDisabled
+	}
+	order, err := CreateStars(userID, name)
+	if err != nil {
+		return nil, "", err
+	}
+	link, err := Stars.StarsInvoiceLink(ctx, "TBooks "+order.Pack, Describe(order), order.Memo, order.Price)
+	if err != nil {
+		return nil, "", err
+	}
+	return order, link, nil
+}
+
+// CreateStars 为用户创建 Stars 付款的商品包订单
+func CreateStars(userID, name string) (*models.Order, error) {
+	name, p, ok := pack(name)
+	if !ok || p.Stars <= 0 {
+		return nil, ErrUnknownPack
+	}
+	return create(models.Order{
+		UserID:   userID,
+		Pack:     name,
+		Cards:    p.Cards,
+		Amount:   models.Units(p.Points),
+		Currency: CurrencyStars,
+		Price:    p.Stars,
+	})
+}
+
+// starsOrder 按发票 payload 查找 Stars 订单
+func starsOrder(payload string) (models.Order, error) {
+	var order models.Order
+	err := daos.DB.Where("memo = ? AND currency = ?", payload, CurrencyStars).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return order, ErrOrderNotFound
+	}
+	return order, err
+}
+
+// checkStars 核对付款人、币种和金额，只接受待付款的订单
+func checkStars(order models.Order, userID, currency string, amount int64) error {
+	if order.UserID != userID || currency != CurrencyStars || amount != order.Price {
+		return ErrPaymentInvalid
+	}
+	if order.Status != models.OrderPending || (order.ExpiresAt != nil && order.ExpiresAt.Before(time.Now())) {
+		return ErrOrderClosed
+	}
+	return nil
+}
+
+// CheckStars 回复 pre_checkout_query 前核对订单，返回错误时应拒绝付款
+func CheckStars(userID, payload, currency string, amount int64) error {
+	order, err := starsOrder(payload)
+	if err != nil {
+		return err
+	}
+	return checkStars(order, userID, currency, amount)
+}
+
+// StarsPayment successful_payment 中的付款信息
+type StarsPayment struct {
+	UserID   string // 付款的 Telegram 用户ID
+	Payload  string // 发票 payload，即订单备注
+	Currency string // 币种，Stars 为 XTR
+	Amount   int64  // Stars 数量
+	ChargeID string // telegram_payment_charge_id
+}
+
+// StarsResult Stars 付款的处理结果
+type StarsResult string
+
+const (
+	StarsApplied      StarsResult = "applied"       // 计入订单
+	StarsRefunded     StarsResult = "refunded"      // 未计入订单，已退回
+	StarsRefundFailed StarsResult = "refund_failed" // 未计入订单，退回失败，需要人工退款
+)
+
+// PayStars 记录 Stars 付款并发放，返回订单和付款的处理结果
+// 同一 ChargeID 重复调用时不会重复入账；与 pre_checkout_query 时一样核对订单，不符或订单已关闭时付款不计入，自动退回
+func PayStars(ctx context.Context, p StarsPayment) (*models.Order, StarsResult, error) {
+	order, err := starsOrder(p.Payload)
+	if err != nil {
+		return nil, "", err
+	}
+	applied := true
+	if err := checkStars(order, p.UserID, p.Currency, p.Amount); err != nil {
+		logs.Warn("Stars payment %s not applied to order %d: %v", p.ChargeID, order.ID, err)
+		applied = false
+	}
+	err = daos.DB.Transaction(func(tx *gorm.DB) error {
+		payment := models.OrderPayment{OrderID: order.ID, TxHash: p.ChargeID, From: p.UserID, Amount: p.Amount, Applied: applied}
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+		if !applied {
+			return nil
+		}
+		order.PaidAmount = p.Amount
+		return transition(tx, &order, models.OrderPaid, map[string]interface{}{
+			"tx_hash": p.ChargeID, "paid_amount": p.Amount, "paid_at": time.Now(),
+		})
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// Telegram 重复推送了同一笔付款
+		var payment models.OrderPayment
+		if err := daos.DB.Where("tx_hash = ?", p.ChargeID).First(&payment).Error; err != nil {
+			return nil, "", err
+		}
+		applied = payment.Applied
+		if !applied && payment.RefundedAt != nil {
+			return &order, StarsRefunded, nil
+		}
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	if !applied {
+		// 订单已关闭，退回这笔付款
+		if err := refundStars(ctx, p.UserID, p.ChargeID); err != nil {
+			logs.Error("Failed to refund stars payment %s for order %d, needs a manual refund: %v", p.ChargeID, order.ID, err)
+			return &order, StarsRefundFailed, nil
+		}
+		if err := MarkPaymentRefunded(p.ChargeID); err != nil {
+			logs.Error("Failed to record refund of stars payment %s: %v", p.ChargeID, err)
+		}
+		return &order, StarsRefunded, nil
+	}
+	if err := Fulfill(ctx, order.ID); err != nil {
+		logs.Warn("Failed to fulfill order %d, will retry: %v", order.ID, err)
+	}
+	if err := daos.DB.First(&order, order.ID).Error; err != nil {
+		return nil, "", err
+	}
+	return &order, StarsApplied, nil
+}
+
+// MarkPaymentRefunded 记录未计入订单的付款已退回
+func MarkPaymentRefunded(txHash string) error {
+	return daos.DB.Model(&models.OrderPayment{}).
+		Where("tx_hash = ? AND applied = ? AND refunded_at IS NULL", txHash, false).
+		Update("refunded_at", time.Now()).Error
+}
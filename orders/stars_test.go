@@ -0,0 +1,150 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/models"
+	"testing"
+	"time"
+)
+
+// fakeStars 记录退回的付款，err 为下一次退回返回的错误
+type fakeStars struct {
+	refunds []string
+	err     error
+}
+
+func (f *fakeStars) StarsInvoiceLink(ctx context.Context, title, description, payload string, stars int64) (string, error) {
+	return "https://t.me/$" + payload, nil
+}
+
+func (f *fakeStars) RefundStarPayment(ctx context.Context, userID int64, chargeID string) error {
+	f.refunds = append(f.refunds, chargeID)
+	err := f.err
+	f.err = nil
+	return err
+}
+
+func setupStars(t *testing.T) *fakeStars {
+	t.Helper()
+	setupOrders(t, "42", 0, 0)
+	configtest.Load(t, "payment:\n  packs:\n    cards10:\n      cards: 10\n      stars: 50\n")
+	fake := &fakeStars{}
+	Stars = fake
+	t.Cleanup(func() { Stars = nil })
+	return fake
+}
+
+func payments(t *testing.T, chargeID string) []models.OrderPayment {
+	t.Helper()
+	var list []models.OrderPayment
+	if err := daos.DB.Where("tx_hash = ?", chargeID).Find(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+	return list
+}
+
+func TestPayStarsOnce(t *testing.T) {
+	fake := setupStars(t)
+	ctx := context.Background()
+	order, link, err := StarsInvoice(ctx, "42", "Cards10")
+	if err != nil || link != "https://t.me/$"+order.Memo || order.Price != 50 || order.Currency != CurrencyStars {
+		t.Fatalf("invoice %+v %q %v", order, link, err)
+	}
+
+	// Telegram 重复推送同一笔付款
+	p := StarsPayment{UserID: "42", Payload: order.Memo, Currency: CurrencyStars, Amount: 50, ChargeID: "charge1"}
+	for i := 0; i < 2; i++ {
+		paid, result, err := PayStars(ctx, p)
+		if err != nil || result != StarsApplied || paid.Status != models.OrderFulfilled || paid.TxHash == nil || *paid.TxHash != "charge1" {
+			t.Fatalf("delivery %d: %+v %v %v", i, paid, result, err)
+		}
+	}
+	if cards, _ := balances(t, "42"); cards != 10 {
+		t.Fatalf("%d cards after a repeated payment, want 10", cards)
+	}
+	if n := len(payments(t, "charge1")); n != 1 || len(fake.refunds) != 0 {
+		t.Fatalf("%d payments recorded, refunds %v", n, fake.refunds)
+	}
+	if _, _, err := PayStars(ctx, StarsPayment{UserID: "42", Payload: "unknown", Currency: CurrencyStars, Amount: 50, ChargeID: "charge2"}); !errors.Is(err, ErrOrderNotFound) {
+		t.Fatalf("payment for an unknown invoice: %v", err)
+	}
+}
+
+func TestPayStarsRefundsRejectedPayments(t *testing.T) {
+	fake := setupStars(t)
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	expired := newOrder(t, models.Order{UserID: "42", Status: models.OrderPending, Cards: 10, Currency: CurrencyStars, Price: 50, ExpiresAt: &past})
+	pending := newOrder(t, models.Order{UserID: "42", Status: models.OrderPending, Cards: 10, Currency: CurrencyStars, Price: 50})
+
+	// 过期订单的付款自动退回，第一次退回失败时重复推送会再次退回
+	fake.err = errors.New("telegram refundStarPayment: 500 Internal Server Error")
+	p := StarsPayment{UserID: "42", Payload: expired.Memo, Currency: CurrencyStars, Amount: 50, ChargeID: "late"}
+	for i, want := range []StarsResult{StarsRefundFailed, StarsRefunded, StarsRefunded} {
+		if _, result, err := PayStars(ctx, p); err != nil || result != want {
+			t.Fatalf("delivery %d: %v %v, want %v", i, result, err, want)
+		}
+	}
+	if len(fake.refunds) != 2 {
+		t.Fatalf("refunds %v, want one failed and one successful attempt", fake.refunds)
+	}
+	if list := payments(t, "late"); len(list) != 1 || list[0].Applied || list[0].RefundedAt == nil {
+		t.Fatalf("payment %+v", list)
+	}
+
+	// 金额或付款人与订单不符同样不计入
+	for _, p := range []StarsPayment{
+		{UserID: "42", Payload: pending.Memo, Currency: CurrencyStars, Amount: 51, ChargeID: "over"},
+		{UserID: "43", Payload: pending.Memo, Currency: CurrencyStars, Amount: 50, ChargeID: "stranger"},
+	} {
+		if _, result, err := PayStars(ctx, p); err != nil || result != StarsRefunded {
+			t.Fatalf("%s: %v %v", p.ChargeID, result, err)
+		}
+	}
+	if orderStatus(t, expired.ID) != models.OrderPending || orderStatus(t, pending.ID) != models.OrderPending {
+		t.Fatal("rejected payment changed an order")
+	}
+	if cards, _ := balances(t, "42"); cards != 0 || len(fake.refunds) != 4 {
+		t.Fatalf("%d cards granted, refunds %v", cards, fake.refunds)
+	}
+}
+
+func TestRefundStarsOrder(t *testing.T) {
+	fake := setupStars(t)
+	ctx := context.Background()
+	order, _, err := StarsInvoice(ctx, "42", "cards10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := PayStars(ctx, StarsPayment{UserID: "42", Payload: order.Memo, Currency: CurrencyStars, Amount: 50, ChargeID: "charge1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 卡片先收回，退回 Stars 失败时订单停在 refunding
+	fake.err = errors.New("telegram refundStarPayment: 502 Bad Gateway")
+	if _, err := Refund(ctx, order.ID, "support"); err == nil {
+		t.Fatal("refund succeeded although Telegram failed")
+	}
+	if status := orderStatus(t, order.ID); status != models.OrderRefunding {
+		t.Fatalf("status %s after a failed Stars refund", status)
+	}
+	if cards, _ := balances(t, "42"); cards != 0 {
+		t.Fatalf("%d cards kept after refund", cards)
+	}
+
+	// 重试时 Telegram 报告已经退回过
+	fake.err = errors.New("telegram refundStarPayment: 400 Bad Request: CHARGE_ALREADY_REFUNDED")
+	refunded, err := Refund(ctx, order.ID, "support")
+	if err != nil || refunded.Status != models.OrderRefunded {
+		t.Fatalf("retry: %+v %v", refunded, err)
+	}
+	if len(fake.refunds) != 2 || fake.refunds[1] != "charge1" {
+		t.Fatalf("refunds %v", fake.refunds)
+	}
+	if cards, _ := balances(t, "42"); cards != 0 {
+		t.Fatalf("%d cards after the retried refund", cards)
+	}
+}
@@ -0,0 +1,181 @@
+package orders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/models"
+	"time"
+)
+
+// 付款监听按顺序读取收款地址的转入交易，按备注找到订单并核对金额
+// 每处理完一笔交易保存游标，中途失败时下次从该交易重新处理；每笔交易记录在 order_payment 中，不会重复入账
+// 一个订单可以分多笔付款，付足后确认到账，多付的部分和订单关闭后的转账需要人工退款
+
+// Transfer 转入收款地址的一笔交易
+type Transfer struct {
+	Hash   string    // 交易哈希
+	Cursor string    // 交易在链上的位置，下次从该位置之后查询
+	From   string    // 付款地址
+	To     string    // 收款地址
+	Amount int64     // 金额，链上最小单位
+	Memo   string    // 转账备注
+	Time   time.Time // 上链时间
+}
+
+// ChainClient 查询收款地址的转入交易
+type ChainClient interface {
+	// Transfers 按链上顺序返回 cursor 之后转入 address 的最多 limit 笔交易，cursor 为空时从最早的交易开始
+	// 失败、退回等不计入的交易也要返回，金额为 0，以便推进游标
+	Transfers(ctx context.Context, address, cursor string, limit int) ([]Transfer, error)
+}
+
+// Chain 未设置时不监听付款，测试时可以替换为本地实现
+var Chain ChainClient
+
+// applyTransfer 处理一笔转账，测试时替换
+var applyTransfer = apply
+
+// cursorKey Redis 中收款地址已处理到的位置
+func cursorKey(address string) string {
+	return "order_watch_cursor:" + address
+}
+
+// Watch 处理收款地址的新转账，返回匹配到订单的转账数
+func Watch(ctx context.Context) (int, error) {
+	address := configs.Config().Payment.DepositAddress
+	if Chain == nil || address == "" {
+		return 0, nil
+	}
+	key := cursorKey(address)
+	cursor, err := configs.Rdb.Get(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+
+	matched := 0
+	for {
+		transfers, err := Chain.Transfers(ctx, address, cursor, batchSize)
+		if err != nil {
+			return matched, err
+		}
+		for _, t := range transfers {
+			ok, err := applyTransfer(ctx, t)
+			if err != nil {
+				return matched, fmt.Errorf("transfer %s: %w", t.Hash, err)
+			}
+			if ok {
+				matched++
+			}
+			cursor = t.Cursor
+			if err := configs.Rdb.Set(ctx, key, cursor, 0).Err(); err != nil {
+				return matched, err
+			}
+		}
+		if len(transfers) < batchSize {
+			return matched, nil
+		}
+	}
+}
+
+// settle 根据累计到账金额决定订单的新状态，金额不足时返回失败原因
+// 期限内未付足的订单继续等待补款，过期后收到的转账仍不足时失败
+func settle(order models.Order) (models.OrderStatus, string) {
+	switch {
+	case order.PaidAmount >= order.Price:
+		return models.OrderPaid, ""
+	case order.Status == models.OrderExpired:
+		return models.OrderFailed, underpaid(order)
+	default:
+		return order.Status, ""
+	}
+}
+
+// underpaid 金额不足的失败原因
+func underpaid(order models.Order) string {
+	return fmt.Sprintf("underpaid: received %d of %d", order.PaidAmount, order.Price)
+}
+
+// acceptsPayment 订单是否还能计入转账，已付足或已关闭的订单收到的转账需要退款
+func acceptsPayment(status models.OrderStatus) bool {
+	return status == models.OrderPending || status == models.OrderExpired
+}
+
+// apply 将转账匹配到订单并记录，付足后立即发放，返回是否计入订单
+// 同一笔交易重复出现时直接跳过；没有备注、找不到订单或订单已关闭时只记录日志，需要人工退款
+func apply(ctx context.Context, t Transfer) (bool, error) {
+	memo := strings.TrimSpace(t.Memo)
+	if memo == "" || t.Amount <= 0 {
+		return false, nil
+	}
+	var order models.Order
+	// Stars 订单的备注用作发票 payload，不匹配链上转账
+	err := daos.DB.Where("memo = ? AND currency <> ?", memo, CurrencyStars).First(&order).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		logs.Error("Transfer %s with memo %q matches no order", t.Hash, memo)
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	applied := acceptsPayment(order.Status)
+	err = daos.DB.Transaction(func(tx *gorm.DB) error {
+		payment := models.OrderPayment{OrderID: order.ID, TxHash: t.Hash, From: t.From, Amount: t.Amount, Applied: applied}
+		if err := tx.Create(&payment).Error; err != nil {
+			return err
+		}
+		if !applied {
+			return nil
+		}
+		res := tx.Model(&models.Order{}).Where("id = ? AND status = ?", order.ID, order.Status).
+			Update("paid_amount", gorm.Expr("paid_amount + ?", t.Amount))
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("%w: order %d", ErrStatusChanged, order.ID)
+		}
+		order.PaidAmount += t.Amount
+
+		to, reason := settle(order)
+		switch to {
+		case models.OrderPaid:
+			return transition(tx, &order, to, map[string]interface{}{"tx_hash": t.Hash, "paid_at": time.Now()})
+		case models.OrderFailed:
+			order.FailReason = reason
+			return transition(tx, &order, to, map[string]interface{}{"fail_reason": reason})
+		}
+		return nil
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// 交易已经处理过
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	switch {
+	case !applied:
+		logs.Error("Order %d is %s, transfer %s of %d needs a manual refund", order.ID, order.Status, t.Hash, t.Amount)
+		return false, nil
+	case order.Status == models.OrderFailed:
+		logs.Warn("Order %d failed: %s", order.ID, order.FailReason)
+		return true, nil
+	case order.Status != models.OrderPaid:
+		logs.Warn("Order %d partially paid: %d of %d", order.ID, order.PaidAmount, order.Price)
+		return true, nil
+	}
+	if order.PaidAmount > order.Price {
+		logs.Error("Order %d overpaid by %d, the excess needs a manual refund", order.ID, order.PaidAmount-order.Price)
+	}
+	if err := Fulfill(ctx, order.ID); err != nil {
+		logs.Warn("Failed to fulfill order %d, will retry: %v", order.ID, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,509 @@
+package quest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gorm.io/gorm"
+	"sort"
+	"strings"
+	"sync"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/ledger"
+	"tbooks/models"
+	"tbooks/timeutil"
+	"tbooks/usersync"
+	"time"
+)
+
+// 任务和成就以数据的形式保存在 task 表中，按用户状态判断是否完成
+// 完成后以 AchievementReward 的 (user_id, achievement_name) 唯一索引保证奖励只发放一次
+
+const (
+	ListRegular = "regular" // 日常任务
+	ListFree    = "free"    // 免费任务
+)
+
+const (
+	// rewardCardsExpire 发放卡片奖励幂等键的有效期
+	rewardCardsExpire = 30 * 24 * time.Hour
+)
+
+var (
+	ErrNoTask         = errors.New("No active task for this trigger")
+	ErrAlreadyGranted = errors.New("Reward already granted for this achievement")
+	ErrInvalidList    = errors.New("Invalid task list")
+)
+
+// defaultTasks 数据库中没有任务配置时使用的默认任务
+var defaultTasks = map[string][]models.Task{
+	ListRegular: {
+		{TaskKey: "10Friend", Title: "Invite 10 Frens", Description: "邀请10个朋友", ImageURL: "invite_10_frens.png",
+			Trigger: models.TaskTriggerInviteCount, Threshold: 10, RewardType: models.TaskRewardBalance, RewardAmount: 1000},
+		{TaskKey: "InviteBonus", Title: "Invite Bonus", Description: "邀请奖金", ImageURL: "invite_bonus.png",
+			Trigger: models.TaskTriggerNone, RewardType: models.TaskRewardBalance},
+		{TaskKey: "discord", Title: "Join Channel", Description: "加入频道", ImageURL: "join_channel.png",
+			Trigger: models.TaskTriggerJoinedDiscord, RewardType: models.TaskRewardBalance, RewardAmount: 10000},
+		{TaskKey: "x", Title: "Follow us on X", Description: "在X上关注我们", ImageURL: "follow_us_on_x.png",
+			Trigger: models.TaskTriggerJoinedX, RewardType: models.TaskRewardBalance, RewardAmount: 10000},
+		{TaskKey: "telegram", Title: "Join Telegram Channel", Description: "加入Telegram频道", ImageURL: "join_telegram_channel.png",
+			Trigger: models.TaskTriggerJoinedTelegram, RewardType: models.TaskRewardBalance, RewardAmount: 10000},
+	},
+	ListFree: {
+		{TaskKey: "10Friend", Title: "Invite a Frens", Description: "Earn 500", ImageURL: "invite_10_frens.png",
+			Trigger: models.TaskTriggerInviteCount, Threshold: 10, RewardType: models.TaskRewardBalance, RewardAmount: 1000},
+		{TaskKey: "InvitePremiumFren", Title: "Invite a Premium Fren", Description: "Earn 500", ImageURL: "invite_bonus.png",
+			Trigger: models.TaskTriggerNone, RewardType: models.TaskRewardBalance},
+	},
+}
+
+var (
+	tasks  = normalizedDefaultTasks()
+	rTasks sync.RWMutex
+)
+
+// normalizedDefaultTasks 返回补全列表、顺序和启用状态的默认任务副本
+func normalizedDefaultTasks() []models.Task {
+	var all []models.Task
+	for list, defaults := range defaultTasks {
+		for i, task := range defaults {
+			task.List = list
+			task.Sort = i + 1
+			task.Repeat = models.TaskRepeatOnce
+			task.Enabled = true
+			all = append(all, task)
+		}
+	}
+	sortTasks(all)
+	return all
+}
+
+func sortTasks(all []models.Task) {
+	sort.SliceStable(all, func(i, j int) bool {
+		if all[i].List != all[j].List {
+			return all[i].List < all[j].List
+		}
+		return all[i].Sort < all[j].Sort
+	})
+}
+
+// Load 从数据库加载任务配置，表为空时写入默认任务
+func Load() error {
+	var rows []models.Task
+	if err := daos.DB.Find(&rows).Error; err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		rows = normalizedDefaultTasks()
+		if err := daos.DB.Create(&rows).Error; err != nil {
+			return err
+		}
+	}
+	sortTasks(rows)
+	rTasks.Lock()
+	tasks = rows
+	rTasks.Unlock()
+	return nil
+}
+
+// All 返回全部任务配置，包括未启用的
+func All() []models.Task {
+	rTasks.RLock()
+	defer rTasks.RUnlock()
+	return append([]models.Task(nil), tasks...)
+}
+
+// List 返回列表中启用且在有效期内的任务
+func List(list string, now time.Time) []models.Task {
+	var active []models.Task
+	for _, task := range All() {
+		if task.List == list && Active(task, now) {
+			active = append(active, task)
+		}
+	}
+	return active
+}
+
+// Active 任务是否启用且在有效期内
+func Active(task models.Task, now time.Time) bool {
+	if !task.Enabled {
+		return false
+	}
+	if task.StartAt != nil && now.Before(*task.StartAt) {
+		return false
+	}
+	return task.EndAt == nil || now.Before(*task.EndAt)
+}
+
+// TaskFlag 任务的功能开关名称，未定义该开关时任务对所有用户开放
+func TaskFlag(task models.Task) string {
+	return "task:" + task.List + ":" + task.TaskKey
+}
+
+// visible 过滤掉功能开关对用户未开启的任务
+func visible(ctx context.Context, all []models.Task, userID string) []models.Task {
+	flags := configs.LoadFlags(ctx)
+	out := all[:0]
+	for _, task := range all {
+		if flags.Allowed(TaskFlag(task), userID) {
+			out = append(out, task)
+		}
+	}
+	return out
+}
+
+// AchievementName 任务在 now 所在周期的成就名称，每日任务带用户时区的日期后缀
+func AchievementName(task models.Task, now time.Time, loc *time.Location) string {
+	if task.Repeat == models.TaskRepeatDaily {
+		return task.TaskKey + ":" + timeutil.DayKey(now, loc)
+	}
+	return task.TaskKey
+}
+
+// ValidList 是否为已知的任务列表
+func ValidList(list string) bool {
+	_, ok := defaultTasks[list]
+	return ok
+}
+
+// Validate 校验管理员提交的任务列表，不同列表中同名任务的条件和奖励必须一致
+func Validate(list string, input []models.Task) error {
+	if !ValidList(list) {
+		return ErrInvalidList
+	}
+	others := make(map[string]models.Task)
+	for _, task := range All() {
+		if task.List != list {
+			others[task.TaskKey] = task
+		}
+	}
+	seen := make(map[string]bool, len(input))
+	for _, task := range input {
+		if task.TaskKey == "" || task.Title == "" {
+			return errors.New("Task key and title are required")
+		}
+		if seen[task.TaskKey] {
+			return fmt.Errorf("Duplicate task key %s", task.TaskKey)
+		}
+		seen[task.TaskKey] = true
+		if !task.Trigger.Valid() {
+			return fmt.Errorf("Invalid task trigger %q", task.Trigger)
+		}
+		if !task.RewardType.Valid() {
+			return fmt.Errorf("Invalid task reward type %q", task.RewardType)
+		}
+		if !task.Repeat.Valid() {
+			return fmt.Errorf("Invalid task repeat %q", task.Repeat)
+		}
+		if task.Threshold < 0 || task.RewardAmount < 0 {
+			return fmt.Errorf("Task %s has negative threshold or reward", task.TaskKey)
+		}
+		if task.StartAt != nil && task.EndAt != nil && !task.EndAt.After(*task.StartAt) {
+			return fmt.Errorf("Task %s ends before it starts", task.TaskKey)
+		}
+		if other, ok := others[task.TaskKey]; ok && (other.Trigger != task.Trigger || other.Threshold != task.Threshold ||
+			other.RewardType != task.RewardType || other.RewardAmount != task.RewardAmount || other.Repeat != task.Repeat) {
+			return fmt.Errorf("Task %s differs from the same task in list %s", task.TaskKey, other.List)
+		}
+	}
+	return nil
+}
+
+// Replace 替换某个列表的全部任务并重新加载
+func Replace(list string, input []models.Task) error {
+	for i := range input {
+		input[i].ID = 0
+		input[i].List = list
+		if input[i].Repeat == "" {
+			input[i].Repeat = models.TaskRepeatOnce
+		}
+	}
+	if err := Validate(list, input); err != nil {
+		return err
+	}
+	err := daos.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("list = ?", list).Delete(&models.Task{}).Error; err != nil {
+			return err
+		}
+		if len(input) == 0 {
+			return nil
+		}
+		return tx.Create(&input).Error
+	})
+	if err != nil {
+		return err
+	}
+	return Load()
+}
+
+// State 判断任务完成情况所需的用户状态
+type State struct {
+	User        models.User
+	InviteCount int64           // 一级邀请人数
+	Location    *time.Location  // 用户时区
+	Granted     map[string]bool // 已发放的成就名称
+}
+
+// LoadState 读取用户状态
+func LoadState(userID string) (*State, error) {
+	state := &State{Granted: make(map[string]bool)}
+	if err := daos.DB.Where("user_id = ?", userID).First(&state.User).Error; err != nil {
+		return nil, err
+	}
+	state.Location = timeutil.UserLocation(state.User.Timezone)
+	if err := daos.DB.Model(&models.Invitation{}).Where("inviter_id = ? AND level = ?", userID, 1).Count(&state.InviteCount).Error; err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// loadGranted 读取 names 中已发放的成就
+func (s *State) loadGranted(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	var granted []string
+	if err := daos.DB.Model(&models.AchievementReward{}).
+		Where("user_id = ? AND achievement_name IN ?", s.User.UserID, names).
+		Pluck("achievement_name", &granted).Error; err != nil {
+		return err
+	}
+	for _, name := range granted {
+		s.Granted[name] = true
+	}
+	return nil
+}
+
+// Completed 用户是否满足任务的完成条件
+func Completed(task models.Task, state *State) bool {
+	switch task.Trigger {
+	case models.TaskTriggerInviteCount:
+		return state.InviteCount >= task.Threshold
+	case models.TaskTriggerJoinedDiscord:
+		return state.User.JoinedDiscord
+	case models.TaskTriggerJoinedX:
+		return state.User.JoinedX
+	case models.TaskTriggerJoinedTelegram:
+		return state.User.JoinedTelegram
+	}
+	return false
+}
+
+// Progress 用户在某个任务上的进度
+type Progress struct {
+	models.Task
+	Completed bool `json:"completed"` // 满足完成条件
+	Granted   bool `json:"granted"`   // 本周期的奖励已发放
+}
+
+// Evaluate 返回列表中任务的完成情况，并为已完成但未发放的任务发放奖励
+func Evaluate(ctx context.Context, list, userID string) ([]Progress, error) {
+	now := time.Now()
+	active := visible(ctx, List(list, now), userID)
+	state, err := LoadState(userID)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(active))
+	for i, task := range active {
+		names[i] = AchievementName(task, now, state.Location)
+	}
+	if err := state.loadGranted(names); err != nil {
+		return nil, err
+	}
+
+	progress := make([]Progress, 0, len(active))
+	for i, task := range active {
+		p := Progress{Task: task, Completed: Completed(task, state), Granted: state.Granted[names[i]]}
+		if p.Completed && !p.Granted {
+			if _, err := Grant(ctx, userID, task, names[i]); err != nil {
+				return nil, err
+			}
+			p.Granted = true
+			state.Granted[names[i]] = true
+		}
+		progress = append(progress, p)
+	}
+	return progress, nil
+}
+
+// Grant 记录成就并发放奖励，已发放过时返回 false
+// 奖励记录与发放在同一事务中，发放失败时记录回滚，下次仍会重新发放
+// 余额以成就名称作为账本引用、卡片以成就名称作为幂等键，事务提交失败后重试不会重复发放
+func Grant(ctx context.Context, userID string, task models.Task, name string) (bool, error) {
+	err := daos.DB.Transaction(func(tx *gorm.DB) error {
+		reward := models.AchievementReward{
+			UserID:          userID,
+			AchievementName: name,
+			RewardType:      string(task.RewardType),
+			Amount:          task.RewardAmount,
+			CreatedAt:       time.Now(),
+		}
+		if err := tx.Create(&reward).Error; err != nil {
+			return err
+		}
+		if task.RewardAmount <= 0 {
+			return nil
+		}
+		switch task.RewardType {
+		case models.TaskRewardCard:
+			_, err := usersync.AddCardsOnce(ctx, userID, task.RewardAmount, rewardCardsKey(userID, name), rewardCardsExpire)
+			return err
+		default:
+			_, err := ledger.Credit(ctx, userID, models.Units(task.RewardAmount), reason(task), name)
+			return err
+		}
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// rewardCardsKey 成就卡片奖励的幂等键
+func rewardCardsKey(userID, name string) string {
+	return "achievement_reward:" + userID + ":" + name
+}
+
+// reason 社交任务记为任务奖励，其余记为成就奖励
+func reason(task models.Task) ledger.Reason {
+	switch task.Trigger {
+	case models.TaskTriggerJoinedDiscord, models.TaskTriggerJoinedX, models.TaskTriggerJoinedTelegram:
+		return ledger.ReasonTaskReward
+	}
+	return ledger.ReasonAchievementReward
+}
+
+// Complete 用户自行完成某类任务（例如加入 Discord），更新用户状态并发放对应任务的奖励
+// 对应任务都已发放时返回 ErrAlreadyGranted，没有对应任务时返回 ErrNoTask
+func Complete(ctx context.Context, userID string, trigger models.TaskTrigger) (*models.User, []Progress, error) {
+	now := time.Now()
+	state, err := LoadState(userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// 不同列表中的同名任务只发放一次
+	var matched []models.Task
+	var names []string
+	seen := make(map[string]bool)
+	for _, task := range visible(ctx, All(), userID) {
+		if task.Trigger != trigger || !Active(task, now) {
+			continue
+		}
+		name := AchievementName(task, now, state.Location)
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		matched = append(matched, task)
+		names = append(names, name)
+	}
+	if len(matched) == 0 {
+		return nil, nil, ErrNoTask
+	}
+	if err := state.loadGranted(names); err != nil {
+		return nil, nil, err
+	}
+	pending := false
+	for _, name := range names {
+		if !state.Granted[name] {
+			pending = true
+		}
+	}
+	if !pending {
+		return nil, nil, ErrAlreadyGranted
+	}
+
+	user := state.User
+	switch trigger {
+	case models.TaskTriggerJoinedDiscord:
+		user.JoinedDiscord = true
+	case models.TaskTriggerJoinedX:
+		user.JoinedX = true
+	case models.TaskTriggerJoinedTelegram:
+		user.JoinedTelegram = true
+	}
+	user.UpdatedAt = now
+	// 余额由账本维护，不在这里写入
+	if err := daos.DB.Model(&user).Select("joined_discord", "joined_x", "joined_telegram", "updated_at").Updates(&user).Error; err != nil {
+		return nil, nil, err
+	}
+	state.User = user
+
+	granted := make([]Progress, 0, len(matched))
+	for i, task := range matched {
+		if state.Granted[names[i]] || !Completed(task, state) {
+			continue
+		}
+		ok, err := Grant(ctx, userID, task, names[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if ok {
+			granted = append(granted, Progress{Task: task, Completed: true, Granted: true})
+		}
+	}
+	return &user, granted, nil
+}
+
+// Revoke 撤回某类任务已发放的余额奖励并清除用户的完成状态，返回实际撤回的金额
+// 成就记录保留，之后不会再次发放；余额不足时只撤回到 0，卡片奖励可能已被使用，不撤回
+func Revoke(ctx context.Context, userID string, trigger models.TaskTrigger) (models.Amount, error) {
+	// 每日任务的成就名带有日期后缀，按前缀匹配
+	var conds []string
+	var args []interface{}
+	seen := map[string]bool{}
+	for _, task := range All() {
+		if task.Trigger == trigger && !seen[task.TaskKey] {
+			seen[task.TaskKey] = true
+			conds = append(conds, "achievement_name = ? OR achievement_name LIKE ?")
+			args = append(args, task.TaskKey, task.TaskKey+":%")
+		}
+	}
+	var rewards []models.AchievementReward
+	if len(conds) > 0 {
+		query := daos.DB.Where("user_id = ?", userID).Where(strings.Join(conds, " OR "), args...)
+		if err := query.Find(&rewards).Error; err != nil {
+			return 0, err
+		}
+	}
+
+	var revoked models.Amount
+	for _, reward := range rewards {
+		if reward.RewardType != string(models.TaskRewardBalance) || reward.Amount <= 0 {
+			continue
+		}
+		refID := reward.AchievementName + ":revoked"
+		amount := models.Units(reward.Amount)
+		balance, err := ledger.Debit(ctx, userID, amount, ledger.ReasonRewardRevoked, refID)
+		if errors.Is(err, ledger.ErrInsufficientBalance) && balance > 0 {
+			amount = balance
+			_, err = ledger.Debit(ctx, userID, amount, ledger.ReasonRewardRevoked, refID)
+		}
+		if errors.Is(err, ledger.ErrInsufficientBalance) {
+			continue
+		}
+		if err != nil {
+			return revoked, err
+		}
+		revoked += amount
+	}
+
+	column := ""
+	switch trigger {
+	case models.TaskTriggerJoinedDiscord:
+		column = "joined_discord"
+	case models.TaskTriggerJoinedX:
+		column = "joined_x"
+	case models.TaskTriggerJoinedTelegram:
+		column = "joined_telegram"
+	}
+	if column != "" {
+		if err := daos.DB.Model(&models.User{}).Where("user_id = ?", userID).
+			Updates(map[string]interface{}{column: false, "updated_at": time.Now()}).Error; err != nil {
+			return revoked, err
+		}
+	}
+	return revoked, nil
+}
@@ -0,0 +1,201 @@
+package quest
+
+import (
+	"context"
+	"errors"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/ledger"
+	"tbooks/models"
+	"tbooks/usersync"
+	"testing"
+	"time"
+)
+
+// setup 使用测试数据库和 Redis，创建用户并加载默认任务
+func setup(t *testing.T, userID string, cards int) {
+	t.Helper()
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "")
+	user := models.User{UserID: userID, Address: "addr-" + userID, CardCount: cards, CreatedAt: time.Now()}
+	if err := daos.DB.Create(&user).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := Load(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rTasks.Lock()
+		tasks = normalizedDefaultTasks()
+		rTasks.Unlock()
+	})
+}
+
+func cards(t *testing.T, userID string) int64 {
+	t.Helper()
+	n, err := configs.Rdb.Get(context.Background(), usersync.CardCountKey(userID)).Int64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func balance(t *testing.T, userID string) models.Amount {
+	t.Helper()
+	v, err := configs.Rdb.Get(context.Background(), ledger.BalanceKey(userID)).Int64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.Amount(v)
+}
+
+func rewards(t *testing.T, userID string) int64 {
+	t.Helper()
+	var n int64
+	if err := daos.DB.Model(&models.AchievementReward{}).Where("user_id = ?", userID).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestGrantOnce(t *testing.T) {
+	setup(t, "U", 2)
+	ctx := context.Background()
+	cardTask := models.Task{TaskKey: "cards", Trigger: models.TaskTriggerInviteCount, RewardType: models.TaskRewardCard, RewardAmount: 3}
+	balanceTask := models.Task{TaskKey: "coins", Trigger: models.TaskTriggerInviteCount, RewardType: models.TaskRewardBalance, RewardAmount: 10}
+
+	for i, want := range []bool{true, false} {
+		for _, task := range []models.Task{cardTask, balanceTask} {
+			ok, err := Grant(ctx, "U", task, task.TaskKey)
+			if err != nil || ok != want {
+				t.Fatalf("grant %s #%d: %v %v, want %v", task.TaskKey, i+1, ok, err, want)
+			}
+		}
+	}
+	if n := cards(t, "U"); n != 5 {
+		t.Fatalf("cards %d, want 5", n)
+	}
+	if b := balance(t, "U"); b != models.Units(10) {
+		t.Fatalf("balance %s, want 10", b)
+	}
+	if n := rewards(t, "U"); n != 2 {
+		t.Fatalf("%d achievement rewards, want 2", n)
+	}
+}
+
+func TestGrantRetryAfterRollback(t *testing.T) {
+	setup(t, "U", 0)
+	ctx := context.Background()
+	cardTask := models.Task{TaskKey: "cards", Trigger: models.TaskTriggerInviteCount, RewardType: models.TaskRewardCard, RewardAmount: 3}
+	balanceTask := models.Task{TaskKey: "coins", Trigger: models.TaskTriggerInviteCount, RewardType: models.TaskRewardBalance, RewardAmount: 10}
+
+	// 上次发放已写入 Redis 但事务提交失败，成就记录没有保存
+	if _, err := usersync.AddCardsOnce(ctx, "U", 3, rewardCardsKey("U", "cards"), rewardCardsExpire); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.Credit(ctx, "U", models.Units(10), reason(balanceTask), "coins"); err != nil {
+		t.Fatal(err)
+	}
+	for _, task := range []models.Task{cardTask, balanceTask} {
+		if ok, err := Grant(ctx, "U", task, task.TaskKey); err != nil || !ok {
+			t.Fatalf("retry %s: %v %v", task.TaskKey, ok, err)
+		}
+	}
+	if n := cards(t, "U"); n != 3 {
+		t.Fatalf("cards %d after retry, want 3", n)
+	}
+	if b := balance(t, "U"); b != models.Units(10) {
+		t.Fatalf("balance %s after retry, want 10", b)
+	}
+	if n := rewards(t, "U"); n != 2 {
+		t.Fatalf("%d achievement rewards, want 2", n)
+	}
+}
+
+func TestCompleteAndRevoke(t *testing.T) {
+	setup(t, "U", 0)
+	ctx := context.Background()
+
+	// regular 列表中的 discord 任务奖励 10000
+	user, granted, err := Complete(ctx, "U", models.TaskTriggerJoinedDiscord)
+	if err != nil || !user.JoinedDiscord || len(granted) != 1 {
+		t.Fatalf("complete: %+v %v", granted, err)
+	}
+	if _, _, err := Complete(ctx, "U", models.TaskTriggerJoinedDiscord); !errors.Is(err, ErrAlreadyGranted) {
+		t.Fatalf("second complete: %v", err)
+	}
+	if _, _, err := Complete(ctx, "U", models.TaskTrigger("unknown")); !errors.Is(err, ErrNoTask) {
+		t.Fatalf("trigger without task: %v", err)
+	}
+	if b := balance(t, "U"); b != models.Units(10000) {
+		t.Fatalf("balance %s, want 10000", b)
+	}
+
+	if _, err := ledger.Debit(ctx, "U", models.Units(4000), ledger.ReasonCardPurchase, "spent"); err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := Revoke(ctx, "U", models.TaskTriggerJoinedDiscord)
+	if err != nil || revoked != models.Units(6000) {
+		t.Fatalf("revoke: %s %v", revoked, err)
+	}
+	if b := balance(t, "U"); b != 0 {
+		t.Fatalf("balance %s after revoke", b)
+	}
+	// 撤回后成就记录保留，不会再次发放
+	if _, _, err := Complete(ctx, "U", models.TaskTriggerJoinedDiscord); !errors.Is(err, ErrAlreadyGranted) {
+		t.Fatalf("complete after revoke: %v", err)
+	}
+}
+
+func TestRevokeDaily(t *testing.T) {
+	setup(t, "U", 0)
+	ctx := context.Background()
+	daily := models.Task{List: ListFree, TaskKey: "checkin", Title: "Check in", Trigger: models.TaskTriggerNone,
+		RewardType: models.TaskRewardBalance, RewardAmount: 5, Repeat: models.TaskRepeatDaily}
+	if err := Replace(ListFree, []models.Task{daily}); err != nil {
+		t.Fatal(err)
+	}
+	// 连续两天完成，成就名带有各自的日期
+	now := time.Now()
+	for _, day := range []time.Time{now.AddDate(0, 0, -1), now} {
+		if ok, err := Grant(ctx, "U", daily, AchievementName(daily, day, time.UTC)); err != nil || !ok {
+			t.Fatalf("grant: %v %v", ok, err)
+		}
+	}
+	revoked, err := Revoke(ctx, "U", models.TaskTriggerNone)
+	if err != nil || revoked != models.Units(10) {
+		t.Fatalf("revoke: %s %v", revoked, err)
+	}
+	if b := balance(t, "U"); b != 0 {
+		t.Fatalf("balance %s after revoke", b)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	setup(t, "U", 0)
+	valid := models.Task{TaskKey: "new", Title: "New", Trigger: models.TaskTriggerNone,
+		RewardType: models.TaskRewardBalance, Repeat: models.TaskRepeatOnce}
+	if err := Validate(ListFree, []models.Task{valid}); err != nil {
+		t.Fatal(err)
+	}
+	if err := Validate("nope", []models.Task{valid}); !errors.Is(err, ErrInvalidList) {
+		t.Fatalf("unknown list: %v", err)
+	}
+	if err := Replace("nope", nil); !errors.Is(err, ErrInvalidList) {
+		t.Fatalf("replace unknown list: %v", err)
+	}
+	if err := Validate(ListFree, []models.Task{valid, valid}); err == nil {
+		t.Fatal("duplicate task key accepted")
+	}
+	// 与 regular 列表中的 discord 任务奖励不同
+	discord := valid
+	discord.TaskKey = "discord"
+	discord.Trigger = models.TaskTriggerJoinedDiscord
+	discord.RewardAmount = 1
+	if err := Validate(ListFree, []models.Task{discord}); err == nil {
+		t.Fatal("conflicting task accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package quota
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"tbooks/configs"
+	"tbooks/timeutil"
+	"time"
+)
+
+// 额度记录为 Redis 有序集合，成员为每次使用的令牌，分数为使用时间（毫秒）
+// 自然日窗口和滚动窗口都按时间范围计数，窗口起点由调用方的时区决定
+
+const (
+	PolicyFreeCard = "free_card" // 登录触发的免费卡片
+	PolicyLuckDraw = "luck_draw" // 抽奖
+	PolicyBuyCard  = "buy_card"  // 用余额购买卡片
+
+	WindowDay     = "day"     // 按用户时区的自然日
+	WindowRolling = "rolling" // 滚动窗口
+)
+
+var (
+	ErrExceeded      = errors.New("Quota exceeded")
+	ErrUnknownPolicy = errors.New("Unknown quota policy")
+)
+
+// defaultPolicies 配置中没有时使用的默认策略，抽奖默认不限制，需要时在配置中设置
+var defaultPolicies = map[string]configs.QuotaPolicy{
+	PolicyFreeCard: {Max: 5, Window: WindowDay, MinInterval: 600},
+	PolicyLuckDraw: {},
+	PolicyBuyCard:  {Max: 100, Window: WindowDay},
+}
+
+// timeNow 当前时间，测试中替换
+var timeNow = time.Now
+
+// Lookup 返回策略，配置中的同名策略优先
+func Lookup(name string) (configs.QuotaPolicy, bool) {
+	policy, ok := configs.Config().Quotas[name]
+	if !ok {
+		policy, ok = defaultPolicies[name]
+	}
+	// 限制次数但没有指定窗口时按自然日计算
+	if policy.Window == "" && policy.Max > 0 {
+		policy.Window = WindowDay
+	}
+	return policy, ok
+}
+
+// Result 额度检查结果
+type Result struct {
+	Allowed   bool      `json:"allowed"`
+	Used      int64     `json:"used"`      // 当前窗口已使用次数
+	Limit     int64     `json:"limit"`     // 窗口内最多次数，0 表示不限
+	Remaining int64     `json:"remaining"` // 剩余次数，不限次数时为 -1
+	NextAt    time.Time `json:"next_at"`   // 下一次可用时间，当前可用时为零值
+	Token     string    `json:"-"`         // 本次使用的令牌，用于 Release
+}
+
+// quotaScript 检查并可选地使用一次额度
+// KEYS[1] 使用记录
+// ARGV[1] 当前时间  ARGV[2] 窗口起点  ARGV[3] 自然日窗口终点(滚动窗口为 0)  ARGV[4] 最多次数
+// ARGV[5] 最小间隔  ARGV[6] 滚动窗口长度  ARGV[7] 记录保留时长  ARGV[8] 是否使用  ARGV[9] 令牌
+// 时间单位均为毫秒，返回 {是否允许, 已使用次数, 下一次可用时间}
+var quotaScript = redis.NewScript(`
+local now, windowStart, windowEnd = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local max, minInterval, period = tonumber(ARGV[4]), tonumber(ARGV[5]), tonumber(ARGV[6])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - tonumber(ARGV[7]))
+
+local function state()
+	local used = redis.call('ZCOUNT', KEYS[1], windowStart, '+inf')
+	local nextAt = 0
+	if minInterval > 0 then
+		local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+		if #last > 0 and tonumber(last[2]) + minInterval > now then
+			nextAt = tonumber(last[2]) + minInterval
+		end
+	end
+	if max > 0 and used >= max then
+		local resetAt = windowEnd
+		if windowEnd == 0 then
+			-- 滚动窗口在第 used-max+1 早的记录过期后恢复
+			local oldest = redis.call('ZRANGEBYSCORE', KEYS[1], windowStart, '+inf', 'WITHSCORES', 'LIMIT', used - max, 1)
+			resetAt = tonumber(oldest[2]) + period
+		end
+		if resetAt > nextAt then
+			nextAt = resetAt
+		end
+	end
+	return used, nextAt
+end
+
+local used, nextAt = state()
+if nextAt > 0 then
+	return {0, used, nextAt}
+end
+if ARGV[8] == '1' then
+	redis.call('ZADD', KEYS[1], now, ARGV[9])
+	redis.call('PEXPIRE', KEYS[1], ARGV[7])
+	used, nextAt = state()
+end
+return {1, used, nextAt}
+`)
+
+func key(policy, subject string) string {
+	return "quota:" + policy + ":" + subject
+}
+
+// Check 查询额度，不使用
+func Check(ctx context.Context, policy, subject string, loc *time.Location) (*Result, error) {
+	return run(ctx, policy, subject, loc, false)
+}
+
+// Consume 使用一次额度，额度不足时返回 ErrExceeded 和当前状态
+func Consume(ctx context.Context, policy, subject string, loc *time.Location) (*Result, error) {
+	result, err := run(ctx, policy, subject, loc, true)
+	if err == nil && !result.Allowed {
+		return result, ErrExceeded
+	}
+	return result, err
+}
+
+// Release 撤销一次使用，用于操作在使用额度后失败的情况
+func Release(ctx context.Context, policy, subject string, result *Result) error {
+	if result == nil || result.Token == "" {
+		return nil
+	}
+	return configs.Rdb.ZRem(ctx, key(policy, subject), result.Token).Err()
+}
+
+func run(ctx context.Context, name, subject string, loc *time.Location, consume bool) (*Result, error) {
+	policy, ok := Lookup(name)
+	if !ok {
+		return nil, ErrUnknownPolicy
+	}
+	now := timeNow()
+	var windowStart, windowEnd time.Time
+	retention := time.Duration(policy.MinInterval) * time.Second
+	switch policy.Window {
+	case WindowDay:
+		windowStart, windowEnd = timeutil.DayRange(now, loc)
+		// 夏令时当天可能长达 25 小时
+		retention = max(retention, windowEnd.Sub(windowStart))
+	case WindowRolling:
+		windowStart = now.Add(-time.Duration(policy.Period) * time.Second)
+		retention = max(retention, time.Duration(policy.Period)*time.Second)
+	default:
+		// 只限制间隔
+		windowStart = now
+	}
+	retention = max(retention, time.Second)
+
+	token := ""
+	consumeArg := "0"
+	if consume {
+		token = newToken(now)
+		consumeArg = "1"
+	}
+	var windowEndMs int64
+	if !windowEnd.IsZero() {
+		windowEndMs = windowEnd.UnixMilli()
+	}
+	res, err := quotaScript.Run(ctx, configs.Rdb, []string{key(name, subject)},
+		now.UnixMilli(), windowStart.UnixMilli(), windowEndMs, policy.Max, policy.MinInterval*1000,
+		policy.Period*1000, retention.Milliseconds(), consumeArg, token).Int64Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{
+		Allowed:   res[0] == 1,
+		Used:      res[1],
+		Limit:     policy.Max,
+		Remaining: -1,
+	}
+	if policy.Max > 0 {
+		result.Remaining = max(policy.Max-result.Used, 0)
+	}
+	if res[2] > 0 {
+		result.NextAt = time.UnixMilli(res[2])
+	}
+	if result.Allowed {
+		result.Token = token
+	}
+	return result, nil
+}
+
+func newToken(now time.Time) string {
+	buf := make([]byte, 6)
+	_, _ = rand.Read(buf)
+	return now.Format("20060102150405.000") + ":" + hex.EncodeToString(buf)
+}
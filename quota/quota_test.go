@@ -0,0 +1,142 @@
+package quota
+
+import (
+	"context"
+	"errors"
+	"tbooks/configs/configtest"
+	"testing"
+	"time"
+)
+
+// setClock 固定当前时间，测试结束时恢复
+func setClock(t *testing.T, at time.Time) func(time.Duration) {
+	t.Helper()
+	now := at
+	timeNow = func() time.Time { return now }
+	t.Cleanup(func() { timeNow = time.Now })
+	return func(d time.Duration) { now = now.Add(d) }
+}
+
+func setup(t *testing.T) {
+	t.Helper()
+	configtest.Redis(t)
+	configtest.Load(t, `quotas:
+  daily:
+    max: 2
+  rolling:
+    max: 2
+    window: rolling
+    period: 3600
+  interval:
+    mininterval: 60
+`)
+}
+
+// consume 使用一次额度，want 为是否允许
+func consume(t *testing.T, policy string, loc *time.Location, want bool) *Result {
+	t.Helper()
+	result, err := Consume(context.Background(), policy, "U", loc)
+	if want && err != nil {
+		t.Fatalf("consume %s: %v", policy, err)
+	}
+	if !want && !errors.Is(err, ErrExceeded) {
+		t.Fatalf("consume %s: %+v %v, want ErrExceeded", policy, result, err)
+	}
+	return result
+}
+
+func TestDayWindow(t *testing.T) {
+	setup(t)
+	loc := time.FixedZone("UTC+8", 8*3600)
+	// UTC 当天深夜，用户时区已经是第二天早上
+	advance := setClock(t, time.Date(2026, 3, 10, 23, 30, 0, 0, time.UTC))
+
+	consume(t, "daily", loc, true)
+	advance(time.Hour)
+	if r := consume(t, "daily", loc, true); r.Used != 2 || r.Remaining != 0 {
+		t.Fatalf("second use: %+v", r)
+	}
+	r := consume(t, "daily", loc, false)
+	if want := time.Date(2026, 3, 12, 0, 0, 0, 0, loc); !r.NextAt.Equal(want) {
+		t.Fatalf("next at %s, want %s", r.NextAt, want)
+	}
+	// 用户时区的下一个自然日恢复
+	advance(r.NextAt.Sub(timeNow()))
+	if r := consume(t, "daily", loc, true); r.Used != 1 {
+		t.Fatalf("next day: %+v", r)
+	}
+}
+
+func TestRollingWindow(t *testing.T) {
+	setup(t)
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	advance := setClock(t, start)
+
+	consume(t, "rolling", time.UTC, true)
+	advance(10 * time.Minute)
+	consume(t, "rolling", time.UTC, true)
+	advance(10 * time.Minute)
+	// 最早的一次使用过期后恢复
+	if r := consume(t, "rolling", time.UTC, false); !r.NextAt.Equal(start.Add(time.Hour)) {
+		t.Fatalf("next at %s, want %s", r.NextAt, start.Add(time.Hour))
+	}
+	advance(40 * time.Minute)
+	if r := consume(t, "rolling", time.UTC, true); r.Used != 2 {
+		t.Fatalf("after the first use expired: %+v", r)
+	}
+	if r := consume(t, "rolling", time.UTC, false); !r.NextAt.Equal(start.Add(70 * time.Minute)) {
+		t.Fatalf("next at %s, want %s", r.NextAt, start.Add(70*time.Minute))
+	}
+}
+
+func TestMinInterval(t *testing.T) {
+	setup(t)
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	advance := setClock(t, start)
+
+	if r := consume(t, "interval", time.UTC, true); r.Limit != 0 || r.Remaining != -1 {
+		t.Fatalf("unlimited policy: %+v", r)
+	}
+	advance(30 * time.Second)
+	r, err := Check(context.Background(), "interval", "U", time.UTC)
+	if err != nil || r.Allowed || !r.NextAt.Equal(start.Add(time.Minute)) {
+		t.Fatalf("check within the interval: %+v %v", r, err)
+	}
+	consume(t, "interval", time.UTC, false)
+	advance(30 * time.Second)
+	consume(t, "interval", time.UTC, true)
+}
+
+func TestRelease(t *testing.T) {
+	setup(t)
+	ctx := context.Background()
+	setClock(t, time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC))
+
+	consume(t, "daily", time.UTC, true)
+	last := consume(t, "daily", time.UTC, true)
+	consume(t, "daily", time.UTC, false)
+	if err := Release(ctx, "daily", "U", last); err != nil {
+		t.Fatal(err)
+	}
+	if r := consume(t, "daily", time.UTC, true); r.Used != 2 {
+		t.Fatalf("after release: %+v", r)
+	}
+	// 没有使用额度的结果不撤销任何记录
+	if err := Release(ctx, "daily", "U", nil); err != nil {
+		t.Fatal(err)
+	}
+	if r, _ := Check(ctx, "daily", "U", time.UTC); r.Used != 2 {
+		t.Fatalf("after empty release: %+v", r)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	setup(t)
+	if _, err := Check(context.Background(), "nope", "U", time.UTC); !errors.Is(err, ErrUnknownPolicy) {
+		t.Fatalf("unknown policy: %v", err)
+	}
+	// 抽奖默认不限制
+	for i := 0; i < 3; i++ {
+		consume(t, PolicyLuckDraw, time.UTC, true)
+	}
+}
@@ -0,0 +1,225 @@
+package referral
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"net/url"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/models"
+	"time"
+)
+
+// 推荐码由服务端生成，CreateUser、机器人的 /start 和归因接口都通过 Attribute 或 AttributeSignup 归因
+// 未注册的用户打开推荐链接时先记下推荐码，在归因窗口内注册时生效
+
+const (
+	// codeAlphabet 推荐码字符集，去掉了容易混淆的 0 O 1 I L
+	codeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	// codeLength 推荐码长度，约 39 位随机数
+	codeLength = 8
+	// codeRetries 推荐码冲突时的重试次数
+	codeRetries = 5
+	// defaultAttributionWindow 未配置时的归因窗口
+	defaultAttributionWindow = 7 * 24 * time.Hour
+)
+
+var (
+	ErrInvalidCode          = errors.New("Invalid referral code")
+	ErrAlreadyAttributed    = errors.New("User already has an inviter")
+	ErrAttributionExpired   = errors.New("Referral attribution window has passed")
+	ErrReferralCodeConflict = errors.New("Unable to generate a unique referral code")
+)
+
+// AttributionWindow 归因窗口
+func AttributionWindow() time.Duration {
+	if window := configs.Config().Referral.AttributionWindow; window > 0 {
+		return time.Duration(window) * time.Second
+	}
+	return defaultAttributionWindow
+}
+
+func pendingKey(userID string) string {
+	return "referral_pending:" + userID
+}
+
+// NormalizeCode 统一推荐码的大小写和空白
+func NormalizeCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+func newCode() (string, error) {
+	buf := make([]byte, codeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for i, b := range buf {
+		// 256 不能被字符集长度整除，偏差可以忽略
+		buf[i] = codeAlphabet[int(b)%len(codeAlphabet)]
+	}
+	return string(buf), nil
+}
+
+// Link 推荐码对应的机器人深度链接，未配置机器人用户名时为空
+func Link(code string) string {
+	username := configs.Config().Telegram.BotUsername
+	if username == "" {
+		return ""
+	}
+	return "https://t.me/" + url.PathEscape(strings.TrimPrefix(username, "@")) + "?start=" + url.QueryEscape(code)
+}
+
+// GetCode 返回用户的推荐码，没有时生成
+func GetCode(userID string) (*models.ReferralCode, error) {
+	var code models.ReferralCode
+	err := daos.DB.Where("user_id = ?", userID).First(&code).Error
+	if err == nil {
+		return &code, nil
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, err
+	}
+	if err := daos.DB.Where("user_id = ?", userID).First(&models.User{}).Error; err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < codeRetries; i++ {
+		value, err := newCode()
+		if err != nil {
+			return nil, err
+		}
+		code = models.ReferralCode{UserID: userID, Code: value, CreatedAt: time.Now()}
+		err = daos.DB.Create(&code).Error
+		if err == nil {
+			return &code, nil
+		}
+		if !errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, err
+		}
+		// 并发请求已经为该用户生成了推荐码
+		if err := daos.DB.Where("user_id = ?", userID).First(&code).Error; err == nil {
+			return &code, nil
+		}
+	}
+	return nil, ErrReferralCodeConflict
+}
+
+// Resolve 返回推荐码的所有者
+func Resolve(tx *gorm.DB, code string) (*models.User, error) {
+	var owner models.ReferralCode
+	err := tx.Where("code = ?", NormalizeCode(code)).First(&owner).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidCode
+	} else if err != nil {
+		return nil, err
+	}
+	var inviter models.User
+	err = tx.Where("user_id = ?", owner.UserID).First(&inviter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInvalidCode
+	}
+	return &inviter, err
+}
+
+// Attribution 归因结果
+type Attribution struct {
+	InviterID string `json:"inviter_id"`
+	Pending   bool   `json:"pending"` // 用户尚未注册，注册后生效
+}
+
+// Attribute 将用户归因到推荐码的所有者
+// 用户未注册时记下推荐码，在归因窗口内注册时由 AttributeSignup 生效；已注册的用户只能在注册后的归因窗口内补充归因
+func Attribute(ctx context.Context, userID, code string) (*Attribution, error) {
+	inviter, err := Resolve(daos.DB, code)
+	if err != nil {
+		return nil, err
+	}
+	if inviter.UserID == userID {
+		return nil, ErrSelfInvite
+	}
+
+	var invitee models.User
+	err = daos.DB.Where("user_id = ?", userID).First(&invitee).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// 以第一次打开的推荐链接为准
+		if err := configs.Rdb.SetNX(ctx, pendingKey(userID), NormalizeCode(code), AttributionWindow()).Err(); err != nil {
+			return nil, err
+		}
+		return &Attribution{InviterID: inviter.UserID, Pending: true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if time.Since(invitee.CreatedAt) > AttributionWindow() {
+		return nil, ErrAttributionExpired
+	}
+	err = daos.DB.Transaction(func(tx *gorm.DB) error {
+		return attach(tx, &invitee, inviter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Attribution{InviterID: inviter.UserID}, nil
+}
+
+// attach 检查用户是否已有邀请人后记录邀请链，重复归因到同一邀请人时视为成功
+func attach(tx *gorm.DB, invitee, inviter *models.User) error {
+	var current models.Invitation
+	err := tx.Where("invitee_user_id = ? AND level = ?", invitee.UserID, 1).First(&current).Error
+	if err == nil {
+		if current.InviterID == inviter.UserID {
+			return nil
+		}
+		return ErrAlreadyAttributed
+	}
+	if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	err = Attach(tx, invitee, inviter)
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// 并发归因
+		return ErrAlreadyAttributed
+	}
+	return err
+}
+
+// AttributeSignup 在创建用户的事务中归因，依次使用推荐码、邀请人地址和注册前记下的推荐码，没有时不归因
+// 返回邀请人，没有邀请人时为 nil
+func AttributeSignup(ctx context.Context, tx *gorm.DB, invitee *models.User, code, inviterAddress string) (*models.User, error) {
+	var inviter *models.User
+	var err error
+	switch {
+	case code != "":
+		inviter, err = Resolve(tx, code)
+	case inviterAddress != "":
+		inviter, err = FindInviter(tx, inviterAddress)
+	default:
+		pending, getErr := configs.Rdb.Get(ctx, pendingKey(invitee.UserID)).Result()
+		if getErr == redis.Nil {
+			return nil, nil
+		} else if getErr != nil {
+			return nil, getErr
+		}
+		inviter, err = Resolve(tx, pending)
+		// 记下的推荐码已经失效时不影响注册
+		if errors.Is(err, ErrInvalidCode) {
+			return nil, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := attach(tx, invitee, inviter); err != nil {
+		return nil, err
+	}
+	return inviter, nil
+}
+
+// ClearPending 注册完成后删除记下的推荐码
+func ClearPending(ctx context.Context, userID string) error {
+	return configs.Rdb.Del(ctx, pendingKey(userID)).Err()
+}
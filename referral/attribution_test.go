@@ -0,0 +1,107 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"testing"
+	"time"
+)
+
+// newUser 创建用户和推荐码，推荐码为用户ID加前缀
+func newUser(t *testing.T, userID string, createdAt time.Time) *models.User {
+	t.Helper()
+	user := &models.User{UserID: userID, Address: "addr-" + userID, CreatedAt: createdAt}
+	if err := daos.DB.Create(user).Error; err != nil {
+		t.Fatal(err)
+	}
+	code := models.ReferralCode{UserID: userID, Code: "CODE" + userID, CreatedAt: createdAt}
+	if err := daos.DB.Create(&code).Error; err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestAttribute(t *testing.T) {
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "")
+	ctx := context.Background()
+	now := time.Now()
+	newUser(t, "A", now)
+	newUser(t, "B", now)
+	newUser(t, "C", now)
+	newUser(t, "OLD", now.Add(-30*24*time.Hour))
+
+	if _, err := Attribute(ctx, "B", "nope"); !errors.Is(err, ErrInvalidCode) {
+		t.Fatalf("invalid code: %v", err)
+	}
+	if _, err := Attribute(ctx, "A", "codea"); !errors.Is(err, ErrSelfInvite) {
+		t.Fatalf("A -> A: %v", err)
+	}
+	res, err := Attribute(ctx, "B", " codea ")
+	if err != nil || res.InviterID != "A" || res.Pending {
+		t.Fatalf("B -> A: %+v %v", res, err)
+	}
+	// 重复归因到同一邀请人视为成功，换邀请人被拒绝
+	if _, err := Attribute(ctx, "B", "CODEA"); err != nil {
+		t.Fatalf("repeated attribution: %v", err)
+	}
+	if _, err := Attribute(ctx, "B", "CODEC"); !errors.Is(err, ErrAlreadyAttributed) {
+		t.Fatalf("second inviter: %v", err)
+	}
+	if _, err := Attribute(ctx, "A", "CODEB"); !errors.Is(err, ErrCyclicReferral) {
+		t.Fatalf("A -> B -> A: %v", err)
+	}
+	if _, err := Attribute(ctx, "OLD", "CODEA"); !errors.Is(err, ErrAttributionExpired) {
+		t.Fatalf("outside the window: %v", err)
+	}
+	if got := chain(t, "A"); len(got) != 0 {
+		t.Fatalf("A has inviters %v", got)
+	}
+}
+
+func TestAttributeSignup(t *testing.T) {
+	daostest.Open(t)
+	mr := configtest.Redis(t)
+	configtest.Load(t, "referral:\n  attributionwindow: 60\n")
+	ctx := context.Background()
+	newUser(t, "A", time.Now())
+
+	// 未注册的用户先记下推荐码，以第一次打开的为准
+	res, err := Attribute(ctx, "NEW", "CODEA")
+	if err != nil || !res.Pending || res.InviterID != "A" {
+		t.Fatalf("pending attribution: %+v %v", res, err)
+	}
+	newUser(t, "Z", time.Now())
+	if _, err := Attribute(ctx, "NEW", "CODEZ"); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(pendingKey("NEW")); ttl != time.Minute {
+		t.Fatalf("pending code expires in %s, want the attribution window", ttl)
+	}
+
+	invitee := &models.User{UserID: "NEW", Address: "addr-NEW", CreatedAt: time.Now()}
+	if err := daos.DB.Create(invitee).Error; err != nil {
+		t.Fatal(err)
+	}
+	inviter, err := AttributeSignup(ctx, daos.DB, invitee, "", "")
+	if err != nil || inviter == nil || inviter.UserID != "A" {
+		t.Fatalf("signup with pending code: %+v %v", inviter, err)
+	}
+	if got := chain(t, "NEW"); got[1] != "A" {
+		t.Fatalf("chain %v", got)
+	}
+
+	// 没有推荐码时不归因
+	other := &models.User{UserID: "OTHER", CreatedAt: time.Now()}
+	if inviter, err := AttributeSignup(ctx, daos.DB, other, "", ""); inviter != nil || err != nil {
+		t.Fatalf("signup without code: %+v %v", inviter, err)
+	}
+	if _, err := AttributeSignup(ctx, daos.DB, other, "", "addr-missing"); !errors.Is(err, ErrInviterNotFound) {
+		t.Fatalf("unknown inviter address: %v", err)
+	}
+}
@@ -0,0 +1,433 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/ledger"
+	"tbooks/models"
+	"time"
+)
+
+// 每个用户注册时为其每一级上级写入一条 Invitation，邀请链最多 maxLevels 层
+// 后台任务按账本分录ID顺序读取用户的收益，按各级比例通过账本给上级返佣；奖励被撤回时按撤回比例收回返佣
+
+const (
+	// defaultMaxLevels 未配置时记录的邀请链层数
+	defaultMaxLevels = 10
+	// cursorKey 已处理到的账本分录ID
+	cursorKey = "referral_cursor"
+	// batchSize 每批处理的账本分录数
+	batchSize = 200
+	// maxCycleChecks 检查邀请环时最多向上查找的次数，每次跨越 MaxLevels 层
+	maxCycleChecks = 100
+)
+
+var (
+	ErrInviterNotFound = errors.New("Invitation address not found")
+	ErrSelfInvite      = errors.New("Cannot invite yourself")
+	ErrCyclicReferral  = errors.New("Cyclic referral is not allowed")
+)
+
+// defaultRates 未配置时各级的返佣比例
+var defaultRates = []float64{0.1, 0.05}
+
+// earningReasons 需要给上级返佣的收益
+var earningReasons = []ledger.Reason{ledger.ReasonDrawPrize, ledger.ReasonTaskReward, ledger.ReasonAchievementReward}
+
+// Rates 各级的返佣比例，第 0 项为直接邀请人
+func Rates() []float64 {
+	if rates := configs.Config().Referral.Rates; len(rates) > 0 {
+		return rates
+	}
+	return defaultRates
+}
+
+// MaxLevels 为每个用户记录的邀请链层数
+func MaxLevels() int {
+	levels := configs.Config().Referral.MaxLevels
+	if levels <= 0 {
+		levels = defaultMaxLevels
+	}
+	return max(levels, len(Rates()))
+}
+
+// FindInviter 按地址查找邀请人
+func FindInviter(tx *gorm.DB, address string) (*models.User, error) {
+	var inviter models.User
+	err := tx.Where("address = ?", address).First(&inviter).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrInviterNotFound
+	}
+	return &inviter, err
+}
+
+// isAncestor userID 是否为 descendantID 的上级
+// 邀请链只记录 MaxLevels 层，超过时从最上层的上级继续向上查找
+func isAncestor(tx *gorm.DB, userID, descendantID string) (bool, error) {
+	current := descendantID
+	for i := 0; i < maxCycleChecks; i++ {
+		var chain []models.Invitation
+		if err := tx.Where("invitee_user_id = ?", current).Order("level").Find(&chain).Error; err != nil {
+			return false, err
+		}
+		for _, inv := range chain {
+			if inv.InviterID == userID {
+				return true, nil
+			}
+		}
+		if len(chain) == 0 {
+			return false, nil
+		}
+		current = chain[len(chain)-1].InviterID
+	}
+	return false, errors.New("Referral chain is too deep")
+}
+
+// Attach 记录用户的邀请链：邀请人为第 1 级，邀请人的第 n 级上级为第 n+1 级
+// 已经邀请过其他用户的老用户补充归因时，同时把新的上级补到其下级的邀请链中
+func Attach(tx *gorm.DB, invitee, inviter *models.User) error {
+	if invitee.UserID == inviter.UserID {
+		return ErrSelfInvite
+	}
+	cyclic, err := isAncestor(tx, invitee.UserID, inviter.UserID)
+	if err != nil {
+		return err
+	}
+	if cyclic {
+		return ErrCyclicReferral
+	}
+
+	levels := MaxLevels()
+	var upper []models.Invitation
+	if err := tx.Where("invitee_user_id = ? AND level < ?", inviter.UserID, levels).Order("level").Find(&upper).Error; err != nil {
+		return err
+	}
+	ancestors := make([]models.Invitation, 0, len(upper)+1)
+	ancestors = append(ancestors, models.Invitation{InviterID: inviter.UserID, InviterAddress: inviter.Address, Level: 1})
+	for _, inv := range upper {
+		ancestors = append(ancestors, models.Invitation{InviterID: inv.InviterID, InviterAddress: inv.InviterAddress, Level: inv.Level + 1})
+	}
+
+	var descendants []models.Invitation
+	if err := tx.Where("inviter_id = ? AND level < ?", invitee.UserID, levels).Find(&descendants).Error; err != nil {
+		return err
+	}
+	// 用户自己相对于自己是第 0 级
+	descendants = append(descendants, models.Invitation{InviteeUserID: invitee.UserID, InviteeAddress: invitee.Address})
+
+	now := time.Now()
+	var chain []models.Invitation
+	for _, desc := range descendants {
+		for _, anc := range ancestors {
+			if desc.Level+anc.Level > levels {
+				break
+			}
+			chain = append(chain, models.Invitation{
+				InviterID:      anc.InviterID,
+				InviterAddress: anc.InviterAddress,
+				InviteeUserID:  desc.InviteeUserID,
+				InviteeAddress: desc.InviteeAddress,
+				Level:          desc.Level + anc.Level,
+				CreatedAt:      now,
+			})
+		}
+	}
+	return tx.Create(&chain).Error
+}
+
+// Commission 按比例计算返佣，不足最小单位的部分舍去
+func Commission(amount models.Amount, rate float64) models.Amount {
+	if amount <= 0 || rate <= 0 {
+		return 0
+	}
+	return models.Amount(math.Floor(float64(amount) * rate))
+}
+
+// loadCursor 读取处理进度，首次运行时从当前最新的分录开始，不为历史收益返佣
+func loadCursor(ctx context.Context) (uint, error) {
+	cursor, err := configs.Rdb.Get(ctx, cursorKey).Uint64()
+	if err == nil {
+		return uint(cursor), nil
+	}
+	if err != redis.Nil {
+		return 0, err
+	}
+	var latest uint
+	if err := daos.DB.Model(&models.LedgerEntry{}).Select("COALESCE(MAX(id), 0)").Scan(&latest).Error; err != nil {
+		return 0, err
+	}
+	if err := configs.Rdb.SetNX(ctx, cursorKey, latest, 0).Err(); err != nil {
+		return 0, err
+	}
+	cursor, err = configs.Rdb.Get(ctx, cursorKey).Uint64()
+	return uint(cursor), err
+}
+
+// Process 为新入账的收益给上级返佣，返回处理的分录数
+func Process(ctx context.Context) (int, error) {
+	cursor, err := loadCursor(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rates := Rates()
+	processed := 0
+	for {
+		var entries []models.LedgerEntry
+		if err := daos.DB.Where("id > ? AND account LIKE ? AND ((reason IN ? AND amount > 0) OR (reason = ? AND amount < 0))",
+			cursor, "user:%", earningReasons, ledger.ReasonRewardRevoked).
+			Order("id").Limit(batchSize).Find(&entries).Error; err != nil {
+			return processed, err
+		}
+		for _, entry := range entries {
+			handle := pay
+			if entry.Reason == string(ledger.ReasonRewardRevoked) {
+				handle = reverse
+			}
+			if err := handle(ctx, entry, rates); err != nil {
+				return processed, err
+			}
+			cursor = entry.ID
+			if err := configs.Rdb.Set(ctx, cursorKey, cursor, 0).Err(); err != nil {
+				return processed, err
+			}
+			processed++
+		}
+		if len(entries) < batchSize {
+			return processed, nil
+		}
+	}
+}
+
+// pay 为一笔收益给各级上级返佣
+// 返佣记录与入账在同一事务中，入账以分录ID和层级幂等，重复处理不会重复返佣
+func pay(ctx context.Context, entry models.LedgerEntry, rates []float64) error {
+	userID := strings.TrimPrefix(entry.Account, ledger.UserAccount(""))
+	var chain []models.Invitation
+	if err := daos.DB.Where("invitee_user_id = ? AND level <= ?", userID, len(rates)).Order("level").Find(&chain).Error; err != nil {
+		return err
+	}
+	for _, inv := range chain {
+		amount := Commission(entry.Amount, rates[inv.Level-1])
+		if amount <= 0 {
+			continue
+		}
+		err := daos.DB.Transaction(func(tx *gorm.DB) error {
+			commission := models.ReferralCommission{
+				SourceEntryID: entry.ID,
+				InviterID:     inv.InviterID,
+				InviteeUserID: userID,
+				Level:         inv.Level,
+				Reason:        entry.Reason,
+				Amount:        amount,
+				CreatedAt:     time.Now(),
+			}
+			if err := tx.Create(&commission).Error; err != nil {
+				return err
+			}
+			refID := strconv.FormatUint(uint64(entry.ID), 10) + ":" + strconv.Itoa(inv.Level)
+			_, err := ledger.Credit(ctx, inv.InviterID, amount, ledger.ReasonReferralCommission, refID)
+			return err
+		})
+		switch {
+		case errors.Is(err, gorm.ErrDuplicatedKey):
+			// 已经返佣过
+		case errors.Is(err, gorm.ErrRecordNotFound):
+			logs.Warn("Skip referral commission for missing inviter %s", inv.InviterID)
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
+
+// revokedSuffix 撤回奖励的业务ID后缀，与 quest.Revoke 一致
+const revokedSuffix = ":revoked"
+
+// reverse 奖励被撤回时按撤回比例收回该奖励产生的返佣，上级余额不足时只收回到 0
+// 收回记录为负数的返佣，以撤回分录ID和层级幂等
+func reverse(ctx context.Context, entry models.LedgerEntry, _ []float64) error {
+	userID := strings.TrimPrefix(entry.Account, ledger.UserAccount(""))
+	var source models.LedgerEntry
+	err := daos.DB.Where("account = ? AND ref_id = ? AND reason IN ? AND amount > 0",
+		entry.Account, strings.TrimSuffix(entry.RefID, revokedSuffix), earningReasons).Order("id").First(&source).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var paid []models.ReferralCommission
+	if err := daos.DB.Where("source_entry_id = ? AND amount > 0", source.ID).Order("level").Find(&paid).Error; err != nil {
+		return err
+	}
+	for _, commission := range paid {
+		amount := min(commission.Amount, models.Amount(int64(commission.Amount)*int64(-entry.Amount)/int64(source.Amount)))
+		if amount <= 0 {
+			continue
+		}
+		err := daos.DB.Transaction(func(tx *gorm.DB) error {
+			reversal := models.ReferralCommission{
+				SourceEntryID: entry.ID,
+				InviterID:     commission.InviterID,
+				InviteeUserID: userID,
+				Level:         commission.Level,
+				Reason:        entry.Reason,
+				Amount:        -amount,
+				CreatedAt:     time.Now(),
+			}
+			if err := tx.Create(&reversal).Error; err != nil {
+				return err
+			}
+			refID := strconv.FormatUint(uint64(entry.ID), 10) + ":" + strconv.Itoa(commission.Level)
+			debited, err := debitUpTo(ctx, commission.InviterID, amount, refID)
+			if err != nil || debited == amount {
+				return err
+			}
+			return tx.Model(&reversal).Update("amount", -debited).Error
+		})
+		switch {
+		case errors.Is(err, gorm.ErrDuplicatedKey):
+			// 已经收回过
+		case err != nil:
+			return err
+		}
+	}
+	return nil
+}
+
+// debitUpTo 收回返佣，余额不足时只扣到 0，返回实际扣减的金额
+func debitUpTo(ctx context.Context, userID string, amount models.Amount, refID string) (models.Amount, error) {
+	balance, err := ledger.Debit(ctx, userID, amount, ledger.ReasonCommissionReversed, refID)
+	if errors.Is(err, ledger.ErrInsufficientBalance) {
+		if balance <= 0 {
+			return 0, nil
+		}
+		amount = balance
+		_, err = ledger.Debit(ctx, userID, amount, ledger.ReasonCommissionReversed, refID)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return amount, nil
+}
+
+// Node 邀请树中的一个用户
+type Node struct {
+	UserID     string        `json:"user_id"`
+	Address    string        `json:"address"`
+	Level      int           `json:"level"`      // 相对于树根的层级
+	JoinedAt   time.Time     `json:"joined_at"`  // 注册时间
+	Commission models.Amount `json:"commission"` // 树根从该用户获得的累计返佣
+	Children   []*Node       `json:"children"`
+}
+
+// LevelStats 每一级的人数和累计返佣
+type LevelStats struct {
+	Level      int           `json:"level"`
+	Count      int64         `json:"count"`
+	Commission models.Amount `json:"commission"`
+	Rate       float64       `json:"rate"` // 当前返佣比例
+}
+
+// Tree 用户的邀请树
+type Tree struct {
+	Levels     []LevelStats  `json:"levels"`
+	Commission models.Amount `json:"commission"` // 累计返佣
+	Children   []*Node       `json:"children"`   // 直接邀请的用户
+}
+
+// GetTree 返回用户的邀请树、每一级的人数和累计返佣
+func GetTree(userID string) (*Tree, error) {
+	var descendants []models.Invitation
+	if err := daos.DB.Where("inviter_id = ?", userID).Order("level, id").Find(&descendants).Error; err != nil {
+		return nil, err
+	}
+
+	// 每个下级的直接邀请人即其在树中的父节点
+	ids := make([]string, len(descendants))
+	for i, inv := range descendants {
+		ids[i] = inv.InviteeUserID
+	}
+	parents := make(map[string]string, len(ids))
+	if len(ids) > 0 {
+		var direct []models.Invitation
+		if err := daos.DB.Where("invitee_user_id IN ? AND level = ?", ids, 1).Find(&direct).Error; err != nil {
+			return nil, err
+		}
+		for _, inv := range direct {
+			parents[inv.InviteeUserID] = inv.InviterID
+		}
+	}
+
+	var byInvitee []struct {
+		InviteeUserID string
+		Level         int
+		Total         models.Amount
+	}
+	if err := daos.DB.Model(&models.ReferralCommission{}).
+		Select("invitee_user_id, level, SUM(amount) AS total").
+		Where("inviter_id = ?", userID).
+		Group("invitee_user_id, level").
+		Scan(&byInvitee).Error; err != nil {
+		return nil, err
+	}
+	commissions := make(map[string]models.Amount, len(byInvitee))
+	levelCommissions := make(map[int]models.Amount)
+	tree := &Tree{Children: []*Node{}}
+	for _, row := range byInvitee {
+		commissions[row.InviteeUserID] += row.Total
+		levelCommissions[row.Level] += row.Total
+		tree.Commission += row.Total
+	}
+
+	nodes := map[string]*Node{userID: {Children: []*Node{}}}
+	levelCounts := make(map[int]int64)
+	for _, inv := range descendants {
+		node := &Node{
+			UserID:     inv.InviteeUserID,
+			Address:    inv.InviteeAddress,
+			Level:      inv.Level,
+			JoinedAt:   inv.CreatedAt,
+			Commission: commissions[inv.InviteeUserID],
+			Children:   []*Node{},
+		}
+		nodes[inv.InviteeUserID] = node
+		levelCounts[inv.Level]++
+	}
+	// 按层级从小到大挂到父节点上
+	for _, inv := range descendants {
+		if parent, ok := nodes[parents[inv.InviteeUserID]]; ok {
+			parent.Children = append(parent.Children, nodes[inv.InviteeUserID])
+		}
+	}
+	tree.Children = nodes[userID].Children
+
+	rates := Rates()
+	seen := make(map[int]bool)
+	for level := range levelCounts {
+		seen[level] = true
+	}
+	for level := range levelCommissions {
+		seen[level] = true
+	}
+	for level := 1; level <= len(rates); level++ {
+		seen[level] = true
+	}
+	for level := range seen {
+		stats := LevelStats{Level: level, Count: levelCounts[level], Commission: levelCommissions[level]}
+		if level <= len(rates) {
+			stats.Rate = rates[level-1]
+		}
+		tree.Levels = append(tree.Levels, stats)
+	}
+	sort.Slice(tree.Levels, func(i, j int) bool { return tree.Levels[i].Level < tree.Levels[j].Level })
+	return tree, nil
+}
@@ -0,0 +1,252 @@
+package referral
+
+import (
+	"context"
+	"errors"
+	"gorm.io/gorm"
+	"strings"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/ledger"
+	"tbooks/models"
+	"testing"
+	"time"
+)
+
+// chain 用户的各级上级，键为层级
+func chain(t *testing.T, userID string) map[int]string {
+	t.Helper()
+	var invitations []models.Invitation
+	if err := daos.DB.Where("invitee_user_id = ?", userID).Find(&invitations).Error; err != nil {
+		t.Fatal(err)
+	}
+	levels := make(map[int]string, len(invitations))
+	for _, inv := range invitations {
+		levels[inv.Level] = inv.InviterID
+	}
+	return levels
+}
+
+func equal(got map[int]string, want ...string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i, id := range want {
+		if got[i+1] != id {
+			return false
+		}
+	}
+	return true
+}
+
+func TestAttach(t *testing.T) {
+	daostest.Open(t)
+	configtest.Load(t, "referral:\n  maxlevels: 3\n")
+	users := make(map[string]*models.User)
+	for _, id := range []string{"A", "B", "C", "D", "E", "F"} {
+		users[id] = &models.User{UserID: id, Address: "addr-" + id, CreatedAt: time.Now()}
+	}
+	attach := func(invitee, inviter string) error {
+		return daos.DB.Transaction(func(tx *gorm.DB) error {
+			return Attach(tx, users[invitee], users[inviter])
+		})
+	}
+
+	if err := attach("A", "A"); !errors.Is(err, ErrSelfInvite) {
+		t.Fatalf("A -> A: %v", err)
+	}
+	if err := attach("B", "A"); err != nil {
+		t.Fatal(err)
+	}
+	if err := attach("A", "B"); !errors.Is(err, ErrCyclicReferral) {
+		t.Fatalf("A -> B -> A: %v", err)
+	}
+	if err := attach("C", "B"); err != nil {
+		t.Fatal(err)
+	}
+	if got := chain(t, "C"); !equal(got, "B", "A") {
+		t.Fatalf("C chain %v, want [B A]", got)
+	}
+
+	// 已经邀请过 E 的 D 补充归因到 C，E 的邀请链随之补上新的上级，超过 3 层的部分不记录
+	if err := attach("E", "D"); err != nil {
+		t.Fatal(err)
+	}
+	if err := attach("D", "C"); err != nil {
+		t.Fatal(err)
+	}
+	if got := chain(t, "D"); !equal(got, "C", "B", "A") {
+		t.Fatalf("D chain %v, want [C B A]", got)
+	}
+	if got := chain(t, "E"); !equal(got, "D", "C", "B") {
+		t.Fatalf("E chain %v, want [D C B]", got)
+	}
+
+	// A 在 F 的第 4 级，超出 E 记录的层数，仍要识别出环
+	if err := attach("F", "E"); err != nil {
+		t.Fatal(err)
+	}
+	if err := attach("A", "F"); !errors.Is(err, ErrCyclicReferral) {
+		t.Fatalf("A -> F -> ... -> A: %v", err)
+	}
+	if got := chain(t, "A"); len(got) != 0 {
+		t.Fatalf("A chain %v after rejected attachments", got)
+	}
+}
+
+func TestCommission(t *testing.T) {
+	tests := []struct {
+		amount models.Amount
+		rate   float64
+		want   models.Amount
+	}{
+		{models.Units(10), 0.1, models.Units(1)},
+		{999, 0.1, 99}, // 向下取整
+		{1, 0.05, 0},
+		{-100, 0.1, 0},
+		{100, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := Commission(tt.amount, tt.rate); got != tt.want {
+			t.Fatalf("Commission(%d, %v) = %d, want %d", tt.amount, tt.rate, got, tt.want)
+		}
+	}
+}
+
+// commissions 用户收到的返佣记录，按ID排序
+func commissions(t *testing.T, inviterID string) []models.Amount {
+	t.Helper()
+	var list []models.ReferralCommission
+	if err := daos.DB.Where("inviter_id = ?", inviterID).Order("id").Find(&list).Error; err != nil {
+		t.Fatal(err)
+	}
+	amounts := make([]models.Amount, len(list))
+	for i, c := range list {
+		amounts[i] = c.Amount
+	}
+	return amounts
+}
+
+func balance(t *testing.T, userID string) models.Amount {
+	t.Helper()
+	v, err := configs.Rdb.Get(context.Background(), ledger.BalanceKey(userID)).Int64()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return models.Amount(v)
+}
+
+// post 入账并写入账本后处理返佣
+func post(t *testing.T, userID string, amount models.Amount, reason ledger.Reason, refID string) {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := ledger.Post(ctx, userID, amount, reason, refID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ledger.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Process(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "referral:\n  rates: [0.1, 0.05]\n")
+	now := time.Now()
+	a, b, c := newUser(t, "A", now), newUser(t, "B", now), newUser(t, "C", now)
+	if err := Attach(daos.DB, b, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := Attach(daos.DB, c, b); err != nil {
+		t.Fatal(err)
+	}
+	// 首次运行从当前最新的分录开始
+	post(t, "C", models.Units(1000), ledger.ReasonDrawPrize, "before")
+	if got := commissions(t, "B"); len(got) != 0 {
+		t.Fatalf("commission paid for history: %v", got)
+	}
+
+	post(t, "C", models.Units(100), ledger.ReasonTaskReward, "follow")
+	post(t, "C", models.Units(100), ledger.ReasonAdjustment, "manual") // 不是收益
+	if got := commissions(t, "B"); len(got) != 1 || got[0] != models.Units(10) {
+		t.Fatalf("B commissions %v", got)
+	}
+	if got := commissions(t, "A"); len(got) != 1 || got[0] != models.Units(5) {
+		t.Fatalf("A commissions %v", got)
+	}
+
+	// 重新处理同一分录不重复返佣
+	var entry models.LedgerEntry
+	daos.DB.Where("account = ? AND ref_id = ?", "user:C", "follow").First(&entry)
+	if err := pay(context.Background(), entry, Rates()); err != nil {
+		t.Fatal(err)
+	}
+	if b := balance(t, "B"); b != models.Units(10) {
+		t.Fatalf("B balance %s after replay", b)
+	}
+
+	// 奖励撤回时收回返佣，B 已经花掉一部分，只收回到 0
+	post(t, "B", -models.Units(6), ledger.ReasonCardPurchase, "spent")
+	post(t, "C", -models.Units(100), ledger.ReasonRewardRevoked, "follow:revoked")
+	if got := commissions(t, "B"); len(got) != 2 || got[1] != -models.Units(4) {
+		t.Fatalf("B commissions after revoke %v", got)
+	}
+	if got := commissions(t, "A"); len(got) != 2 || got[1] != -models.Units(5) {
+		t.Fatalf("A commissions after revoke %v", got)
+	}
+	if a, b := balance(t, "A"), balance(t, "B"); a != 0 || b != 0 {
+		t.Fatalf("balances after revoke: A %s, B %s", a, b)
+	}
+	// 重复处理撤回不重复收回
+	daos.DB.Where("account = ? AND ref_id = ?", "user:C", "follow:revoked").First(&entry)
+	if err := reverse(context.Background(), entry, Rates()); err != nil {
+		t.Fatal(err)
+	}
+	if got := commissions(t, "A"); len(got) != 2 {
+		t.Fatalf("A commissions after replayed revoke %v", got)
+	}
+
+	// 部分撤回按比例收回
+	post(t, "C", models.Units(100), ledger.ReasonAchievementReward, "streak")
+	post(t, "C", -models.Units(50), ledger.ReasonRewardRevoked, "streak:revoked")
+	if got := commissions(t, "B"); len(got) != 4 || got[2] != models.Units(10) || got[3] != -models.Units(5) {
+		t.Fatalf("B commissions after partial revoke %v", got)
+	}
+	if got := commissions(t, "A"); len(got) != 4 || got[3] != -models.Amount(250) {
+		t.Fatalf("A commissions after partial revoke %v", got)
+	}
+	if b := balance(t, "B"); b != models.Units(5) {
+		t.Fatalf("B balance %s", b)
+	}
+}
+
+func TestNewCode(t *testing.T) {
+	seen := make(map[string]bool)
+	for i := 0; i < 1000; i++ {
+		code, err := newCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(code) != codeLength {
+			t.Fatalf("code %q has length %d, want %d", code, len(code), codeLength)
+		}
+		for _, r := range code {
+			if !strings.ContainsRune(codeAlphabet, r) {
+				t.Fatalf("code %q contains %q outside the alphabet", code, r)
+			}
+		}
+		if seen[code] {
+			t.Fatalf("duplicate code %q", code)
+		}
+		seen[code] = true
+		// 用户输入的推荐码不区分大小写
+		if NormalizeCode(" "+strings.ToLower(code)+"\n") != code {
+			t.Fatalf("NormalizeCode did not restore %q", code)
+		}
+	}
+}
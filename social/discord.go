@@ -0,0 +1,99 @@
+package social
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"tbooks/configs"
+)
+
+const (
+	// defaultDiscordApiURL Discord 接口地址
+	defaultDiscordApiURL = "https://discord.com/api/v10"
+	// discordAuthorizeURL Discord 授权页面
+	discordAuthorizeURL = "https://discord.com/oauth2/authorize"
+	// discordScopes 读取用户身份和在服务器中的成员信息
+	discordScopes = "identify guilds.members.read"
+)
+
+// DiscordVerifier 通过用户授权的 OAuth 令牌校验用户是否加入服务器
+type DiscordVerifier struct {
+	ApiURL     string // 为空时使用 defaultDiscordApiURL
+	HTTPClient *http.Client
+}
+
+func (d *DiscordVerifier) apiURL() string {
+	if d.ApiURL != "" {
+		return strings.TrimRight(d.ApiURL, "/")
+	}
+	return defaultDiscordApiURL
+}
+
+func (d *DiscordVerifier) config() configs.OAuthConfig {
+	return configs.Config().Social.Discord.OAuthConfig
+}
+
+func (d *DiscordVerifier) authURL(cfg configs.OAuthConfig, state, challenge string) string {
+	return discordAuthorizeURL + "?" + url.Values{
+		"response_type": {"code"},
+		"client_id":     {cfg.ClientID},
+		"redirect_uri":  {cfg.RedirectURL},
+		"scope":         {discordScopes},
+		"state":         {state},
+		"prompt":        {"none"},
+	}.Encode()
+}
+
+func (d *DiscordVerifier) exchange(ctx context.Context, form url.Values) (*Token, error) {
+	// Discord 的机密客户端不使用 PKCE
+	form.Del("code_verifier")
+	return postForm(ctx, d.HTTPClient, d.apiURL()+"/oauth2/token", form, d.config(), false)
+}
+
+func (d *DiscordVerifier) get(ctx context.Context, accessToken, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.apiURL()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return doJSON(d.HTTPClient, req, out)
+}
+
+func (d *DiscordVerifier) identity(ctx context.Context, accessToken string) (*Identity, error) {
+	var out struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	if err := d.get(ctx, accessToken, "/users/@me", &out); err != nil {
+		return nil, fmt.Errorf("discord identity: %w", err)
+	}
+	return &Identity{ID: out.ID, Username: out.Username}, nil
+}
+
+// Verify 用户绑定的 Discord 账号是否为服务器成员
+func (d *DiscordVerifier) Verify(ctx context.Context, userID string) (bool, error) {
+	guildID := configs.Config().Social.Discord.GuildID
+	if guildID == "" {
+		return false, errors.New("Discord guild is not configured")
+	}
+	account, err := accessToken(ctx, d, userID, PlatformDiscord)
+	if err != nil {
+		return false, err
+	}
+	err = d.get(ctx, account.AccessToken, "/users/@me/guilds/"+url.PathEscape(guildID)+"/member", nil)
+	var httpErr *httpError
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.As(err, &httpErr) && httpErr.Status == http.StatusNotFound:
+		// 不在服务器中
+		return false, nil
+	case errors.As(err, &httpErr) && httpErr.Status == http.StatusUnauthorized:
+		// 用户撤销了授权
+		return false, ErrNotLinked
+	}
+	return false, fmt.Errorf("discord guild member: %w", err)
+}
@@ -0,0 +1,288 @@
+package social
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/models"
+	"time"
+)
+
+const (
+	// oauthStateExpire 授权链接的有效期
+	oauthStateExpire = 10 * time.Minute
+	// tokenRefreshMargin access token 过期前多久刷新
+	tokenRefreshMargin = time.Minute
+)
+
+var (
+	ErrInvalidState  = errors.New("Invalid or expired OAuth state")
+	ErrAccountTaken  = errors.New("Social account is already linked to another user")
+	ErrAccountLocked = errors.New("Linked account cannot be changed after the task reward was granted")
+)
+
+// Identity 平台上的用户身份
+type Identity struct {
+	ID       string
+	Username string
+}
+
+// Token OAuth 令牌
+type Token struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// oauthProvider 需要用户授权的平台
+type oauthProvider interface {
+	config() configs.OAuthConfig
+	authURL(cfg configs.OAuthConfig, state, challenge string) string
+	exchange(ctx context.Context, form url.Values) (*Token, error)
+	identity(ctx context.Context, accessToken string) (*Identity, error)
+}
+
+func provider(platform string) (oauthProvider, bool) {
+	p, ok := Verifiers[platform].(oauthProvider)
+	return p, ok
+}
+
+// oauthState 授权过程中保存在 Redis 中的状态
+type oauthState struct {
+	UserID   string `json:"user_id"`
+	Platform string `json:"platform"`
+	Verifier string `json:"verifier"` // PKCE code_verifier
+}
+
+func oauthStateKey(state string) string {
+	return "social_oauth_state:" + state
+}
+
+func randomString(n int) (string, error) {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// AuthorizeURL 生成绑定社交账号的授权链接
+func AuthorizeURL(ctx context.Context, userID, platform string) (string, error) {
+	p, ok := provider(platform)
+	if !ok {
+		return "", ErrUnknownPlatform
+	}
+	cfg := p.config()
+	if cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return "", fmt.Errorf("%s OAuth is not configured", platform)
+	}
+	state, err := randomString(24)
+	if err != nil {
+		return "", err
+	}
+	verifier, err := randomString(32)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(oauthState{UserID: userID, Platform: platform, Verifier: verifier})
+	if err != nil {
+		return "", err
+	}
+	if err := configs.Rdb.Set(ctx, oauthStateKey(state), data, oauthStateExpire).Err(); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	return p.authURL(cfg, state, base64.RawURLEncoding.EncodeToString(sum[:])), nil
+}
+
+// Link 处理授权回调，用授权码换取令牌并绑定账号
+func Link(ctx context.Context, platform, state, code string) (*models.SocialAccount, error) {
+	p, ok := provider(platform)
+	if !ok {
+		return nil, ErrUnknownPlatform
+	}
+	// 授权状态只能使用一次
+	data, err := configs.Rdb.GetDel(ctx, oauthStateKey(state)).Result()
+	if err == redis.Nil {
+		return nil, ErrInvalidState
+	} else if err != nil {
+		return nil, err
+	}
+	var st oauthState
+	if err := json.Unmarshal([]byte(data), &st); err != nil || st.Platform != platform {
+		return nil, ErrInvalidState
+	}
+
+	cfg := p.config()
+	token, err := p.exchange(ctx, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {cfg.RedirectURL},
+		"code_verifier": {st.Verifier},
+	})
+	if err != nil {
+		return nil, err
+	}
+	id, err := p.identity(ctx, token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	account := models.SocialAccount{
+		UserID:       st.UserID,
+		Platform:     platform,
+		ExternalID:   id.ID,
+		Username:     id.Username,
+		AccessToken:  token.AccessToken,
+		RefreshToken: token.RefreshToken,
+		ExpiresAt:    time.Now().Add(time.Duration(token.ExpiresIn) * time.Second),
+	}
+	err = daos.DB.Transaction(func(tx *gorm.DB) error {
+		return saveAccount(tx, &account)
+	})
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		// 并发绑定同一账号
+		return nil, ErrAccountTaken
+	} else if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// saveAccount 绑定或更新用户在平台上的账号
+// 同一平台账号只能绑定一个用户；已经领取过奖励的用户不能换绑，否则原账号可以再被其他用户用来领取奖励
+func saveAccount(tx *gorm.DB, account *models.SocialAccount) error {
+	var owner models.SocialAccount
+	err := tx.Where("platform = ? AND external_id = ?", account.Platform, account.ExternalID).First(&owner).Error
+	if err == nil && owner.UserID != account.UserID {
+		return ErrAccountTaken
+	} else if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+
+	var current models.SocialAccount
+	err = tx.Where("user_id = ? AND platform = ?", account.UserID, account.Platform).First(&current).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return tx.Create(account).Error
+	} else if err != nil {
+		return err
+	}
+	if current.ExternalID != account.ExternalID {
+		var rewarded int64
+		if err := tx.Model(&models.SocialClaim{}).Where("user_id = ? AND platform = ? AND status IN ?", account.UserID, account.Platform,
+			[]models.SocialClaimStatus{models.SocialClaimVerified, models.SocialClaimRevoked}).Count(&rewarded).Error; err != nil {
+			return err
+		}
+		if rewarded > 0 {
+			return ErrAccountLocked
+		}
+	}
+	account.ID, account.CreatedAt = current.ID, current.CreatedAt
+	return tx.Model(account).Select("external_id", "username", "access_token", "refresh_token", "expires_at", "updated_at").
+		Updates(account).Error
+}
+
+// accessToken 返回用户绑定账号的有效 access token，即将过期时刷新
+func accessToken(ctx context.Context, p oauthProvider, userID, platform string) (*models.SocialAccount, error) {
+	var account models.SocialAccount
+	err := daos.DB.Where("user_id = ? AND platform = ?", userID, platform).First(&account).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNotLinked
+	} else if err != nil {
+		return nil, err
+	}
+	if time.Now().Add(tokenRefreshMargin).Before(account.ExpiresAt) {
+		return &account, nil
+	}
+	if account.RefreshToken == "" {
+		return nil, ErrNotLinked
+	}
+	token, err := p.exchange(ctx, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {account.RefreshToken},
+	})
+	if err != nil {
+		return nil, err
+	}
+	account.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		account.RefreshToken = token.RefreshToken
+	}
+	account.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	if err := daos.DB.Model(&account).Select("access_token", "refresh_token", "expires_at", "updated_at").Updates(&account).Error; err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// httpError 平台接口返回的非成功状态
+type httpError struct {
+	Status int
+	Body   string
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.Status, e.Body)
+}
+
+// doJSON 发送请求并解析 JSON 响应，非 2xx 状态返回 *httpError，请求失败时错误中不包含请求地址
+func doJSON(client *http.Client, req *http.Request, out interface{}) error {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", req.Method, req.URL.Host, stripURL(err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return &httpError{Status: resp.StatusCode, Body: strings.TrimSpace(string(body))}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// stripURL 去掉 *url.Error 中的请求地址，Telegram 的地址中带有机器人令牌，不能写入错误信息
+func stripURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
+
+// postForm 以表单提交令牌请求，basicAuth 为 true 时用客户端凭据做 HTTP Basic 认证
+func postForm(ctx context.Context, client *http.Client, endpoint string, form url.Values, cfg configs.OAuthConfig, basicAuth bool) (*Token, error) {
+	if !basicAuth {
+		form.Set("client_id", cfg.ClientID)
+		form.Set("client_secret", cfg.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if basicAuth {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+	var token Token
+	if err := doJSON(client, req, &token); err != nil {
+		return nil, err
+	}
+	return &token, nil
+}
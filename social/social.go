@@ -0,0 +1,261 @@
+package social
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"gorm.io/gorm"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/models"
+	"tbooks/quest"
+	"time"
+)
+
+// 用户声明完成社交任务后由对应平台的 Verifier 校验，校验通过才发放奖励
+// 未通过的声明进入 pending 状态由后台任务重新检查，发放后在撤回窗口内退出的撤回奖励
+
+const (
+	PlatformDiscord  = "discord"
+	PlatformX        = "x"
+	PlatformTelegram = "telegram"
+
+	defaultRecheckInterval   = 5 * time.Minute
+	defaultMaxAttempts       = 12
+	defaultRetentionInterval = time.Hour
+	// batchSize 每批重新检查的声明数
+	batchSize = 100
+	// verifyTimeout 单次校验的超时时间
+	verifyTimeout = 10 * time.Second
+)
+
+var (
+	ErrUnknownPlatform = errors.New("Invalid task type")
+	ErrNotLinked       = errors.New("Social account is not linked")
+	ErrClaimRevoked    = errors.New("Reward was revoked because the task is no longer completed")
+)
+
+// Verifier 校验用户当前是否完成了某个平台的任务
+// 返回 false 表示确定未完成，返回错误表示暂时无法确定
+type Verifier interface {
+	Verify(ctx context.Context, userID string) (bool, error)
+}
+
+// Verifiers 各平台的校验器，测试时可以替换
+var Verifiers = map[string]Verifier{
+	PlatformTelegram: &TelegramVerifier{},
+	PlatformDiscord:  &DiscordVerifier{},
+	PlatformX:        &XVerifier{},
+}
+
+// triggers 平台对应的任务完成条件
+var triggers = map[string]models.TaskTrigger{
+	PlatformDiscord:  models.TaskTriggerJoinedDiscord,
+	PlatformX:        models.TaskTriggerJoinedX,
+	PlatformTelegram: models.TaskTriggerJoinedTelegram,
+}
+
+// settings 重新检查和撤回的时间设置
+type settings struct {
+	recheckInterval   time.Duration
+	maxAttempts       int
+	revokeWindow      time.Duration
+	retentionInterval time.Duration
+}
+
+func loadSettings() settings {
+	cfg := configs.Config().Social
+	s := settings{
+		recheckInterval:   defaultRecheckInterval,
+		maxAttempts:       defaultMaxAttempts,
+		revokeWindow:      time.Duration(cfg.RevokeWindow) * time.Second,
+		retentionInterval: defaultRetentionInterval,
+	}
+	if cfg.RecheckInterval > 0 {
+		s.recheckInterval = time.Duration(cfg.RecheckInterval) * time.Second
+	}
+	if cfg.MaxAttempts > 0 {
+		s.maxAttempts = cfg.MaxAttempts
+	}
+	if cfg.RetentionInterval > 0 {
+		s.retentionInterval = time.Duration(cfg.RetentionInterval) * time.Second
+	}
+	return s
+}
+
+// action 一次检查后需要执行的操作
+type action int
+
+const (
+	actionNone action = iota
+	actionGrant
+	actionRevoke
+)
+
+// advance 根据一次检查的结果更新声明状态，返回需要执行的操作
+func advance(claim *models.SocialClaim, ok bool, verifyErr error, now time.Time, s settings) action {
+	claim.LastError = ""
+	if verifyErr != nil {
+		claim.LastError = truncate(verifyErr.Error(), 255)
+	}
+
+	if claim.Status == models.SocialClaimVerified {
+		// 撤回窗口内只有确定退出才撤回，暂时无法确定时稍后再查
+		if verifyErr == nil && !ok {
+			claim.Status = models.SocialClaimRevoked
+			claim.RevokedAt = &now
+			return actionRevoke
+		}
+		claim.NextCheckAt = now.Add(s.retentionInterval)
+		return actionNone
+	}
+
+	if verifyErr == nil && ok {
+		claim.Status = models.SocialClaimVerified
+		claim.VerifiedAt = &now
+		claim.Attempts = 0
+		claim.NextCheckAt = now.Add(s.retentionInterval)
+		return actionGrant
+	}
+	claim.Attempts++
+	if claim.Attempts >= s.maxAttempts {
+		claim.Status = models.SocialClaimRejected
+		return actionNone
+	}
+	claim.Status = models.SocialClaimPending
+	claim.NextCheckAt = now.Add(time.Duration(claim.Attempts) * s.recheckInterval)
+	return actionNone
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n]
+}
+
+func verify(ctx context.Context, platform, userID string) (bool, error) {
+	verifier, ok := Verifiers[platform]
+	if !ok {
+		return false, ErrUnknownPlatform
+	}
+	ctx, cancel := context.WithTimeout(ctx, verifyTimeout)
+	defer cancel()
+	return verifier.Verify(ctx, userID)
+}
+
+// Result 提交声明的结果
+type Result struct {
+	Claim   models.SocialClaim `json:"claim"`
+	User    *models.User       `json:"user,omitempty"`
+	Rewards []quest.Progress   `json:"rewards"`
+}
+
+// Submit 用户声明完成某个平台的任务，立即校验一次
+// 校验通过时发放奖励，否则声明进入 pending 状态等待重新检查
+func Submit(ctx context.Context, userID, platform string) (*Result, error) {
+	trigger, ok := triggers[platform]
+	if !ok {
+		return nil, ErrUnknownPlatform
+	}
+	if err := daos.DB.Where("user_id = ?", userID).First(&models.User{}).Error; err != nil {
+		return nil, err
+	}
+
+	var claim models.SocialClaim
+	err := daos.DB.Where("user_id = ? AND platform = ?", userID, platform).First(&claim).Error
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		claim = models.SocialClaim{UserID: userID, Platform: platform, Status: models.SocialClaimPending}
+	case err != nil:
+		return nil, err
+	case claim.Status == models.SocialClaimRevoked:
+		return nil, ErrClaimRevoked
+	case claim.Status == models.SocialClaimVerified:
+		// 已通过校验，补发上次未完成的奖励，已发放时返回 quest.ErrAlreadyGranted
+		user, granted, err := quest.Complete(ctx, userID, trigger)
+		if err != nil {
+			return nil, err
+		}
+		return &Result{Claim: claim, User: user, Rewards: granted}, nil
+	}
+
+	member, verifyErr := verify(ctx, platform, userID)
+	if errors.Is(verifyErr, ErrNotLinked) {
+		return nil, verifyErr
+	}
+	now := time.Now()
+	// 用户重新提交时重新计算检查次数
+	if claim.Status == models.SocialClaimRejected {
+		claim.Status = models.SocialClaimPending
+		claim.Attempts = 0
+	}
+	act := advance(&claim, member, verifyErr, now, loadSettings())
+	if err := daos.DB.Save(&claim).Error; err != nil {
+		return nil, err
+	}
+
+	result := &Result{Claim: claim}
+	if act == actionGrant {
+		user, granted, err := quest.Complete(ctx, userID, trigger)
+		if err != nil {
+			return nil, err
+		}
+		result.User, result.Rewards = user, granted
+	}
+	return result, nil
+}
+
+// Recheck 重新检查到期的 pending 声明，以及撤回窗口内已发放的声明，返回检查的数量
+func Recheck(ctx context.Context) (int, error) {
+	s := loadSettings()
+	now := time.Now()
+	query := daos.DB.Where("status = ? AND next_check_at <= ?", models.SocialClaimPending, now)
+	if s.revokeWindow > 0 {
+		query = query.Or("status = ? AND next_check_at <= ? AND verified_at > ?",
+			models.SocialClaimVerified, now, now.Add(-s.revokeWindow))
+	}
+	var claims []models.SocialClaim
+	if err := query.Order("next_check_at").Limit(batchSize).Find(&claims).Error; err != nil {
+		return 0, err
+	}
+
+	// 单个声明失败时记录后继续，不影响之后的声明，下次运行时重试
+	for i := range claims {
+		if err := recheck(ctx, &claims[i], s); err != nil {
+			logs.Error("Failed to recheck %s claim %d of user %s: %v", claims[i].Platform, claims[i].ID, claims[i].UserID, err)
+		}
+	}
+	return len(claims), nil
+}
+
+func recheck(ctx context.Context, claim *models.SocialClaim, s settings) error {
+	member, verifyErr := verify(ctx, claim.Platform, claim.UserID)
+	now := time.Now()
+	act := advance(claim, member, verifyErr, now, s)
+	// 先执行撤回，失败时保留 verified 状态下次重试
+	if act == actionRevoke {
+		revoked, err := quest.Revoke(ctx, claim.UserID, triggers[claim.Platform])
+		if err != nil {
+			return fmt.Errorf("revoke %s reward of user %s: %w", claim.Platform, claim.UserID, err)
+		}
+		logs.Info("Revoked %s reward of user %s, reclaimed %s", claim.Platform, claim.UserID, revoked)
+	}
+	if err := daos.DB.Save(claim).Error; err != nil {
+		return err
+	}
+	if act == actionGrant {
+		if _, _, err := quest.Complete(ctx, claim.UserID, triggers[claim.Platform]); err != nil && !errors.Is(err, quest.ErrAlreadyGranted) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Claims 用户的全部社交任务声明
+func Claims(userID string) ([]models.SocialClaim, error) {
+	var claims []models.SocialClaim
+	err := daos.DB.Where("user_id = ?", userID).Order("platform").Find(&claims).Error
+	return claims, err
+}
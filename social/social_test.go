@@ -0,0 +1,388 @@
+package social
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gorm.io/gorm"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"testing"
+	"time"
+)
+
+func TestTelegramVerifier(t *testing.T) {
+	configtest.Load(t, "telegram:\n  bottoken: TOKEN\nsocial:\n  telegramchannel: \"@tbooks\"\n")
+
+	members := map[string]string{
+		"1": `{"ok":true,"result":{"status":"member"}}`,
+		"2": `{"ok":true,"result":{"status":"left"}}`,
+		"3": `{"ok":true,"result":{"status":"restricted","is_member":true}}`,
+		"4": `{"ok":true,"result":{"status":"kicked"}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/botTOKEN/getChatMember" || r.URL.Query().Get("chat_id") != "@tbooks" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		switch userID := r.URL.Query().Get("user_id"); userID {
+		case "5":
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"ok":false,"description":"Bad Request: user not found"}`))
+		case "6":
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"ok":false,"description":"Too Many Requests: retry after 5"}`))
+		default:
+			w.Write([]byte(members[userID]))
+		}
+	}))
+	defer srv.Close()
+
+	verifier := &TelegramVerifier{ApiURL: srv.URL}
+	tests := []struct {
+		userID  string
+		want    bool
+		wantErr bool
+	}{
+		{"1", true, false},
+		{"2", false, false},
+		{"3", true, false},
+		{"4", false, false},
+		{"5", false, false},
+		{"6", false, true},
+	}
+	for _, tt := range tests {
+		got, err := verifier.Verify(context.Background(), tt.userID)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("user %s: got %v, %v; want %v, error %v", tt.userID, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+// failingTransport 所有请求都返回连接错误
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestTelegramErrorHidesToken(t *testing.T) {
+	configtest.Load(t, "telegram:\n  bottoken: 123456:SECRET\nsocial:\n  telegramchannel: \"@tbooks\"\n")
+	old := Verifiers[PlatformTelegram]
+	Verifiers[PlatformTelegram] = &TelegramVerifier{HTTPClient: &http.Client{Transport: failingTransport{}}}
+	defer func() { Verifiers[PlatformTelegram] = old }()
+
+	ok, err := verify(context.Background(), PlatformTelegram, "1")
+	if err == nil || ok {
+		t.Fatalf("verify through a failing transport: %v, %v", ok, err)
+	}
+	claim := &models.SocialClaim{Platform: PlatformTelegram, Status: models.SocialClaimPending}
+	advance(claim, ok, err, time.Now(), settings{recheckInterval: time.Minute, maxAttempts: 3})
+	if claim.LastError == "" || strings.Contains(claim.LastError, "SECRET") {
+		t.Fatalf("last error %q", claim.LastError)
+	}
+	data, err := json.Marshal(claim)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "connection refused") {
+		t.Fatalf("claim exposes the last error: %s", data)
+	}
+}
+
+// fakeVerifier 按顺序返回预设的校验结果
+type fakeVerifier struct {
+	results []bool
+	errs    []error
+	calls   int
+}
+
+func (f *fakeVerifier) Verify(ctx context.Context, userID string) (bool, error) {
+	i := f.calls
+	f.calls++
+	return f.results[i], f.errs[i]
+}
+
+func TestClaimLifecycle(t *testing.T) {
+	s := settings{recheckInterval: time.Minute, maxAttempts: 3, revokeWindow: 24 * time.Hour, retentionInterval: time.Hour}
+	fake := &fakeVerifier{
+		results: []bool{false, false, true, true, false},
+		errs:    []error{nil, errors.New("timeout"), nil, nil, nil},
+	}
+	old := Verifiers[PlatformTelegram]
+	Verifiers[PlatformTelegram] = fake
+	defer func() { Verifiers[PlatformTelegram] = old }()
+
+	now := time.Now()
+	claim := &models.SocialClaim{Platform: PlatformTelegram, Status: models.SocialClaimPending}
+	step := func(wantAction action, wantStatus models.SocialClaimStatus) {
+		t.Helper()
+		ok, err := verify(context.Background(), claim.Platform, "1")
+		if got := advance(claim, ok, err, now, s); got != wantAction || claim.Status != wantStatus {
+			t.Fatalf("call %d: action %v status %s, want %v %s", fake.calls, got, claim.Status, wantAction, wantStatus)
+		}
+	}
+
+	// 未加入：等待重新检查，第 n 次失败后延迟 n 倍间隔
+	step(actionNone, models.SocialClaimPending)
+	if want := now.Add(time.Minute); !claim.NextCheckAt.Equal(want) {
+		t.Fatalf("next check at %s, want %s", claim.NextCheckAt, want)
+	}
+	// 暂时无法确定同样计为一次失败
+	step(actionNone, models.SocialClaimPending)
+	if claim.LastError != "timeout" || !claim.NextCheckAt.Equal(now.Add(2*time.Minute)) {
+		t.Fatalf("last error %q, next check at %s", claim.LastError, claim.NextCheckAt)
+	}
+	step(actionGrant, models.SocialClaimVerified)
+	if claim.Attempts != 0 || claim.VerifiedAt == nil {
+		t.Fatalf("attempts %d, verified at %v", claim.Attempts, claim.VerifiedAt)
+	}
+	// 撤回窗口内仍是成员
+	step(actionNone, models.SocialClaimVerified)
+	// 退出后撤回
+	step(actionRevoke, models.SocialClaimRevoked)
+}
+
+func TestClaimRejectedAfterMaxAttempts(t *testing.T) {
+	s := settings{recheckInterval: time.Minute, maxAttempts: 2, retentionInterval: time.Hour}
+	claim := &models.SocialClaim{Status: models.SocialClaimPending}
+	now := time.Now()
+	advance(claim, false, nil, now, s)
+	if claim.Status != models.SocialClaimPending {
+		t.Fatalf("status %s after first attempt", claim.Status)
+	}
+	advance(claim, false, nil, now, s)
+	if claim.Status != models.SocialClaimRejected {
+		t.Fatalf("status %s after max attempts, want rejected", claim.Status)
+	}
+}
+
+func TestVerifiedClaimKeptOnTransientError(t *testing.T) {
+	s := settings{recheckInterval: time.Minute, maxAttempts: 2, revokeWindow: time.Hour, retentionInterval: time.Hour}
+	claim := &models.SocialClaim{Status: models.SocialClaimVerified}
+	if act := advance(claim, false, errors.New("rate limited"), time.Now(), s); act != actionNone || claim.Status != models.SocialClaimVerified {
+		t.Fatalf("action %v status %s, want claim kept", act, claim.Status)
+	}
+}
+
+// linkAccount 直接写入绑定的账号
+func linkAccount(t *testing.T, userID, platform, externalID, token string, expiresAt time.Time) {
+	t.Helper()
+	account := models.SocialAccount{UserID: userID, Platform: platform, ExternalID: externalID, AccessToken: token,
+		RefreshToken: "refresh-" + userID, ExpiresAt: expiresAt}
+	if err := daos.DB.Create(&account).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiscordVerifier(t *testing.T) {
+	daostest.Open(t)
+	configtest.Load(t, "social:\n  discord:\n    clientid: ID\n    clientsecret: SECRET\n    guildid: G1\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/oauth2/token" {
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "refresh_token" || r.Form.Get("refresh_token") != "refresh-5" || r.Form.Get("client_secret") != "SECRET" {
+				t.Errorf("unexpected token request %v", r.Form)
+			}
+			w.Write([]byte(`{"access_token":"member","refresh_token":"refresh-5b","expires_in":3600}`))
+			return
+		}
+		if r.URL.Path != "/users/@me/guilds/G1/member" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer member":
+			w.Write([]byte(`{"roles":[]}`))
+		case "Bearer left":
+			w.WriteHeader(http.StatusNotFound)
+		case "Bearer revoked":
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	valid := time.Now().Add(time.Hour)
+	linkAccount(t, "1", PlatformDiscord, "d1", "member", valid)
+	linkAccount(t, "2", PlatformDiscord, "d2", "left", valid)
+	linkAccount(t, "3", PlatformDiscord, "d3", "revoked", valid)
+	linkAccount(t, "4", PlatformDiscord, "d4", "broken", valid)
+	// 令牌已过期，先刷新
+	linkAccount(t, "5", PlatformDiscord, "d5", "expired", time.Now())
+
+	verifier := &DiscordVerifier{ApiURL: srv.URL}
+	tests := []struct {
+		userID  string
+		want    bool
+		wantErr error
+	}{
+		{"1", true, nil},
+		{"2", false, nil},
+		{"3", false, ErrNotLinked},
+		{"4", false, errors.New("status 500")},
+		{"5", true, nil},
+		{"6", false, ErrNotLinked},
+	}
+	for _, tt := range tests {
+		got, err := verifier.Verify(context.Background(), tt.userID)
+		if got != tt.want || (err == nil) != (tt.wantErr == nil) || (errors.Is(tt.wantErr, ErrNotLinked) && !errors.Is(err, ErrNotLinked)) {
+			t.Errorf("user %s: got %v, %v; want %v, %v", tt.userID, got, err, tt.want, tt.wantErr)
+		}
+	}
+	var refreshed models.SocialAccount
+	daos.DB.Where("user_id = ?", "5").First(&refreshed)
+	if refreshed.AccessToken != "member" || refreshed.RefreshToken != "refresh-5b" || !refreshed.ExpiresAt.After(valid.Add(-time.Minute)) {
+		t.Errorf("refreshed token not saved: %+v", refreshed)
+	}
+}
+
+func TestXVerifier(t *testing.T) {
+	daostest.Open(t)
+	configtest.Load(t, "social:\n  x:\n    targetuserid: T1\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "Bearer revoked" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		// x1 第二页关注了目标账号，x2 没有关注
+		switch r.URL.Path + "?" + r.URL.Query().Get("pagination_token") {
+		case "/2/users/x1/following?":
+			w.Write([]byte(`{"data":[{"id":"A"}],"meta":{"next_token":"p2"}}`))
+		case "/2/users/x1/following?p2":
+			w.Write([]byte(`{"data":[{"id":"B"},{"id":"T1"}],"meta":{}}`))
+		case "/2/users/x2/following?":
+			w.Write([]byte(`{"data":[{"id":"A"}],"meta":{}}`))
+		default:
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	valid := time.Now().Add(time.Hour)
+	linkAccount(t, "1", PlatformX, "x1", "token", valid)
+	linkAccount(t, "2", PlatformX, "x2", "token", valid)
+	linkAccount(t, "3", PlatformX, "x3", "revoked", valid)
+
+	verifier := &XVerifier{ApiURL: srv.URL}
+	if ok, err := verifier.Verify(context.Background(), "1"); !ok || err != nil {
+		t.Errorf("following on the second page: %v, %v", ok, err)
+	}
+	if ok, err := verifier.Verify(context.Background(), "2"); ok || err != nil {
+		t.Errorf("not following: %v, %v", ok, err)
+	}
+	if _, err := verifier.Verify(context.Background(), "3"); !errors.Is(err, ErrNotLinked) {
+		t.Errorf("revoked token: %v", err)
+	}
+}
+
+func TestLinkAccountOnce(t *testing.T) {
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "social:\n  discord:\n    clientid: ID\n    redirecturl: https://example.com/callback\n")
+	// 授权码即平台上的用户ID
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/oauth2/token":
+			r.ParseForm()
+			w.Write([]byte(`{"access_token":"` + r.Form.Get("code") + `","expires_in":3600}`))
+		case "/users/@me":
+			id := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			w.Write([]byte(`{"id":"` + id + `","username":"name-` + id + `"}`))
+		}
+	}))
+	defer srv.Close()
+	old := Verifiers[PlatformDiscord]
+	Verifiers[PlatformDiscord] = &DiscordVerifier{ApiURL: srv.URL}
+	defer func() { Verifiers[PlatformDiscord] = old }()
+
+	ctx := context.Background()
+	link := func(userID, externalID string) (*models.SocialAccount, error) {
+		t.Helper()
+		authURL, err := AuthorizeURL(ctx, userID, PlatformDiscord)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, _ := url.Parse(authURL)
+		return Link(ctx, PlatformDiscord, u.Query().Get("state"), externalID)
+	}
+
+	if _, err := link("1", "d1"); err != nil {
+		t.Fatal(err)
+	}
+	// 同一账号不能再绑定给其他用户
+	if _, err := link("2", "d1"); !errors.Is(err, ErrAccountTaken) {
+		t.Fatalf("second user linked the same account: %v", err)
+	}
+	// 重新授权同一账号只更新令牌，未领取奖励前可以换绑
+	if account, err := link("1", "d1"); err != nil || account.AccessToken != "d1" {
+		t.Fatalf("relink: %+v %v", account, err)
+	}
+	if _, err := link("1", "d1b"); err != nil {
+		t.Fatalf("change account before reward: %v", err)
+	}
+	claim := models.SocialClaim{UserID: "1", Platform: PlatformDiscord, Status: models.SocialClaimVerified}
+	if err := daos.DB.Create(&claim).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := link("1", "d1c"); !errors.Is(err, ErrAccountLocked) {
+		t.Fatalf("change account after reward: %v", err)
+	}
+	var count int64
+	daos.DB.Model(&models.SocialAccount{}).Count(&count)
+	var account models.SocialAccount
+	daos.DB.Where("user_id = ?", "1").First(&account)
+	if count != 1 || account.ExternalID != "d1b" {
+		t.Fatalf("%d accounts, user 1 linked to %s", count, account.ExternalID)
+	}
+	// 唯一索引兜底并发绑定
+	dup := models.SocialAccount{UserID: "3", Platform: PlatformDiscord, ExternalID: "d1b"}
+	if err := daos.DB.Create(&dup).Error; !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Fatalf("duplicate external account inserted: %v", err)
+	}
+}
+
+func TestRecheckContinuesAfterFailure(t *testing.T) {
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "social:\n  revokewindow: 86400\n")
+	fake := &fakeVerifier{results: []bool{false, false}, errs: []error{nil, nil}}
+	old := Verifiers[PlatformTelegram]
+	Verifiers[PlatformTelegram] = fake
+	defer func() { Verifiers[PlatformTelegram] = old }()
+
+	now := time.Now()
+	// 第一条撤回时扣减余额失败：用户不存在，无法加载余额
+	verifiedAt := now.Add(-time.Hour)
+	claims := []models.SocialClaim{
+		{UserID: "ghost", Platform: PlatformTelegram, Status: models.SocialClaimVerified, VerifiedAt: &verifiedAt, NextCheckAt: now.Add(-2 * time.Minute)},
+		{UserID: "2", Platform: PlatformTelegram, Status: models.SocialClaimPending, NextCheckAt: now.Add(-time.Minute)},
+	}
+	if err := daos.DB.Create(&claims).Error; err != nil {
+		t.Fatal(err)
+	}
+	reward := models.AchievementReward{UserID: "ghost", AchievementName: "telegram", RewardType: string(models.TaskRewardBalance), Amount: 10000}
+	if err := daos.DB.Create(&reward).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := Recheck(context.Background())
+	if err != nil || n != 2 || fake.calls != 2 {
+		t.Fatalf("checked %d claims, %d verified, err %v", n, fake.calls, err)
+	}
+	var first, second models.SocialClaim
+	daos.DB.First(&first, claims[0].ID)
+	daos.DB.First(&second, claims[1].ID)
+	if first.Status != models.SocialClaimVerified {
+		t.Errorf("failed revocation changed status to %s", first.Status)
+	}
+	if second.Status != models.SocialClaimPending || second.Attempts != 1 {
+		t.Errorf("claim after the failure not checked: %+v", second)
+	}
+}
@@ -0,0 +1,67 @@
+package social
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"tbooks/configs"
+)
+
+// defaultTelegramApiURL Telegram Bot API 地址
+const defaultTelegramApiURL = "https://api.telegram.org"
+
+// TelegramVerifier 通过 Bot API getChatMember 校验用户是否在频道中
+// 用户ID即 Telegram 用户ID，机器人需为频道管理员
+type TelegramVerifier struct {
+	ApiURL     string // 为空时使用 defaultTelegramApiURL
+	HTTPClient *http.Client
+}
+
+// Verify 用户是否为频道成员
+func (t *TelegramVerifier) Verify(ctx context.Context, userID string) (bool, error) {
+	channel := configs.Config().Social.TelegramChannel
+	botToken := configs.Config().Telegram.BotToken
+	if channel == "" || botToken == "" {
+		return false, errors.New("Telegram channel is not configured")
+	}
+	apiURL := t.ApiURL
+	if apiURL == "" {
+		apiURL = defaultTelegramApiURL
+	}
+	query := url.Values{"chat_id": {channel}, "user_id": {userID}}
+	endpoint := fmt.Sprintf("%s/bot%s/getChatMember?%s", strings.TrimRight(apiURL, "/"), botToken, query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return false, fmt.Errorf("telegram getChatMember: %w", stripURL(err))
+	}
+
+	var out struct {
+		Ok          bool   `json:"ok"`
+		Description string `json:"description"`
+		Result      struct {
+			Status   string `json:"status"`
+			IsMember bool   `json:"is_member"` // 仅 restricted 状态有该字段
+		} `json:"result"`
+	}
+	if err := doJSON(t.HTTPClient, req, &out); err != nil {
+		var httpErr *httpError
+		// 从未与机器人或频道产生过交互的用户会返回 user not found
+		if errors.As(err, &httpErr) && httpErr.Status == http.StatusBadRequest && strings.Contains(httpErr.Body, "user not found") {
+			return false, nil
+		}
+		return false, fmt.Errorf("telegram getChatMember: %w", err)
+	}
+	if !out.Ok {
+		return false, fmt.Errorf("telegram getChatMember: %s", out.Description)
+	}
+	switch out.Result.Status {
+	case "creator", "administrator", "member":
+		return true, nil
+	case "restricted":
+		return out.Result.IsMember, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,124 @@
+package social
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"tbooks/configs"
+)
+
+const (
+	// defaultXApiURL X 接口地址
+	defaultXApiURL = "https://api.twitter.com"
+	// xAuthorizeURL X 授权页面
+	xAuthorizeURL = "https://twitter.com/i/oauth2/authorize"
+	// xScopes 读取用户身份和关注列表，offline.access 用于刷新令牌
+	xScopes = "tweet.read users.read follows.read offline.access"
+	// xMaxFollowingPages 最多翻页查询的关注列表页数，每页 1000 个
+	xMaxFollowingPages = 5
+)
+
+// XVerifier 通过用户授权的 OAuth 2.0 令牌校验用户是否关注了指定账号
+type XVerifier struct {
+	ApiURL     string // 为空时使用 defaultXApiURL
+	HTTPClient *http.Client
+}
+
+func (x *XVerifier) apiURL() string {
+	if x.ApiURL != "" {
+		return strings.TrimRight(x.ApiURL, "/")
+	}
+	return defaultXApiURL
+}
+
+func (x *XVerifier) config() configs.OAuthConfig {
+	return configs.Config().Social.X.OAuthConfig
+}
+
+func (x *XVerifier) authURL(cfg configs.OAuthConfig, state, challenge string) string {
+	return xAuthorizeURL + "?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {cfg.ClientID},
+		"redirect_uri":          {cfg.RedirectURL},
+		"scope":                 {xScopes},
+		"state":                 {state},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}.Encode()
+}
+
+func (x *XVerifier) exchange(ctx context.Context, form url.Values) (*Token, error) {
+	return postForm(ctx, x.HTTPClient, x.apiURL()+"/2/oauth2/token", form, x.config(), true)
+}
+
+func (x *XVerifier) get(ctx context.Context, accessToken, path string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, x.apiURL()+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	return doJSON(x.HTTPClient, req, out)
+}
+
+func (x *XVerifier) identity(ctx context.Context, accessToken string) (*Identity, error) {
+	var out struct {
+		Data struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"data"`
+	}
+	if err := x.get(ctx, accessToken, "/2/users/me", &out); err != nil {
+		return nil, fmt.Errorf("x identity: %w", err)
+	}
+	return &Identity{ID: out.Data.ID, Username: out.Data.Username}, nil
+}
+
+// Verify 用户绑定的 X 账号是否关注了指定账号
+func (x *XVerifier) Verify(ctx context.Context, userID string) (bool, error) {
+	target := configs.Config().Social.X.TargetUserID
+	if target == "" {
+		return false, errors.New("X target account is not configured")
+	}
+	account, err := accessToken(ctx, x, userID, PlatformX)
+	if err != nil {
+		return false, err
+	}
+
+	pageToken := ""
+	for page := 0; page < xMaxFollowingPages; page++ {
+		query := url.Values{"max_results": {"1000"}}
+		if pageToken != "" {
+			query.Set("pagination_token", pageToken)
+		}
+		var out struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+			Meta struct {
+				NextToken string `json:"next_token"`
+			} `json:"meta"`
+		}
+		err := x.get(ctx, account.AccessToken, "/2/users/"+url.PathEscape(account.ExternalID)+"/following?"+query.Encode(), &out)
+		var httpErr *httpError
+		if errors.As(err, &httpErr) && httpErr.Status == http.StatusUnauthorized {
+			return false, ErrNotLinked
+		}
+		if err != nil {
+			return false, fmt.Errorf("x following: %w", err)
+		}
+		for _, user := range out.Data {
+			if user.ID == target {
+				return true, nil
+			}
+		}
+		if out.Meta.NextToken == "" {
+			return false, nil
+		}
+		pageToken = out.Meta.NextToken
+	}
+	// 关注列表过长，无法确定
+	return false, errors.New("X following list is too long to verify")
+}
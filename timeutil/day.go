@@ -0,0 +1,90 @@
+package timeutil
+
+import (
+	"sync"
+	"tbooks/configs"
+	"time"
+	_ "time/tzdata" // 运行环境没有时区数据库时使用内置数据
+)
+
+// DefaultTimezone 未配置时区时使用的时区
+const DefaultTimezone = "UTC"
+
+// locations 已解析的时区
+var locations sync.Map
+
+// LoadLocation 解析 IANA 时区名称，例如 Asia/Shanghai，结果会被缓存
+func LoadLocation(name string) (*time.Location, error) {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location), nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, loc)
+	return loc, nil
+}
+
+// DefaultLocation 活动每日额度使用的时区，取自配置 Timezone，未配置或无效时为 UTC
+func DefaultLocation() *time.Location {
+	name := configs.Config().Timezone
+	if name == "" {
+		name = DefaultTimezone
+	}
+	loc, err := LoadLocation(name)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// UserLocation 用户设置的时区，未设置或无效时使用 DefaultLocation
+func UserLocation(timezone string) *time.Location {
+	if timezone != "" {
+		if loc, err := LoadLocation(timezone); err == nil {
+			return loc
+		}
+	}
+	return DefaultLocation()
+}
+
+// StartOfDay 返回 t 在 loc 时区所在自然日的第一个时刻
+// 夏令时在零点开始的时区当天没有 00:00，此时返回切换后的第一秒
+func StartOfDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return startOfDate(year, month, day, loc)
+}
+
+func startOfDate(year int, month time.Month, day int, loc *time.Location) time.Time {
+	start := time.Date(year, month, day, 0, 0, 0, 0, loc)
+	if y, m, d := start.Date(); y == year && m == month && d == day {
+		return start
+	}
+	// 零点不存在时 time.Date 可能返回前一天的时刻，二分查找当天的第一秒
+	lo, hi := start.Unix(), start.Add(3*time.Hour).Unix()
+	for hi-lo > 1 {
+		mid := lo + (hi-lo)/2
+		if y, m, d := time.Unix(mid, 0).In(loc).Date(); y == year && m == month && d == day {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return time.Unix(hi, 0).In(loc)
+}
+
+// DayRange 返回 t 在 loc 时区所在自然日的区间 [start, end)
+// 夏令时切换当天的长度可能是 23 或 25 小时
+func DayRange(t time.Time, loc *time.Location) (start, end time.Time) {
+	year, month, day := t.In(loc).Date()
+	start = startOfDate(year, month, day, loc)
+	next := time.Date(year, month, day+1, 12, 0, 0, 0, loc)
+	end = startOfDate(next.Year(), next.Month(), next.Day(), loc)
+	return start, end
+}
+
+// DayKey 返回 t 在 loc 时区的日期，格式为 20060102，用于每日计数的键
+func DayKey(t time.Time, loc *time.Location) string {
+	return t.In(loc).Format("20060102")
+}
@@ -0,0 +1,94 @@
+package timeutil
+
+import (
+	"testing"
+	"time"
+)
+
+func mustLoad(t *testing.T, name string) *time.Location {
+	t.Helper()
+	loc, err := LoadLocation(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return loc
+}
+
+func TestDayRangeDST(t *testing.T) {
+	tests := []struct {
+		name      string
+		zone      string
+		at        time.Time // UTC
+		wantStart string
+		wantHours float64
+	}{
+		{"spring forward", "America/New_York", time.Date(2024, 3, 10, 15, 0, 0, 0, time.UTC), "2024-03-10T00:00:00-05:00", 23},
+		{"fall back", "America/New_York", time.Date(2024, 11, 3, 15, 0, 0, 0, time.UTC), "2024-11-03T00:00:00-04:00", 25},
+		{"europe spring", "Europe/Berlin", time.Date(2024, 3, 31, 10, 0, 0, 0, time.UTC), "2024-03-31T00:00:00+01:00", 23},
+		{"half hour shift", "Australia/Lord_Howe", time.Date(2024, 4, 7, 0, 0, 0, 0, time.UTC), "2024-04-07T00:00:00+11:00", 24.5},
+		// 零点开始夏令时，当天从 01:00 开始
+		{"midnight gap", "America/Santiago", time.Date(2024, 9, 8, 12, 0, 0, 0, time.UTC), "2024-09-08T01:00:00-03:00", 23},
+		{"midnight gap havana", "America/Havana", time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC), "2024-03-10T01:00:00-04:00", 23},
+		{"day before midnight gap", "America/Santiago", time.Date(2024, 9, 7, 12, 0, 0, 0, time.UTC), "2024-09-07T00:00:00-04:00", 24},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc := mustLoad(t, tt.zone)
+			start, end := DayRange(tt.at, loc)
+			if got := start.Format(time.RFC3339); got != tt.wantStart {
+				t.Fatalf("start = %s, want %s", got, tt.wantStart)
+			}
+			if got := end.Sub(start).Hours(); got != tt.wantHours {
+				t.Fatalf("day length = %vh, want %vh", got, tt.wantHours)
+			}
+			if tt.at.Before(start) || !tt.at.Before(end) {
+				t.Fatalf("%s not in [%s, %s)", tt.at, start, end)
+			}
+			// 区间前一秒属于前一天，结束时刻属于后一天
+			if DayKey(start.Add(-time.Second), loc) == DayKey(start, loc) {
+				t.Fatalf("second before start is on the same day")
+			}
+			if DayKey(end, loc) == DayKey(end.Add(-time.Second), loc) {
+				t.Fatalf("end is on the same day")
+			}
+		})
+	}
+}
+
+func TestDayRangeDateLine(t *testing.T) {
+	kiritimati := mustLoad(t, "Pacific/Kiritimati") // UTC+14
+	pagoPago := mustLoad(t, "Pacific/Pago_Pago")    // UTC-11
+
+	// 同一时刻，两地相差一天
+	at := time.Date(2024, 6, 15, 11, 30, 0, 0, time.UTC)
+	if got := DayKey(at, kiritimati); got != "20240616" {
+		t.Fatalf("Kiritimati day = %s, want 20240616", got)
+	}
+	if got := DayKey(at, pagoPago); got != "20240615" {
+		t.Fatalf("Pago Pago day = %s, want 20240615", got)
+	}
+
+	east, _ := DayRange(at, kiritimati)
+	west, _ := DayRange(at, pagoPago)
+	if want := time.Date(2024, 6, 15, 10, 0, 0, 0, time.UTC); !east.Equal(want) {
+		t.Fatalf("Kiritimati start = %s, want %s", east.UTC(), want)
+	}
+	if want := time.Date(2024, 6, 15, 11, 0, 0, 0, time.UTC); !west.Equal(want) {
+		t.Fatalf("Pago Pago start = %s, want %s", west.UTC(), want)
+	}
+
+	// 同一个日期 6 月 16 日，Kiritimati 比 Pago Pago 早开始 25 小时
+	westJune16, _ := DayRange(at.Add(24*time.Hour), pagoPago)
+	if got := westJune16.Sub(east); got != 25*time.Hour {
+		t.Fatalf("June 16 starts %s apart across the date line, want 25h", got)
+	}
+}
+
+func TestUserLocationFallback(t *testing.T) {
+	if loc := UserLocation("Not/AZone"); loc.String() != DefaultTimezone {
+		t.Fatalf("invalid timezone fell back to %s, want %s", loc, DefaultTimezone)
+	}
+	if loc := UserLocation("Asia/Shanghai"); loc.String() != "Asia/Shanghai" {
+		t.Fatalf("location = %s, want Asia/Shanghai", loc)
+	}
+}
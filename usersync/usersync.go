@@ -0,0 +1,360 @@
+package usersync
+
+import (
+	"context"
+	"fmt"
+	"github.com/beego/beego/v2/core/logs"
+	"github.com/redis/go-redis/v9"
+	"gorm.io/gorm"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"tbooks/configs"
+	"tbooks/daos"
+	"tbooks/ledger"
+	"tbooks/models"
+	"time"
+)
+
+// 用户卡片数量以 Redis 为准，修改后将用户加入待同步集合，由同步任务批量写回 MySQL
+// 余额由账本队列写回 MySQL，不经过这里
+
+const (
+	// DirtyKey 待写回 MySQL 的用户，分数为首次标记的毫秒时间戳
+	DirtyKey = "user_dirty"
+	// processingKey 已被某个实例领取、正在写回的用户，分数为领取时间
+	processingKey = "user_dirty_processing"
+	// batchSize 每批写回的用户数
+	batchSize = 500
+	// claimTimeout 领取后超过该时间仍未完成，视为实例异常并放回待同步集合
+	claimTimeout = time.Minute
+)
+
+// CardCountKey Redis 中用户卡片数量的键
+func CardCountKey(userID string) string {
+	return userID + "_card_count"
+}
+
+// LuaMarkDirty Redis 脚本中标记用户待同步的函数，参数为待同步集合键、毫秒时间戳和用户ID
+const LuaMarkDirty = `
+local function markDirty(key, now, userID)
+	redis.call('ZADD', key, 'NX', now, userID)
+end
+`
+
+// MarkDirty 标记用户待同步，已在集合中的用户保留首次标记时间
+func MarkDirty(ctx context.Context, userIDs ...string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+	now := float64(time.Now().UnixMilli())
+	members := make([]redis.Z, 0, len(userIDs))
+	for _, userID := range userIDs {
+		members = append(members, redis.Z{Score: now, Member: userID})
+	}
+	return configs.Rdb.ZAddNX(ctx, DirtyKey, members...).Err()
+}
+
+// LoadUser Redis 中没有用户卡片数量或余额时从 MySQL 加载，已有的值不覆盖
+func LoadUser(ctx context.Context, userID string) error {
+	var user models.User
+	if err := daos.DB.Where("user_id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+	pipe := configs.Rdb.TxPipeline()
+	pipe.SetNX(ctx, CardCountKey(userID), user.CardCount, 0)
+	pipe.SetNX(ctx, ledger.BalanceKey(userID), int64(user.Balance), 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// addCardsScript 增加用户卡片并标记待同步
+// KEYS[1] 卡片数量  KEYS[2] 待同步集合  ARGV[1] 增加数量  ARGV[2] 毫秒时间戳  ARGV[3] 用户ID
+var addCardsScript = redis.NewScript(LuaMarkDirty + `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local cards = redis.call('INCRBY', KEYS[1], ARGV[1])
+markDirty(KEYS[2], ARGV[2], ARGV[3])
+return cards
+`)
+
+// AddCards 增加用户卡片数量，返回增加后的数量
+func AddCards(ctx context.Context, userID string, n int64) (int64, error) {
+	for i := 0; i < 2; i++ {
+		cards, err := addCardsScript.Run(ctx, configs.Rdb, []string{CardCountKey(userID), DirtyKey},
+			n, time.Now().UnixMilli(), userID).Int64()
+		if err == redis.Nil {
+			if err := LoadUser(ctx, userID); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		return cards, err
+	}
+	return 0, gorm.ErrRecordNotFound
+}
+
+// addCardsOnceScript 以幂等键增加用户卡片并标记待同步，已增加过时返回 -1
+// KEYS[1] 卡片数量  KEYS[2] 待同步集合  KEYS[3] 幂等键
+// ARGV[1] 增加数量  ARGV[2] 毫秒时间戳  ARGV[3] 用户ID  ARGV[4] 幂等键有效期（秒）
+var addCardsOnceScript = redis.NewScript(LuaMarkDirty + `
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return -1
+end
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return false
+end
+local cards = redis.call('INCRBY', KEYS[1], ARGV[1])
+redis.call('SET', KEYS[3], 1, 'EX', ARGV[4])
+markDirty(KEYS[2], ARGV[2], ARGV[3])
+return cards
+`)
+
+// AddCardsOnce 与 AddCards 相同，但同一幂等键在 expire 内只增加一次，重复调用时返回 false
+func AddCardsOnce(ctx context.Context, userID string, n int64, key string, expire time.Duration) (bool, error) {
+	for i := 0; i < 2; i++ {
+		cards, err := addCardsOnceScript.Run(ctx, configs.Rdb, []string{CardCountKey(userID), DirtyKey, key},
+			n, time.Now().UnixMilli(), userID, int64(expire/time.Second)).Int64()
+		if err == redis.Nil {
+			if err := LoadUser(ctx, userID); err != nil {
+				return false, err
+			}
+			continue
+		}
+		return err == nil && cards >= 0, err
+	}
+	return false, gorm.ErrRecordNotFound
+}
+
+// removeCardsOnceScript 以幂等键扣减用户卡片并标记待同步，卡片不足时扣到 0，返回扣减的数量，已扣减过时返回 -1
+// KEYS[1] 卡片数量  KEYS[2] 待同步集合  KEYS[3] 幂等键
+// ARGV[1] 扣减数量  ARGV[2] 毫秒时间戳  ARGV[3] 用户ID  ARGV[4] 幂等键有效期（秒）
+var removeCardsOnceScript = redis.NewScript(LuaMarkDirty + `
+if redis.call('EXISTS', KEYS[3]) == 1 then
+	return -1
+end
+local cards = redis.call('GET', KEYS[1])
+if not cards then
+	return false
+end
+local n = math.min(tonumber(ARGV[1]), tonumber(cards))
+if n > 0 then
+	redis.call('DECRBY', KEYS[1], n)
+	markDirty(KEYS[2], ARGV[2], ARGV[3])
+else
+	n = 0
+end
+redis.call('SET', KEYS[3], 1, 'EX', ARGV[4])
+return n
+`)
+
+// RemoveCardsOnce 收回用户的卡片，同一幂等键在 expire 内只扣减一次
+// 返回实际扣减的数量，已使用的卡片无法收回；重复调用时返回 -1
+func RemoveCardsOnce(ctx context.Context, userID string, n int64, key string, expire time.Duration) (int64, error) {
+	for i := 0; i < 2; i++ {
+		removed, err := removeCardsOnceScript.Run(ctx, configs.Rdb, []string{CardCountKey(userID), DirtyKey, key},
+			n, time.Now().UnixMilli(), userID, int64(expire/time.Second)).Int64()
+		if err == redis.Nil {
+			if err := LoadUser(ctx, userID); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		return removed, err
+	}
+	return 0, gorm.ErrRecordNotFound
+}
+
+// Balances 返回 Redis 中用户的卡片数量和余额，没有时从 MySQL 加载
+func Balances(ctx context.Context, userID string) (int64, models.Amount, error) {
+	keys := []string{CardCountKey(userID), ledger.BalanceKey(userID)}
+	values, err := configs.Rdb.MGet(ctx, keys...).Result()
+	if err == nil && (values[0] == nil || values[1] == nil) {
+		if err := LoadUser(ctx, userID); err != nil {
+			return 0, 0, err
+		}
+		values, err = configs.Rdb.MGet(ctx, keys...).Result()
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	cardStr, _ := values[0].(string)
+	balanceStr, _ := values[1].(string)
+	cards, err := strconv.ParseInt(cardStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse card count: %w", err)
+	}
+	balance, err := strconv.ParseInt(balanceStr, 10, 64)
+	if err != nil {
+		return 0, 0, fmt.Errorf("parse balance: %w", err)
+	}
+	return cards, models.Amount(balance), nil
+}
+
+// claimScript 放回超时的领取，再领取一批当前没有被其他实例处理的用户
+// 正在被其他实例处理的用户跳过，继续向后查找，直到领满一批或待同步集合中没有可领取的用户
+// KEYS[1] 待同步集合  KEYS[2] 处理中集合  ARGV[1] 领取时间  ARGV[2] 批量大小  ARGV[3] 超时截止时间
+var claimScript = redis.NewScript(`
+local stale = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[3])
+for _, userID in ipairs(stale) do
+	redis.call('ZADD', KEYS[1], 'NX', ARGV[1], userID)
+	redis.call('ZREM', KEYS[2], userID)
+end
+
+local limit = tonumber(ARGV[2])
+local claimed = {}
+-- 领取的用户从待同步集合移除，offset 只计跳过的用户
+local offset = 0
+while #claimed < limit do
+	local candidates = redis.call('ZRANGE', KEYS[1], offset, offset + limit - 1)
+	if #candidates == 0 then
+		break
+	end
+	for _, userID in ipairs(candidates) do
+		if #claimed >= limit then
+			break
+		end
+		-- 同一用户同时只由一个实例写回，避免旧值覆盖新值
+		if redis.call('ZSCORE', KEYS[2], userID) then
+			offset = offset + 1
+		else
+			redis.call('ZREM', KEYS[1], userID)
+			redis.call('ZADD', KEYS[2], ARGV[1], userID)
+			claimed[#claimed + 1] = userID
+		end
+	end
+end
+return claimed
+`)
+
+// completeScript 移除本实例领取的用户，已被超时放回并重新领取的不动
+// KEYS[1] 处理中集合  ARGV[1] 领取时间  ARGV[2..] 用户ID
+var completeScript = redis.NewScript(`
+for i = 2, #ARGV do
+	if redis.call('ZSCORE', KEYS[1], ARGV[i]) == ARGV[1] then
+		redis.call('ZREM', KEYS[1], ARGV[i])
+	end
+end
+return 0
+`)
+
+var (
+	syncedTotal atomic.Int64
+	lastSyncAt  atomic.Int64
+)
+
+// Sync 分批领取待同步用户并将卡片数量写回 MySQL，可在多个实例上同时运行，返回写回的用户数
+func Sync(ctx context.Context) (int, error) {
+	synced := 0
+	for {
+		now := time.Now()
+		token := strconv.FormatInt(now.UnixMilli(), 10)
+		userIDs, err := claimScript.Run(ctx, configs.Rdb, []string{DirtyKey, processingKey},
+			token, batchSize, now.Add(-claimTimeout).UnixMilli()).StringSlice()
+		if err != nil {
+			return synced, err
+		}
+		if len(userIDs) == 0 {
+			lastSyncAt.Store(now.Unix())
+			return synced, nil
+		}
+
+		n, err := writeBack(ctx, userIDs)
+		if err != nil {
+			// 写回失败的用户留在处理中集合，超时后重新同步
+			return synced, err
+		}
+		args := make([]interface{}, 0, len(userIDs)+1)
+		args = append(args, token)
+		for _, userID := range userIDs {
+			args = append(args, userID)
+		}
+		if err := completeScript.Run(ctx, configs.Rdb, []string{processingKey}, args...).Err(); err != nil {
+			return synced, err
+		}
+		synced += n
+		syncedTotal.Add(int64(n))
+		if len(userIDs) < batchSize {
+			lastSyncAt.Store(now.Unix())
+			return synced, nil
+		}
+	}
+}
+
+// writeBack 读取一批用户的卡片数量，用一条 UPDATE 写回 MySQL
+func writeBack(ctx context.Context, userIDs []string) (int, error) {
+	keys := make([]string, len(userIDs))
+	for i, userID := range userIDs {
+		keys[i] = CardCountKey(userID)
+	}
+	values, err := configs.Rdb.MGet(ctx, keys...).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		caseSQL strings.Builder
+		args    []interface{}
+		ids     []string
+	)
+	caseSQL.WriteString("CASE user_id")
+	for i, value := range values {
+		s, ok := value.(string)
+		if !ok {
+			// Redis 中已没有该用户，MySQL 无需更新
+			continue
+		}
+		cards, err := strconv.Atoi(s)
+		if err != nil {
+			logs.Error("Failed to parse card count:", keys[i], s, err)
+			continue
+		}
+		caseSQL.WriteString(" WHEN ? THEN ?")
+		args = append(args, userIDs[i], cards)
+		ids = append(ids, userIDs[i])
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	caseSQL.WriteString(" ELSE card_count END")
+
+	err = daos.DB.Model(&models.User{}).Where("user_id IN ?", ids).
+		Update("card_count", gorm.Expr(caseSQL.String(), args...)).Error
+	if err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// Stats 同步进度指标
+type Stats struct {
+	Pending    int64     `json:"pending"`      // 待同步用户数
+	Processing int64     `json:"processing"`   // 正在写回的用户数
+	LagSeconds float64   `json:"lag_seconds"`  // 最早的待同步标记距今的秒数
+	LastSyncAt time.Time `json:"last_sync_at"` // 本实例最近一次清空待同步集合的时间
+	Synced     int64     `json:"synced"`       // 本实例累计写回的用户数
+}
+
+// GetStats 返回当前的同步积压和延迟
+func GetStats(ctx context.Context) (*Stats, error) {
+	pipe := configs.Rdb.Pipeline()
+	pending := pipe.ZCard(ctx, DirtyKey)
+	processing := pipe.ZCard(ctx, processingKey)
+	oldest := pipe.ZRangeWithScores(ctx, DirtyKey, 0, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	stats := &Stats{
+		Pending:    pending.Val(),
+		Processing: processing.Val(),
+		Synced:     syncedTotal.Load(),
+	}
+	if last := lastSyncAt.Load(); last > 0 {
+		stats.LastSyncAt = time.Unix(last, 0)
+	}
+	if items := oldest.Val(); len(items) > 0 {
+		stats.LagSeconds = time.Since(time.UnixMilli(int64(items[0].Score))).Seconds()
+	}
+	return stats, nil
+}
@@ -0,0 +1,166 @@
+package usersync
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"sync"
+	"tbooks/configs"
+	"tbooks/configs/configtest"
+	"tbooks/daos"
+	"tbooks/daos/daostest"
+	"tbooks/models"
+	"testing"
+	"time"
+)
+
+// setup 创建 n 个用户并加载到 Redis，返回用户ID
+func setup(t *testing.T, n int) []string {
+	t.Helper()
+	daostest.Open(t)
+	configtest.Redis(t)
+	configtest.Load(t, "")
+	userIDs := make([]string, n)
+	users := make([]models.User, n)
+	for i := range users {
+		userIDs[i] = fmt.Sprintf("U%04d", i)
+		users[i] = models.User{UserID: userIDs[i], Address: "addr-" + userIDs[i], CreatedAt: time.Now()}
+	}
+	if err := daos.DB.CreateInBatches(&users, 200).Error; err != nil {
+		t.Fatal(err)
+	}
+	for _, userID := range userIDs {
+		if err := LoadUser(context.Background(), userID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return userIDs
+}
+
+// storedCards MySQL 中用户的卡片数量
+func storedCards(t *testing.T) map[string]int {
+	t.Helper()
+	var users []models.User
+	if err := daos.DB.Find(&users).Error; err != nil {
+		t.Fatal(err)
+	}
+	cards := make(map[string]int, len(users))
+	for _, user := range users {
+		cards[user.UserID] = user.CardCount
+	}
+	return cards
+}
+
+func claim(t *testing.T, token string, limit int) []string {
+	t.Helper()
+	userIDs, err := claimScript.Run(context.Background(), configs.Rdb, []string{DirtyKey, processingKey},
+		token, limit, 0).StringSlice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return userIDs
+}
+
+func TestClaimSkipsProcessing(t *testing.T) {
+	configtest.Redis(t)
+	ctx := context.Background()
+	// 前 5 个用户正在被其他实例写回，期间又被标记待同步
+	for i := 0; i < 8; i++ {
+		userID := fmt.Sprintf("U%d", i)
+		configs.Rdb.ZAdd(ctx, DirtyKey, redis.Z{Score: float64(i), Member: userID})
+		if i < 5 {
+			configs.Rdb.ZAdd(ctx, processingKey, redis.Z{Score: 1, Member: userID})
+		}
+	}
+
+	if got := claim(t, "2", 2); len(got) != 2 || got[0] != "U5" || got[1] != "U6" {
+		t.Fatalf("first claim %v, want [U5 U6]", got)
+	}
+	if got := claim(t, "3", 2); len(got) != 1 || got[0] != "U7" {
+		t.Fatalf("second claim %v, want [U7]", got)
+	}
+	if got := claim(t, "4", 2); len(got) != 0 {
+		t.Fatalf("third claim %v, want none", got)
+	}
+	if n := configs.Rdb.ZCard(ctx, DirtyKey).Val(); n != 5 {
+		t.Fatalf("%d users left to sync, want 5", n)
+	}
+}
+
+func TestSyncConcurrent(t *testing.T) {
+	userIDs := setup(t, batchSize*2+50)
+	ctx := context.Background()
+	for i, userID := range userIDs {
+		if _, err := AddCards(ctx, userID, int64(i%7+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 多个实例同时写回，期间卡片数量继续变化
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := Sync(ctx); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for _, userID := range userIDs[:100] {
+			if _, err := AddCards(ctx, userID, 10); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if _, err := Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := GetStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Pending != 0 || stats.Processing != 0 {
+		t.Fatalf("stats after sync %+v", stats)
+	}
+	stored := storedCards(t)
+	for i, userID := range userIDs {
+		want := i%7 + 1
+		if i < 100 {
+			want += 10
+		}
+		if stored[userID] != want {
+			t.Fatalf("user %s has %d cards in MySQL, want %d", userID, stored[userID], want)
+		}
+	}
+}
+
+func TestSyncRecoversStaleClaims(t *testing.T) {
+	userIDs := setup(t, 2)
+	ctx := context.Background()
+	if _, err := AddCards(ctx, userIDs[0], 3); err != nil {
+		t.Fatal(err)
+	}
+	// 领取该用户的实例在写回前退出
+	stale := time.Now().Add(-2 * claimTimeout).UnixMilli()
+	if got := claim(t, fmt.Sprint(stale), batchSize); len(got) != 1 {
+		t.Fatalf("claimed %v", got)
+	}
+	if n, err := Sync(ctx); err != nil || n != 1 {
+		t.Fatalf("sync: %d %v", n, err)
+	}
+	if got := storedCards(t)[userIDs[0]]; got != 3 {
+		t.Fatalf("user has %d cards in MySQL, want 3", got)
+	}
+}